@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"io"
 	"net/http"
 	"sync"
@@ -14,6 +15,7 @@ var (
 
 type Client interface {
 	Request(method string, url string, body io.Reader) (*http.Response, error)
+	RequestContext(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error)
 }
 
 type clientImpl struct{}
@@ -27,14 +29,23 @@ func GetInstance() Client {
 
 // Request is a method that make a request to a client
 func (c *clientImpl) Request(method string, url string, body io.Reader) (*http.Response, error) {
-	request, _ := http.NewRequest(method, url, body)
+	return c.RequestContext(context.Background(), method, url, body)
+}
+
+// RequestContext makes the request under ctx, cancelling it when ctx is done
+func (c *clientImpl) RequestContext(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
 	request.Header.Add("Origin", "go-processor")
 
 	httpClient := &http.Client{
 		Transport: &http.Transport{
 			MaxIdleConnsPerHost: 1000,
 		},
-		Timeout: time.Duration(5*time.Second) * time.Second,
+		Timeout: 5 * time.Second,
 	}
 
 	return httpClient.Do(request)
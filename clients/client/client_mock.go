@@ -1,6 +1,7 @@
 package client
 
 import (
+	"context"
 	"github.com/stretchr/testify/mock"
 	"io"
 	"net/http"
@@ -23,3 +24,9 @@ func (c *ClientMock) Request(method string, url string, body io.Reader) (*http.R
 	args := c.Called(method, url, body)
 	return args.Get(0).(*http.Response), args.Error(1)
 }
+
+//RequestContext is a mock for RequestContext
+func (c *ClientMock) RequestContext(ctx context.Context, method string, url string, body io.Reader) (*http.Response, error) {
+	args := c.Called(ctx, method, url, body)
+	return args.Get(0).(*http.Response), args.Error(1)
+}
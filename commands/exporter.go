@@ -0,0 +1,168 @@
+package commands
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"github.com/labstack/gommon/log"
+	"io"
+	"os"
+	"time"
+)
+
+//exporters stream a collection, keyed by the collection name
+var exporters = map[string]func(ctx context.Context, filter domains.UserFilter, fn func(user *domains.User) error) error{
+	"users": func(ctx context.Context, f domains.UserFilter, fn func(*domains.User) error) error {
+		return userService.GetInstance().Each(ctx, f, fn)
+	},
+	"old_users": func(ctx context.Context, f domains.UserFilter, fn func(*domains.User) error) error {
+		return olduser.GetInstance().Each(ctx, f, func(entry *domains.ArchivedUser) error {
+			return fn(&entry.User)
+		})
+	},
+}
+
+// Export streams the users or old_users collection to a JSONL or CSV file
+func Export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	collection := flags.String("collection", "users", "users or old_users")
+	format := flags.String("format", "jsonl", "jsonl or csv")
+	output := flags.String("output", "", "file to write, stdout when empty")
+	compress := flags.Bool("gzip", false, "gzip the output")
+	clientID := flags.String("client-id", "", "only users of this clientId, every tenant when empty")
+	status := flags.String("status", "", "only users with this status")
+	updatedFrom := flags.String("updated-from", "", "only users updated at or after this RFC3339 time")
+	updatedTo := flags.String("updated-to", "", "only users updated before this RFC3339 time")
+	deleted := flags.Bool("deleted", false, "only the soft deleted users, instead of the live ones")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	filter := domains.UserFilter{ClientID: *clientID, Status: *status, Deleted: *deleted}
+	var err error
+	if filter.UpdatedFrom, err = parseTime(*updatedFrom); err != nil {
+		return fmt.Errorf("export: invalid -updated-from: %s", err)
+	}
+	if filter.UpdatedTo, err = parseTime(*updatedTo); err != nil {
+		return fmt.Errorf("export: invalid -updated-to: %s", err)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	count, err := exportUsers(context.Background(), out, *collection, *format, *compress, filter)
+	log.Infof("[Export] Finished. Collection: %s Users: %d", *collection, count)
+	return err
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func exportUsers(ctx context.Context, out io.Writer, collection string, format string, compress bool, filter domains.UserFilter) (int, error) {
+	each, ok := exporters[collection]
+	if !ok {
+		return 0, fmt.Errorf("export: unknown collection %q", collection)
+	}
+
+	buffered := bufio.NewWriter(out)
+	out = buffered
+	var zipped *gzip.Writer
+	if compress {
+		zipped = gzip.NewWriter(buffered)
+		out = zipped
+	}
+
+	write, flush, err := newUserWriter(out, format)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for _, tenantFilter := range tenantFilters(filter) {
+		err = each(ctx, tenantFilter, func(user *domains.User) error {
+			count++
+			return write(user)
+		})
+		if err != nil {
+			return count, err
+		}
+	}
+
+	if err = flush(); err != nil {
+		return count, err
+	}
+	if zipped != nil {
+		if err = zipped.Close(); err != nil {
+			return count, err
+		}
+	}
+	return count, buffered.Flush()
+}
+
+//tenantFilters splits a filter without ClientID by tenant when tenants are routed: the shared database, unless
+//the policy rejects it, and then every routed ClientID
+func tenantFilters(filter domains.UserFilter) []domains.UserFilter {
+	router := tenant.GetInstance()
+	if filter.ClientID != "" || !router.Enabled() {
+		return []domains.UserFilter{filter}
+	}
+
+	var filters []domains.UserFilter
+	if _, err := router.Resolve(""); err == nil {
+		filters = append(filters, filter)
+	}
+	for _, clientID := range router.ClientIDs() {
+		routed := filter
+		routed.ClientID = clientID
+		filters = append(filters, routed)
+	}
+	return filters
+}
+
+//newUserWriter returns functions writing one user in the format and flushing the pending output
+func newUserWriter(out io.Writer, format string) (func(user *domains.User) error, func() error, error) {
+	switch format {
+	case "jsonl":
+		encoder := json.NewEncoder(out)
+		return func(user *domains.User) error { return encoder.Encode(user) }, func() error { return nil }, nil
+
+	case "csv":
+		writer := csv.NewWriter(out)
+		if err := writer.Write(userFields); err != nil {
+			return nil, nil, err
+		}
+		row := make([]string, len(userFields))
+		write := func(user *domains.User) error {
+			for i, field := range userFields {
+				row[i] = userGetters[field](user)
+			}
+			return writer.Write(row)
+		}
+		flush := func() error {
+			writer.Flush()
+			return writer.Error()
+		}
+		return write, flush, nil
+	}
+	return nil, nil, errors.New("export: unknown format " + format)
+}
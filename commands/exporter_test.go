@@ -0,0 +1,95 @@
+package commands
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	"github.com/coaraujo/users-go-processor/services/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportUsers_JSONL(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	filter := domains.UserFilter{ClientID: "client"}
+
+	_ = userServiceMock.Initialize()
+	userServiceMock.On("Each", mock.Anything, filter).
+		Return([]*domains.User{{ID: "1", ClientID: "client"}, {ID: "2", ClientID: "client"}}, nil).
+		Once()
+
+	var out bytes.Buffer
+	count, err := exportUsers(context.Background(), &out, "users", "jsonl", false, filter)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "{\"_id\":\"1\",\"clientId\":\"client\",\"updatedAt\":\"0001-01-01T00:00:00Z\"}\n"+
+		"{\"_id\":\"2\",\"clientId\":\"client\",\"updatedAt\":\"0001-01-01T00:00:00Z\"}\n", out.String())
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestExportUsers_EveryTenant(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Database: "users_acme"},
+		"globex": {Prefix: "globex_"}}, config.TenantReject)
+	userServiceMock := &user.UserMock{}
+
+	_ = userServiceMock.Initialize()
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{ClientID: "acme", Status: "ACTIVE"}).
+		Return([]*domains.User{{ID: "1", ClientID: "acme"}}, nil).
+		Once()
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{ClientID: "globex", Status: "ACTIVE"}).
+		Return([]*domains.User{{ID: "2", ClientID: "globex"}}, nil).
+		Once()
+
+	var out bytes.Buffer
+	count, err := exportUsers(context.Background(), &out, "users", "jsonl", false, domains.UserFilter{Status: "ACTIVE"})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 2, count)
+	assert.Equal(t, "{\"_id\":\"1\",\"clientId\":\"acme\",\"updatedAt\":\"0001-01-01T00:00:00Z\"}\n"+
+		"{\"_id\":\"2\",\"clientId\":\"globex\",\"updatedAt\":\"0001-01-01T00:00:00Z\"}\n", out.String())
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestExportUsers_CSVGzip(t *testing.T) {
+	olduserServiceMock := &olduser.OldUserMock{}
+	updatedAt := time.Date(2019, 8, 15, 18, 15, 59, 0, time.UTC)
+
+	_ = olduserServiceMock.Initialize()
+	olduserServiceMock.On("Each", mock.Anything, domains.UserFilter{}).
+		Return([]*domains.ArchivedUser{{ID: "entry", UserID: "1", User: domains.User{ID: "1", Name: "Name, One", UpdatedAt: updatedAt,
+			Phones:    domains.Phones{{Type: domains.PhoneMobile, Number: "9999"}},
+			Addresses: []domains.Address{{Type: domains.AddressShipping, CEP: "01001-000"}}}}}, nil).
+		Once()
+
+	var out bytes.Buffer
+	count, err := exportUsers(context.Background(), &out, "old_users", "csv", true, domains.UserFilter{})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, count)
+
+	reader, err := gzip.NewReader(&out)
+	assert.Nil(t, err)
+	content, _ := ioutil.ReadAll(reader)
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(lines[0], "_id,email,username,fullName"))
+	assert.Equal(t, "1,,,\"Name, One\",,,,,2019-08-15T18:15:59Z,\"[{\"\"type\"\":\"\"mobile\"\",\"\"number\"\":\"\"9999\"\",\"\"verificationUpdatedAt\"\":\"\"0001-01-01T00:00:00Z\"\",\"\"updatedAt\"\":\"\"0001-01-01T00:00:00Z\"\"}]\",\"[{\"\"type\"\":\"\"shipping\"\",\"\"cep\"\":\"\"01001-000\"\"}]\"", lines[1])
+
+	olduserServiceMock.AssertExpectations(t)
+}
+
+func TestExportUsers_UnknownCollection(t *testing.T) {
+	_, err := exportUsers(context.Background(), &bytes.Buffer{}, "sessions", "jsonl", false, domains.UserFilter{})
+	assert.NotNil(t, err)
+}
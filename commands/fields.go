@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"strconv"
+	"time"
+)
+
+//userFields are the user fields in CSV column order, named after their json tags
+var userFields = []string{
+	"_id", "email", "username", "fullName", "gender", "status", "birthDate", "clientId", "updatedAt", "phones",
+	"addresses",
+}
+
+//userSetters fill a domains.User field from a CSV value, keyed by the field json name
+var userSetters = map[string]func(user *domains.User, value string) error{
+	"_id":       func(u *domains.User, v string) error { u.ID = v; return nil },
+	"email":     func(u *domains.User, v string) error { u.Email = v; return nil },
+	"username":  func(u *domains.User, v string) error { u.Username = v; return nil },
+	"fullName":  func(u *domains.User, v string) error { u.Name = v; return nil },
+	"gender":    func(u *domains.User, v string) error { u.Gender = v; return nil },
+	"status":    func(u *domains.User, v string) error { u.Status = v; return nil },
+	"birthDate": func(u *domains.User, v string) error { u.BirthDate = v; return nil },
+	"clientId":  func(u *domains.User, v string) error { u.ClientID = v; return nil },
+	"updatedAt": func(u *domains.User, v string) (err error) {
+		u.UpdatedAt, err = time.Parse(time.RFC3339, v)
+		return err
+	},
+	//phones is the JSON list of phones, the phones.* columns of the legacy single phone are still read
+	"phones": func(u *domains.User, v string) error { return json.Unmarshal([]byte(v), &u.Phones) },
+	//addresses is the JSON list of addresses
+	"addresses": func(u *domains.User, v string) error { return json.Unmarshal([]byte(v), &u.Addresses) },
+	"phones.phone": func(u *domains.User, v string) error {
+		phoneOfType(u, domains.PhoneHome).Number = v
+		return nil
+	},
+	"phones.cellphone": func(u *domains.User, v string) error {
+		phoneOfType(u, domains.PhoneMobile).Number = v
+		return nil
+	},
+	"phones.ddd_cellphone": func(u *domains.User, v string) error {
+		phoneOfType(u, domains.PhoneMobile).DDD = v
+		return nil
+	},
+	"phones.mobile_phone_confirmed": func(u *domains.User, v string) error {
+		confirmed, err := strconv.ParseBool(v)
+		if err != nil {
+			return err
+		}
+		phoneOfType(u, domains.PhoneMobile).Verification = domains.PhoneUnverified
+		if confirmed {
+			phoneOfType(u, domains.PhoneMobile).Verification = domains.PhoneVerified
+		}
+		return nil
+	},
+}
+
+//phoneOfType returns the phone of the type, added when the user has none. Mobile phones are primary as in
+//the legacy shape.
+func phoneOfType(user *domains.User, phoneType string) *domains.PhoneNumber {
+	for i := range user.Phones {
+		if user.Phones[i].Type == phoneType {
+			return &user.Phones[i]
+		}
+	}
+	user.Phones = append(user.Phones, domains.PhoneNumber{Type: phoneType, Primary: phoneType == domains.PhoneMobile})
+	return &user.Phones[len(user.Phones)-1]
+}
+
+//dropEmptyPhones removes the phones without number, left by legacy columns filled only with a confirmation
+func dropEmptyPhones(user *domains.User) {
+	var phones domains.Phones
+	for _, phone := range user.Phones {
+		if phone.Number != "" {
+			phones = append(phones, phone)
+		}
+	}
+	user.Phones = phones
+}
+
+//userGetters read a domains.User field as a CSV value, keyed by the field json name
+var userGetters = map[string]func(user *domains.User) string{
+	"_id":       func(u *domains.User) string { return u.ID },
+	"email":     func(u *domains.User) string { return u.Email },
+	"username":  func(u *domains.User) string { return u.Username },
+	"fullName":  func(u *domains.User) string { return u.Name },
+	"gender":    func(u *domains.User) string { return u.Gender },
+	"status":    func(u *domains.User) string { return u.Status },
+	"birthDate": func(u *domains.User) string { return u.BirthDate },
+	"clientId":  func(u *domains.User) string { return u.ClientID },
+	"updatedAt": func(u *domains.User) string {
+		if u.UpdatedAt.IsZero() {
+			return ""
+		}
+		return u.UpdatedAt.Format(time.RFC3339)
+	},
+	"phones": func(u *domains.User) string {
+		if len(u.Phones) == 0 {
+			return ""
+		}
+		phones, _ := json.Marshal(u.Phones)
+		return string(phones)
+	},
+	"addresses": func(u *domains.User) string {
+		if len(u.Addresses) == 0 {
+			return ""
+		}
+		addresses, _ := json.Marshal(u.Addresses)
+		return string(addresses)
+	},
+}
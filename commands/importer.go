@@ -0,0 +1,346 @@
+package commands
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"github.com/labstack/gommon/log"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+//importOptions configures an import run
+type importOptions struct {
+	format    string
+	columns   map[string]string
+	batchSize int
+	fromLine  int
+	progress  int
+}
+
+//importReport counts what an import run did. LastLine is the last line written, so a run can resume from the next one.
+type importReport struct {
+	Lines    int
+	Inserted int64
+	Updated  int64
+	Errors   int
+	LastLine int
+}
+
+//importError is reported for every line that could not be imported
+type importError struct {
+	Line  int    `json:"line"`
+	Kind  string `json:"kind"`
+	Error string `json:"error"`
+}
+
+//record is a decoded line waiting to be written
+type record struct {
+	line int
+	user *domains.User
+}
+
+// Import loads users from a CSV or JSONL file, merging them into the users collection
+func Import(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ContinueOnError)
+	file := flags.String("file", "", "CSV or JSONL file to import")
+	format := flags.String("format", "", "csv or jsonl, guessed from the file extension when empty")
+	columns := flags.String("columns", "", "CSV column mapping as field=header pairs separated by commas, e.g. _id=id,fullName=name")
+	batchSize := flags.Int("batch", 500, "users written per bulk operation")
+	fromLine := flags.Int("from-line", 0, "skip the lines before this one, used to resume an interrupted import")
+	progress := flags.Int("progress", 10000, "log the progress every N lines")
+	errorsFile := flags.String("errors", "", "file where the lines that failed are reported as JSONL, stderr when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return errors.New("import: -file is required")
+	}
+
+	options := importOptions{format: *format, batchSize: *batchSize, fromLine: *fromLine, progress: *progress}
+	if options.format == "" {
+		options.format = strings.TrimPrefix(filepath.Ext(*file), ".")
+	}
+	mapping, err := parseColumns(*columns)
+	if err != nil {
+		return err
+	}
+	options.columns = mapping
+
+	input, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer input.Close()
+
+	errorsOutput := io.Writer(os.Stderr)
+	if *errorsFile != "" {
+		f, err := os.Create(*errorsFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		errorsOutput = f
+	}
+
+	report, err := importUsers(context.Background(), input, errorsOutput, options)
+	log.Infof("[Import] Finished. Lines: %d Inserted: %d Updated: %d Errors: %d Last line: %d", report.Lines,
+		report.Inserted, report.Updated, report.Errors, report.LastLine)
+	if err != nil {
+		return fmt.Errorf("import stopped, resume with -from-line %d: %s", report.LastLine+1, err)
+	}
+	return nil
+}
+
+//parseColumns parses field=header pairs, checking that every field can be set
+func parseColumns(columns string) (map[string]string, error) {
+	mapping := make(map[string]string)
+	if columns == "" {
+		return mapping, nil
+	}
+	for _, pair := range strings.Split(columns, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("import: invalid column mapping %q", pair)
+		}
+		field := strings.TrimSpace(kv[0])
+		if _, ok := userSetters[field]; !ok {
+			return nil, fmt.Errorf("import: unknown user field %q", field)
+		}
+		mapping[field] = strings.TrimSpace(kv[1])
+	}
+	return mapping, nil
+}
+
+func importUsers(ctx context.Context, input io.Reader, errorsOutput io.Writer, options importOptions) (*importReport, error) {
+	report := &importReport{LastLine: options.fromLine - 1}
+	if report.LastLine < 0 {
+		report.LastLine = 0
+	}
+	if options.batchSize <= 0 {
+		options.batchSize = 1
+	}
+	encoder := json.NewEncoder(errorsOutput)
+	start := time.Now()
+
+	reportError := func(line int, err error) {
+		report.Errors++
+		_ = encoder.Encode(importError{Line: line, Kind: storage.KindOf(err).String(), Error: err.Error()})
+	}
+
+	batch := make([]record, 0, options.batchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		users := make([]*domains.User, len(batch))
+		for i, r := range batch {
+			users[i] = r.user
+		}
+
+		result, err := userService.GetInstance().BulkSave(ctx, users)
+		if err != nil {
+			return err
+		}
+		for i, err := range result.Failed {
+			reportError(batch[i].line, err)
+		}
+		report.Inserted += result.Inserted
+		report.Updated += result.Updated
+		report.LastLine = batch[len(batch)-1].line
+		batch = batch[:0]
+		return nil
+	}
+
+	next, err := newRecordReader(input, options)
+	if err != nil {
+		return report, err
+	}
+	lastRead := report.LastLine
+	for {
+		line, user, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && storage.KindOf(err) != storage.KindValidation {
+			//the input cannot be read any further, the lines read so far are still written
+			if flushErr := flush(); flushErr != nil {
+				return report, flushErr
+			}
+			return report, err
+		}
+		if line < options.fromLine {
+			continue
+		}
+		lastRead = line
+		report.Lines++
+		if options.progress > 0 && report.Lines%options.progress == 0 {
+			log.Infof("[Import] Lines: %d Inserted: %d Updated: %d Errors: %d Rate: %.0f lines/s", report.Lines,
+				report.Inserted, report.Updated, report.Errors, float64(report.Lines)/time.Since(start).Seconds())
+		}
+
+		if err == nil {
+			err = userService.Validate(user)
+		}
+		if err != nil {
+			reportError(line, err)
+			continue
+		}
+
+		batch = append(batch, record{line: line, user: user})
+		if len(batch) == options.batchSize {
+			if err := flush(); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := flush(); err != nil {
+		return report, err
+	}
+	report.LastLine = lastRead
+	return report, nil
+}
+
+//newRecordReader returns a function reading the next user and its line number, io.EOF at the end of input. A line
+//that cannot be decoded is a validation error, any other error means the input cannot be read any further.
+func newRecordReader(input io.Reader, options importOptions) (func() (int, *domains.User, error), error) {
+	switch options.format {
+	case "jsonl":
+		return jsonlReader(input), nil
+	case "csv":
+		return csvReader(input, options.columns)
+	}
+	return nil, fmt.Errorf("import: unknown format %q", options.format)
+}
+
+//maxLineSize is the longest JSONL line imported, longer lines are skipped as invalid
+const maxLineSize = 4 * 1024 * 1024
+
+//errLineTooLong is returned by readLine for the lines over maxLineSize
+var errLineTooLong = fmt.Errorf("line is longer than %d bytes", maxLineSize)
+
+func jsonlReader(input io.Reader) func() (int, *domains.User, error) {
+	reader := bufio.NewReaderSize(input, 64*1024)
+	line := 0
+
+	return func() (int, *domains.User, error) {
+		for {
+			text, err := readLine(reader)
+			if err == io.EOF {
+				return line, nil, io.EOF
+			}
+			line++
+			if err == errLineTooLong {
+				return line, nil, storage.NewError(storage.KindValidation, err)
+			}
+			if err != nil {
+				return line, nil, err
+			}
+			if len(bytes.TrimSpace(text)) == 0 {
+				continue
+			}
+			var user domains.User
+			if err := json.Unmarshal(text, &user); err != nil {
+				return line, nil, storage.NewError(storage.KindValidation, err)
+			}
+			return line, &user, nil
+		}
+	}
+}
+
+//readLine reads the next line without its line break. A line over maxLineSize is read to its end and
+//discarded with errLineTooLong.
+func readLine(reader *bufio.Reader) ([]byte, error) {
+	var text []byte
+	started, tooLong := false, false
+	for {
+		chunk, isPrefix, err := reader.ReadLine()
+		if err == io.EOF && started {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		started = true
+		if !tooLong && len(text)+len(chunk) > maxLineSize {
+			tooLong, text = true, nil
+		}
+		if !tooLong {
+			text = append(text, chunk...)
+		}
+		if !isPrefix {
+			break
+		}
+	}
+	if tooLong {
+		return nil, errLineTooLong
+	}
+	return text, nil
+}
+
+//csvReader maps the columns of every row to user fields. Fields without mapping use their own name as header.
+func csvReader(input io.Reader, columns map[string]string) (func() (int, *domains.User, error), error) {
+	reader := csv.NewReader(input)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("import: could not read the CSV header: %s", err)
+	}
+
+	positions := make(map[string]int)
+	for i, name := range header {
+		positions[strings.TrimSpace(name)] = i
+	}
+	fields := make(map[int]string)
+	for field := range userSetters {
+		name := field
+		if mapped, ok := columns[field]; ok {
+			name = mapped
+		}
+		if i, ok := positions[name]; ok {
+			fields[i] = field
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("import: no CSV column matches a user field")
+	}
+
+	line := 1
+	return func() (int, *domains.User, error) {
+		row, err := reader.Read()
+		line++
+		if err == io.EOF {
+			return line, nil, io.EOF
+		}
+		if _, ok := err.(*csv.ParseError); ok {
+			return line, nil, storage.NewError(storage.KindValidation, err)
+		}
+		if err != nil {
+			return line, nil, err
+		}
+
+		var user domains.User
+		for i, field := range fields {
+			if i >= len(row) || row[i] == "" {
+				continue
+			}
+			if err := userSetters[field](&user, row[i]); err != nil {
+				return line, nil, storage.NewError(storage.KindValidation, fmt.Errorf("%s: %s", field, err))
+			}
+		}
+		dropEmptyPhones(&user)
+		return line, &user, nil
+	}, nil
+}
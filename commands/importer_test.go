@@ -0,0 +1,156 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/services/user"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestImportUsers_CSVWithMapping(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	input := "id,name,cell,confirmed\n1,Name One,99999,true\n2,Name Two,,false\n,No ID,,\n"
+	expected := []*domains.User{
+		{ID: "1", Name: "Name One", Phones: domains.Phones{{Type: domains.PhoneMobile, Number: "99999", Primary: true,
+			Verification: domains.PhoneVerified}}},
+		{ID: "2", Name: "Name Two"},
+	}
+	userServiceMock.On("BulkSave", mock.Anything, expected).
+		Return(&user.BulkResult{Inserted: 1, Updated: 1}, nil).
+		Once()
+
+	columns, err := parseColumns("_id=id,fullName=name,phones.cellphone=cell,phones.mobile_phone_confirmed=confirmed")
+	assert.Nil(t, err)
+
+	var errorsOutput bytes.Buffer
+	report, err := importUsers(context.Background(), strings.NewReader(input), &errorsOutput,
+		importOptions{format: "csv", columns: columns, batchSize: 10})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Lines)
+	assert.Equal(t, int64(1), report.Inserted)
+	assert.Equal(t, int64(1), report.Updated)
+	assert.Equal(t, 1, report.Errors)
+	assert.Equal(t, 4, report.LastLine)
+	assert.Contains(t, errorsOutput.String(), "\"line\":4")
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestImportUsers_JSONLResumeAndBatches(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	input := "{\"_id\":\"1\"}\n{\"_id\":\"2\"}\nnot json\n{\"_id\":\"3\"}\n{\"_id\":\"4\"}\n"
+	userServiceMock.On("BulkSave", mock.Anything, []*domains.User{{ID: "2"}, {ID: "3"}}).
+		Return(&user.BulkResult{Inserted: 1, Failed: map[int]error{1: storage.NewError(storage.KindConflict, errors.New("dup"))}}, nil).
+		Once()
+	userServiceMock.On("BulkSave", mock.Anything, []*domains.User{{ID: "4"}}).
+		Return(&user.BulkResult{Inserted: 1}, nil).
+		Once()
+
+	var errorsOutput bytes.Buffer
+	report, err := importUsers(context.Background(), strings.NewReader(input), &errorsOutput,
+		importOptions{format: "jsonl", batchSize: 2, fromLine: 2})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 4, report.Lines)
+	assert.Equal(t, int64(2), report.Inserted)
+	assert.Equal(t, 2, report.Errors)
+	assert.Equal(t, 5, report.LastLine)
+	assert.Contains(t, errorsOutput.String(), "{\"line\":3,\"kind\":\"validation\"")
+	assert.Contains(t, errorsOutput.String(), "{\"line\":4,\"kind\":\"conflict\"")
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestImportUsers_BulkSaveError(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	userServiceMock.On("BulkSave", mock.Anything, mock.Anything).
+		Return(&user.BulkResult{}, errors.New("bulk error")).
+		Once()
+
+	report, err := importUsers(context.Background(), strings.NewReader("{\"_id\":\"1\"}\n{\"_id\":\"2\"}\n"), &bytes.Buffer{},
+		importOptions{format: "jsonl", batchSize: 1})
+
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, report.LastLine)
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestImportUsers_JSONLLineTooLong(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	input := "{\"_id\":\"1\"}\n{\"_id\":\"" + strings.Repeat("2", maxLineSize) + "\"}\n{\"_id\":\"3\"}\n"
+	userServiceMock.On("BulkSave", mock.Anything, []*domains.User{{ID: "1"}, {ID: "3"}}).
+		Return(&user.BulkResult{Inserted: 2}, nil).
+		Once()
+
+	var errorsOutput bytes.Buffer
+	report, err := importUsers(context.Background(), strings.NewReader(input), &errorsOutput,
+		importOptions{format: "jsonl", batchSize: 10})
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Lines)
+	assert.Equal(t, 1, report.Errors)
+	assert.Equal(t, 3, report.LastLine)
+	assert.Contains(t, errorsOutput.String(), "{\"line\":2,\"kind\":\"validation\"")
+
+	userServiceMock.AssertExpectations(t)
+}
+
+//failingReader returns its data and then err
+type failingReader struct {
+	data io.Reader
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	n, err := r.data.Read(p)
+	if err == io.EOF {
+		return n, r.err
+	}
+	return n, err
+}
+
+func TestImportUsers_ReadError(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	readError := errors.New("read error")
+	//the lines read before the error are still written
+	userServiceMock.On("BulkSave", mock.Anything, []*domains.User{{ID: "1"}}).
+		Return(&user.BulkResult{Inserted: 1}, nil).
+		Twice()
+
+	for format, input := range map[string]string{"jsonl": "{\"_id\":\"1\"}\n", "csv": "_id\n1\n"} {
+		var errorsOutput bytes.Buffer
+		report, err := importUsers(context.Background(), &failingReader{data: strings.NewReader(input), err: readError},
+			&errorsOutput, importOptions{format: format, batchSize: 10})
+
+		assert.Equal(t, readError, err, format)
+		assert.Equal(t, 0, report.Errors, format)
+		assert.Equal(t, int64(1), report.Inserted, format)
+		assert.Empty(t, errorsOutput.String(), format)
+	}
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestParseColumns_UnknownField(t *testing.T) {
+	_, err := parseColumns("nickname=nick")
+	assert.NotNil(t, err)
+}
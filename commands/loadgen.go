@@ -0,0 +1,282 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/queue"
+	"github.com/coaraujo/users-go-processor/processor"
+	"github.com/labstack/gommon/log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//loadOptions shape the traffic published by a load run
+type loadOptions struct {
+	//Rate is the number of messages published per second
+	Rate float64
+	//Users is the number of distinct user IDs the messages are spread over
+	Users int
+	//UpdateRatio is the share of the writes that update a known user instead of creating one
+	UpdateRatio float64
+	//RemoveRatio is the share of the messages that remove a known user
+	RemoveRatio float64
+	Duration    time.Duration
+	//Wait is how long the outcomes still missing at the end of the run are waited for
+	Wait time.Duration
+	//Results is the result topic of the processor, the latency is not measured when empty
+	Results string
+}
+
+//loadReport summarizes a load run. Completed messages got their outcome on the result topic, lost ones did not
+//within the wait.
+type loadReport struct {
+	Published     int
+	PublishErrors int
+	Elapsed       time.Duration
+	Completed     int
+	Lost          int
+	Results       map[string]int
+	latencies     []time.Duration
+}
+
+//PublishRate is the number of messages published per second
+func (r *loadReport) PublishRate() float64 {
+	if r.Elapsed <= 0 {
+		return 0
+	}
+	return float64(r.Published) / r.Elapsed.Seconds()
+}
+
+//Latency returns the completion latency at the percentile, from 0 to 100
+func (r *loadReport) Latency(percentile float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+	index := int(percentile/100*float64(len(r.latencies))+0.5) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(r.latencies) {
+		index = len(r.latencies) - 1
+	}
+	return r.latencies[index]
+}
+
+//loadPrefix is the prefix of the IDs of the generated users, so they can be told apart from real ones
+const loadPrefix = "loadgen-"
+
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+// LoadGen publishes randomized user traffic to the broker and reports the publish rate and the completion latency
+func LoadGen(broker queue.Broker, args []string) error {
+	flags := flag.NewFlagSet("loadgen", flag.ContinueOnError)
+	options := loadOptions{}
+	flags.Float64Var(&options.Rate, "rate", 100, "messages published per second")
+	flags.IntVar(&options.Users, "users", 1000, "distinct user IDs")
+	flags.Float64Var(&options.UpdateRatio, "update-ratio", 0.5, "share of the writes that update a known user")
+	flags.Float64Var(&options.RemoveRatio, "remove-ratio", 0.1, "share of the messages that remove a known user")
+	flags.DurationVar(&options.Duration, "duration", 30*time.Second, "duration of the run")
+	flags.DurationVar(&options.Wait, "wait", 10*time.Second, "time to wait for the missing outcomes")
+	flags.StringVar(&options.Results, "results", config.ResultTopic, "result topic of the processor")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if err := broker.NewConnection(); err != nil {
+		return err
+	}
+	defer broker.Disconnect()
+
+	report, err := loadgen(context.Background(), broker, options)
+	if err != nil {
+		return err
+	}
+	log.Infof("[LoadGen] Finished. Published: %d Errors: %d Rate: %.1f/s", report.Published, report.PublishErrors,
+		report.PublishRate())
+	if options.Results != "" {
+		log.Infof("[LoadGen] Completed: %d Lost: %d Latency p50: %s p95: %s p99: %s max: %s Results: %v",
+			report.Completed, report.Lost, report.Latency(50), report.Latency(95), report.Latency(99),
+			report.Latency(100), report.Results)
+	}
+	return nil
+}
+
+//loadgen publishes the traffic of the options until the duration elapses or ctx is done. With a result topic
+//every message carries a correlation-id, and the outcomes published by the processor complete them.
+func loadgen(ctx context.Context, broker queue.Broker, options loadOptions) (*loadReport, error) {
+	if options.Rate <= 0 || options.Users <= 0 {
+		return nil, errors.New("rate and users must be positive")
+	}
+
+	report := &loadReport{Results: make(map[string]int)}
+	var mu sync.Mutex
+	pending := make(map[string]time.Time)
+	run := strconv.FormatInt(time.Now().UnixNano(), 36)
+
+	stop := make(chan struct{})
+	listened := make(chan struct{})
+	if options.Results != "" {
+		go broker.Listen(options.Results)
+		go func() {
+			defer close(listened)
+			for {
+				select {
+				case msg := <-broker.Notifier(options.Results):
+					broker.AckMessage(msg)
+					mu.Lock()
+					complete(report, pending, msg)
+					mu.Unlock()
+				case <-stop:
+					return
+				}
+			}
+		}()
+	} else {
+		close(listened)
+	}
+
+	traffic := newTraffic(options)
+	start := time.Now()
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+publishing:
+	for elapsed := time.Duration(0); elapsed < options.Duration; elapsed = time.Since(start) {
+		due := int(elapsed.Seconds() * options.Rate)
+		for sent := report.Published + report.PublishErrors; sent < due; sent++ {
+			msg := traffic.next()
+			correlation := run + "-" + strconv.Itoa(sent)
+			msg.Header[processor.CorrelationHeader] = correlation
+
+			mu.Lock()
+			pending[correlation] = time.Now()
+			mu.Unlock()
+			if err := broker.Publish(msg); err != nil {
+				log.Errorf("[LoadGen] Could not publish to %s. ERROR: %s", msg.Destination, err)
+				mu.Lock()
+				delete(pending, correlation)
+				report.PublishErrors++
+				mu.Unlock()
+				continue
+			}
+			report.Published++
+		}
+
+		select {
+		case <-ctx.Done():
+			break publishing
+		case <-ticker.C:
+		}
+	}
+	report.Elapsed = time.Since(start)
+
+	if options.Results != "" {
+		for deadline := time.Now().Add(options.Wait); ; time.Sleep(10 * time.Millisecond) {
+			mu.Lock()
+			outstanding := len(pending)
+			mu.Unlock()
+			if outstanding == 0 || time.Now().After(deadline) || ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	close(stop)
+	<-listened
+
+	if options.Results != "" {
+		report.Lost = len(pending)
+	}
+	sort.Slice(report.latencies, func(i, j int) bool { return report.latencies[i] < report.latencies[j] })
+	return report, nil
+}
+
+//complete records the outcome of a pending message. Outcomes of other runs are ignored.
+func complete(report *loadReport, pending map[string]time.Time, msg *queue.Message) {
+	sent, ok := pending[msg.Header[processor.CorrelationHeader]]
+	if !ok {
+		return
+	}
+	delete(pending, msg.Header[processor.CorrelationHeader])
+
+	var outcome processor.Outcome
+	if err := json.Unmarshal(msg.Body, &outcome); err != nil {
+		log.Errorf("[LoadGen] Invalid outcome. BODY: %s ERROR: %s", string(msg.Body), err)
+		return
+	}
+	result := string(outcome.Result)
+	if outcome.Error != "" {
+		result = outcome.Kind
+	}
+	report.Completed++
+	report.Results[result]++
+	report.latencies = append(report.latencies, time.Since(sent))
+}
+
+//traffic picks the next message of a run, tracking which of the user IDs were created and not removed yet
+type traffic struct {
+	options loadOptions
+	known   []string
+	index   map[string]int
+}
+
+func newTraffic(options loadOptions) *traffic {
+	return &traffic{options: options, index: make(map[string]int)}
+}
+
+func (t *traffic) next() *queue.Message {
+	if len(t.known) > 0 && random.Float64() < t.options.RemoveRatio {
+		id := t.known[random.Intn(len(t.known))]
+		t.forget(id)
+		return userMessage(config.UserRemovedTopic, &domains.User{ID: id, UpdatedAt: time.Now().UTC()})
+	}
+
+	id := loadPrefix + strconv.Itoa(random.Intn(t.options.Users))
+	if len(t.known) > 0 && (random.Float64() < t.options.UpdateRatio || len(t.known) == t.options.Users) {
+		id = t.known[random.Intn(len(t.known))]
+	}
+	t.remember(id)
+	return userMessage(config.UserCreateTopic, randomUser(id))
+}
+
+func (t *traffic) remember(id string) {
+	if _, ok := t.index[id]; !ok {
+		t.index[id] = len(t.known)
+		t.known = append(t.known, id)
+	}
+}
+
+func (t *traffic) forget(id string) {
+	i := t.index[id]
+	last := t.known[len(t.known)-1]
+	t.known[i], t.index[last] = last, i
+	t.known = t.known[:len(t.known)-1]
+	delete(t.index, id)
+}
+
+func userMessage(topic string, user *domains.User) *queue.Message {
+	body, _ := json.Marshal(user)
+	return queue.NewMessage(topic, "application/json", body)
+}
+
+//randomUser returns a valid active user with random contact data
+func randomUser(id string) *domains.User {
+	n := random.Intn(1000000)
+	return &domains.User{
+		ID:     id,
+		Name:   fmt.Sprintf("Load User %d", n),
+		Email:  fmt.Sprintf("user%d@loadgen.example", n),
+		Status: domains.StatusActive,
+		Phones: domains.Phones{{Type: domains.PhoneMobile, DDD: "11", Number: fmt.Sprintf("9%08d", n),
+			Primary: true, Verification: domains.PhoneUnverified}},
+		Addresses: []domains.Address{{Type: domains.AddressShipping, Street: "Rua Load", Number: strconv.Itoa(n % 1000),
+			City: "São Paulo", UF: "SP"}},
+		UpdatedAt: time.Now().UTC(),
+	}
+}
@@ -0,0 +1,83 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/queue"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/processor"
+	"github.com/stretchr/testify/assert"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadGen_Processor(t *testing.T) {
+	random = rand.New(rand.NewSource(1))
+	broker := queue.NewMemoryBroker()
+	db := storage.NewMemoryDB()
+	p := processor.New(processor.Options{Broker: broker, Storage: db, ResultTopic: "results"})
+	if err := p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = p.Stop(context.Background()) }()
+
+	report, err := loadgen(context.Background(), broker, loadOptions{Rate: 500, Users: 20, UpdateRatio: 0.5,
+		RemoveRatio: 0.2, Duration: 200 * time.Millisecond, Wait: 5 * time.Second, Results: "results"})
+
+	assert.Nil(t, err)
+	assert.True(t, report.Published >= 50, "published %d", report.Published)
+	assert.Equal(t, 0, report.PublishErrors)
+	//a remove can reach the processor before the create of its user, and be redelivered past the maximum
+	assert.Equal(t, report.Published, report.Completed+report.Lost)
+	assert.True(t, report.Lost <= report.Published/10, "lost %d", report.Lost)
+	assert.True(t, report.Results[string(processor.Created)] > 0)
+	assert.True(t, report.Results[string(processor.Updated)] > 0)
+	assert.True(t, report.Latency(50) <= report.Latency(99))
+	assert.Equal(t, report.latencies[len(report.latencies)-1], report.Latency(100))
+}
+
+func TestLoadGen_WithoutResults(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	defer broker.Disconnect()
+
+	report, err := loadgen(context.Background(), broker, loadOptions{Rate: 1000, Users: 5, UpdateRatio: 1,
+		Duration: 50 * time.Millisecond})
+
+	assert.Nil(t, err)
+	assert.Equal(t, report.Published, len(broker.Queued(config.UserCreateTopic)))
+	assert.Equal(t, 0, report.Completed)
+	assert.Equal(t, 0, report.Lost)
+	for _, msg := range broker.Queued(config.UserCreateTopic) {
+		var user domains.User
+		assert.Nil(t, json.Unmarshal(msg.Body, &user))
+		assert.True(t, strings.HasPrefix(user.ID, loadPrefix))
+		assert.NotEmpty(t, msg.Header[processor.CorrelationHeader])
+	}
+}
+
+func TestLoadGen_InvalidOptions(t *testing.T) {
+	_, err := loadgen(context.Background(), queue.NewMemoryBroker(), loadOptions{Users: 10})
+
+	assert.NotNil(t, err)
+}
+
+func TestTraffic_RemovesKnownUsers(t *testing.T) {
+	random = rand.New(rand.NewSource(1))
+	traffic := newTraffic(loadOptions{Users: 3, RemoveRatio: 0.5})
+
+	for i := 0; i < 100; i++ {
+		msg := traffic.next()
+		var user domains.User
+		assert.Nil(t, json.Unmarshal(msg.Body, &user))
+		if msg.Destination == config.UserRemovedTopic {
+			continue
+		}
+		_, known := traffic.index[user.ID]
+		assert.True(t, known)
+		assert.True(t, len(traffic.known) <= 3)
+	}
+}
@@ -0,0 +1,192 @@
+package commands
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/clients/client"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/coaraujo/users-go-processor/processor"
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"github.com/labstack/gommon/log"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const (
+	driftMissing  = "missing"
+	driftExtra    = "extra"
+	driftMismatch = "mismatch"
+)
+
+//drift is reported for every user that differs from users-go-api
+type drift struct {
+	ID       string   `json:"_id"`
+	Drift    string   `json:"drift"`
+	Fields   []string `json:"fields,omitempty"`
+	Repaired bool     `json:"repaired,omitempty"`
+	Error    string   `json:"error,omitempty"`
+}
+
+//reconcileReport counts the drift found by a reconciliation run
+type reconcileReport struct {
+	Upstream   int
+	Missing    int
+	Extra      int
+	Mismatched int
+	Repaired   int
+	Errors     int
+}
+
+// Reconcile compares the users collection with users-go-api, reporting and optionally repairing the drift
+func Reconcile(args []string) error {
+	flags := flag.NewFlagSet("reconcile", flag.ContinueOnError)
+	api := flags.String("api", config.UsersAPIURL, "users-go-api base URL")
+	pageSize := flags.Int("page-size", 100, "users requested per page")
+	repair := flags.Bool("repair", false, "apply the upstream state to the drifted users")
+	output := flags.String("output", "", "file where the drift is reported as JSONL, stdout when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *api == "" {
+		return errors.New("reconcile: -api or USERS_API_URL is required")
+	}
+
+	out := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		out = f
+	}
+
+	report, err := reconcile(context.Background(), *api, *pageSize, *repair, out)
+	log.Infof("[Reconcile] Finished. Upstream: %d Missing: %d Extra: %d Mismatched: %d Repaired: %d Errors: %d",
+		report.Upstream, report.Missing, report.Extra, report.Mismatched, report.Repaired, report.Errors)
+	return err
+}
+
+func reconcile(ctx context.Context, api string, pageSize int, repair bool, out io.Writer) (*reconcileReport, error) {
+	report := &reconcileReport{}
+	encoder := json.NewEncoder(out)
+	seen := make(map[string]bool)
+
+	record := func(d *drift, fix func() error) error {
+		switch d.Drift {
+		case driftMissing:
+			report.Missing++
+		case driftExtra:
+			report.Extra++
+		case driftMismatch:
+			report.Mismatched++
+		}
+		if repair {
+			if err := fix(); err != nil {
+				report.Errors++
+				d.Error = err.Error()
+			} else {
+				report.Repaired++
+				d.Repaired = true
+			}
+		}
+		return encoder.Encode(d)
+	}
+
+	for page := 1; ; page++ {
+		upstreamUsers, err := fetchUsersPage(api, page, pageSize)
+		if err != nil {
+			return report, err
+		}
+
+		for _, upstream := range upstreamUsers {
+			report.Upstream++
+			seen[upstream.ID] = true
+
+			local, err := userService.GetInstance().Get(tenant.WithClientID(ctx, upstream.ClientID), upstream.ID)
+			if storage.IsNotFound(err) {
+				err = record(&drift{ID: upstream.ID, Drift: driftMissing}, func() error {
+					_, err := userService.GetInstance().Insert(ctx, upstream)
+					return err
+				})
+			} else if err == nil {
+				if fields := diffUsers(upstream, local); len(fields) > 0 {
+					err = record(&drift{ID: upstream.ID, Drift: driftMismatch, Fields: fields}, func() error {
+						upstream.Version = local.Version
+						upstream.StatusHistory = local.StatusHistory
+						if upstream.Status != "" && !domains.SameStatus(local.Status, upstream.Status) {
+							upstream.StatusHistory = append(upstream.StatusHistory, domains.StatusTransition{
+								From: local.Status, To: upstream.Status, At: upstream.UpdatedAt})
+						}
+						return userService.GetInstance().Replace(ctx, upstream)
+					})
+				}
+			}
+			if err != nil {
+				return report, err
+			}
+		}
+
+		if len(upstreamUsers) < pageSize {
+			break
+		}
+	}
+
+	for _, filter := range tenantFilters(domains.UserFilter{}) {
+		err := userService.GetInstance().Each(ctx, filter, func(local *domains.User) error {
+			if seen[local.ID] {
+				return nil
+			}
+			return record(&drift{ID: local.ID, Drift: driftExtra}, func() error {
+				_, err := processor.RemoveUser(ctx, local)
+				return err
+			})
+		})
+		if err != nil {
+			return report, err
+		}
+	}
+	return report, nil
+}
+
+//fetchUsersPage requests GET {api}/users?page={page}&limit={pageSize}, pages starting at 1
+var fetchUsersPage = func(api string, page int, pageSize int) ([]*domains.User, error) {
+	url := fmt.Sprintf("%s/users?page=%d&limit=%d", strings.TrimSuffix(api, "/"), page, pageSize)
+	resp, err := client.GetInstance().Request(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reconcile: GET %s returned %d", url, resp.StatusCode)
+	}
+
+	var users []*domains.User
+	if err := json.NewDecoder(resp.Body).Decode(&users); err != nil {
+		return nil, fmt.Errorf("reconcile: could not decode page %d: %s", page, err)
+	}
+	return users, nil
+}
+
+//diffUsers returns the fields where the users differ, ignoring updatedAt
+func diffUsers(upstream *domains.User, local *domains.User) []string {
+	var fields []string
+	for _, field := range userFields {
+		if field == "updatedAt" {
+			continue
+		}
+		if userGetters[field](upstream) != userGetters[field](local) {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
@@ -0,0 +1,150 @@
+package commands
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	"github.com/coaraujo/users-go-processor/services/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/mongo"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//usersAPI is an httptest stand-in for users-go-api serving the given pages
+func usersAPI(pages ...[]*domains.User) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if r.URL.Path != "/users" || r.URL.Query().Get("limit") != "2" || page < 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if page > len(pages) {
+			_, _ = w.Write([]byte("[]"))
+			return
+		}
+		_ = json.NewEncoder(w).Encode(pages[page-1])
+	}))
+}
+
+func decodeDrift(t *testing.T, out *bytes.Buffer) map[string]drift {
+	drifts := make(map[string]drift)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		var d drift
+		assert.Nil(t, json.Unmarshal([]byte(line), &d))
+		drifts[d.ID] = d
+	}
+	return drifts
+}
+
+func TestReconcile_ReportOnly(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	server := usersAPI(
+		[]*domains.User{{ID: "1", Email: "email1"}, {ID: "2", Email: "email2"}},
+		[]*domains.User{{ID: "3", Email: "email3"}},
+	)
+	defer server.Close()
+
+	_ = userServiceMock.Initialize()
+	userServiceMock.On("Get", mock.Anything, "1").Return(&domains.User{ID: "1", Email: "email1"}, nil).Once()
+	userServiceMock.On("Get", mock.Anything, "2").Return(&domains.User{ID: "2", Email: "other", Status: "active"}, nil).Once()
+	userServiceMock.On("Get", mock.Anything, "3").Return(&domains.User{}, mongo.ErrNoDocuments).Once()
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{}).
+		Return([]*domains.User{{ID: "1"}, {ID: "2"}, {ID: "4"}}, nil).
+		Once()
+
+	var out bytes.Buffer
+	report, err := reconcile(context.Background(), server.URL, 2, false, &out)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &reconcileReport{Upstream: 3, Missing: 1, Extra: 1, Mismatched: 1}, report)
+
+	drifts := decodeDrift(t, &out)
+	assert.Equal(t, []string{"email", "status"}, drifts["2"].Fields)
+	assert.Equal(t, driftMissing, drifts["3"].Drift)
+	assert.Equal(t, driftExtra, drifts["4"].Drift)
+
+	userServiceMock.AssertNotCalled(t, "Insert", mock.Anything)
+	userServiceMock.AssertNotCalled(t, "Replace", mock.Anything)
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestReconcile_ExtraInEveryTenant(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Database: "users_acme"}}, config.TenantShared)
+	userServiceMock := &user.UserMock{}
+	server := usersAPI([]*domains.User{{ID: "1", Email: "email1"}})
+	defer server.Close()
+
+	_ = userServiceMock.Initialize()
+	userServiceMock.On("Get", mock.Anything, "1").Return(&domains.User{ID: "1", Email: "email1"}, nil).Once()
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{}).
+		Return([]*domains.User{{ID: "1"}, {ID: "4"}}, nil).
+		Once()
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{ClientID: "acme"}).
+		Return([]*domains.User{{ID: "5", ClientID: "acme"}}, nil).
+		Once()
+
+	var out bytes.Buffer
+	report, err := reconcile(context.Background(), server.URL, 2, false, &out)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &reconcileReport{Upstream: 1, Extra: 2}, report)
+	drifts := decodeDrift(t, &out)
+	assert.Equal(t, driftExtra, drifts["4"].Drift)
+	assert.Equal(t, driftExtra, drifts["5"].Drift)
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestReconcile_Repair(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	olduserServiceMock := &olduser.OldUserMock{}
+	upstreamMismatch := &domains.User{ID: "1", Email: "email1"}
+	upstreamMissing := &domains.User{ID: "2", Email: "email2"}
+	extra := &domains.User{ID: "3"}
+	server := usersAPI([]*domains.User{upstreamMismatch, upstreamMissing})
+	defer server.Close()
+
+	_ = userServiceMock.Initialize()
+	_ = olduserServiceMock.Initialize()
+	userServiceMock.On("Get", mock.Anything, "1").Return(&domains.User{ID: "1"}, nil).Once()
+	userServiceMock.On("Replace", mock.Anything, upstreamMismatch).Return(nil).Once()
+	userServiceMock.On("Get", mock.Anything, "2").Return(&domains.User{}, mongo.ErrNoDocuments).Once()
+	userServiceMock.On("Insert", mock.Anything, upstreamMissing).Return("2", nil).Once()
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{}).Return([]*domains.User{extra}, nil).Once()
+	userServiceMock.On("Get", mock.Anything, "3").Return(extra, nil).Once()
+	olduserServiceMock.On("Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser")).Return("3", nil).Once()
+	userServiceMock.On("Delete", mock.Anything, "3").Return(nil).Once()
+
+	var out bytes.Buffer
+	report, err := reconcile(context.Background(), server.URL, 2, true, &out)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 3, report.Repaired)
+	assert.Equal(t, 0, report.Errors)
+	for _, d := range decodeDrift(t, &out) {
+		assert.True(t, d.Repaired)
+	}
+
+	olduserServiceMock.AssertExpectations(t)
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestReconcile_UpstreamError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	_, err := reconcile(context.Background(), server.URL, 2, false, &bytes.Buffer{})
+	assert.NotNil(t, err)
+}
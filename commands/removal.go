@@ -0,0 +1,112 @@
+package commands
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"github.com/labstack/gommon/log"
+	"time"
+)
+
+//removalReport counts the users converted by a removal strategy migration
+type removalReport struct {
+	Converted int
+	Skipped   int
+	Errors    int
+}
+
+// MigrateRemoval converts the removed users stored with the other strategies to the given one
+func MigrateRemoval(args []string) error {
+	flags := flag.NewFlagSet("migrate-removal", flag.ContinueOnError)
+	to := flags.String("to", config.RemovalStrategy, "removal strategy to convert to: archive, soft or hard")
+	clientID := flags.String("client-id", "", "tenant whose users are converted, the shared storage when empty")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	report, err := migrateRemoval(tenant.NewContext(context.Background(), *clientID), *to)
+	log.Infof("[MigrateRemoval] Finished. Strategy: %s Converted: %d Skipped: %d Errors: %d",
+		*to, report.Converted, report.Skipped, report.Errors)
+	return err
+}
+
+//migrateRemoval converts the removed users to the strategy:
+//  - archive moves the soft deleted users to old_users
+//  - soft copies the latest generation of the archived users missing from users back as soft deleted, old_users
+//    is kept
+//  - hard deletes the soft deleted users, old_users is kept
+//A user that fails is reported and skipped, the migration can be run again.
+func migrateRemoval(ctx context.Context, to string) (*removalReport, error) {
+	report := &removalReport{}
+	record := func(id string, err error) {
+		if err != nil {
+			log.Errorf("[MigrateRemoval] Could not convert user %s. ERROR: %s", id, err)
+			report.Errors++
+			return
+		}
+		report.Converted++
+	}
+
+	switch to {
+	case config.RemovalArchive, "":
+		err := userService.GetInstance().Each(ctx, domains.UserFilter{Deleted: true}, func(user *domains.User) error {
+			record(user.ID, archiveDeleted(ctx, user))
+			return nil
+		})
+		return report, err
+	case config.RemovalSoftDelete:
+		err := olduser.GetInstance().Each(ctx, domains.UserFilter{}, func(entry *domains.ArchivedUser) error {
+			_, err := userService.GetInstance().GetWithDeleted(ctx, entry.UserID)
+			if err == nil {
+				report.Skipped++
+				return nil
+			}
+			if storage.IsNotFound(err) {
+				err = restoreDeleted(ctx, entry.UserID)
+			}
+			record(entry.UserID, err)
+			return nil
+		})
+		return report, err
+	case config.RemovalHardDelete:
+		err := userService.GetInstance().Each(ctx, domains.UserFilter{Deleted: true}, func(user *domains.User) error {
+			record(user.ID, userService.GetInstance().Delete(ctx, user.ID))
+			return nil
+		})
+		return report, err
+	}
+	return report, fmt.Errorf("migrate-removal: unknown strategy %q", to)
+}
+
+//archiveDeleted moves a soft deleted user to a new entry of old_users, archived when it was deleted
+var archiveDeleted = func(ctx context.Context, user *domains.User) error {
+	entry := &domains.ArchivedUser{UserID: user.ID, ArchivedAt: *user.DeletedAt, Reason: domains.ArchiveMigrated,
+		User: *user}
+	entry.User.DeletedAt = nil
+	if _, err := olduser.GetInstance().Insert(ctx, entry); err != nil {
+		return err
+	}
+	return userService.GetInstance().Delete(ctx, user.ID)
+}
+
+//restoreDeleted inserts the latest archived generation of the user in users, soft deleted when it was archived
+var restoreDeleted = func(ctx context.Context, userID string) error {
+	entry, err := olduser.GetInstance().Latest(ctx, userID)
+	if err != nil {
+		return err
+	}
+	user := entry.User
+	deletedAt := entry.ArchivedAt
+	if deletedAt.IsZero() {
+		deletedAt = time.Now()
+	}
+	user.DeletedAt = &deletedAt
+	_, err = userService.GetInstance().Insert(ctx, &user)
+	return err
+}
@@ -0,0 +1,71 @@
+package commands
+
+import (
+	"context"
+	"errors"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	"github.com/coaraujo/users-go-processor/services/user"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"testing"
+	"time"
+)
+
+func TestMigrateRemoval_Archive(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	olduserServiceMock := &olduser.OldUserMock{}
+	_ = userServiceMock.Initialize()
+	_ = olduserServiceMock.Initialize()
+
+	deletedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	userServiceMock.On("Each", mock.Anything, domains.UserFilter{Deleted: true}).
+		Return([]*domains.User{{ID: "1", DeletedAt: &deletedAt}, {ID: "2", DeletedAt: &deletedAt}}, nil).
+		Once()
+	olduserServiceMock.On("Insert", mock.Anything, &domains.ArchivedUser{UserID: "1", ArchivedAt: deletedAt,
+		Reason: domains.ArchiveMigrated, User: domains.User{ID: "1"}}).Return("a", nil).Once()
+	olduserServiceMock.On("Insert", mock.Anything, &domains.ArchivedUser{UserID: "2", ArchivedAt: deletedAt,
+		Reason: domains.ArchiveMigrated, User: domains.User{ID: "2"}}).Return("", errors.New("timeout")).Once()
+	userServiceMock.On("Delete", mock.Anything, "1").Return(nil).Once()
+
+	report, err := migrateRemoval(context.Background(), config.RemovalArchive)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &removalReport{Converted: 1, Errors: 1}, report)
+	userServiceMock.AssertExpectations(t)
+	olduserServiceMock.AssertExpectations(t)
+}
+
+func TestMigrateRemoval_SoftDelete(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	olduserServiceMock := &olduser.OldUserMock{}
+	_ = userServiceMock.Initialize()
+	_ = olduserServiceMock.Initialize()
+
+	archivedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	latest := &domains.ArchivedUser{ID: "b", UserID: "1", ArchivedAt: archivedAt, User: domains.User{ID: "1", Name: "latest"}}
+	olduserServiceMock.On("Each", mock.Anything, domains.UserFilter{}).
+		Return([]*domains.ArchivedUser{{ID: "a", UserID: "1"}, {ID: "c", UserID: "2"}}, nil).
+		Once()
+	userServiceMock.On("GetWithDeleted", mock.Anything, "1").Return((*domains.User)(nil), storage.ErrNotFound).Once()
+	userServiceMock.On("GetWithDeleted", mock.Anything, "2").Return(&domains.User{ID: "2"}, nil).Once()
+	olduserServiceMock.On("Latest", mock.Anything, "1").Return(latest, nil).Once()
+	userServiceMock.On("Insert", mock.Anything, &domains.User{ID: "1", Name: "latest", DeletedAt: &archivedAt}).
+		Return("1", nil).
+		Once()
+
+	report, err := migrateRemoval(context.Background(), config.RemovalSoftDelete)
+
+	assert.Nil(t, err)
+	assert.Equal(t, &removalReport{Converted: 1, Skipped: 1}, report)
+	userServiceMock.AssertExpectations(t)
+	olduserServiceMock.AssertExpectations(t)
+}
+
+func TestMigrateRemoval_UnknownStrategy(t *testing.T) {
+	_, err := migrateRemoval(context.Background(), "move")
+
+	assert.NotNil(t, err)
+}
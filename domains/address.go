@@ -0,0 +1,28 @@
+package domains
+
+const (
+	AddressShipping = "shipping"
+	AddressBilling  = "billing"
+
+	//AddressRemove is the action of an event address that removes the stored address
+	AddressRemove = "remove"
+)
+
+//Address is a postal address of the user. Addresses are identified by type, CEP, number and complement.
+type Address struct {
+	Type         string `bson:"type,omitempty" json:"type,omitempty"`
+	CEP          string `bson:"cep,omitempty" json:"cep,omitempty"`
+	Street       string `bson:"street,omitempty" json:"street,omitempty"`
+	Number       string `bson:"number,omitempty" json:"number,omitempty"`
+	Complement   string `bson:"complement,omitempty" json:"complement,omitempty"`
+	Neighborhood string `bson:"neighborhood,omitempty" json:"neighborhood,omitempty"`
+	City         string `bson:"city,omitempty" json:"city,omitempty"`
+	UF           string `bson:"uf,omitempty" json:"uf,omitempty"`
+	//Action is only read from events: empty adds or replaces the address, AddressRemove removes it
+	Action string `bson:"-" json:"action,omitempty"`
+}
+
+//Key identifies the address regardless of the formatting of its CEP
+func (a Address) Key() string {
+	return a.Type + "|" + digits(a.CEP) + "|" + a.Number + "|" + a.Complement
+}
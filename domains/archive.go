@@ -0,0 +1,23 @@
+package domains
+
+import "time"
+
+const (
+	//ArchiveRemoved is the reason of users archived by a remove event
+	ArchiveRemoved = "removed"
+	//ArchiveMigrated is the reason of soft deleted users moved to the archive by a removal strategy migration
+	ArchiveMigrated = "migrated"
+)
+
+//ArchivedUser is a generation of a user in old_users. A user that is removed, created again and removed again
+//has one entry per removal, each with its own ID.
+type ArchivedUser struct {
+	ID         string    `bson:"_id,omitempty" json:"_id,omitempty"`
+	UserID     string    `bson:"userId,omitempty" json:"userId,omitempty"`
+	ArchivedAt time.Time `bson:"archivedAt,omitempty" json:"archivedAt,omitempty"`
+	Reason     string    `bson:"reason,omitempty" json:"reason,omitempty"`
+	//Source is the event that removed the user, when there was one
+	Source *User `bson:"source,omitempty" json:"source,omitempty"`
+	//User is the snapshot of the user when it was archived
+	User User `bson:"user" json:"user"`
+}
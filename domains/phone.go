@@ -0,0 +1,136 @@
+package domains
+
+import (
+	"encoding/json"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"strings"
+	"time"
+)
+
+const (
+	PhoneMobile = "mobile"
+	PhoneHome   = "home"
+	PhoneWork   = "work"
+
+	PhoneUnverified = "unverified"
+	PhonePending    = "pending"
+	PhoneVerified   = "verified"
+
+	//PhoneRemove is the action of an event phone that removes the stored number
+	PhoneRemove = "remove"
+)
+
+//PhoneNumber is a phone of the user. Numbers are identified by country code, DDD and number.
+type PhoneNumber struct {
+	Type                  string    `bson:"type,omitempty" json:"type,omitempty"`
+	CountryCode           string    `bson:"countryCode,omitempty" json:"countryCode,omitempty"`
+	DDD                   string    `bson:"ddd,omitempty" json:"ddd,omitempty"`
+	Number                string    `bson:"number,omitempty" json:"number,omitempty"`
+	Primary               bool      `bson:"primary,omitempty" json:"primary,omitempty"`
+	Verification          string    `bson:"verification,omitempty" json:"verification,omitempty"`
+	VerificationUpdatedAt time.Time `bson:"verificationUpdatedAt,omitempty" json:"verificationUpdatedAt,omitempty"`
+	UpdatedAt             time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	//Action is only read from events: empty adds or replaces the number, PhoneRemove removes it
+	Action string `bson:"-" json:"action,omitempty"`
+	//Legacy marks the numbers converted from the legacy Phone shape, which replace the legacy slots when merged
+	Legacy bool `bson:"-" json:"-"`
+}
+
+//LegacySlot reports whether the number holds one of the fields of the legacy Phone shape: the primary mobile
+//number is the cellphone and the home numbers the phone
+func (p PhoneNumber) LegacySlot() bool {
+	return p.Type == PhoneHome || (p.Type == PhoneMobile && p.Primary)
+}
+
+//Key identifies the number regardless of its formatting
+func (p PhoneNumber) Key() string {
+	return digits(p.CountryCode) + "|" + digits(p.DDD) + "|" + digits(p.Number)
+}
+
+func digits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, value)
+}
+
+//Phones are the phones of the user. Documents and events in the legacy single Phone shape are read as the
+//equivalent list, and written back as a list.
+type Phones []PhoneNumber
+
+//Phone is the legacy shape of phones, one landline and one cellphone
+type Phone struct {
+	Phone                string    `bson:"phone,omitempty" json:"phone,omitempty"`
+	CellPhone            string    `bson:"cellphone,omitempty" json:"cellphone,omitempty"`
+	DddCellPhone         string    `bson:"ddd_cellphone,omitempty" json:"ddd_cellphone,omitempty"`
+	MobilePhoneConfirmed bool      `bson:"mobile_phone_confirmed,omitempty" json:"mobile_phone_confirmed,omitempty"`
+	UpdatedAt            time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+}
+
+//Phones converts the legacy shape: the cellphone becomes the primary mobile number, verified when it was
+//confirmed, and the phone a home number
+func (p Phone) Phones() Phones {
+	phones := Phones{}
+	if p.CellPhone != "" {
+		mobile := PhoneNumber{Type: PhoneMobile, DDD: p.DddCellPhone, Number: p.CellPhone, Primary: true,
+			Verification: PhoneUnverified, UpdatedAt: p.UpdatedAt}
+		if p.MobilePhoneConfirmed {
+			mobile.Verification = PhoneVerified
+			mobile.VerificationUpdatedAt = p.UpdatedAt
+		}
+		phones = append(phones, mobile)
+	}
+	if p.Phone != "" {
+		phones = append(phones, PhoneNumber{Type: PhoneHome, Number: p.Phone, Primary: p.CellPhone == "",
+			UpdatedAt: p.UpdatedAt})
+	}
+	return phones
+}
+
+//UnmarshalJSON reads a list of phones or the legacy Phone object, whose numbers are marked Legacy
+func (p *Phones) UnmarshalJSON(data []byte) error {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "{") {
+		var legacy Phone
+		if err := json.Unmarshal(data, &legacy); err != nil {
+			return err
+		}
+		phones := legacy.Phones()
+		for i := range phones {
+			phones[i].Legacy = true
+		}
+		*p = phones
+		return nil
+	}
+
+	var phones []PhoneNumber
+	if err := json.Unmarshal(data, &phones); err != nil {
+		return err
+	}
+	*p = phones
+	return nil
+}
+
+//UnmarshalBSONValue reads an array of phones or the legacy Phone document
+func (p *Phones) UnmarshalBSONValue(t bsontype.Type, data []byte) error {
+	value := bson.RawValue{Type: t, Value: data}
+	switch t {
+	case bsontype.EmbeddedDocument:
+		var legacy Phone
+		if err := value.Unmarshal(&legacy); err != nil {
+			return err
+		}
+		*p = legacy.Phones()
+	case bsontype.Null, bsontype.Undefined:
+		*p = nil
+	default:
+		var phones []PhoneNumber
+		if err := value.Unmarshal(&phones); err != nil {
+			return err
+		}
+		*p = phones
+	}
+	return nil
+}
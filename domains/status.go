@@ -0,0 +1,80 @@
+package domains
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	StatusPending  = "pending"
+	StatusActive   = "active"
+	StatusInactive = "inactive"
+	StatusBlocked  = "blocked"
+	StatusDeleted  = "deleted"
+)
+
+//statusTransitions are the statuses each status can move to, deleted is final
+var statusTransitions = map[string][]string{
+	StatusPending:  {StatusActive, StatusBlocked, StatusDeleted},
+	StatusActive:   {StatusInactive, StatusBlocked, StatusDeleted},
+	StatusInactive: {StatusActive, StatusBlocked, StatusDeleted},
+	StatusBlocked:  {StatusActive, StatusDeleted},
+	StatusDeleted:  {},
+}
+
+//StatusTransition records a change of the status of the user, From is empty for the status the user was
+//created with
+type StatusTransition struct {
+	From string    `bson:"from,omitempty" json:"from,omitempty"`
+	To   string    `bson:"to,omitempty" json:"to,omitempty"`
+	At   time.Time `bson:"at,omitempty" json:"at,omitempty"`
+}
+
+//statuses are the defined statuses in the order they are listed
+var statuses = []string{StatusPending, StatusActive, StatusInactive, StatusBlocked, StatusDeleted}
+
+//Statuses returns the accepted spellings of the defined statuses, lowercase and then uppercase. The user schemas
+//list them as the status enum.
+func Statuses() []string {
+	spellings := make([]string, 0, 2*len(statuses))
+	spellings = append(spellings, statuses...)
+	for _, status := range statuses {
+		spellings = append(spellings, strings.ToUpper(status))
+	}
+	return spellings
+}
+
+//IsStatus reports whether status is one of the defined statuses, in lowercase or uppercase like Statuses
+func IsStatus(status string) bool {
+	if status != strings.ToLower(status) && status != strings.ToUpper(status) {
+		return false
+	}
+	_, ok := statusTransitions[strings.ToLower(status)]
+	return ok
+}
+
+//SameStatus reports whether both statuses are the same, regardless of case
+func SameStatus(status, another string) bool {
+	return strings.EqualFold(status, another)
+}
+
+//CanTransition reports whether a user can move from a status to another. Users without a status, or with a
+//status stored before they were defined, can move to any status.
+func CanTransition(from, to string) bool {
+	if !IsStatus(to) {
+		return false
+	}
+	if SameStatus(from, to) {
+		return true
+	}
+	allowed, ok := statusTransitions[strings.ToLower(from)]
+	if !ok {
+		return true
+	}
+	for _, status := range allowed {
+		if status == strings.ToLower(to) {
+			return true
+		}
+	}
+	return false
+}
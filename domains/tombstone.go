@@ -0,0 +1,17 @@
+package domains
+
+import "time"
+
+//Tombstone records that a user was removed, so the events of the user that arrive out of order are not
+//applied. It is ignored after ExpiresAt.
+type Tombstone struct {
+	UserID    string    `bson:"_id" json:"_id"`
+	RemovedAt time.Time `bson:"removedAt" json:"removedAt"`
+	ExpiresAt time.Time `bson:"expiresAt" json:"expiresAt"`
+}
+
+//Covers reports whether the tombstone rejects an event of its user updated at updatedAt. Events without an
+//update time are never covered.
+func (t *Tombstone) Covers(updatedAt time.Time) bool {
+	return !updatedAt.IsZero() && !updatedAt.After(t.RemovedAt)
+}
@@ -1,6 +1,10 @@
 package domains
 
-import "time"
+import (
+	"strconv"
+	"strings"
+	"time"
+)
 
 type User struct {
 	ID        string    `bson:"_id,omitempty" json:"_id,omitempty"`
@@ -10,15 +14,75 @@ type User struct {
 	Gender    string    `bson:"gender,omitempty" json:"gender,omitempty"`
 	Status    string    `bson:"status,omitempty" json:"status,omitempty"`
 	BirthDate string    `bson:"birthDate,omitempty" json:"birthDate,omitempty"`
-	Phones    *Phone    `bson:"phones,omitempty" json:"phones,omitempty"`
+	Phones    Phones    `bson:"phones,omitempty" json:"phones,omitempty"`
+	Addresses []Address `bson:"addresses,omitempty" json:"addresses,omitempty"`
 	ClientID  string    `bson:"clientId,omitempty" json:"clientId,omitempty"`
 	UpdatedAt time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+	//StatusHistory records every change of Status, it is kept by the service and ignored on events
+	StatusHistory []StatusTransition `bson:"statusHistory,omitempty" json:"statusHistory,omitempty"`
+	//DeletedAt marks users removed with the soft delete strategy, they are hidden from reads of users
+	DeletedAt *time.Time `bson:"deletedAt,omitempty" json:"deletedAt,omitempty"`
+	//Version is incremented on every write, zero for users stored before versioning
+	Version int64 `bson:"version,omitempty" json:"version,omitempty"`
 }
 
-type Phone struct {
-	Phone                string    `bson:"phone,omitempty" json:"phone,omitempty"`
-	CellPhone            string    `bson:"cellphone,omitempty" json:"cellphone,omitempty"`
-	DddCellPhone         string    `bson:"ddd_cellphone,omitempty" json:"ddd_cellphone,omitempty"`
-	MobilePhoneConfirmed bool      `bson:"mobile_phone_confirmed,omitempty" json:"mobile_phone_confirmed,omitempty"`
-	UpdatedAt            time.Time `bson:"updatedAt,omitempty" json:"updatedAt,omitempty"`
+//UserFilter selects users by client, status and update time. Empty fields match everything.
+type UserFilter struct {
+	ClientID    string
+	Status      string
+	UpdatedFrom time.Time
+	UpdatedTo   time.Time
+	//Deleted selects the soft deleted users instead of the live ones, it only applies to users
+	Deleted bool
+}
+
+//Query returns the filter as a storage query
+func (f UserFilter) Query() map[string]interface{} {
+	query := make(map[string]interface{})
+	if f.ClientID != "" {
+		query["clientId"] = f.ClientID
+	}
+	if f.Status != "" {
+		query["status"] = f.Status
+	}
+
+	updatedAt := make(map[string]interface{})
+	if !f.UpdatedFrom.IsZero() {
+		updatedAt["$gte"] = f.UpdatedFrom
+	}
+	if !f.UpdatedTo.IsZero() {
+		updatedAt["$lt"] = f.UpdatedTo
+	}
+	if len(updatedAt) > 0 {
+		query["updatedAt"] = updatedAt
+	}
+	return query
+}
+
+//Where returns the filter as a SQL condition over the client_id, status and updated_at columns and its arguments
+func (f UserFilter) Where() (string, []interface{}) {
+	var conditions []string
+	var args []interface{}
+	add := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, condition+" $"+strconv.Itoa(len(args)))
+	}
+
+	if f.ClientID != "" {
+		add("client_id =", f.ClientID)
+	}
+	if f.Status != "" {
+		add("status =", f.Status)
+	}
+	if !f.UpdatedFrom.IsZero() {
+		add("updated_at >=", f.UpdatedFrom)
+	}
+	if !f.UpdatedTo.IsZero() {
+		add("updated_at <", f.UpdatedTo)
+	}
+
+	if len(conditions) == 0 {
+		return "TRUE", nil
+	}
+	return strings.Join(conditions, " AND "), args
 }
@@ -3,6 +3,7 @@ module github.com/coaraujo/users-go-processor
 go 1.12
 
 require (
+	github.com/DATA-DOG/go-sqlmock v1.3.3
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/go-stomp/stomp v2.0.3+incompatible
@@ -11,7 +12,9 @@ require (
 	github.com/kr/pretty v0.1.0 // indirect
 	github.com/labstack/echo v3.3.10+incompatible
 	github.com/labstack/gommon v0.2.9
+	github.com/lib/pq v1.1.1
 	github.com/pkg/errors v0.8.1
+	github.com/segmentio/kafka-go v0.3.5
 	github.com/stretchr/testify v1.3.0
 	github.com/tidwall/pretty v1.0.0 // indirect
 	github.com/xdg/scram v0.0.0-20180814205039-7eeb5667e42c // indirect
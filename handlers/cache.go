@@ -0,0 +1,14 @@
+package handlers
+
+import (
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+//RegisterCache adds the endpoint exposing the hit and miss counters of the cache of users
+func RegisterCache(e *echo.Echo, users userService.Users) {
+	e.GET("/v1/cache/users", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, userService.CacheStatsOf(users))
+	})
+}
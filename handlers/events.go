@@ -0,0 +1,146 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/schema"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/processor"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+//EventResult is the synchronous outcome of an ingested user event
+type EventResult struct {
+	Index  *int             `json:"index,omitempty"`
+	ID     string           `json:"_id,omitempty"`
+	Result processor.Result `json:"result,omitempty"`
+	Kind   string           `json:"kind,omitempty"`
+	Error  string           `json:"error,omitempty"`
+	//Violations locate the fields that do not match the schema of the event
+	Violations []schema.Violation `json:"violations,omitempty"`
+}
+
+type eventDecoder func(body []byte) (*domains.User, error)
+
+type eventHandler func(ctx context.Context, user *domains.User) (processor.Result, error)
+
+//RegisterEvents adds the user event ingestion endpoints, which run the pipeline of p, the one consuming the broker
+//topics
+func RegisterEvents(e *echo.Echo, p processor.Processor) {
+	e.POST("/v1/events/users", single(processor.DecodeUser, p.SaveUser))
+	e.POST("/v1/events/users/batch", batch(processor.DecodeUser, p.SaveUser))
+	e.POST("/v1/events/users/remove", single(processor.DecodeRemovedUser, p.RemoveUser))
+	e.POST("/v1/events/users/remove/batch", batch(processor.DecodeRemovedUser, p.RemoveUser))
+}
+
+//errBodyTooLarge is returned by readBody for the request bodies over config.EventsMaxBodySize
+var errBodyTooLarge = errors.New("request body is too large")
+
+func single(decode eventDecoder, handle eventHandler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := readBody(c)
+		if err == errBodyTooLarge {
+			return tooLarge(c, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		result := handleEvent(c.Request().Context(), body, decode, handle)
+		return c.JSON(statusOf(result), result)
+	}
+}
+
+func batch(decode eventDecoder, handle eventHandler) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body, err := readBody(c)
+		if err == errBodyTooLarge {
+			return tooLarge(c, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		var events []json.RawMessage
+		if err := json.Unmarshal(body, &events); err != nil {
+			result := &EventResult{Kind: storage.KindValidation.String(), Error: err.Error()}
+			return c.JSON(http.StatusBadRequest, result)
+		}
+		if len(events) > config.EventsMaxBatchSize {
+			return tooLarge(c, fmt.Errorf("batch has %d events, more than %d", len(events), config.EventsMaxBatchSize))
+		}
+
+		results := make([]*EventResult, len(events))
+		for i, event := range events {
+			index := i
+			results[i] = handleEvent(c.Request().Context(), event, decode, handle)
+			results[i].Index = &index
+		}
+		return c.JSON(http.StatusOK, results)
+	}
+}
+
+//readBody reads the request body, failing with errBodyTooLarge past config.EventsMaxBodySize bytes
+func readBody(c echo.Context) ([]byte, error) {
+	limit := int64(config.EventsMaxBodySize)
+	body, err := ioutil.ReadAll(io.LimitReader(c.Request().Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, errBodyTooLarge
+	}
+	return body, nil
+}
+
+func tooLarge(c echo.Context, err error) error {
+	result := &EventResult{Kind: storage.KindValidation.String(), Error: err.Error()}
+	return c.JSON(http.StatusRequestEntityTooLarge, result)
+}
+
+func handleEvent(ctx context.Context, body []byte, decode eventDecoder, handle eventHandler) *EventResult {
+	user, err := decode(body)
+	if err != nil {
+		log.Errorf("[Handlers handleEvent] Invalid event. BODY: %s ERROR: %s", string(body), err)
+		return &EventResult{Kind: storage.KindOf(err).String(), Error: err.Error(), Violations: schema.Violations(err)}
+	}
+
+	result, err := handle(ctx, user)
+	if err != nil {
+		return &EventResult{ID: user.ID, Kind: storage.KindOf(err).String(), Error: err.Error()}
+	}
+
+	log.Infof("[Handlers handleEvent] Event successfully processed. User %s with ID: %s", result, user.ID)
+	return &EventResult{ID: user.ID, Result: result}
+}
+
+var statusOf = func(result *EventResult) int {
+	if result.Error == "" {
+		if result.Result == processor.Created {
+			return http.StatusCreated
+		}
+		return http.StatusOK
+	}
+
+	switch result.Kind {
+	case storage.KindValidation.String():
+		return http.StatusBadRequest
+	case storage.KindNotFound.String():
+		return http.StatusNotFound
+	case storage.KindConflict.String():
+		return http.StatusConflict
+	case storage.KindTimeout.String():
+		return http.StatusGatewayTimeout
+	case storage.KindNetwork.String(), storage.KindTransient.String(), storage.KindCanceled.String():
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
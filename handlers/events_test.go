@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/queue"
+	"github.com/coaraujo/users-go-processor/infrastructure/schema"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/processor"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	"github.com/coaraujo/users-go-processor/services/user"
+	"github.com/labstack/echo"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func serve(method, path, body string) *httptest.ResponseRecorder {
+	e := echo.New()
+	RegisterEvents(e, processor.New(processor.Options{Broker: &queue.BrokerMock{}}))
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestEvents_CreateUser_Created(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	id := "111111-222-3333-45454545-888990000"
+	newUser := &domains.User{ID: id}
+
+	_ = userServiceMock.Initialize()
+	userServiceMock.On("Upsert", mock.Anything, newUser).
+		Return(true, nil).
+		Once()
+
+	rec := serve(http.MethodPost, "/v1/events/users", "{ \"_id\":\""+id+"\" }")
+
+	var result EventResult
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, id, result.ID)
+	assert.Equal(t, "created", string(result.Result))
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestEvents_RunOnGivenProcessor(t *testing.T) {
+	db := storage.NewMemoryDB()
+	e := echo.New()
+	RegisterEvents(e, processor.New(processor.Options{Broker: &queue.BrokerMock{}, Storage: db}))
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/events/users", strings.NewReader("{ \"_id\":\"1\" }"))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	stored, err := user.New(db).Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", stored.ID)
+}
+
+func TestEvents_CreateUser_ValidationError(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	rec := serve(http.MethodPost, "/v1/events/users", "{ \"email\":\"email\" }")
+
+	var result EventResult
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, "validation", result.Kind)
+
+	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
+}
+
+func TestEvents_RemoveUser_Deleted(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	olduserServiceMock := &olduser.OldUserMock{}
+	id := "111111-222-3333-45454545-888990000"
+	userMock := &domains.User{ID: id}
+
+	_ = userServiceMock.Initialize()
+	_ = olduserServiceMock.Initialize()
+	userServiceMock.On("Get", mock.Anything, id).
+		Return(userMock, nil).
+		Once()
+	olduserServiceMock.On("Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser")).
+		Return(id, nil).
+		Once()
+	userServiceMock.On("Delete", mock.Anything, id).
+		Return(nil).
+		Once()
+
+	rec := serve(http.MethodPost, "/v1/events/users/remove", "{ \"_id\":\""+id+"\" }")
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "deleted")
+
+	olduserServiceMock.AssertExpectations(t)
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestEvents_CreateUsers_Batch(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+
+	_ = userServiceMock.Initialize()
+	userServiceMock.On("Upsert", mock.Anything, &domains.User{ID: "1", Email: "email"}).
+		Return(false, nil).
+		Once()
+	userServiceMock.On("Upsert", mock.Anything, &domains.User{ID: "2"}).
+		Return(false, errors.New("upsert error")).
+		Once()
+
+	rec := serve(http.MethodPost, "/v1/events/users/batch",
+		"[{ \"_id\":\"1\", \"email\":\"email\" }, { \"_id\":\"2\" }, { \"email\":\"email\" }]")
+
+	var results []EventResult
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &results))
+	assert.Len(t, results, 3)
+	assert.Equal(t, "updated", string(results[0].Result))
+	assert.Equal(t, "unknown", results[1].Kind)
+	assert.Equal(t, "validation", results[2].Kind)
+	assert.Equal(t, 2, *results[2].Index)
+
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestEvents_CreateUsers_BatchNotArray(t *testing.T) {
+	rec := serve(http.MethodPost, "/v1/events/users/batch", "{ \"_id\":\"1\" }")
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestEvents_BodyTooLarge(t *testing.T) {
+	defer func(size int) { config.EventsMaxBodySize = size }(config.EventsMaxBodySize)
+	config.EventsMaxBodySize = 16
+
+	for _, path := range []string{"/v1/events/users", "/v1/events/users/batch"} {
+		rec := serve(http.MethodPost, path, "[{ \"_id\":\"111111-222-3333\" }]")
+
+		assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code, path)
+		assert.Contains(t, rec.Body.String(), "validation", path)
+	}
+}
+
+func TestEvents_BatchTooLong(t *testing.T) {
+	defer func(size int) { config.EventsMaxBatchSize = size }(config.EventsMaxBatchSize)
+	config.EventsMaxBatchSize = 2
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	rec := serve(http.MethodPost, "/v1/events/users/batch", "[{ \"_id\":\"1\" }, { \"_id\":\"2\" }, { \"_id\":\"3\" }]")
+
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Contains(t, rec.Body.String(), "batch has 3 events, more than 2")
+	userServiceMock.AssertNotCalled(t, "Upsert", mock.Anything, mock.Anything)
+}
+
+func TestEvents_SchemaValidation(t *testing.T) {
+	defer func(validation bool) { config.SchemaValidation = validation }(config.SchemaValidation)
+	config.SchemaValidation = true
+
+	rec := serve(http.MethodPost, "/v1/events/users", "{ \"_id\":\"1\", \"phones\":[{\"type\":\"fax\"}] }")
+
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	var result EventResult
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &result))
+	assert.Equal(t, "validation", result.Kind)
+	assert.Equal(t, []schema.Violation{{Path: "$.phones[0].type", Message: "must be one of mobile, home, work"}},
+		result.Violations)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
+	"github.com/labstack/echo"
+	"github.com/labstack/gommon/log"
+	"net/http"
+)
+
+//RegisterFaults adds the endpoints reading and replacing the rules of the fault injection. They only have an
+//effect when the storage and the broker were wrapped at startup.
+func RegisterFaults(e *echo.Echo) {
+	e.GET("/admin/faults", func(c echo.Context) error {
+		return c.JSON(http.StatusOK, fault.GetInstance().Rules())
+	})
+	e.PUT("/admin/faults", func(c echo.Context) error {
+		rules := make(map[string]fault.Rule)
+		if err := c.Bind(&rules); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := fault.Validate(rules); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		log.Infof("[Handlers RegisterFaults] Replacing fault rules: %v", rules)
+		fault.GetInstance().SetRules(rules)
+		return c.JSON(http.StatusOK, rules)
+	})
+	e.DELETE("/admin/faults", func(c echo.Context) error {
+		log.Infof("[Handlers RegisterFaults] Clearing fault rules")
+		fault.GetInstance().SetRules(nil)
+		return c.NoContent(http.StatusNoContent)
+	})
+}
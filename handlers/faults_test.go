@@ -0,0 +1,40 @@
+package handlers
+
+import (
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestFaults(t *testing.T) {
+	defer fault.GetInstance().SetRules(nil)
+	e := echo.New()
+	RegisterFaults(e)
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPut, "/admin/faults", strings.NewReader(`{"storage.FindOne":{"latency":100}}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, map[string]fault.Rule{"storage.FindOne": {Latency: 100}}, fault.GetInstance().Rules())
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/admin/faults", nil))
+	assert.JSONEq(t, `{"storage.FindOne":{"latency":100}}`, rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodPut, "/admin/faults", strings.NewReader(`{"storage.FindOne":{"dropRate":3}}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+	assert.Len(t, fault.GetInstance().Rules(), 1)
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/admin/faults", nil))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	assert.Empty(t, fault.GetInstance().Rules())
+}
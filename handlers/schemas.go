@@ -0,0 +1,18 @@
+package handlers
+
+import (
+	"github.com/coaraujo/users-go-processor/infrastructure/schema"
+	"github.com/labstack/echo"
+	"net/http"
+)
+
+//RegisterSchemas adds the endpoint serving the JSON schemas of the user messages, by name
+func RegisterSchemas(e *echo.Echo) {
+	e.GET("/schemas/:name", func(c echo.Context) error {
+		s, ok := schema.Get(c.Param("name"))
+		if !ok {
+			return c.JSON(http.StatusNotFound, map[string]interface{}{"error": "unknown schema", "schemas": schema.Names()})
+		}
+		return c.JSON(http.StatusOK, s)
+	})
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"encoding/json"
+	"github.com/labstack/echo"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSchemas_Get(t *testing.T) {
+	e := echo.New()
+	RegisterSchemas(e)
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schemas/user-create", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	var doc map[string]interface{}
+	assert.Nil(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, "/schemas/user-create", doc["$id"])
+	assert.Contains(t, doc["properties"], "phones")
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/schemas/user-update", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Contains(t, rec.Body.String(), "user-remove")
+}
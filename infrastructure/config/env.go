@@ -1,18 +1,49 @@
 package config
 
-import "os"
+import (
+	"os"
+	"strconv"
+	"time"
+)
 
 const (
 	UserCreateTopic  = "VirtualTopic.user-create"
 	UserRemovedTopic = "VirtualTopic.user-remove"
+	DeadLetterQueue  = "DLQ.users-go-processor"
+
+	StorageMongoDB  = "mongodb"
+	StoragePostgres = "postgres"
+	StorageMemory   = "memory"
+
+	//UserCacheFull caches found and missing users, meant for a single replica writing each user
+	UserCacheFull = "full"
+	//UserCacheNegative caches only missing users, safe with any number of replicas
+	UserCacheNegative = "negative"
+
+	//RemovalArchive moves removed users to old_users, the default
+	RemovalArchive = "archive"
+	//RemovalSoftDelete keeps removed users in users with a deletedAt marker
+	RemovalSoftDelete = "soft"
+	//RemovalHardDelete deletes removed users without archiving them
+	RemovalHardDelete = "hard"
+
+	//TenantShared stores the users of unknown tenants in the shared database, the default
+	TenantShared = "shared"
+	//TenantReject rejects the users of unknown tenants as invalid
+	TenantReject = "reject"
 )
 
 var (
+	Broker = os.Getenv("BROKER")
+
 	ActiveMQAddress  = os.Getenv("ACTIVEMQ_ADDRESS")
 	ActiveMQUser     = os.Getenv("ACTIVEMQ_USER")
 	ActiveMQPass     = os.Getenv("ACTIVEMQ_PASSWORD")
 	ActiveMQProtocol = os.Getenv("ACTIVEMQ_PROTOCOL")
 
+	KafkaBrokers = os.Getenv("KAFKA_BROKERS")
+	KafkaGroupID = os.Getenv("KAFKA_GROUP_ID")
+
 	MongodbAuth     = os.Getenv("MONGODB_AUTH")
 	MongodbDatabase = os.Getenv("MONGODB")
 	MongodbUser     = os.Getenv("MONGODB_USER")
@@ -20,6 +51,77 @@ var (
 	MongodbHost     = os.Getenv("MONGODB_HOSTS")
 	MongodbPort     = os.Getenv("MONGODB_PORT")
 
+	StorageBackend = os.Getenv("STORAGE_BACKEND")
+	PostgresDSN    = os.Getenv("POSTGRES_DSN")
+
+	UsersAPIURL = os.Getenv("USERS_API_URL")
+
+	//EventsMaxBodySize is the largest request body accepted by the ingestion endpoints, in bytes
+	EventsMaxBodySize = intFromEnv("EVENTS_MAX_BODY_SIZE", 1<<20)
+	//EventsMaxBatchSize is the largest number of events accepted by a batch ingestion request
+	EventsMaxBatchSize = intFromEnv("EVENTS_MAX_BATCH_SIZE", 1000)
+
+	//CEPAPIURL is a ViaCEP compatible API used to fill the addresses of users, enrichment is off when empty
+	CEPAPIURL    = os.Getenv("CEP_API_URL")
+	CEPCacheSize = intFromEnv("CEP_CACHE_SIZE", 10000)
+	CEPCacheTTL  = millisecondsFromEnv("CEP_CACHE_TTL", 86400000)
+	//CEPTimeout bounds each lookup, the user is saved without enrichment when it expires
+	CEPTimeout = millisecondsFromEnv("CEP_TIMEOUT", 1000)
+
+	UserCacheMode = os.Getenv("USER_CACHE_MODE")
+	UserCacheSize = intFromEnv("USER_CACHE_SIZE", 10000)
+	UserCacheTTL  = millisecondsFromEnv("USER_CACHE_TTL", 30000)
+
+	//RemovalStrategy is how removed users are deleted, RemovalArchive when empty
+	RemovalStrategy = os.Getenv("REMOVAL_STRATEGY")
+
+	//FaultInjection are the fault rules applied from the start, a JSON object of rules by operation. The storage
+	//and the broker are wrapped with the fault injection when it is set or FaultAdmin is on.
+	FaultInjection = os.Getenv("FAULT_INJECTION")
+	//FaultAdmin exposes the fault rules on /admin/faults, to change them at runtime
+	FaultAdmin = os.Getenv("FAULT_ADMIN") == "true"
+
+	//Tenants routes the users of a ClientID to a dedicated database or to prefixed collections, a JSON object of
+	//routes by ClientID
+	Tenants = os.Getenv("TENANTS")
+	//TenantPolicy is what happens to the users of a ClientID without a route, TenantShared when empty
+	TenantPolicy = os.Getenv("TENANT_POLICY")
+
+	//ResultTopic receives the outcome of every message the processor settles, nothing is published when empty
+	ResultTopic = os.Getenv("RESULT_TOPIC")
+
+	//SchemaValidation checks every user message against its JSON schema before decoding it
+	SchemaValidation = os.Getenv("SCHEMA_VALIDATION") == "true"
+
+	//TombstoneTTL is how long removed users keep rejecting older creates, tombstones are off when zero
+	TombstoneTTL = millisecondsFromEnv("TOMBSTONE_TTL", 0)
+
+	//TombstonePurgeInterval is how often the expired tombstones are deleted from PostgreSQL, MongoDB expires them
+	//by itself
+	TombstonePurgeInterval = millisecondsFromEnv("TOMBSTONE_PURGE_INTERVAL", 3600000)
+
+	//StorageReadTimeout, StorageWriteTimeout and StorageBulkTimeout bound each Users and OldUsers operation,
+	//on top of the deadline or cancellation of the caller context
+	StorageReadTimeout  = millisecondsFromEnv("STORAGE_READ_TIMEOUT", 1000)
+	StorageWriteTimeout = millisecondsFromEnv("STORAGE_WRITE_TIMEOUT", 1000)
+	StorageBulkTimeout  = millisecondsFromEnv("STORAGE_BULK_TIMEOUT", 10000)
+
 	MaximumRedeliveries = 10
 	RedeliveryDelay     = 1000
+	MaximumWriteRetries = 3
 )
+
+//intFromEnv returns the integer value of the environment variable, or def when it is unset or invalid
+func intFromEnv(name string, def int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return def
+	}
+	return value
+}
+
+//millisecondsFromEnv returns the environment variable as a duration in milliseconds, or def milliseconds when it
+//is unset or invalid
+func millisecondsFromEnv(name string, def int) time.Duration {
+	return time.Duration(intFromEnv(name, def)) * time.Millisecond
+}
@@ -0,0 +1,186 @@
+package fault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	instance *Injector
+	once     sync.Once
+)
+
+//Rule describes the faults injected in an operation. Rates go from 0, never, to 1, always.
+type Rule struct {
+	//Latency is added before the operation runs, in milliseconds. It gives up when the context is done.
+	Latency int `json:"latency,omitempty"`
+	//ErrorRate fails the operation instead of running it, for the operations that return an error
+	ErrorRate float64 `json:"errorRate,omitempty"`
+	//ErrorKind is the storage kind of the injected errors, network by default
+	ErrorKind string `json:"errorKind,omitempty"`
+	//DropRate skips the operation as if it succeeded, for broker publishes and acks
+	DropRate float64 `json:"dropRate,omitempty"`
+	//DuplicateRate delivers a message twice, for broker deliveries
+	DuplicateRate float64 `json:"duplicateRate,omitempty"`
+}
+
+//ErrorKinds are the names of the storage error kinds accepted as ErrorKind. They mirror storage.ParseKind, which
+//can not be used here since the storage package imports this one, and a storage test keeps them in sync.
+var ErrorKinds = []string{"unknown", "not_found", "conflict", "timeout", "network", "validation", "transient", "canceled"}
+
+//Error is returned by the operations failed on purpose
+type Error struct {
+	Op   string
+	Kind string
+}
+
+func (e *Error) Error() string {
+	return "injected fault in " + e.Op
+}
+
+//Injector holds the rules of the operations, keyed by "storage.<method>" or "broker.<operation>". A key ending
+//in ".*" matches the operations of the prefix without a rule of their own.
+type Injector struct {
+	mu     sync.RWMutex
+	rules  map[string]Rule
+	random *rand.Rand
+}
+
+//GetInstance returns the injector shared by the wrappers and the admin endpoint
+func GetInstance() *Injector {
+	once.Do(func() {
+		instance = New()
+	})
+	return instance
+}
+
+//New returns an injector without rules
+func New() *Injector {
+	return &Injector{rules: make(map[string]Rule), random: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+//ParseRules reads the rules from JSON, an object of rules by operation. An empty spec has no rules.
+func ParseRules(spec string) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	if strings.TrimSpace(spec) == "" {
+		return rules, nil
+	}
+	if err := json.Unmarshal([]byte(spec), &rules); err != nil {
+		return nil, err
+	}
+	return rules, Validate(rules)
+}
+
+//Validate checks the operation names, the error kinds and that the rates are between 0 and 1
+func Validate(rules map[string]Rule) error {
+	for op, rule := range rules {
+		if !strings.HasPrefix(op, "storage.") && !strings.HasPrefix(op, "broker.") {
+			return fmt.Errorf("fault rule %s: operation must have the storage or broker prefix", op)
+		}
+		if rule.Latency < 0 {
+			return fmt.Errorf("fault rule %s: latency must not be negative", op)
+		}
+		if rule.ErrorKind != "" && !knownKind(rule.ErrorKind) {
+			return fmt.Errorf("fault rule %s: error kind must be one of %s", op, strings.Join(ErrorKinds, ", "))
+		}
+		for _, rate := range []float64{rule.ErrorRate, rule.DropRate, rule.DuplicateRate} {
+			if rate < 0 || rate > 1 {
+				return fmt.Errorf("fault rule %s: rates must be between 0 and 1", op)
+			}
+		}
+	}
+	return nil
+}
+
+func knownKind(name string) bool {
+	for _, kind := range ErrorKinds {
+		if kind == name {
+			return true
+		}
+	}
+	return false
+}
+
+//SetRules replaces the rules, an empty map turns the injection off
+func (i *Injector) SetRules(rules map[string]Rule) {
+	copied := make(map[string]Rule, len(rules))
+	for op, rule := range rules {
+		copied[op] = rule
+	}
+	i.mu.Lock()
+	i.rules = copied
+	i.mu.Unlock()
+}
+
+//Rules returns a copy of the rules
+func (i *Injector) Rules() map[string]Rule {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	rules := make(map[string]Rule, len(i.rules))
+	for op, rule := range i.rules {
+		rules[op] = rule
+	}
+	return rules
+}
+
+//Rule returns the rule of the operation, or the one of its prefix wildcard
+func (i *Injector) Rule(op string) (Rule, bool) {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	if rule, ok := i.rules[op]; ok {
+		return rule, true
+	}
+	if dot := strings.Index(op, "."); dot >= 0 {
+		rule, ok := i.rules[op[:dot]+".*"]
+		return rule, ok
+	}
+	return Rule{}, false
+}
+
+//Before runs the latency of the operation and rolls its error, it returns the context error when ctx is done
+//during the latency and an *Error for an injected failure
+func (i *Injector) Before(ctx context.Context, op string) error {
+	rule, ok := i.Rule(op)
+	if !ok {
+		return nil
+	}
+	if rule.Latency > 0 {
+		timer := time.NewTimer(time.Duration(rule.Latency) * time.Millisecond)
+		defer timer.Stop()
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if i.roll(rule.ErrorRate) {
+		return &Error{Op: op, Kind: rule.ErrorKind}
+	}
+	return nil
+}
+
+//Drop rolls the drop rate of the operation
+func (i *Injector) Drop(op string) bool {
+	rule, _ := i.Rule(op)
+	return i.roll(rule.DropRate)
+}
+
+//Duplicate rolls the duplicate rate of the operation
+func (i *Injector) Duplicate(op string) bool {
+	rule, _ := i.Rule(op)
+	return i.roll(rule.DuplicateRate)
+}
+
+func (i *Injector) roll(rate float64) bool {
+	if rate <= 0 {
+		return false
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.random.Float64() < rate
+}
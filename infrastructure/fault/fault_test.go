@@ -0,0 +1,76 @@
+package fault
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseRules(t *testing.T) {
+	rules, err := ParseRules(`{"storage.FindOne":{"latency":20,"errorRate":0.5,"errorKind":"timeout"},"broker.Ack":{"dropRate":1}}`)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Rule{
+		"storage.FindOne": {Latency: 20, ErrorRate: 0.5, ErrorKind: "timeout"},
+		"broker.Ack":      {DropRate: 1},
+	}, rules)
+
+	rules, err = ParseRules("")
+	assert.Nil(t, err)
+	assert.Empty(t, rules)
+}
+
+func TestParseRules_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		`{"storage.FindOne":{"errorRate":2}}`,
+		`{"storage.FindOne":{"latency":-1}}`,
+		`{"mongo.FindOne":{"errorRate":1}}`,
+		`{"storage.FindOne":{"errorRate":1,"errorKind":"Timeout"}}`,
+		`[]`,
+	} {
+		_, err := ParseRules(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestInjector_Rule_Wildcard(t *testing.T) {
+	injector := New()
+	injector.SetRules(map[string]Rule{"storage.*": {ErrorRate: 1}, "storage.Count": {Latency: 1}})
+
+	rule, ok := injector.Rule("storage.Insert")
+	assert.True(t, ok)
+	assert.Equal(t, Rule{ErrorRate: 1}, rule)
+	rule, _ = injector.Rule("storage.Count")
+	assert.Equal(t, Rule{Latency: 1}, rule)
+	_, ok = injector.Rule("broker.Publish")
+	assert.False(t, ok)
+}
+
+func TestInjector_Before(t *testing.T) {
+	injector := New()
+	assert.Nil(t, injector.Before(context.Background(), "storage.Insert"))
+
+	injector.SetRules(map[string]Rule{"storage.Insert": {Latency: 20, ErrorRate: 1, ErrorKind: "conflict"}})
+	start := time.Now()
+	err := injector.Before(context.Background(), "storage.Insert")
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+	assert.Equal(t, &Error{Op: "storage.Insert", Kind: "conflict"}, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, injector.Before(ctx, "storage.Insert"))
+}
+
+func TestInjector_DropDuplicate(t *testing.T) {
+	injector := New()
+	injector.SetRules(map[string]Rule{"broker.Ack": {DropRate: 1}, "broker.Deliver": {DuplicateRate: 1}})
+
+	assert.True(t, injector.Drop("broker.Ack"))
+	assert.False(t, injector.Duplicate("broker.Ack"))
+	assert.True(t, injector.Duplicate("broker.Deliver"))
+
+	injector.SetRules(nil)
+	assert.False(t, injector.Drop("broker.Ack"))
+	assert.Empty(t, injector.Rules())
+}
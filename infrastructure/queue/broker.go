@@ -20,46 +20,79 @@ type Broker interface {
 	Listen(channel string)
 	NewConnection() error
 	Disconnect()
-	Notifier(channel string) chan *stomp.Message
-	AckMessage(message *stomp.Message)
-	RedeliveryMessage(message *stomp.Message)
+	Notifier(channel string) chan *Message
+	Publish(message *Message) error
+	AckMessage(message *Message)
+	RedeliveryMessage(message *Message)
+	DeadLetterMessage(message *Message, reason error)
 }
 
 type brokerImpl struct {
 	conn     *stomp.Conn
-	notifier map[string]chan *stomp.Message
+	mu       sync.Mutex
+	notifier map[string]chan *Message
+	done     chan struct{}
+
+	protocol string
+	address  string
+	user     string
+	password string
 }
 
 func GetInstance() Broker {
 	once.Do(func() {
-		instance = &brokerImpl{notifier: make(map[string]chan *stomp.Message, 0)}
+		instance = NewStompBroker(config.ActiveMQProtocol, config.ActiveMQAddress, config.ActiveMQUser, config.ActiveMQPass)
 	})
 	return instance
 }
 
+//NewStompBroker returns a STOMP broker apart from the package instance, connected by NewConnection
+func NewStompBroker(protocol, address, user, password string) Broker {
+	return &brokerImpl{
+		notifier: make(map[string]chan *Message, 0),
+		protocol: protocol,
+		address:  address,
+		user:     user,
+		password: password,
+	}
+}
+
 func (b *brokerImpl) NewConnection() error {
-	conn, err := stomp.Dial(config.ActiveMQProtocol, config.ActiveMQAddress,
-		stomp.ConnOpt.Login(config.ActiveMQUser, config.ActiveMQPass),
+	conn, err := stomp.Dial(b.protocol, b.address,
+		stomp.ConnOpt.Login(b.user, b.password),
 		stomp.ConnOpt.HeartBeat(0*time.Second, 0*time.Second))
 	if err != nil {
 		return err
 	}
 
+	b.mu.Lock()
 	b.conn = conn
+	b.done = make(chan struct{})
+	b.mu.Unlock()
 	return nil
 }
 
-func (b *brokerImpl) AckMessage(message *stomp.Message) {
-	if message.ShouldAck() {
-		b.conn.Ack(message)
+func (b *brokerImpl) Publish(message *Message) error {
+	return b.conn.Send(message.Destination, message.ContentType, message.Body, headerFunc(message.Header))
+}
+
+func (b *brokerImpl) AckMessage(message *Message) {
+	if msg, ok := message.raw.(*stomp.Message); ok && msg.ShouldAck() {
+		b.conn.Ack(msg)
 	}
 }
 
-func (b *brokerImpl) RedeliveryMessage(message *stomp.Message) {
+func (b *brokerImpl) nackMessage(message *Message) {
+	if msg, ok := message.raw.(*stomp.Message); ok && msg.ShouldAck() {
+		b.conn.Nack(msg)
+	}
+}
+
+func (b *brokerImpl) RedeliveryMessage(message *Message) {
 	log.Infof("[Broker RedeliveryMessage] Redelivering Message: %s", string(message.Body))
 
 	attempt := 1
-	attemptsHeader := message.Header.Get("attempts")
+	attemptsHeader := message.Header["attempts"]
 	if attemptsHeader != "" {
 		attempt, _ = strconv.Atoi(attemptsHeader)
 		attempt++
@@ -67,29 +100,90 @@ func (b *brokerImpl) RedeliveryMessage(message *stomp.Message) {
 
 	if attempt > config.MaximumRedeliveries {
 		log.Infof("[Broker RedeliveryMessage] Attempt: %d Nack Message: %s", attempt, string(message.Body))
-		b.conn.Nack(message)
+		b.nackMessage(message)
 		return
 	}
 
 	log.Infof("[Broker RedeliveryMessage] Resending message. Attempt: %d Message: %s", attempt, string(message.Body))
-	b.conn.Ack(message)
+	b.AckMessage(message)
 
 	//Redelivery with delay
 	go func() {
 		time.Sleep(time.Duration(config.RedeliveryDelay) * time.Millisecond)
-		b.conn.Send(message.Destination, message.ContentType, message.Body, attemptFunc(attempt))
+		b.conn.Send(message.Destination, message.ContentType, message.Body, forwardFunc(message.Header),
+			attemptFunc(attempt))
 	}()
 }
 
+func (b *brokerImpl) DeadLetterMessage(message *Message, reason error) {
+	log.Infof("[Broker DeadLetterMessage] Moving message to %s. Reason: %s Message: %s", config.DeadLetterQueue, reason,
+		string(message.Body))
+
+	if err := b.conn.Send(config.DeadLetterQueue, message.ContentType, message.Body, forwardFunc(message.Header),
+		deadLetterFunc(message.Destination, reason)); err != nil {
+		log.Errorf("[Broker DeadLetterMessage] Fail to send to dead letter queue. Error: %s", err)
+		b.nackMessage(message)
+		return
+	}
+	b.AckMessage(message)
+}
+
+var deadLetterFunc = func(destination string, reason error) func(f *frame.Frame) error {
+	return func(f *frame.Frame) error {
+		f.Header.Add("original-destination", destination)
+		if reason != nil {
+			f.Header.Add("dead-letter-reason", reason.Error())
+		}
+		return nil
+	}
+}
+
 var attemptFunc = func(attempt int) func(f *frame.Frame) error {
 	return func(f *frame.Frame) error {
-		f.Header.Add("attempts", strconv.Itoa(attempt))
+		f.Header.Set("attempts", strconv.Itoa(attempt))
+		return nil
+	}
+}
+
+//stompHeaders are set by the server on every received message, they are not forwarded
+var stompHeaders = map[string]bool{
+	frame.Destination:   true,
+	frame.MessageId:     true,
+	frame.Subscription:  true,
+	frame.Ack:           true,
+	frame.ContentLength: true,
+	frame.ContentType:   true,
+}
+
+//forwardFunc copies the application headers of a received message, such as its correlation-id
+var forwardFunc = func(header map[string]string) func(f *frame.Frame) error {
+	return func(f *frame.Frame) error {
+		for k, v := range header {
+			if !stompHeaders[k] {
+				f.Header.Set(k, v)
+			}
+		}
+		return nil
+	}
+}
+
+var headerFunc = func(header map[string]string) func(f *frame.Frame) error {
+	return func(f *frame.Frame) error {
+		for k, v := range header {
+			f.Header.Set(k, v)
+		}
 		return nil
 	}
 }
 
 func (b *brokerImpl) Disconnect() {
 	log.Infof("[Broker Disconnect] Disconnecting..")
+	b.mu.Lock()
+	if b.done != nil {
+		close(b.done)
+		b.done = nil
+	}
+	b.mu.Unlock()
 	err := b.conn.Disconnect()
 	if err != nil {
 		log.Errorf("[Broker Disconnect] Fail to disconnect. Error: %s ", err)
@@ -97,25 +191,70 @@ func (b *brokerImpl) Disconnect() {
 	log.Infof("[Broker Disconnect] Disconnected")
 }
 
-func (b *brokerImpl) Notifier(channel string) chan *stomp.Message {
-	return b.notifier[channel]
+//Notifier returns the channel where messages of the channel are delivered, it can be selected before Listen
+//subscribes
+func (b *brokerImpl) Notifier(channel string) chan *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	notifier, ok := b.notifier[channel]
+	if !ok {
+		notifier = make(chan *Message)
+		b.notifier[channel] = notifier
+	}
+	return notifier
 }
 
+//Listen delivers the messages of the channel to its notifier until the broker disconnects. A message that
+//was not delivered is left unacked, so the server sends it again.
 func (b *brokerImpl) Listen(channel string) {
-	notifier := make(chan *stomp.Message)
-	b.notifier[channel] = notifier
+	notifier := b.Notifier(channel)
+	b.mu.Lock()
+	done := b.done
+	b.mu.Unlock()
 
 	log.Infof("[Broker Listen] Subscribing on CHANNEL: %s", channel)
 	subID := channel + "-" + strconv.Itoa(rand.Intn(1000))
 	sub, err := b.conn.Subscribe(channel, stomp.AckClientIndividual, stomp.SubscribeOpt.Id(subID))
 	if err != nil {
 		log.Errorf("[Broker Listen] Fail to subscribe. CHANNEL: %s ERROR: %s", string(channel), err)
+		return
 	}
 	log.Infof("[Broker Listen] Subscribed on CHANNEL: %s", channel)
 
 	for {
-		msg := <-sub.C
+		var msg *stomp.Message
+		select {
+		case msg = <-sub.C:
+		case <-done:
+			return
+		}
+		if msg == nil {
+			log.Infof("[Broker Listen] Subscription closed. CHANNEL: %s", channel)
+			return
+		}
+		if msg.Err != nil {
+			log.Errorf("[Broker Listen] Subscription failed. CHANNEL: %s ERROR: %s", channel, msg.Err)
+			return
+		}
 		log.Infof("[Broker Listen] Received new message. CHANNEL: %s MESSAGE: %s", string(channel), string(msg.Body))
-		b.notifier[channel] <- msg
+
+		select {
+		case notifier <- fromStompMessage(msg):
+		case <-done:
+			return
+		}
+	}
+}
+
+func fromStompMessage(msg *stomp.Message) *Message {
+	message := NewMessage(msg.Destination, msg.ContentType, msg.Body)
+	if msg.Header != nil {
+		for i := 0; i < msg.Header.Len(); i++ {
+			key, value := msg.Header.GetAt(i)
+			message.Header[key] = value
+		}
 	}
+	message.raw = msg
+	return message
 }
@@ -1,7 +1,6 @@
 package queue
 
 import (
-	"github.com/go-stomp/stomp"
 	"github.com/stretchr/testify/mock"
 )
 
@@ -30,17 +29,28 @@ func (b *BrokerMock) NewConnection() error {
 func (b *BrokerMock) Disconnect() {}
 
 //Notifier is a mock for notify a subscriber about channel
-func (b *BrokerMock) Notifier(channel string) chan *stomp.Message {
+func (b *BrokerMock) Notifier(channel string) chan *Message {
 	args := b.Called(channel)
-	return args.Get(0).(chan *stomp.Message)
+	return args.Get(0).(chan *Message)
+}
+
+//Publish is a mock for Publish
+func (b *BrokerMock) Publish(message *Message) error {
+	args := b.Called(message)
+	return args.Error(0)
 }
 
 //AckMessage is a mock for AckMessage
-func (b *BrokerMock) AckMessage(message *stomp.Message) {
-	return
+func (b *BrokerMock) AckMessage(message *Message) {
+	b.Called(message)
 }
 
 //RedeliveryMessage is a mock for RedeliveryMessage
-func (b *BrokerMock) RedeliveryMessage(message *stomp.Message) {
-	return
-}
\ No newline at end of file
+func (b *BrokerMock) RedeliveryMessage(message *Message) {
+	b.Called(message)
+}
+
+//DeadLetterMessage is a mock for DeadLetterMessage
+func (b *BrokerMock) DeadLetterMessage(message *Message, reason error) {
+	b.Called(message, reason)
+}
@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
+	"github.com/labstack/gommon/log"
+	"sync"
+)
+
+//FaultyBroker wraps a Broker with the faults of its injector, under the operations:
+//  - broker.Publish: latency, errors and drops, a dropped message is reported as published
+//  - broker.Ack: latency and drops, a dropped ack leaves the message unsettled on the broker, which holds its
+//    topic on Kafka
+//  - broker.Redelivery and broker.DeadLetter: latency
+//  - broker.Deliver: latency and duplicates, a duplicate is a copy of the received message that the broker
+//    does not know about, so acking it does nothing
+type FaultyBroker struct {
+	broker   Broker
+	injector *fault.Injector
+
+	mu       sync.Mutex
+	notifier map[string]chan *Message
+	done     chan struct{}
+}
+
+//NewFaultyBroker wraps broker with the rules of injector
+func NewFaultyBroker(broker Broker, injector *fault.Injector) *FaultyBroker {
+	return &FaultyBroker{
+		broker:   broker,
+		injector: injector,
+		notifier: make(map[string]chan *Message),
+		done:     make(chan struct{}),
+	}
+}
+
+//NewConnection connects the wrapped broker
+func (b *FaultyBroker) NewConnection() error {
+	if err := b.broker.NewConnection(); err != nil {
+		return err
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	select {
+	case <-b.done:
+		b.done = make(chan struct{})
+		b.notifier = make(map[string]chan *Message)
+	default:
+	}
+	return nil
+}
+
+//Disconnect stops the deliveries and disconnects the wrapped broker
+func (b *FaultyBroker) Disconnect() {
+	b.mu.Lock()
+	select {
+	case <-b.done:
+	default:
+		close(b.done)
+	}
+	b.mu.Unlock()
+	b.broker.Disconnect()
+}
+
+//Listen subscribes the wrapped broker to the channel
+func (b *FaultyBroker) Listen(channel string) {
+	b.broker.Listen(channel)
+}
+
+//Notifier returns the channel where the messages of the wrapped notifier are delivered, after the faults of
+//broker.Deliver
+func (b *FaultyBroker) Notifier(channel string) chan *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	notifier, ok := b.notifier[channel]
+	if !ok {
+		notifier = make(chan *Message)
+		b.notifier[channel] = notifier
+		go b.deliver(b.broker.Notifier(channel), notifier, b.done)
+	}
+	return notifier
+}
+
+func (b *FaultyBroker) deliver(from <-chan *Message, to chan<- *Message, done <-chan struct{}) {
+	for {
+		var msg *Message
+		select {
+		case msg = <-from:
+		case <-done:
+			return
+		}
+
+		_ = b.injector.Before(context.Background(), "broker.Deliver")
+		deliveries := []*Message{msg}
+		if b.injector.Duplicate("broker.Deliver") {
+			log.Infof("[FaultyBroker deliver] Duplicating message on CHANNEL: %s", msg.Destination)
+			deliveries = append(deliveries, msg.clone())
+		}
+		for _, delivery := range deliveries {
+			select {
+			case to <- delivery:
+			case <-done:
+				return
+			}
+		}
+	}
+}
+
+//Publish runs the broker.Publish faults, then publishes on the wrapped broker
+func (b *FaultyBroker) Publish(message *Message) error {
+	if err := b.injector.Before(context.Background(), "broker.Publish"); err != nil {
+		return err
+	}
+	if b.injector.Drop("broker.Publish") {
+		log.Infof("[FaultyBroker Publish] Dropping message to %s", message.Destination)
+		return nil
+	}
+	return b.broker.Publish(message)
+}
+
+//AckMessage runs the broker.Ack faults, then acks on the wrapped broker
+func (b *FaultyBroker) AckMessage(message *Message) {
+	_ = b.injector.Before(context.Background(), "broker.Ack")
+	if b.injector.Drop("broker.Ack") {
+		log.Infof("[FaultyBroker AckMessage] Dropping ack of message on %s", message.Destination)
+		return
+	}
+	b.broker.AckMessage(message)
+}
+
+//RedeliveryMessage runs the broker.Redelivery latency, then redelivers on the wrapped broker
+func (b *FaultyBroker) RedeliveryMessage(message *Message) {
+	_ = b.injector.Before(context.Background(), "broker.Redelivery")
+	b.broker.RedeliveryMessage(message)
+}
+
+//DeadLetterMessage runs the broker.DeadLetter latency, then dead-letters on the wrapped broker
+func (b *FaultyBroker) DeadLetterMessage(message *Message, reason error) {
+	_ = b.injector.Before(context.Background(), "broker.DeadLetter")
+	b.broker.DeadLetterMessage(message, reason)
+}
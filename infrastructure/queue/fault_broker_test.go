@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"errors"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestFaultyBroker_Publish(t *testing.T) {
+	injector := fault.New()
+	memory := NewMemoryBroker()
+	broker := NewFaultyBroker(memory, injector)
+	defer broker.Disconnect()
+
+	injector.SetRules(map[string]fault.Rule{"broker.Publish": {DropRate: 1}})
+	assert.Nil(t, broker.Publish(NewMessage("users", "application/json", []byte("{}"))))
+	assert.Empty(t, memory.Queued("users"))
+
+	injector.SetRules(map[string]fault.Rule{"broker.Publish": {ErrorRate: 1}})
+	assert.IsType(t, &fault.Error{}, broker.Publish(NewMessage("users", "application/json", []byte("{}"))))
+	assert.Empty(t, memory.Queued("users"))
+
+	injector.SetRules(nil)
+	assert.Nil(t, broker.Publish(NewMessage("users", "application/json", []byte("{}"))))
+	assert.Len(t, memory.Queued("users"), 1)
+}
+
+func TestFaultyBroker_DuplicateAndDropAck(t *testing.T) {
+	injector := fault.New()
+	memory := NewMemoryBroker()
+	broker := NewFaultyBroker(memory, injector)
+	defer broker.Disconnect()
+	injector.SetRules(map[string]fault.Rule{"broker.Deliver": {DuplicateRate: 1}, "broker.Ack": {DropRate: 1}})
+
+	go broker.Listen("users")
+	_ = broker.Publish(NewMessage("users", "application/json", []byte(`{"_id":"1"}`)))
+	first, duplicate := receive(t, broker, "users"), receive(t, broker, "users")
+	assert.Equal(t, first.Body, duplicate.Body)
+
+	broker.AckMessage(first)
+	assert.Equal(t, 1, memory.InFlight())
+
+	injector.SetRules(nil)
+	broker.AckMessage(duplicate)
+	assert.Equal(t, 1, memory.InFlight())
+	broker.AckMessage(first)
+	assert.Equal(t, 0, memory.InFlight())
+}
+
+func TestFaultyBroker_DeadLetter(t *testing.T) {
+	memory := NewMemoryBroker()
+	broker := NewFaultyBroker(memory, fault.New())
+	defer broker.Disconnect()
+
+	go broker.Listen("users")
+	_ = broker.Publish(NewMessage("users", "application/json", []byte(`{"_id":"1"}`)))
+	broker.DeadLetterMessage(receive(t, broker, "users"), errors.New("invalid"))
+
+	assert.Len(t, memory.Queued(config.DeadLetterQueue), 1)
+}
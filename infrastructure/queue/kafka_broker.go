@@ -0,0 +1,366 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/labstack/gommon/log"
+	"github.com/segmentio/kafka-go"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrMaxRedeliveries is the dead letter reason of messages that exhausted config.MaximumRedeliveries
+	ErrMaxRedeliveries = errors.New("maximum redeliveries reached")
+)
+
+type kafkaReader interface {
+	FetchMessage(ctx context.Context) (kafka.Message, error)
+	CommitMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+//kafkaRaw is the transport handle of a message received from Kafka. settled tells the listener of the topic
+//whether the message was redelivered once it is settled.
+type kafkaRaw struct {
+	reader  kafkaReader
+	message kafka.Message
+	settled chan bool
+}
+
+func (r kafkaRaw) settle(redeliver bool) {
+	select {
+	case r.settled <- redeliver:
+	default:
+	}
+}
+
+//KafkaBroker is a Broker backed by Kafka consumer groups. Messages are keyed by user _id so every
+//event of a user lands on the same partition, and offsets are only committed once a message is
+//acked or dead-lettered.
+//The messages of a topic are delivered one at a time: the next one is only fetched once the last one is
+//settled, and a redelivered message is delivered again after the config.RedeliveryDelay of the broker creation
+//instead of being published to the tail of the topic. This keeps the events of a user in order, at the cost of holding the
+//whole topic while a message waits to be retried. A message that is never settled holds its topic until
+//the broker disconnects.
+type KafkaBroker struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	cancel    context.CancelFunc
+	listeners sync.WaitGroup
+	readers   map[string]kafkaReader
+	writers   map[string]kafkaWriter
+	notifier  map[string]chan *Message
+	ping      func(ctx context.Context) error
+	newReader func(topic string) kafkaReader
+	newWriter func(topic string) kafkaWriter
+
+	redeliveryDelay     time.Duration
+	maximumRedeliveries int
+}
+
+//NewKafkaBroker creates a KafkaBroker consuming as groupID from the given brokers
+func NewKafkaBroker(brokers []string, groupID string) *KafkaBroker {
+	b := newKafkaBroker()
+	b.ping = func(ctx context.Context) error {
+		conn, err := kafka.DialContext(ctx, "tcp", brokers[0])
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	b.newReader = func(topic string) kafkaReader {
+		return kafka.NewReader(kafka.ReaderConfig{
+			Brokers:  brokers,
+			GroupID:  groupID,
+			Topic:    topic,
+			MinBytes: 1,
+			MaxBytes: 10e6,
+		})
+	}
+	b.newWriter = func(topic string) kafkaWriter {
+		return kafka.NewWriter(kafka.WriterConfig{
+			Brokers:  brokers,
+			Topic:    topic,
+			Balancer: &kafka.Hash{},
+		})
+	}
+	return b
+}
+
+func newKafkaBroker() *KafkaBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KafkaBroker{
+		ctx:      ctx,
+		cancel:   cancel,
+		readers:  make(map[string]kafkaReader),
+		writers:  make(map[string]kafkaWriter),
+		notifier: make(map[string]chan *Message),
+		ping:     func(ctx context.Context) error { return nil },
+
+		redeliveryDelay:     time.Duration(config.RedeliveryDelay) * time.Millisecond,
+		maximumRedeliveries: config.MaximumRedeliveries,
+	}
+}
+
+//NewConnection checks that the cluster is reachable
+func (b *KafkaBroker) NewConnection() error {
+	b.mu.Lock()
+	if b.ctx.Err() != nil {
+		b.ctx, b.cancel = context.WithCancel(context.Background())
+	}
+	ctx := b.ctx
+	b.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	return b.ping(ctx)
+}
+
+//Disconnect stops the listeners, closes every reader and writer and returns once the listeners exited.
+//Uncommitted messages are delivered again to the consumer group.
+func (b *KafkaBroker) Disconnect() {
+	log.Infof("[KafkaBroker Disconnect] Disconnecting..")
+	b.disconnect()
+	b.listeners.Wait()
+	log.Infof("[KafkaBroker Disconnect] Disconnected")
+}
+
+func (b *KafkaBroker) disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.cancel()
+	for topic, reader := range b.readers {
+		if err := reader.Close(); err != nil {
+			log.Errorf("[KafkaBroker Disconnect] Fail to close reader. TOPIC: %s Error: %s", topic, err)
+		}
+		delete(b.readers, topic)
+	}
+	for topic, writer := range b.writers {
+		if err := writer.Close(); err != nil {
+			log.Errorf("[KafkaBroker Disconnect] Fail to close writer. TOPIC: %s Error: %s", topic, err)
+		}
+		delete(b.writers, topic)
+	}
+}
+
+//Notifier returns the channel where messages of the topic are delivered
+func (b *KafkaBroker) Notifier(channel string) chan *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	notifier, ok := b.notifier[channel]
+	if !ok {
+		notifier = make(chan *Message)
+		b.notifier[channel] = notifier
+	}
+	return notifier
+}
+
+//Listen joins the consumer group of the topic and delivers its messages until the broker disconnects. A
+//disconnected broker does not listen until it connects again.
+func (b *KafkaBroker) Listen(channel string) {
+	notifier := b.Notifier(channel)
+
+	b.mu.Lock()
+	ctx := b.ctx
+	if ctx.Err() != nil {
+		b.mu.Unlock()
+		return
+	}
+	reader := b.newReader(channel)
+	b.readers[channel] = reader
+	b.listeners.Add(1)
+	b.mu.Unlock()
+	defer b.listeners.Done()
+
+	log.Infof("[KafkaBroker Listen] Subscribed on TOPIC: %s", channel)
+	for {
+		msg, err := reader.FetchMessage(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			log.Errorf("[KafkaBroker Listen] Fail to fetch message. TOPIC: %s ERROR: %s", channel, err)
+			select {
+			case <-time.After(time.Second):
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		log.Infof("[KafkaBroker Listen] Received new message. TOPIC: %s PARTITION: %d OFFSET: %d", channel,
+			msg.Partition, msg.Offset)
+
+		if !deliver(ctx, notifier, reader, msg, b.redeliveryDelay) {
+			return
+		}
+	}
+}
+
+//deliver sends msg to the notifier until it is acked or dead-lettered, waiting redeliveryDelay before each
+//redelivery. It returns false when ctx is done first, leaving the offset uncommitted.
+func deliver(ctx context.Context, notifier chan *Message, reader kafkaReader, msg kafka.Message,
+	redeliveryDelay time.Duration) bool {
+	attempts, _ := strconv.Atoi(headerValue(msg, "attempts"))
+	for {
+		message := fromKafkaMessage(reader, msg)
+		if attempts > 0 {
+			message.Header["attempts"] = strconv.Itoa(attempts)
+		}
+		select {
+		case notifier <- message:
+		case <-ctx.Done():
+			return false
+		}
+
+		select {
+		case redeliver := <-message.raw.(kafkaRaw).settled:
+			if !redeliver {
+				return true
+			}
+		case <-ctx.Done():
+			return false
+		}
+
+		attempts++
+		delay := time.NewTimer(redeliveryDelay)
+		select {
+		case <-delay.C:
+		case <-ctx.Done():
+			delay.Stop()
+			return false
+		}
+	}
+}
+
+func (b *KafkaBroker) writer(topic string) kafkaWriter {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	writer, ok := b.writers[topic]
+	if !ok {
+		writer = b.newWriter(topic)
+		b.writers[topic] = writer
+	}
+	return writer
+}
+
+//connection returns the context of the current connection, done once the broker disconnects
+func (b *KafkaBroker) connection() context.Context {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.ctx
+}
+
+//Publish writes the message on its destination topic keyed by message.Key
+func (b *KafkaBroker) Publish(message *Message) error {
+	return b.writer(message.Destination).WriteMessages(b.connection(), toKafkaMessage(message))
+}
+
+//AckMessage commits the offset of the message and lets its topic go on. A failed commit is only logged, the
+//offsets committed after it cover the message.
+func (b *KafkaBroker) AckMessage(message *Message) {
+	raw, ok := message.raw.(kafkaRaw)
+	if !ok {
+		return
+	}
+	if err := raw.reader.CommitMessages(b.connection(), raw.message); err != nil {
+		log.Errorf("[KafkaBroker AckMessage] Fail to commit offset. TOPIC: %s PARTITION: %d OFFSET: %d ERROR: %s",
+			raw.message.Topic, raw.message.Partition, raw.message.Offset, err)
+	}
+	raw.settle(false)
+}
+
+//RedeliveryMessage delivers the message again after the redelivery delay, with the attempts header
+//incremented, before any later message of its topic. Once config.MaximumRedeliveries, as of the broker
+//creation, is reached the message is dead-lettered.
+func (b *KafkaBroker) RedeliveryMessage(message *Message) {
+	raw, ok := message.raw.(kafkaRaw)
+	if !ok {
+		return
+	}
+	attempt, _ := strconv.Atoi(message.Header["attempts"])
+	attempt++
+
+	if attempt > b.maximumRedeliveries {
+		log.Infof("[KafkaBroker RedeliveryMessage] Attempt: %d Message: %s", attempt, string(message.Body))
+		b.DeadLetterMessage(message, ErrMaxRedeliveries)
+		return
+	}
+	raw.settle(true)
+}
+
+//DeadLetterMessage publishes the message on config.DeadLetterQueue and commits the original. When the dead
+//letter topic cannot be written the message is redelivered instead.
+func (b *KafkaBroker) DeadLetterMessage(message *Message, reason error) {
+	raw, ok := message.raw.(kafkaRaw)
+	if !ok {
+		return
+	}
+	deadLetter := message.clone()
+	deadLetter.Destination = config.DeadLetterQueue
+	deadLetter.Header["original-destination"] = message.Destination
+	if reason != nil {
+		deadLetter.Header["dead-letter-reason"] = reason.Error()
+	}
+
+	if err := b.Publish(deadLetter); err != nil {
+		log.Errorf("[KafkaBroker DeadLetterMessage] Fail to send to dead letter topic, redelivering. ERROR: %s", err)
+		raw.settle(true)
+		return
+	}
+	b.AckMessage(message)
+}
+
+func fromKafkaMessage(reader kafkaReader, msg kafka.Message) *Message {
+	message := &Message{
+		Destination: msg.Topic,
+		Key:         string(msg.Key),
+		Header:      make(map[string]string, len(msg.Headers)),
+		Body:        msg.Value,
+		raw:         kafkaRaw{reader: reader, message: msg, settled: make(chan bool, 1)},
+	}
+	for _, h := range msg.Headers {
+		if h.Key == "content-type" {
+			message.ContentType = string(h.Value)
+			continue
+		}
+		message.Header[h.Key] = string(h.Value)
+	}
+	return message
+}
+
+func headerValue(msg kafka.Message, key string) string {
+	for _, h := range msg.Headers {
+		if h.Key == key {
+			return string(h.Value)
+		}
+	}
+	return ""
+}
+
+func toKafkaMessage(message *Message) kafka.Message {
+	key := message.Key
+	if key == "" {
+		key = messageKey(message.Body)
+	}
+
+	headers := make([]kafka.Header, 0, len(message.Header)+1)
+	if message.ContentType != "" {
+		headers = append(headers, kafka.Header{Key: "content-type", Value: []byte(message.ContentType)})
+	}
+	for k, v := range message.Header {
+		headers = append(headers, kafka.Header{Key: k, Value: []byte(v)})
+	}
+
+	return kafka.Message{Key: []byte(key), Value: message.Body, Headers: headers}
+}
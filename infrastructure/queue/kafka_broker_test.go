@@ -0,0 +1,322 @@
+package queue
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const fakePartitions = 3
+
+//fakeKafka is an in-process cluster with a single consumer group member per reader
+type fakeKafka struct {
+	mu         sync.Mutex
+	cond       *sync.Cond
+	partitions map[string][][]kafka.Message
+	committed  map[string][]int64
+}
+
+func newFakeKafka() *fakeKafka {
+	k := &fakeKafka{partitions: make(map[string][][]kafka.Message), committed: make(map[string][]int64)}
+	k.cond = sync.NewCond(&k.mu)
+	return k
+}
+
+func (k *fakeKafka) topic(topic string) [][]kafka.Message {
+	if _, ok := k.partitions[topic]; !ok {
+		k.partitions[topic] = make([][]kafka.Message, fakePartitions)
+		k.committed[topic] = make([]int64, fakePartitions)
+	}
+	return k.partitions[topic]
+}
+
+func (k *fakeKafka) broker() *KafkaBroker {
+	b := newKafkaBroker()
+	b.newReader = func(topic string) kafkaReader {
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		k.topic(topic)
+		return &fakeReader{kafka: k, topic: topic, position: append([]int64(nil), k.committed[topic]...)}
+	}
+	b.newWriter = func(topic string) kafkaWriter {
+		return &fakeWriter{kafka: k, topic: topic}
+	}
+	return b
+}
+
+func (k *fakeKafka) messages(topic string) []kafka.Message {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	var messages []kafka.Message
+	for _, partition := range k.topic(topic) {
+		messages = append(messages, partition...)
+	}
+	return messages
+}
+
+func (k *fakeKafka) committedOffsets(topic string) []int64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.topic(topic)
+	return append([]int64(nil), k.committed[topic]...)
+}
+
+type fakeWriter struct {
+	kafka *fakeKafka
+	topic string
+}
+
+func (w *fakeWriter) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	w.kafka.mu.Lock()
+	defer w.kafka.mu.Unlock()
+
+	partitions := w.kafka.topic(w.topic)
+	for _, msg := range msgs {
+		h := fnv.New32a()
+		_, _ = h.Write(msg.Key)
+		p := int(h.Sum32() % fakePartitions)
+
+		msg.Topic = w.topic
+		msg.Partition = p
+		msg.Offset = int64(len(partitions[p]))
+		partitions[p] = append(partitions[p], msg)
+	}
+	w.kafka.cond.Broadcast()
+	return nil
+}
+
+func (w *fakeWriter) Close() error { return nil }
+
+type fakeReader struct {
+	kafka    *fakeKafka
+	topic    string
+	position []int64
+	closed   bool
+}
+
+func (r *fakeReader) FetchMessage(ctx context.Context) (kafka.Message, error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			r.kafka.mu.Lock()
+			r.kafka.cond.Broadcast()
+			r.kafka.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+	for {
+		if err := ctx.Err(); err != nil || r.closed {
+			return kafka.Message{}, context.Canceled
+		}
+		for p, partition := range r.kafka.topic(r.topic) {
+			if r.position[p] < int64(len(partition)) {
+				msg := partition[r.position[p]]
+				r.position[p]++
+				return msg, nil
+			}
+		}
+		r.kafka.cond.Wait()
+	}
+}
+
+func (r *fakeReader) CommitMessages(ctx context.Context, msgs ...kafka.Message) error {
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+
+	for _, msg := range msgs {
+		if msg.Offset+1 > r.kafka.committed[r.topic][msg.Partition] {
+			r.kafka.committed[r.topic][msg.Partition] = msg.Offset + 1
+		}
+	}
+	return nil
+}
+
+func (r *fakeReader) Close() error {
+	r.kafka.mu.Lock()
+	defer r.kafka.mu.Unlock()
+	r.closed = true
+	r.kafka.cond.Broadcast()
+	return nil
+}
+
+func receive(t *testing.T, b Broker, topic string) *Message {
+	select {
+	case msg := <-b.Notifier(topic):
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+		return nil
+	}
+}
+
+func TestKafkaBroker_KeyedByUserID(t *testing.T) {
+	cluster := newFakeKafka()
+	broker := cluster.broker()
+	defer broker.Disconnect()
+
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, broker.Publish(NewMessage(testChannel, "application/json", []byte("{\"_id\":\"user-1\"}"))))
+	}
+	assert.Nil(t, broker.Publish(NewMessage(testChannel, "application/json", []byte("{\"_id\":\"user-2\"}"))))
+
+	var partition = -1
+	for _, msg := range cluster.messages(testChannel) {
+		if string(msg.Key) != "user-1" {
+			continue
+		}
+		if partition == -1 {
+			partition = msg.Partition
+		}
+		assert.Equal(t, partition, msg.Partition)
+	}
+}
+
+func TestKafkaBroker_CommitOnlyAfterAck(t *testing.T) {
+	cluster := newFakeKafka()
+	broker := cluster.broker()
+
+	_ = broker.Publish(NewMessage(testChannel, "application/json", []byte("{\"_id\":\"user-1\"}")))
+	go broker.Listen(testChannel)
+
+	msg := receive(t, broker, testChannel)
+	assert.Equal(t, "user-1", msg.Key)
+	assert.Equal(t, "application/json", msg.ContentType)
+	broker.Disconnect()
+
+	//not acked, so a new member of the group gets it again
+	broker = cluster.broker()
+	go broker.Listen(testChannel)
+
+	msg = receive(t, broker, testChannel)
+	broker.AckMessage(msg)
+	broker.Disconnect()
+
+	var committed int64
+	for _, offset := range cluster.committedOffsets(testChannel) {
+		committed += offset
+	}
+	assert.Equal(t, int64(1), committed)
+}
+
+func TestKafkaBroker_RedeliveryAndDeadLetter(t *testing.T) {
+	defer func(delay int) { config.RedeliveryDelay = delay }(config.RedeliveryDelay)
+	config.RedeliveryDelay = 0
+	cluster := newFakeKafka()
+	broker := cluster.broker()
+	defer broker.Disconnect()
+
+	_ = broker.Publish(NewMessage(testChannel, "", []byte("{\"_id\":\"user-1\"}")))
+	go broker.Listen(testChannel)
+
+	for attempt := 0; attempt <= config.MaximumRedeliveries; attempt++ {
+		msg := receive(t, broker, testChannel)
+		if attempt > 0 {
+			assert.Equal(t, strconv.Itoa(attempt), msg.Header["attempts"])
+		}
+		broker.RedeliveryMessage(msg)
+	}
+
+	//redelivered in place, the topic is not written again
+	assert.Len(t, cluster.messages(testChannel), 1)
+	deadLetters := cluster.messages(config.DeadLetterQueue)
+	if assert.Len(t, deadLetters, 1) {
+		assert.Equal(t, "user-1", string(deadLetters[0].Key))
+	}
+}
+
+func TestKafkaBroker_RedeliveryKeepsOrder(t *testing.T) {
+	defer func(delay int) { config.RedeliveryDelay = delay }(config.RedeliveryDelay)
+	config.RedeliveryDelay = 0
+	cluster := newFakeKafka()
+	broker := cluster.broker()
+	defer broker.Disconnect()
+
+	_ = broker.Publish(NewMessage(testChannel, "", []byte("{\"_id\":\"user-1\",\"name\":\"first\"}")))
+	_ = broker.Publish(NewMessage(testChannel, "", []byte("{\"_id\":\"user-1\",\"name\":\"second\"}")))
+	go broker.Listen(testChannel)
+
+	first := receive(t, broker, testChannel)
+	broker.RedeliveryMessage(first)
+	redelivered := receive(t, broker, testChannel)
+	assert.Equal(t, first.Body, redelivered.Body)
+	broker.AckMessage(redelivered)
+	second := receive(t, broker, testChannel)
+	assert.Contains(t, string(second.Body), "second")
+}
+
+func TestKafkaBroker_RedeliveryDelayDoesNotBlock(t *testing.T) {
+	defer func(delay int) { config.RedeliveryDelay = delay }(config.RedeliveryDelay)
+	config.RedeliveryDelay = int(time.Hour / time.Millisecond)
+	cluster := newFakeKafka()
+	broker := cluster.broker()
+
+	_ = broker.Publish(NewMessage(testChannel, "", []byte("{\"_id\":\"user-1\"}")))
+	_ = broker.Publish(NewMessage("other", "", []byte("{\"_id\":\"user-2\"}")))
+	go broker.Listen(testChannel)
+	go broker.Listen("other")
+
+	msg := receive(t, broker, testChannel)
+	returned := make(chan struct{})
+	go func() {
+		broker.RedeliveryMessage(msg)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("redelivery blocked the caller")
+	}
+	//other topics go on while the message waits, and disconnecting ends the wait
+	broker.AckMessage(receive(t, broker, "other"))
+
+	disconnected := make(chan struct{})
+	go func() {
+		broker.Disconnect()
+		close(disconnected)
+	}()
+	select {
+	case <-disconnected:
+	case <-time.After(time.Second):
+		t.Fatal("disconnect waited for the redelivery delay")
+	}
+	for _, offset := range cluster.committedOffsets(testChannel) {
+		assert.Equal(t, int64(0), offset)
+	}
+}
+
+func TestKafkaBroker_ListenAfterDisconnect(t *testing.T) {
+	cluster := newFakeKafka()
+	broker := cluster.broker()
+	readers := 0
+	newReader := broker.newReader
+	broker.newReader = func(topic string) kafkaReader {
+		readers++
+		return newReader(topic)
+	}
+	broker.Disconnect()
+
+	returned := make(chan struct{})
+	go func() {
+		broker.Listen(testChannel)
+		close(returned)
+	}()
+	select {
+	case <-returned:
+	case <-time.After(time.Second):
+		t.Fatal("listened on a disconnected broker")
+	}
+	assert.Equal(t, 0, readers)
+	assert.Empty(t, broker.readers)
+}
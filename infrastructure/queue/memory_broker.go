@@ -0,0 +1,258 @@
+package queue
+
+import (
+	"errors"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/labstack/gommon/log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	//ErrBrokerClosed is returned when publishing on a disconnected MemoryBroker
+	ErrBrokerClosed = errors.New("broker is disconnected")
+)
+
+//MemoryBroker is an in-process Broker with queue semantics, used for tests and standalone runs.
+//Messages published before anyone listens are kept until a subscriber shows up.
+type MemoryBroker struct {
+	mu              sync.Mutex
+	topics          map[string]*memoryTopic
+	inFlight        map[*Message]string
+	acked           map[string][]*Message
+	nacked          map[string][]*Message
+	connected       bool
+	done            chan struct{}
+	RedeliveryDelay time.Duration
+}
+
+type memoryTopic struct {
+	queue    []*Message
+	ready    chan struct{}
+	notifier chan *Message
+}
+
+//NewMemoryBroker creates a connected MemoryBroker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		topics:          make(map[string]*memoryTopic),
+		inFlight:        make(map[*Message]string),
+		acked:           make(map[string][]*Message),
+		nacked:          make(map[string][]*Message),
+		connected:       true,
+		done:            make(chan struct{}),
+		RedeliveryDelay: time.Duration(config.RedeliveryDelay) * time.Millisecond,
+	}
+}
+
+//Initialize makes the MemoryBroker the instance returned by GetInstance
+func (b *MemoryBroker) Initialize() error {
+	GetInstance()
+	instance = b
+	return nil
+}
+
+func (b *MemoryBroker) topic(channel string) *memoryTopic {
+	t, ok := b.topics[channel]
+	if !ok {
+		t = &memoryTopic{ready: make(chan struct{}, 1), notifier: make(chan *Message)}
+		b.topics[channel] = t
+	}
+	return t
+}
+
+//NewConnection reopens a disconnected MemoryBroker
+func (b *MemoryBroker) NewConnection() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.connected {
+		b.connected = true
+		b.done = make(chan struct{})
+	}
+	return nil
+}
+
+//Disconnect stops every listener. Messages still queued are kept for the next connection.
+func (b *MemoryBroker) Disconnect() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.connected {
+		b.connected = false
+		close(b.done)
+	}
+}
+
+//Notifier returns the channel where messages of the channel are delivered
+func (b *MemoryBroker) Notifier(channel string) chan *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.topic(channel).notifier
+}
+
+//Publish enqueues a copy of the message on its destination
+func (b *MemoryBroker) Publish(message *Message) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.connected {
+		return ErrBrokerClosed
+	}
+
+	t := b.topic(message.Destination)
+	t.queue = append(t.queue, message.clone())
+
+	select {
+	case t.ready <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+//Listen delivers the queued messages of the channel to its notifier until the broker disconnects
+func (b *MemoryBroker) Listen(channel string) {
+	b.mu.Lock()
+	t := b.topic(channel)
+	done := b.done
+	b.mu.Unlock()
+
+	log.Infof("[MemoryBroker Listen] Subscribed on CHANNEL: %s", channel)
+	for {
+		msg := b.next(channel, t)
+		if msg == nil {
+			select {
+			case <-t.ready:
+				continue
+			case <-done:
+				return
+			}
+		}
+
+		select {
+		case t.notifier <- msg:
+		case <-done:
+			b.requeue(channel, msg)
+			return
+		}
+	}
+}
+
+func (b *MemoryBroker) next(channel string, t *memoryTopic) *Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(t.queue) == 0 {
+		return nil
+	}
+	msg := t.queue[0]
+	t.queue = t.queue[1:]
+	b.inFlight[msg] = channel
+	return msg
+}
+
+func (b *MemoryBroker) requeue(channel string, msg *Message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.inFlight, msg)
+	t := b.topic(channel)
+	t.queue = append([]*Message{msg}, t.queue...)
+}
+
+//settle removes the message from the in flight set, returning false if it was not delivered or already settled
+func (b *MemoryBroker) settle(message *Message, settled map[string][]*Message) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	channel, ok := b.inFlight[message]
+	if !ok {
+		return false
+	}
+	delete(b.inFlight, message)
+	settled[channel] = append(settled[channel], message)
+	return true
+}
+
+//AckMessage acknowledges a delivered message
+func (b *MemoryBroker) AckMessage(message *Message) {
+	b.settle(message, b.acked)
+}
+
+//NackMessage rejects a delivered message without redelivering it
+func (b *MemoryBroker) NackMessage(message *Message) {
+	b.settle(message, b.nacked)
+}
+
+//RedeliveryMessage acks the message and publishes it again with the attempts header incremented,
+//nacking it once config.MaximumRedeliveries is reached
+func (b *MemoryBroker) RedeliveryMessage(message *Message) {
+	attempt := 1
+	if attemptsHeader := message.Header["attempts"]; attemptsHeader != "" {
+		attempt, _ = strconv.Atoi(attemptsHeader)
+		attempt++
+	}
+
+	if attempt > config.MaximumRedeliveries {
+		log.Infof("[MemoryBroker RedeliveryMessage] Attempt: %d Nack Message: %s", attempt, string(message.Body))
+		b.NackMessage(message)
+		return
+	}
+
+	b.AckMessage(message)
+	redelivery := message.clone()
+	redelivery.Header["attempts"] = strconv.Itoa(attempt)
+
+	republish := func() {
+		_ = b.Publish(redelivery)
+	}
+	if b.RedeliveryDelay <= 0 {
+		republish()
+		return
+	}
+	time.AfterFunc(b.RedeliveryDelay, republish)
+}
+
+//DeadLetterMessage acks the message and publishes it on config.DeadLetterQueue
+func (b *MemoryBroker) DeadLetterMessage(message *Message, reason error) {
+	deadLetter := message.clone()
+	deadLetter.Destination = config.DeadLetterQueue
+	deadLetter.Header["original-destination"] = message.Destination
+	if reason != nil {
+		deadLetter.Header["dead-letter-reason"] = reason.Error()
+	}
+	if err := b.Publish(deadLetter); err != nil {
+		b.NackMessage(message)
+		return
+	}
+	b.AckMessage(message)
+}
+
+//Queued returns the messages of the channel that were not delivered yet
+func (b *MemoryBroker) Queued(channel string) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Message(nil), b.topic(channel).queue...)
+}
+
+//Acked returns the messages of the channel that were acknowledged
+func (b *MemoryBroker) Acked(channel string) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Message(nil), b.acked[channel]...)
+}
+
+//Nacked returns the messages of the channel that were rejected
+func (b *MemoryBroker) Nacked(channel string) []*Message {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]*Message(nil), b.nacked[channel]...)
+}
+
+//InFlight returns how many delivered messages are waiting for ack or nack
+func (b *MemoryBroker) InFlight() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.inFlight)
+}
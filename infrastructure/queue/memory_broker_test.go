@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"errors"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+const testChannel = "VirtualTopic.test"
+
+func TestMemoryBroker_PublishBeforeListen(t *testing.T) {
+	broker := NewMemoryBroker()
+	defer broker.Disconnect()
+
+	assert.Nil(t, broker.Publish(&Message{Destination: testChannel, Body: []byte("body"),
+		Header: map[string]string{"key": "value"}}))
+	assert.Len(t, broker.Queued(testChannel), 1)
+
+	go broker.Listen(testChannel)
+
+	select {
+	case msg := <-broker.Notifier(testChannel):
+		assert.Equal(t, "body", string(msg.Body))
+		assert.Equal(t, "value", msg.Header["key"])
+		assert.Equal(t, 1, broker.InFlight())
+
+		broker.AckMessage(msg)
+		assert.Equal(t, 0, broker.InFlight())
+		assert.Len(t, broker.Acked(testChannel), 1)
+	case <-time.After(time.Second):
+		t.Fatal("message not delivered")
+	}
+}
+
+func TestMemoryBroker_RedeliveryMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.RedeliveryDelay = 0
+	defer broker.Disconnect()
+
+	go broker.Listen(testChannel)
+	_ = broker.Publish(NewMessage(testChannel, "", []byte("body")))
+
+	for attempt := 1; attempt <= config.MaximumRedeliveries; attempt++ {
+		msg := <-broker.Notifier(testChannel)
+		broker.RedeliveryMessage(msg)
+	}
+
+	msg := <-broker.Notifier(testChannel)
+	assert.Equal(t, "10", msg.Header["attempts"])
+
+	broker.RedeliveryMessage(msg)
+	assert.Len(t, broker.Nacked(testChannel), 1)
+	assert.Len(t, broker.Acked(testChannel), config.MaximumRedeliveries)
+	assert.Equal(t, 0, broker.InFlight())
+}
+
+func TestMemoryBroker_DeadLetterMessage(t *testing.T) {
+	broker := NewMemoryBroker()
+	defer broker.Disconnect()
+
+	go broker.Listen(testChannel)
+	_ = broker.Publish(NewMessage(testChannel, "", []byte("body")))
+
+	msg := <-broker.Notifier(testChannel)
+	broker.DeadLetterMessage(msg, errors.New("reason"))
+
+	deadLetters := broker.Queued(config.DeadLetterQueue)
+	assert.Len(t, deadLetters, 1)
+	assert.Equal(t, testChannel, deadLetters[0].Header["original-destination"])
+	assert.Equal(t, "reason", deadLetters[0].Header["dead-letter-reason"])
+	assert.Len(t, broker.Acked(testChannel), 1)
+}
+
+func TestMemoryBroker_PublishDisconnected(t *testing.T) {
+	broker := NewMemoryBroker()
+	broker.Disconnect()
+
+	assert.Equal(t, ErrBrokerClosed, broker.Publish(NewMessage(testChannel, "", []byte("body"))))
+	assert.Nil(t, broker.NewConnection())
+	assert.Nil(t, broker.Publish(NewMessage(testChannel, "", []byte("body"))))
+}
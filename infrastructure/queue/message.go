@@ -0,0 +1,52 @@
+package queue
+
+import "encoding/json"
+
+//Message is a transport-neutral message received from or published to a Broker
+type Message struct {
+	Destination string
+	ContentType string
+	//Key groups messages that must keep their order, the user _id for user events
+	Key    string
+	Header map[string]string
+	Body   []byte
+
+	//raw is the transport message this one was received as, used to ack it
+	raw interface{}
+}
+
+//NewMessage creates a message for the destination keyed by the user _id found in body
+func NewMessage(destination string, contentType string, body []byte) *Message {
+	return &Message{
+		Destination: destination,
+		ContentType: contentType,
+		Key:         messageKey(body),
+		Header:      make(map[string]string),
+		Body:        body,
+	}
+}
+
+//clone copies the message without its transport handle, so it can be published again
+func (m *Message) clone() *Message {
+	header := make(map[string]string, len(m.Header))
+	for k, v := range m.Header {
+		header[k] = v
+	}
+	return &Message{
+		Destination: m.Destination,
+		ContentType: m.ContentType,
+		Key:         m.Key,
+		Header:      header,
+		Body:        m.Body,
+	}
+}
+
+var messageKey = func(body []byte) string {
+	var keyed struct {
+		ID string `json:"_id"`
+	}
+	if err := json.Unmarshal(body, &keyed); err != nil {
+		return ""
+	}
+	return keyed.ID
+}
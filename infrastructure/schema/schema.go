@@ -0,0 +1,162 @@
+package schema
+
+import (
+	"github.com/coaraujo/users-go-processor/domains"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	//UserCreate is the schema of the user create messages
+	UserCreate = "user-create"
+	//UserRemove is the schema of the user remove messages
+	UserRemove = "user-remove"
+
+	draft = "http://json-schema.org/draft-07/schema#"
+)
+
+//Schema is a JSON Schema document, limited to the draft 7 keywords the user messages need
+type Schema struct {
+	Schema      string             `json:"$schema,omitempty"`
+	ID          string             `json:"$id,omitempty"`
+	Title       string             `json:"title,omitempty"`
+	Description string             `json:"description,omitempty"`
+	Type        string             `json:"type,omitempty"`
+	Format      string             `json:"format,omitempty"`
+	Enum        []string           `json:"enum,omitempty"`
+	MinLength   int                `json:"minLength,omitempty"`
+	Properties  map[string]*Schema `json:"properties,omitempty"`
+	Required    []string           `json:"required,omitempty"`
+	Items       *Schema            `json:"items,omitempty"`
+	OneOf       []*Schema          `json:"oneOf,omitempty"`
+}
+
+//annotations complete the properties generated from the domains, keyed by struct name and JSON field
+var annotations = map[string]*Schema{
+	"User._id":                 {MinLength: 1},
+	"User.status":              {Enum: domains.Statuses()},
+	"PhoneNumber.type":         {Enum: []string{domains.PhoneMobile, domains.PhoneHome, domains.PhoneWork}},
+	"PhoneNumber.verification": {Enum: []string{domains.PhoneUnverified, domains.PhonePending, domains.PhoneVerified}},
+	"PhoneNumber.action":       {Enum: []string{domains.PhoneRemove}},
+	"Address.type":             {Enum: []string{domains.AddressShipping, domains.AddressBilling}},
+	"Address.action":           {Enum: []string{domains.AddressRemove}},
+}
+
+//eventIgnored are the fields of domains.User kept by the storage, which events can not set
+var eventIgnored = map[string]bool{"statusHistory": true, "deletedAt": true, "version": true}
+
+var timeType = reflect.TypeOf(time.Time{})
+var phonesType = reflect.TypeOf(domains.Phones{})
+
+var schemas = map[string]*Schema{
+	UserCreate: userCreate(),
+	UserRemove: userRemove(),
+}
+
+//Get returns the schema with the given name
+func Get(name string) (*Schema, bool) {
+	s, ok := schemas[name]
+	return s, ok
+}
+
+//Names returns the names of the schemas, sorted
+func Names() []string {
+	names := make([]string, 0, len(schemas))
+	for name := range schemas {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func userCreate() *Schema {
+	s := generate(reflect.TypeOf(domains.User{}))
+	for field := range eventIgnored {
+		delete(s.Properties, field)
+	}
+	s.Schema, s.ID = draft, "/schemas/"+UserCreate
+	s.Title = "User create message"
+	s.Description = "Creates the user, or merges it into the stored one. Absent fields keep their stored value."
+	s.Required = []string{"_id"}
+	return s
+}
+
+func userRemove() *Schema {
+	user := generate(reflect.TypeOf(domains.User{}))
+	return &Schema{
+		Schema:      draft,
+		ID:          "/schemas/" + UserRemove,
+		Title:       "User remove message",
+		Description: "Removes the user. The whole message is archived next to the removed user.",
+		Type:        "object",
+		Properties: map[string]*Schema{
+			"_id":       user.Properties["_id"],
+			"clientId":  user.Properties["clientId"],
+			"updatedAt": user.Properties["updatedAt"],
+		},
+		Required: []string{"_id"},
+	}
+}
+
+//generate describes the JSON encoding of t. Structs are described by their JSON fields, and the phones
+//accept the list of numbers or the legacy object.
+func generate(t reflect.Type) *Schema {
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t == phonesType:
+		return &Schema{OneOf: []*Schema{
+			{Type: "array", Items: generate(reflect.TypeOf(domains.PhoneNumber{}))},
+			generate(reflect.TypeOf(domains.Phone{})),
+		}}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return generate(t.Elem())
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Type: "integer"}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Type: "number"}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Type: "array", Items: generate(t.Elem())}
+	case reflect.Struct:
+		s := &Schema{Type: "object", Properties: make(map[string]*Schema)}
+		for i := 0; i < t.NumField(); i++ {
+			name := jsonName(t.Field(i))
+			if name == "" {
+				continue
+			}
+			property := generate(t.Field(i).Type)
+			if annotation, ok := annotations[t.Name()+"."+name]; ok {
+				property.Enum = annotation.Enum
+				property.MinLength = annotation.MinLength
+			}
+			s.Properties[name] = property
+		}
+		return s
+	}
+	return &Schema{}
+}
+
+//jsonName returns the name of the field in JSON, empty when it is not encoded
+func jsonName(field reflect.StructField) string {
+	if field.PkgPath != "" {
+		return ""
+	}
+	tag := strings.Split(field.Tag.Get("json"), ",")[0]
+	if tag == "-" {
+		return ""
+	}
+	if tag == "" {
+		return field.Name
+	}
+	return tag
+}
@@ -0,0 +1,108 @@
+package schema
+
+import (
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/stretchr/testify/assert"
+	"reflect"
+	"testing"
+)
+
+func TestSchema_InSyncWithDomains(t *testing.T) {
+	create, _ := Get(UserCreate)
+	for typ, object := range map[reflect.Type]*Schema{
+		reflect.TypeOf(domains.User{}):        create,
+		reflect.TypeOf(domains.PhoneNumber{}): create.Properties["phones"].OneOf[0].Items,
+		reflect.TypeOf(domains.Phone{}):       create.Properties["phones"].OneOf[1],
+		reflect.TypeOf(domains.Address{}):     create.Properties["addresses"].Items,
+	} {
+		assert.Equal(t, "object", object.Type, typ.Name())
+		for i := 0; i < typ.NumField(); i++ {
+			field := jsonName(typ.Field(i))
+			if field == "" || (typ.Name() == "User" && eventIgnored[field]) {
+				continue
+			}
+			assert.Contains(t, object.Properties, field, typ.Name())
+		}
+	}
+
+	assert.Equal(t, []string{"_id"}, create.Required)
+	assert.NotContains(t, create.Properties, "version")
+	assert.Equal(t, &Schema{Type: "string", Format: "date-time"}, create.Properties["updatedAt"])
+	assert.Equal(t, []string{domains.PhoneMobile, domains.PhoneHome, domains.PhoneWork},
+		create.Properties["phones"].OneOf[0].Items.Properties["type"].Enum)
+}
+
+func TestSchema_JSON(t *testing.T) {
+	remove, ok := Get(UserRemove)
+	assert.True(t, ok)
+
+	doc, err := json.Marshal(remove)
+	assert.Nil(t, err)
+	assert.JSONEq(t, `{
+		"$schema": "http://json-schema.org/draft-07/schema#",
+		"$id": "/schemas/user-remove",
+		"title": "User remove message",
+		"description": "Removes the user. The whole message is archived next to the removed user.",
+		"type": "object",
+		"properties": {
+			"_id": {"type": "string", "minLength": 1},
+			"clientId": {"type": "string"},
+			"updatedAt": {"type": "string", "format": "date-time"}
+		},
+		"required": ["_id"]
+	}`, string(doc))
+	assert.Equal(t, []string{UserCreate, UserRemove}, Names())
+}
+
+func TestValidate_Valid(t *testing.T) {
+	for _, body := range []string{
+		`{"_id":"123","fullName":"name","status":"active","updatedAt":"2019-08-15T18:15:59-03:00","enqueuedAt":"any",
+			"phones":[{"type":"mobile","ddd":"21","number":"99999-0000","primary":true,"verification":"verified"},
+				{"ddd":"21","number":"2222-0000","action":"remove"}],
+			"addresses":[{"type":"shipping","cep":"01001-000"}]}`,
+		`{"_id":"123","phones":{"cellphone":"99999-0000","ddd_cellphone":"21","mobile_phone_confirmed":true}}`,
+		`{"_id":"123","phones":null}`,
+		`{"_id":"123","status":"ACTIVE"}`,
+	} {
+		assert.Nil(t, Validate(UserCreate, []byte(body)), body)
+	}
+}
+
+func TestValidate_Violations(t *testing.T) {
+	err := Validate(UserCreate, []byte(`{"_id":"","status":"gone","updatedAt":"yesterday",
+		"phones":[{"type":"mobile"},{"type":"fax","primary":"yes"}],"addresses":{"type":"shipping"}}`))
+
+	assert.Equal(t, []Violation{
+		{Path: "$._id", Message: "must have at least 1 characters"},
+		{Path: "$.addresses", Message: "must be an array"},
+		{Path: "$.phones[1].primary", Message: "must be a boolean"},
+		{Path: "$.phones[1].type", Message: "must be one of mobile, home, work"},
+		{Path: "$.status", Message: "must be one of pending, active, inactive, blocked, deleted, PENDING, ACTIVE, " +
+			"INACTIVE, BLOCKED, DELETED"},
+		{Path: "$.updatedAt", Message: "must be a RFC 3339 date-time"},
+	}, Violations(err))
+	assert.Contains(t, err.Error(), "user-create schema: $._id: must have at least 1 characters; ")
+}
+
+func TestValidate_Remove(t *testing.T) {
+	err := Validate(UserRemove, []byte(`{"clientId":1}`))
+	assert.Equal(t, []Violation{
+		{Path: "$._id", Message: "is required"},
+		{Path: "$.clientId", Message: "must be a string"},
+	}, Violations(err))
+
+	err = Validate(UserRemove, []byte(`[]`))
+	assert.Equal(t, []Violation{{Path: "$", Message: "must be an object"}}, Violations(err))
+
+	err = Validate(UserCreate, []byte(`{"_id":"1","phones":"21 99999-0000"}`))
+	assert.Equal(t, []Violation{{Path: "$.phones", Message: "must be one of the types array, object"}},
+		Violations(storage.NewError(storage.KindValidation, err)))
+
+	err = Validate(UserCreate, []byte(`hello world`))
+	assert.Equal(t, "$", Violations(err)[0].Path)
+
+	assert.NotNil(t, Validate("user-update", []byte(`{}`)))
+	assert.Nil(t, Violations(storage.ErrNotFound))
+}
@@ -0,0 +1,168 @@
+package schema
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//Violation is a value that does not match the schema, Path locates it in the message, $.phones[0].type
+type Violation struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+//ValidationError lists every violation of a message
+type ValidationError struct {
+	Schema     string
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	messages := make([]string, 0, len(e.Violations))
+	for _, v := range e.Violations {
+		messages = append(messages, v.Path+": "+v.Message)
+	}
+	return e.Schema + " schema: " + strings.Join(messages, "; ")
+}
+
+//Violations returns the violations that caused err, nil when it is not a ValidationError
+func Violations(err error) []Violation {
+	if storageErr, ok := err.(*storage.Error); ok {
+		err = storageErr.Err
+	}
+	if validationErr, ok := err.(*ValidationError); ok {
+		return validationErr.Violations
+	}
+	return nil
+}
+
+//Validate checks the message against the named schema, returning a *ValidationError with all of its violations
+func Validate(name string, body []byte) error {
+	s, ok := Get(name)
+	if !ok {
+		return fmt.Errorf("unknown schema %q", name)
+	}
+
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		return &ValidationError{Schema: name, Violations: []Violation{{Path: "$", Message: "invalid JSON: " + err.Error()}}}
+	}
+
+	violations := s.validate("$", value)
+	if len(violations) > 0 {
+		return &ValidationError{Schema: name, Violations: violations}
+	}
+	return nil
+}
+
+func (s *Schema) validate(path string, value interface{}) []Violation {
+	if len(s.OneOf) > 0 {
+		return s.validateOneOf(path, value)
+	}
+	if value == nil {
+		//absent and null values are the same for the omitempty fields of the domains
+		return nil
+	}
+	if s.Type != "" && typeOf(value) != s.Type && !(s.Type == "number" && typeOf(value) == "integer") {
+		return []Violation{{Path: path, Message: "must be " + article(s.Type)}}
+	}
+
+	var violations []Violation
+	switch v := value.(type) {
+	case string:
+		if len(s.Enum) > 0 && !contains(s.Enum, v) {
+			violations = append(violations, Violation{Path: path, Message: "must be one of " + strings.Join(s.Enum, ", ")})
+		}
+		if len(v) < s.MinLength {
+			violations = append(violations, Violation{Path: path,
+				Message: "must have at least " + strconv.Itoa(s.MinLength) + " characters"})
+		}
+		if s.Format == "date-time" {
+			if _, err := time.Parse(time.RFC3339Nano, v); err != nil {
+				violations = append(violations, Violation{Path: path, Message: "must be a RFC 3339 date-time"})
+			}
+		}
+	case map[string]interface{}:
+		for _, field := range s.Required {
+			if _, ok := v[field]; !ok {
+				violations = append(violations, Violation{Path: path + "." + field, Message: "is required"})
+			}
+		}
+		fields := make([]string, 0, len(v))
+		for field := range v {
+			fields = append(fields, field)
+		}
+		sort.Strings(fields)
+		for _, field := range fields {
+			if property, ok := s.Properties[field]; ok {
+				violations = append(violations, property.validate(path+"."+field, v[field])...)
+			}
+		}
+	case []interface{}:
+		if s.Items != nil {
+			for i, item := range v {
+				violations = append(violations, s.Items.validate(path+"["+strconv.Itoa(i)+"]", item)...)
+			}
+		}
+	}
+	return violations
+}
+
+//validateOneOf reports the violations of the alternative with the type of the value, so the paths point
+//inside it
+func (s *Schema) validateOneOf(path string, value interface{}) []Violation {
+	if value == nil {
+		return nil
+	}
+	var types []string
+	for _, alternative := range s.OneOf {
+		if alternative.Type == typeOf(value) {
+			return alternative.validate(path, value)
+		}
+		types = append(types, alternative.Type)
+	}
+	return []Violation{{Path: path, Message: "must be one of the types " + strings.Join(types, ", ")}}
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return "string"
+	case bool:
+		return "boolean"
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return "integer"
+		}
+		return "number"
+	case map[string]interface{}:
+		return "object"
+	case []interface{}:
+		return "array"
+	}
+	return "null"
+}
+
+func article(kind string) string {
+	if kind == "integer" || kind == "object" || kind == "array" {
+		return "an " + kind
+	}
+	return "a " + kind
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -1,10 +1,222 @@
 package storage
 
 import (
+	"context"
+	"database/sql"
+	"github.com/lib/pq"
+	"github.com/pkg/errors"
 	"go.mongodb.org/mongo-driver/mongo"
+	"net"
 )
 
 var (
 	//ErrNotFound for database not found documents
 	ErrNotFound = mongo.ErrNoDocuments
 )
+
+// Kind classifies a storage error so callers can decide if it is worth retrying
+type Kind int
+
+const (
+	//KindUnknown for errors that could not be classified
+	KindUnknown Kind = iota
+	//KindNotFound for queries that matched no documents
+	KindNotFound
+	//KindConflict for duplicate keys and other write conflicts
+	KindConflict
+	//KindTimeout for operations that exceeded their deadline
+	KindTimeout
+	//KindNetwork for connection and topology failures
+	KindNetwork
+	//KindValidation for documents rejected as invalid
+	KindValidation
+	//KindTransient for write conflicts and transactions aborted by the server, which succeed when retried
+	KindTransient
+	//KindCanceled for operations abandoned because their context was cancelled
+	KindCanceled
+)
+
+var kindNames = map[Kind]string{
+	KindUnknown:    "unknown",
+	KindNotFound:   "not_found",
+	KindConflict:   "conflict",
+	KindTimeout:    "timeout",
+	KindNetwork:    "network",
+	KindValidation: "validation",
+	KindTransient:  "transient",
+	KindCanceled:   "canceled",
+}
+
+func (k Kind) String() string {
+	return kindNames[k]
+}
+
+// ParseKind returns the Kind named name, as returned by String
+func ParseKind(name string) (Kind, bool) {
+	for kind, kindName := range kindNames {
+		if kindName == name {
+			return kind, true
+		}
+	}
+	return KindUnknown, false
+}
+
+// Error is a storage error tagged with its Kind
+type Error struct {
+	Kind Kind
+	Err  error
+}
+
+func (e *Error) Error() string {
+	return e.Kind.String() + ": " + e.Err.Error()
+}
+
+// Cause returns the underlying error, compatible with github.com/pkg/errors
+func (e *Error) Cause() error {
+	return e.Err
+}
+
+// NewError tags err with the given kind
+func NewError(kind Kind, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Kind: kind, Err: err}
+}
+
+// Classify wraps a mongo or postgres driver error into an *Error. Not found errors become ErrNotFound
+// so callers comparing against mongo.ErrNoDocuments keep working.
+func Classify(err error) error {
+	if err == nil || err == ErrNotFound {
+		return err
+	}
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if _, ok := err.(*Error); ok {
+		return err
+	}
+	return NewError(KindOf(err), err)
+}
+
+const (
+	duplicateKeyCode          = 11000
+	duplicateKeyLegacyCode    = 11001
+	duplicateKeyUpdateCode    = 12582
+	writeConflictCode         = 112
+	documentValidationCode    = 121
+	maxTimeExpiredCode        = 50
+	networkErrorLabel         = "NetworkError"
+	transientTransactionLabel = "TransientTransactionError"
+)
+
+// KindOf returns the Kind of err, inspecting raw mongo driver errors when err was not classified yet
+func KindOf(err error) Kind {
+	switch e := err.(type) {
+	case nil:
+		return KindUnknown
+	case *Error:
+		return e.Kind
+	case mongo.WriteException:
+		if e.WriteConcernError != nil && e.WriteConcernError.Code == maxTimeExpiredCode {
+			return KindTimeout
+		}
+		for _, we := range e.WriteErrors {
+			if k := kindOfCode(we.Code); k != KindUnknown {
+				return k
+			}
+		}
+		return KindUnknown
+	case mongo.BulkWriteException:
+		for _, we := range e.WriteErrors {
+			if k := kindOfCode(we.Code); k != KindUnknown {
+				return k
+			}
+		}
+		return KindUnknown
+	case mongo.WriteError:
+		return kindOfCode(e.Code)
+	case mongo.CommandError:
+		if e.HasErrorLabel(networkErrorLabel) {
+			return KindNetwork
+		}
+		if k := kindOfCode(int(e.Code)); k != KindUnknown {
+			return k
+		}
+		if e.HasErrorLabel(transientTransactionLabel) {
+			return KindTransient
+		}
+		return KindUnknown
+	case *pq.Error:
+		return kindOfPostgresCode(e.Code)
+	case net.Error:
+		if e.Timeout() {
+			return KindTimeout
+		}
+		return KindNetwork
+	}
+
+	switch errors.Cause(err) {
+	case ErrNotFound, sql.ErrNoRows:
+		return KindNotFound
+	case context.DeadlineExceeded:
+		return KindTimeout
+	case context.Canceled:
+		return KindCanceled
+	case mongo.ErrClientDisconnected:
+		return KindNetwork
+	case mongo.ErrNilDocument, mongo.ErrEmptySlice:
+		return KindValidation
+	}
+	return KindUnknown
+}
+
+func kindOfCode(code int) Kind {
+	switch code {
+	case duplicateKeyCode, duplicateKeyLegacyCode, duplicateKeyUpdateCode:
+		return KindConflict
+	case writeConflictCode:
+		return KindTransient
+	case documentValidationCode:
+		return KindValidation
+	case maxTimeExpiredCode:
+		return KindTimeout
+	}
+	return KindUnknown
+}
+
+// kindOfPostgresCode classifies the SQLSTATE of a postgres error
+func kindOfPostgresCode(code pq.ErrorCode) Kind {
+	switch {
+	case code == "23505":
+		// unique_violation
+		return KindConflict
+	case code == "40001" || code == "40P01":
+		// serialization_failure, deadlock_detected
+		return KindTransient
+	case code.Class() == "23" || code.Class() == "22":
+		// integrity constraint violation, data exception
+		return KindValidation
+	case code == "57014":
+		// query_canceled, raised by statement_timeout
+		return KindTimeout
+	case code.Class() == "08" || code.Class() == "57":
+		// connection exception, operator intervention
+		return KindNetwork
+	}
+	return KindUnknown
+}
+
+// IsNotFound reports whether err means no document matched
+func IsNotFound(err error) bool {
+	return KindOf(err) == KindNotFound
+}
+
+// IsTransient reports whether retrying the operation may succeed
+func IsTransient(err error) bool {
+	switch KindOf(err) {
+	case KindTimeout, KindNetwork, KindTransient, KindCanceled, KindUnknown:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"testing"
+)
+
+func TestKindOf_NotFound(t *testing.T) {
+	assert.Equal(t, KindNotFound, KindOf(mongo.ErrNoDocuments))
+	assert.True(t, IsNotFound(Classify(mongo.ErrNoDocuments)))
+}
+
+func TestKindOf_DuplicateKey(t *testing.T) {
+	err := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000, Message: "E11000 duplicate key"}}}
+
+	assert.Equal(t, KindConflict, KindOf(err))
+	assert.False(t, IsTransient(err))
+}
+
+func TestKindOf_Transient(t *testing.T) {
+	writeConflict := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 112, Message: "WriteConflict"}}}
+	aborted := mongo.CommandError{Code: 251, Message: "transaction aborted", Labels: []string{"TransientTransactionError"}}
+
+	assert.Equal(t, KindTransient, KindOf(writeConflict))
+	assert.Equal(t, KindTransient, KindOf(mongo.CommandError{Code: 112}))
+	assert.Equal(t, KindTransient, KindOf(aborted))
+	assert.Equal(t, KindTransient, KindOf(&pq.Error{Code: "40001"}))
+	assert.True(t, IsTransient(writeConflict))
+	assert.True(t, IsTransient(aborted))
+}
+
+func TestKindOf_DocumentValidation(t *testing.T) {
+	err := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 121, Message: "Document failed validation"}}}
+
+	assert.Equal(t, KindValidation, KindOf(err))
+}
+
+func TestKindOf_NetworkLabel(t *testing.T) {
+	err := mongo.CommandError{Message: "connection reset", Labels: []string{"NetworkError"}}
+
+	assert.Equal(t, KindNetwork, KindOf(err))
+	assert.True(t, IsTransient(err))
+}
+
+func TestKindOf_Timeout(t *testing.T) {
+	assert.Equal(t, KindTimeout, KindOf(context.DeadlineExceeded))
+	assert.Equal(t, KindTimeout, KindOf(mongo.CommandError{Code: 50}))
+}
+
+func TestKindOf_Canceled(t *testing.T) {
+	assert.Equal(t, KindCanceled, KindOf(context.Canceled))
+	assert.Equal(t, KindCanceled, KindOf(Classify(context.Canceled)))
+	assert.True(t, IsTransient(context.Canceled))
+}
+
+func TestKindOf_Unknown(t *testing.T) {
+	assert.Equal(t, KindUnknown, KindOf(errors.New("error")))
+	assert.True(t, IsTransient(errors.New("error")))
+}
+
+func TestClassify_KeepsCause(t *testing.T) {
+	cause := mongo.WriteException{WriteErrors: mongo.WriteErrors{{Code: 11000}}}
+	err := Classify(cause)
+
+	assert.Equal(t, KindConflict, KindOf(err))
+	assert.Equal(t, cause, err.(*Error).Cause())
+	assert.Nil(t, Classify(nil))
+}
+
+func TestKindOf_Postgres(t *testing.T) {
+	assert.Equal(t, KindConflict, KindOf(&pq.Error{Code: "23505"}))
+	assert.Equal(t, KindValidation, KindOf(&pq.Error{Code: "23502"}))
+	assert.Equal(t, KindTimeout, KindOf(&pq.Error{Code: "57014"}))
+	assert.Equal(t, KindNetwork, KindOf(&pq.Error{Code: "08006"}))
+	assert.Equal(t, ErrNotFound, Classify(sql.ErrNoRows))
+}
@@ -0,0 +1,150 @@
+package storage
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// FaultyDB wraps a MongoDB with the faults of its injector, under the "storage.<method>" operations. Injected
+// errors are tagged with the kind of the rule, and the latency ends in a timeout when the context expires first.
+type FaultyDB struct {
+	db       MongoDB
+	injector *fault.Injector
+}
+
+// NewFaultyDB wraps db with the rules of injector
+func NewFaultyDB(db MongoDB, injector *fault.Injector) *FaultyDB {
+	return &FaultyDB{db: db, injector: injector}
+}
+
+// Initialize initializes the wrapped MongoDB and makes the FaultyDB the instance returned by GetInstance
+func (f *FaultyDB) Initialize(ctx context.Context, credential options.Credential, dbURI string, dbName string) error {
+	if err := f.db.Initialize(ctx, credential, dbURI, dbName); err != nil {
+		return err
+	}
+	GetInstance()
+	mongoInstance = f
+	return nil
+}
+
+// Database wraps the database with the given name of the wrapped MongoDB, nil when it can not open one
+func (f *FaultyDB) Database(name string) MongoDB {
+	db, err := openDatabase(f.db, name)
+	if err != nil {
+		return nil
+	}
+	return NewFaultyDB(db, f.injector)
+}
+
+// Expire expires the collection of the wrapped MongoDB, without faults
+func (f *FaultyDB) Expire(ctx context.Context, collName string, field string) error {
+	return expire(ctx, f.db, collName, field)
+}
+
+// Disconnect disconnects the wrapped MongoDB
+func (f *FaultyDB) Disconnect() {
+	f.db.Disconnect()
+}
+
+// before runs the faults of the method, returning them as storage errors
+func (f *FaultyDB) before(ctx context.Context, method string) error {
+	err := f.injector.Before(ctx, "storage."+method)
+	if injected, ok := err.(*fault.Error); ok {
+		kind, ok := ParseKind(injected.Kind)
+		if !ok {
+			kind = KindNetwork
+		}
+		return NewError(kind, injected)
+	}
+	return Classify(err)
+}
+
+// Insert runs the storage.Insert faults, then the wrapped Insert
+func (f *FaultyDB) Insert(ctx context.Context, collName string, doc interface{}) (interface{}, error) {
+	if err := f.before(ctx, "Insert"); err != nil {
+		return nil, err
+	}
+	return f.db.Insert(ctx, collName, doc)
+}
+
+// Find runs the storage.Find faults, then the wrapped Find
+func (f *FaultyDB) Find(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	if err := f.before(ctx, "Find"); err != nil {
+		return err
+	}
+	return f.db.Find(ctx, collName, query, doc)
+}
+
+// FindOne runs the storage.FindOne faults, then the wrapped FindOne
+func (f *FaultyDB) FindOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	if err := f.before(ctx, "FindOne"); err != nil {
+		return err
+	}
+	return f.db.FindOne(ctx, collName, query, doc)
+}
+
+// FindCursor runs the storage.FindCursor faults, then the wrapped FindCursor
+func (f *FaultyDB) FindCursor(ctx context.Context, collName string, query map[string]interface{}) (Cursor, error) {
+	if err := f.before(ctx, "FindCursor"); err != nil {
+		return nil, err
+	}
+	return f.db.FindCursor(ctx, collName, query)
+}
+
+// Count runs the storage.Count faults, then the wrapped Count
+func (f *FaultyDB) Count(ctx context.Context, collName string, query map[string]interface{}) (int64, error) {
+	if err := f.before(ctx, "Count"); err != nil {
+		return 0, err
+	}
+	return f.db.Count(ctx, collName, query)
+}
+
+// UpdateOne runs the storage.UpdateOne faults, then the wrapped UpdateOne
+func (f *FaultyDB) UpdateOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	if err := f.before(ctx, "UpdateOne"); err != nil {
+		return nil, err
+	}
+	return f.db.UpdateOne(ctx, collName, query, doc)
+}
+
+// ReplaceOne runs the storage.ReplaceOne faults, then the wrapped ReplaceOne
+func (f *FaultyDB) ReplaceOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	if err := f.before(ctx, "ReplaceOne"); err != nil {
+		return nil, err
+	}
+	return f.db.ReplaceOne(ctx, collName, query, doc)
+}
+
+// FindOneAndUpdate runs the storage.FindOneAndUpdate faults, then the wrapped FindOneAndUpdate
+func (f *FaultyDB) FindOneAndUpdate(ctx context.Context, collName string, query map[string]interface{}, update interface{}, upsert bool, before interface{}) error {
+	if err := f.before(ctx, "FindOneAndUpdate"); err != nil {
+		return err
+	}
+	return f.db.FindOneAndUpdate(ctx, collName, query, update, upsert, before)
+}
+
+// BulkWrite runs the storage.BulkWrite faults, then the wrapped BulkWrite
+func (f *FaultyDB) BulkWrite(ctx context.Context, collName string, models []mongo.WriteModel) (*mongo.BulkWriteResult, error) {
+	if err := f.before(ctx, "BulkWrite"); err != nil {
+		return nil, err
+	}
+	return f.db.BulkWrite(ctx, collName, models)
+}
+
+// Remove runs the storage.Remove faults, then the wrapped Remove
+func (f *FaultyDB) Remove(ctx context.Context, collName string, query map[string]interface{}) error {
+	if err := f.before(ctx, "Remove"); err != nil {
+		return err
+	}
+	return f.db.Remove(ctx, collName, query)
+}
+
+// WithTransaction runs the storage.WithTransaction faults, then the wrapped WithTransaction
+func (f *FaultyDB) WithTransaction(ctx context.Context, fn func(context.Context) error) error {
+	if err := f.before(ctx, "WithTransaction"); err != nil {
+		return err
+	}
+	return f.db.WithTransaction(ctx, fn)
+}
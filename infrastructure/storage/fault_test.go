@@ -0,0 +1,44 @@
+package storage
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"testing"
+	"time"
+)
+
+func TestFaultyDB(t *testing.T) {
+	injector := fault.New()
+	db := NewFaultyDB(NewMemoryDB(), injector)
+	assert.Nil(t, db.Initialize(context.Background(), options.Credential{}, "", ""))
+	assert.Equal(t, db, GetInstance())
+	ctx := context.Background()
+
+	_, err := db.Insert(ctx, "users", bson.M{"_id": "1"})
+	assert.Nil(t, err)
+
+	injector.SetRules(map[string]fault.Rule{"storage.*": {ErrorRate: 1}, "storage.Count": {ErrorRate: 1, ErrorKind: "conflict"}})
+	_, err = db.Insert(ctx, "users", bson.M{"_id": "2"})
+	assert.Equal(t, KindNetwork, KindOf(err))
+	_, err = db.Count(ctx, "users", nil)
+	assert.Equal(t, KindConflict, KindOf(err))
+
+	injector.SetRules(map[string]fault.Rule{"storage.FindOne": {Latency: 50}})
+	timeout, cancel := context.WithTimeout(ctx, time.Millisecond)
+	defer cancel()
+	var doc bson.M
+	assert.Equal(t, KindTimeout, KindOf(db.FindOne(timeout, "users", map[string]interface{}{"_id": "1"}, &doc)))
+	assert.Nil(t, db.FindOne(ctx, "users", map[string]interface{}{"_id": "1"}, &doc))
+	assert.Equal(t, "1", doc["_id"])
+}
+
+func TestFaultErrorKinds(t *testing.T) {
+	assert.Len(t, fault.ErrorKinds, len(kindNames))
+	for _, name := range fault.ErrorKinds {
+		_, ok := ParseKind(name)
+		assert.True(t, ok, name)
+	}
+}
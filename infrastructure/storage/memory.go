@@ -0,0 +1,864 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	badValueCode      = 2
+	immutableIDCode   = 66
+	memoryIDField     = "_id"
+	memoryPathDivider = "."
+)
+
+// MemoryDB is a MongoDB kept in memory, for tests and the local standalone mode. Documents go through bson
+// like they do on the driver, so bson tags and omitempty apply. It understands the subset of the query
+// language used by the services: equality on dotted fields, $and, $or, $eq, $ne, $in, $nin, $gt, $gte, $lt,
+// $lte and $exists, and the $set, $unset, $inc and $setOnInsert update operators.
+type MemoryDB struct {
+	mu          sync.RWMutex
+	txMu        sync.Mutex
+	collections map[string]*memoryCollection
+	databases   map[string]*MemoryDB
+}
+
+// memoryCollection keeps the documents by _id and their insertion order, which is the order Find returns
+type memoryCollection struct {
+	order []interface{}
+	docs  map[interface{}]bson.M
+}
+
+// NewMemoryDB creates an empty MemoryDB
+func NewMemoryDB() *MemoryDB {
+	return &MemoryDB{collections: make(map[string]*memoryCollection)}
+}
+
+// Database returns the MemoryDB kept under the given name, created empty on first use
+func (m *MemoryDB) Database(name string) MongoDB {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.databases == nil {
+		m.databases = make(map[string]*MemoryDB)
+	}
+	db, ok := m.databases[name]
+	if !ok {
+		db = NewMemoryDB()
+		m.databases[name] = db
+	}
+	return db
+}
+
+// Initialize makes the MemoryDB the instance returned by GetInstance. The connection arguments are ignored.
+func (m *MemoryDB) Initialize(ctx context.Context, credential options.Credential, dbURI, dbName string) error {
+	GetInstance()
+	mongoInstance = m
+	return nil
+}
+
+// WithTransaction runs fn with the other transactions on hold and restores the collections if it fails.
+// Writes made outside of a transaction while fn runs are rolled back as well.
+func (m *MemoryDB) WithTransaction(ctx context.Context, fn func(context.Context) error) error {
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	m.mu.RLock()
+	snapshot := make(map[string]*memoryCollection, len(m.collections))
+	for name, coll := range m.collections {
+		snapshot[name] = coll.copy()
+	}
+	m.mu.RUnlock()
+
+	if err := fn(ctx); err != nil {
+		m.mu.Lock()
+		m.collections = snapshot
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Insert stores the document, generating an ObjectID when it has no _id
+func (m *MemoryDB) Insert(ctx context.Context, collName string, doc interface{}) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Classify(err)
+	}
+	document, err := toDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	id, err := m.collection(collName).insert(collName, document)
+	return id, Classify(err)
+}
+
+// Find decodes every document matching the query into the slice pointed by doc
+func (m *MemoryDB) Find(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	resultv := reflect.ValueOf(doc)
+	if resultv.Kind() != reflect.Ptr || resultv.Elem().Kind() != reflect.Slice {
+		return errors.New("failed to return array response")
+	}
+
+	docs, err := m.find(ctx, collName, query)
+	if err != nil {
+		return err
+	}
+
+	slicev := reflect.MakeSlice(resultv.Elem().Type(), 0, len(docs))
+	for _, document := range docs {
+		elemp := reflect.New(slicev.Type().Elem())
+		if err := fromDocument(document, elemp.Interface()); err != nil {
+			return Classify(err)
+		}
+		slicev = reflect.Append(slicev, elemp.Elem())
+	}
+	resultv.Elem().Set(slicev)
+	return nil
+}
+
+// FindOne decodes the first document matching the query, returning ErrNotFound when there is none
+func (m *MemoryDB) FindOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	docs, err := m.find(ctx, collName, query)
+	if err != nil {
+		return err
+	}
+	if len(docs) == 0 {
+		return ErrNotFound
+	}
+	return Classify(fromDocument(docs[0], doc))
+}
+
+// FindCursor returns a cursor over the documents matching the query when it is called
+func (m *MemoryDB) FindCursor(ctx context.Context, collName string, query map[string]interface{}) (Cursor, error) {
+	docs, err := m.find(ctx, collName, query)
+	if err != nil {
+		return nil, err
+	}
+	return &memoryCursor{docs: docs, position: -1}, nil
+}
+
+// Count returns the number of documents matching the query
+func (m *MemoryDB) Count(ctx context.Context, collName string, query map[string]interface{}) (int64, error) {
+	docs, err := m.find(ctx, collName, query)
+	return int64(len(docs)), err
+}
+
+// UpdateOne applies the update operators to the first document matching the query
+func (m *MemoryDB) UpdateOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Classify(err)
+	}
+	filter, update, err := toFilterAndDocument(query, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result, err := m.collection(collName).update(collName, filter, update, false)
+	return result, Classify(err)
+}
+
+// ReplaceOne replaces the first document matching the query, keeping its _id
+func (m *MemoryDB) ReplaceOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Classify(err)
+	}
+	filter, replacement, err := toFilterAndDocument(query, doc)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	result, err := m.collection(collName).replace(collName, filter, replacement, false)
+	return result, Classify(err)
+}
+
+// FindOneAndUpdate applies the update operators to the first document matching the query, decoding it as it
+// was before the update. ErrNotFound means nothing matched, and the document was inserted when upsert is set.
+func (m *MemoryDB) FindOneAndUpdate(ctx context.Context, collName string, query map[string]interface{}, update interface{}, upsert bool, before interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return Classify(err)
+	}
+	filter, document, err := toFilterAndDocument(query, update)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coll := m.collection(collName)
+
+	docs, err := coll.find(filter, true)
+	if err != nil {
+		return Classify(err)
+	}
+	var previous bson.M
+	if len(docs) > 0 {
+		previous = copyValue(docs[0]).(bson.M)
+	}
+	if _, err := coll.update(collName, filter, document, upsert); err != nil {
+		return Classify(err)
+	}
+
+	if previous == nil {
+		return ErrNotFound
+	}
+	return Classify(fromDocument(previous, before))
+}
+
+// BulkWrite runs the insert, update, replace and delete models unordered, collecting the failures in a
+// mongo.BulkWriteException like the driver does
+func (m *MemoryDB) BulkWrite(ctx context.Context, collName string, models []mongo.WriteModel) (*mongo.BulkWriteResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Classify(err)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	coll := m.collection(collName)
+
+	result := &mongo.BulkWriteResult{UpsertedIDs: make(map[int64]interface{})}
+	var exception mongo.BulkWriteException
+	for i, model := range models {
+		var updateResult *mongo.UpdateResult
+		var err error
+
+		switch model := model.(type) {
+		case *mongo.InsertOneModel:
+			var document bson.M
+			if document, err = toDocument(model.Document); err == nil {
+				if _, err = coll.insert(collName, document); err == nil {
+					result.InsertedCount++
+				}
+			}
+		case *mongo.UpdateOneModel:
+			var filter, update bson.M
+			if filter, update, err = toFilterAndDocument(model.Filter, model.Update); err == nil {
+				updateResult, err = coll.update(collName, filter, update, model.Upsert != nil && *model.Upsert)
+			}
+		case *mongo.ReplaceOneModel:
+			var filter, replacement bson.M
+			if filter, replacement, err = toFilterAndDocument(model.Filter, model.Replacement); err == nil {
+				updateResult, err = coll.replace(collName, filter, replacement, model.Upsert != nil && *model.Upsert)
+			}
+		case *mongo.DeleteOneModel:
+			var filter bson.M
+			if filter, err = toFilter(model.Filter); err == nil {
+				var deleted bool
+				if deleted, err = coll.delete(filter); deleted {
+					result.DeletedCount++
+				}
+			}
+		default:
+			err = fmt.Errorf("memory: unsupported write model %T", model)
+		}
+
+		if updateResult != nil {
+			result.MatchedCount += updateResult.MatchedCount
+			result.ModifiedCount += updateResult.ModifiedCount
+			if updateResult.UpsertedID != nil {
+				result.UpsertedCount++
+				result.UpsertedIDs[int64(i)] = updateResult.UpsertedID
+			}
+		}
+		if err != nil {
+			exception.WriteErrors = append(exception.WriteErrors, mongo.BulkWriteError{
+				WriteError: toWriteError(i, err),
+				Request:    model,
+			})
+		}
+	}
+
+	if len(exception.WriteErrors) > 0 {
+		return result, Classify(exception)
+	}
+	return result, nil
+}
+
+// Remove deletes the first document matching the query
+func (m *MemoryDB) Remove(ctx context.Context, collName string, query map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return Classify(err)
+	}
+	filter, err := toFilter(query)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, err = m.collection(collName).delete(filter)
+	return Classify(err)
+}
+
+// Disconnect keeps the documents, a MemoryDB lives as long as the process
+func (m *MemoryDB) Disconnect() {}
+
+func (m *MemoryDB) find(ctx context.Context, collName string, query map[string]interface{}) ([]bson.M, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, Classify(err)
+	}
+	filter, err := toFilter(query)
+	if err != nil {
+		return nil, err
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	coll, ok := m.collections[collName]
+	if !ok {
+		return nil, nil
+	}
+	docs, err := coll.find(filter, false)
+	return docs, Classify(err)
+}
+
+// collection returns the collection, creating it like mongo does on the first write. Callers hold mu.
+func (m *MemoryDB) collection(collName string) *memoryCollection {
+	coll, ok := m.collections[collName]
+	if !ok {
+		coll = &memoryCollection{docs: make(map[interface{}]bson.M)}
+		m.collections[collName] = coll
+	}
+	return coll
+}
+
+func (c *memoryCollection) copy() *memoryCollection {
+	copied := &memoryCollection{
+		order: append([]interface{}(nil), c.order...),
+		docs:  make(map[interface{}]bson.M, len(c.docs)),
+	}
+	for id, document := range c.docs {
+		copied.docs[id] = copyValue(document).(bson.M)
+	}
+	return copied
+}
+
+// find returns the documents matching the filter in insertion order, only the first one when first is set
+func (c *memoryCollection) find(filter bson.M, first bool) ([]bson.M, error) {
+	if id, ok := filter[memoryIDField]; ok && len(filter) == 1 && !isOperatorDocument(id) {
+		if document, ok := c.docs[id]; ok {
+			return []bson.M{document}, nil
+		}
+		return nil, nil
+	}
+
+	var docs []bson.M
+	for _, id := range c.order {
+		matched, err := matches(c.docs[id], filter)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			docs = append(docs, c.docs[id])
+			if first {
+				break
+			}
+		}
+	}
+	return docs, nil
+}
+
+func (c *memoryCollection) insert(collName string, document bson.M) (interface{}, error) {
+	id, ok := document[memoryIDField]
+	if !ok {
+		id = primitive.NewObjectID()
+		document[memoryIDField] = id
+	}
+	if _, exists := c.docs[id]; exists {
+		return nil, mongo.WriteException{WriteErrors: mongo.WriteErrors{{
+			Code:    duplicateKeyCode,
+			Message: fmt.Sprintf("E11000 duplicate key error collection: %s index: _id_ dup key: { : %v }", collName, id),
+		}}}
+	}
+
+	c.docs[id] = document
+	c.order = append(c.order, id)
+	return id, nil
+}
+
+func (c *memoryCollection) update(collName string, filter bson.M, update bson.M, upsert bool) (*mongo.UpdateResult, error) {
+	for key := range update {
+		if !strings.HasPrefix(key, "$") {
+			return nil, NewError(KindValidation, errors.New("update document must contain key beginning with '$'"))
+		}
+	}
+
+	docs, err := c.find(filter, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		if !upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		document := equalityFields(filter)
+		if err := applyUpdate(document, update, true); err != nil {
+			return nil, err
+		}
+		id, err := c.insert(collName, document)
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: id}, nil
+	}
+
+	current := docs[0]
+	updated := copyValue(current).(bson.M)
+	if err := applyUpdate(updated, update, false); err != nil {
+		return nil, err
+	}
+	if !reflect.DeepEqual(updated[memoryIDField], current[memoryIDField]) {
+		return nil, mongo.WriteError{Code: immutableIDCode, Message: "the _id field cannot be changed"}
+	}
+	if reflect.DeepEqual(updated, current) {
+		return &mongo.UpdateResult{MatchedCount: 1}, nil
+	}
+	c.docs[current[memoryIDField]] = updated
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (c *memoryCollection) replace(collName string, filter bson.M, replacement bson.M, upsert bool) (*mongo.UpdateResult, error) {
+	for key := range replacement {
+		if strings.HasPrefix(key, "$") {
+			return nil, NewError(KindValidation, errors.New("replacement document cannot contain keys beginning with '$'"))
+		}
+	}
+
+	docs, err := c.find(filter, true)
+	if err != nil {
+		return nil, err
+	}
+	if len(docs) == 0 {
+		if !upsert {
+			return &mongo.UpdateResult{}, nil
+		}
+		document := equalityFields(filter)
+		for key, value := range replacement {
+			document[key] = value
+		}
+		id, err := c.insert(collName, document)
+		if err != nil {
+			return nil, err
+		}
+		return &mongo.UpdateResult{UpsertedCount: 1, UpsertedID: id}, nil
+	}
+
+	current := docs[0]
+	if id, ok := replacement[memoryIDField]; ok && !reflect.DeepEqual(id, current[memoryIDField]) {
+		return nil, mongo.WriteError{Code: immutableIDCode, Message: "the _id field cannot be changed"}
+	}
+	replacement[memoryIDField] = current[memoryIDField]
+	if reflect.DeepEqual(replacement, current) {
+		return &mongo.UpdateResult{MatchedCount: 1}, nil
+	}
+	c.docs[current[memoryIDField]] = replacement
+	return &mongo.UpdateResult{MatchedCount: 1, ModifiedCount: 1}, nil
+}
+
+func (c *memoryCollection) delete(filter bson.M) (bool, error) {
+	docs, err := c.find(filter, true)
+	if err != nil || len(docs) == 0 {
+		return false, err
+	}
+
+	id := docs[0][memoryIDField]
+	delete(c.docs, id)
+	for i := range c.order {
+		if reflect.DeepEqual(c.order[i], id) {
+			c.order = append(c.order[:i], c.order[i+1:]...)
+			break
+		}
+	}
+	return true, nil
+}
+
+// memoryCursor iterates over the documents found when it was created
+type memoryCursor struct {
+	docs     []bson.M
+	position int
+	err      error
+}
+
+func (c *memoryCursor) Next(ctx context.Context) bool {
+	if c.err = ctx.Err(); c.err != nil {
+		return false
+	}
+	c.position++
+	return c.position < len(c.docs)
+}
+
+func (c *memoryCursor) Decode(doc interface{}) error {
+	if c.position < 0 || c.position >= len(c.docs) {
+		return errors.New("memory: cursor is not positioned on a document")
+	}
+	return fromDocument(c.docs[c.position], doc)
+}
+
+func (c *memoryCursor) Err() error {
+	return c.err
+}
+
+func (c *memoryCursor) Close(ctx context.Context) error {
+	c.docs = nil
+	return nil
+}
+
+// toDocument marshals doc through bson, so the stored document has the same shape it would have on mongo
+func toDocument(doc interface{}) (bson.M, error) {
+	if doc == nil {
+		return nil, Classify(mongo.ErrNilDocument)
+	}
+	raw, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, NewError(KindValidation, err)
+	}
+	var document bson.M
+	if err := bson.Unmarshal(raw, &document); err != nil {
+		return nil, NewError(KindValidation, err)
+	}
+	return document, nil
+}
+
+// toFilter is toDocument accepting nil as the filter matching every document
+func toFilter(filter interface{}) (bson.M, error) {
+	if filter == nil {
+		return bson.M{}, nil
+	}
+	if query, ok := filter.(map[string]interface{}); ok && query == nil {
+		return bson.M{}, nil
+	}
+	return toDocument(filter)
+}
+
+func toFilterAndDocument(filter interface{}, doc interface{}) (bson.M, bson.M, error) {
+	query, err := toFilter(filter)
+	if err != nil {
+		return nil, nil, err
+	}
+	document, err := toDocument(doc)
+	return query, document, err
+}
+
+func fromDocument(document bson.M, doc interface{}) error {
+	raw, err := bson.Marshal(document)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, doc)
+}
+
+// toWriteError reports err as the driver would in a bulk write
+func toWriteError(index int, err error) mongo.WriteError {
+	if writeException, ok := errors.Cause(err).(mongo.WriteException); ok && len(writeException.WriteErrors) > 0 {
+		writeError := writeException.WriteErrors[0]
+		writeError.Index = index
+		return writeError
+	}
+	if writeError, ok := errors.Cause(err).(mongo.WriteError); ok {
+		writeError.Index = index
+		return writeError
+	}
+	return mongo.WriteError{Index: index, Code: badValueCode, Message: err.Error()}
+}
+
+func copyValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case bson.M:
+		copied := make(bson.M, len(value))
+		for k, v := range value {
+			copied[k] = copyValue(v)
+		}
+		return copied
+	case primitive.A:
+		copied := make(primitive.A, len(value))
+		for i, v := range value {
+			copied[i] = copyValue(v)
+		}
+		return copied
+	}
+	return value
+}
+
+func isOperatorDocument(value interface{}) bool {
+	document, ok := value.(bson.M)
+	if !ok || len(document) == 0 {
+		return false
+	}
+	for key := range document {
+		if !strings.HasPrefix(key, "$") {
+			return false
+		}
+	}
+	return true
+}
+
+// equalityFields returns the fields an upsert copies from the filter
+func equalityFields(filter bson.M) bson.M {
+	document := bson.M{}
+	for key, value := range filter {
+		if strings.HasPrefix(key, "$") || isOperatorDocument(value) {
+			continue
+		}
+		setPath(document, key, copyValue(value))
+	}
+	return document
+}
+
+func lookup(document bson.M, path string) (interface{}, bool) {
+	var value interface{} = document
+	for _, field := range strings.Split(path, memoryPathDivider) {
+		embedded, ok := value.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if value, ok = embedded[field]; !ok {
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+func setPath(document bson.M, path string, value interface{}) {
+	fields := strings.Split(path, memoryPathDivider)
+	for _, field := range fields[:len(fields)-1] {
+		embedded, ok := document[field].(bson.M)
+		if !ok {
+			embedded = bson.M{}
+			document[field] = embedded
+		}
+		document = embedded
+	}
+	document[fields[len(fields)-1]] = value
+}
+
+func unsetPath(document bson.M, path string) {
+	fields := strings.Split(path, memoryPathDivider)
+	for _, field := range fields[:len(fields)-1] {
+		embedded, ok := document[field].(bson.M)
+		if !ok {
+			return
+		}
+		document = embedded
+	}
+	delete(document, fields[len(fields)-1])
+}
+
+func applyUpdate(document bson.M, update bson.M, inserting bool) error {
+	for operator, fields := range update {
+		values, ok := fields.(bson.M)
+		if !ok {
+			return NewError(KindValidation, fmt.Errorf("memory: %s expects a document", operator))
+		}
+		for path, value := range values {
+			switch operator {
+			case "$set":
+				setPath(document, path, value)
+			case "$setOnInsert":
+				if inserting {
+					setPath(document, path, value)
+				}
+			case "$unset":
+				unsetPath(document, path)
+			case "$inc":
+				current, found := lookup(document, path)
+				if !found {
+					setPath(document, path, value)
+					continue
+				}
+				sum, err := add(current, value)
+				if err != nil {
+					return err
+				}
+				setPath(document, path, sum)
+			default:
+				return NewError(KindValidation, fmt.Errorf("memory: unsupported update operator %s", operator))
+			}
+		}
+	}
+	return nil
+}
+
+func matches(document bson.M, filter bson.M) (bool, error) {
+	for key, condition := range filter {
+		var matched bool
+		var err error
+		switch key {
+		case "$and", "$or":
+			matched, err = matchesLogical(document, key, condition)
+		default:
+			value, found := lookup(document, key)
+			if isOperatorDocument(condition) {
+				matched, err = matchesOperators(value, found, condition.(bson.M))
+			} else {
+				matched = equals(value, found, condition)
+			}
+		}
+		if err != nil || !matched {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func matchesLogical(document bson.M, operator string, condition interface{}) (bool, error) {
+	filters, ok := condition.(primitive.A)
+	if !ok {
+		return false, NewError(KindValidation, fmt.Errorf("memory: %s expects an array", operator))
+	}
+	for _, f := range filters {
+		filter, ok := f.(bson.M)
+		if !ok {
+			return false, NewError(KindValidation, fmt.Errorf("memory: %s expects an array of documents", operator))
+		}
+		matched, err := matches(document, filter)
+		if err != nil {
+			return false, err
+		}
+		if operator == "$or" && matched {
+			return true, nil
+		}
+		if operator == "$and" && !matched {
+			return false, nil
+		}
+	}
+	return operator == "$and", nil
+}
+
+func matchesOperators(value interface{}, found bool, operators bson.M) (bool, error) {
+	for operator, argument := range operators {
+		var matched bool
+		switch operator {
+		case "$eq":
+			matched = equals(value, found, argument)
+		case "$ne":
+			matched = !equals(value, found, argument)
+		case "$in", "$nin":
+			values, ok := argument.(primitive.A)
+			if !ok {
+				return false, NewError(KindValidation, fmt.Errorf("memory: %s expects an array", operator))
+			}
+			for _, v := range values {
+				if equals(value, found, v) {
+					matched = true
+					break
+				}
+			}
+			if operator == "$nin" {
+				matched = !matched
+			}
+		case "$gt", "$gte", "$lt", "$lte":
+			if order, ok := compare(value, argument); found && ok {
+				switch operator {
+				case "$gt":
+					matched = order > 0
+				case "$gte":
+					matched = order >= 0
+				case "$lt":
+					matched = order < 0
+				case "$lte":
+					matched = order <= 0
+				}
+			}
+		case "$exists":
+			matched = found == (argument != false && argument != int32(0) && argument != int64(0))
+		default:
+			return false, NewError(KindValidation, fmt.Errorf("memory: unsupported query operator %s", operator))
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// equals matches like a mongo equality: a missing field equals null and an array equals any of its elements
+func equals(value interface{}, found bool, want interface{}) bool {
+	if !found {
+		return want == nil
+	}
+	if values, ok := value.(primitive.A); ok {
+		if _, wantArray := want.(primitive.A); !wantArray {
+			for _, v := range values {
+				if equals(v, true, want) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if order, ok := compare(value, want); ok {
+		return order == 0
+	}
+	return reflect.DeepEqual(value, want)
+}
+
+// compare orders numbers, strings and dates, ok is false for values of other types
+func compare(a, b interface{}) (int, bool) {
+	if x, ok := toFloat(a); ok {
+		if y, ok := toFloat(b); ok {
+			return compareFloat(x, y), true
+		}
+		return 0, false
+	}
+	switch x := a.(type) {
+	case string:
+		if y, ok := b.(string); ok {
+			return strings.Compare(x, y), true
+		}
+	case primitive.DateTime:
+		if y, ok := b.(primitive.DateTime); ok {
+			return compareFloat(float64(x), float64(y)), true
+		}
+	}
+	return 0, false
+}
+
+// add sums two numbers for $inc, keeping integers as integers
+func add(a, b interface{}) (interface{}, error) {
+	x, xok := toFloat(a)
+	y, yok := toFloat(b)
+	if !xok || !yok {
+		return nil, NewError(KindValidation, fmt.Errorf("memory: cannot apply $inc to %T", a))
+	}
+	_, xfloat := a.(float64)
+	_, yfloat := b.(float64)
+	if xfloat || yfloat {
+		return x + y, nil
+	}
+	return int64(x) + int64(y), nil
+}
+
+func compareFloat(x, y float64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+func toFloat(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int32:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
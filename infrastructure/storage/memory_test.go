@@ -0,0 +1,236 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	pkgerrors "github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo"
+	"testing"
+	"time"
+)
+
+const testCollection = "test"
+
+type testDocument struct {
+	ID        string      `bson:"_id,omitempty"`
+	Name      string      `bson:"name,omitempty"`
+	Status    string      `bson:"status,omitempty"`
+	Tags      []string    `bson:"tags,omitempty"`
+	Nested    *testNested `bson:"nested,omitempty"`
+	UpdatedAt time.Time   `bson:"updatedAt"`
+}
+
+type testNested struct {
+	Value string `bson:"value,omitempty"`
+}
+
+func newTestMemoryDB(t *testing.T, docs ...*testDocument) *MemoryDB {
+	db := NewMemoryDB()
+	for _, doc := range docs {
+		if _, err := db.Insert(context.Background(), testCollection, doc); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func TestMemoryDB_Insert_DuplicateID(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1"})
+
+	id, err := db.Insert(context.Background(), testCollection, &testDocument{ID: "1"})
+
+	assert.Nil(t, id)
+	assert.Equal(t, KindConflict, KindOf(err))
+	_, isWriteException := pkgerrors.Cause(err).(mongo.WriteException)
+	assert.True(t, isWriteException)
+}
+
+func TestMemoryDB_Insert_GeneratesID(t *testing.T) {
+	db := NewMemoryDB()
+
+	id, err := db.Insert(context.Background(), testCollection, map[string]interface{}{"name": "x"})
+
+	assert.Nil(t, err)
+	assert.NotNil(t, id)
+	count, _ := db.Count(context.Background(), testCollection, map[string]interface{}{"_id": id})
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryDB_FindOne_NoDocuments(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1"})
+
+	var doc testDocument
+	err := db.FindOne(context.Background(), testCollection, map[string]interface{}{"_id": "2"}, &doc)
+
+	assert.Equal(t, mongo.ErrNoDocuments, err)
+}
+
+func TestMemoryDB_Find_Operators(t *testing.T) {
+	now := time.Now()
+	db := newTestMemoryDB(t,
+		&testDocument{ID: "1", Status: "ACTIVE", Tags: []string{"a"}, UpdatedAt: now.Add(-time.Hour)},
+		&testDocument{ID: "2", Status: "INACTIVE", Tags: []string{"b"}, UpdatedAt: now},
+		&testDocument{ID: "3", Status: "ACTIVE", Nested: &testNested{Value: "v"}, UpdatedAt: now.Add(time.Hour)})
+
+	find := func(query map[string]interface{}) []string {
+		var docs []testDocument
+		assert.Nil(t, db.Find(context.Background(), testCollection, query, &docs))
+		ids := []string{}
+		for _, doc := range docs {
+			ids = append(ids, doc.ID)
+		}
+		return ids
+	}
+
+	assert.Equal(t, []string{"1", "2", "3"}, find(nil))
+	assert.Equal(t, []string{"1", "3"}, find(map[string]interface{}{"status": "ACTIVE"}))
+	assert.Equal(t, []string{"1", "3"}, find(map[string]interface{}{"_id": map[string]interface{}{"$in": []string{"1", "3", "4"}}}))
+	assert.Equal(t, []string{"2"}, find(map[string]interface{}{"tags": "b"}))
+	assert.Equal(t, []string{"3"}, find(map[string]interface{}{"nested.value": "v"}))
+	assert.Equal(t, []string{"1", "2"}, find(map[string]interface{}{"nested": map[string]interface{}{"$exists": false}}))
+	assert.Equal(t, []string{"2", "3"}, find(map[string]interface{}{"updatedAt": map[string]interface{}{"$gte": now}}))
+	assert.Equal(t, []string{"2"}, find(map[string]interface{}{"updatedAt": map[string]interface{}{"$gte": now, "$lt": now.Add(time.Minute)}}))
+
+	err := db.Find(context.Background(), testCollection, map[string]interface{}{"x": map[string]interface{}{"$regex": "a"}}, &[]testDocument{})
+	assert.Equal(t, KindValidation, KindOf(err))
+}
+
+func TestMemoryDB_UpdateOne_SetAndUnset(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1", Name: "name", Status: "ACTIVE"})
+
+	result, err := db.UpdateOne(context.Background(), testCollection, map[string]interface{}{"_id": "1"},
+		map[string]interface{}{"$set": map[string]interface{}{"nested.value": "v"}, "$unset": map[string]interface{}{"status": ""}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result.MatchedCount)
+	assert.Equal(t, int64(1), result.ModifiedCount)
+
+	var doc testDocument
+	assert.Nil(t, db.FindOne(context.Background(), testCollection, map[string]interface{}{"_id": "1"}, &doc))
+	assert.Equal(t, "name", doc.Name)
+	assert.Equal(t, "", doc.Status)
+	assert.Equal(t, &testNested{Value: "v"}, doc.Nested)
+
+	result, err = db.UpdateOne(context.Background(), testCollection, map[string]interface{}{"_id": "2"},
+		map[string]interface{}{"$set": map[string]interface{}{"name": "x"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), result.MatchedCount)
+}
+
+func TestMemoryDB_UpdateOne_Errors(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1"})
+
+	_, err := db.UpdateOne(context.Background(), testCollection, map[string]interface{}{"_id": "1"},
+		map[string]interface{}{"name": "x"})
+	assert.Equal(t, KindValidation, KindOf(err))
+
+	_, err = db.UpdateOne(context.Background(), testCollection, map[string]interface{}{"_id": "1"},
+		map[string]interface{}{"$set": &testDocument{ID: "2"}})
+	assert.NotNil(t, err)
+}
+
+func TestMemoryDB_Remove(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1"}, &testDocument{ID: "2"})
+
+	assert.Nil(t, db.Remove(context.Background(), testCollection, map[string]interface{}{"_id": "1"}))
+	assert.Nil(t, db.Remove(context.Background(), testCollection, map[string]interface{}{"_id": "1"}))
+
+	count, _ := db.Count(context.Background(), testCollection, nil)
+	assert.Equal(t, int64(1), count)
+}
+
+func TestMemoryDB_WithTransaction_Rollback(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1", Name: "name"})
+	failure := errors.New("failure")
+
+	err := db.WithTransaction(context.Background(), func(ctx context.Context) error {
+		_, _ = db.Insert(ctx, testCollection, &testDocument{ID: "2"})
+		_, _ = db.UpdateOne(ctx, testCollection, map[string]interface{}{"_id": "1"},
+			map[string]interface{}{"$set": map[string]interface{}{"name": "changed"}})
+		return failure
+	})
+	assert.Equal(t, failure, err)
+
+	var doc testDocument
+	assert.Nil(t, db.FindOne(context.Background(), testCollection, map[string]interface{}{"_id": "1"}, &doc))
+	assert.Equal(t, "name", doc.Name)
+	count, _ := db.Count(context.Background(), testCollection, nil)
+	assert.Equal(t, int64(1), count)
+
+	assert.Nil(t, db.WithTransaction(context.Background(), func(ctx context.Context) error {
+		_, err := db.Insert(ctx, testCollection, &testDocument{ID: "2"})
+		return err
+	}))
+	count, _ = db.Count(context.Background(), testCollection, nil)
+	assert.Equal(t, int64(2), count)
+}
+
+func TestMemoryDB_BulkWrite_UpsertAndDuplicate(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1", Name: "name"})
+
+	result, err := db.BulkWrite(context.Background(), testCollection, []mongo.WriteModel{
+		mongo.NewUpdateOneModel().SetFilter(map[string]interface{}{"_id": "1"}).
+			SetUpdate(map[string]interface{}{"$set": map[string]interface{}{"status": "ACTIVE"}}).SetUpsert(true),
+		mongo.NewInsertOneModel().SetDocument(&testDocument{ID: "1"}),
+		mongo.NewUpdateOneModel().SetFilter(map[string]interface{}{"_id": "2"}).
+			SetUpdate(map[string]interface{}{"$set": map[string]interface{}{"status": "ACTIVE"}}).SetUpsert(true),
+	})
+
+	assert.Equal(t, KindConflict, KindOf(err))
+	bulkException, ok := pkgerrors.Cause(err).(mongo.BulkWriteException)
+	if assert.True(t, ok) && assert.Len(t, bulkException.WriteErrors, 1) {
+		assert.Equal(t, 1, bulkException.WriteErrors[0].Index)
+	}
+	assert.Equal(t, int64(1), result.MatchedCount)
+	assert.Equal(t, int64(1), result.UpsertedCount)
+
+	var doc testDocument
+	assert.Nil(t, db.FindOne(context.Background(), testCollection, map[string]interface{}{"_id": "2"}, &doc))
+	assert.Equal(t, "ACTIVE", doc.Status)
+}
+
+func TestMemoryDB_FindCursor(t *testing.T) {
+	db := newTestMemoryDB(t, &testDocument{ID: "1"}, &testDocument{ID: "2"})
+
+	cursor, err := db.FindCursor(context.Background(), testCollection, nil)
+	assert.Nil(t, err)
+
+	var ids []string
+	for cursor.Next(context.Background()) {
+		var doc testDocument
+		assert.Nil(t, cursor.Decode(&doc))
+		ids = append(ids, doc.ID)
+	}
+	assert.Nil(t, cursor.Err())
+	assert.Equal(t, []string{"1", "2"}, ids)
+}
+
+func TestMemoryDB_CanceledContext(t *testing.T) {
+	db := NewMemoryDB()
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+
+	_, err := db.Insert(ctx, testCollection, &testDocument{ID: "1"})
+
+	assert.Equal(t, KindTimeout, KindOf(err))
+}
+
+func TestMemoryDB_FindOneAndUpdate_Upsert(t *testing.T) {
+	db := NewMemoryDB()
+	update := map[string]interface{}{
+		"$set": map[string]interface{}{"name": "name"},
+		"$inc": map[string]interface{}{"version": 1},
+	}
+
+	var before map[string]interface{}
+	err := db.FindOneAndUpdate(context.Background(), testCollection, map[string]interface{}{"_id": "1"}, update, true, &before)
+	assert.Equal(t, ErrNotFound, err)
+
+	err = db.FindOneAndUpdate(context.Background(), testCollection, map[string]interface{}{"_id": "1"}, update, true, &before)
+	assert.Nil(t, err)
+	assert.EqualValues(t, 1, before["version"])
+
+	var after map[string]interface{}
+	assert.Nil(t, db.FindOne(context.Background(), testCollection, map[string]interface{}{"_id": "1"}, &after))
+	assert.EqualValues(t, 2, after["version"])
+}
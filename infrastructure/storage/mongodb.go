@@ -16,12 +16,25 @@ var (
 	mongoInstance MongoDB
 )
 
+// Cursor iterates over the documents of a query without loading all of them in memory.
+// *mongo.Cursor implements it.
+type Cursor interface {
+	Next(ctx context.Context) bool
+	Decode(doc interface{}) error
+	Err() error
+	Close(ctx context.Context) error
+}
+
 type MongoDB interface {
 	Insert(ctx context.Context, collName string, doc interface{}) (interface{}, error)
 	Find(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error
 	FindOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error
+	FindCursor(ctx context.Context, collName string, query map[string]interface{}) (Cursor, error)
 	Count(ctx context.Context, collName string, query map[string]interface{}) (int64, error)
 	UpdateOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error)
+	ReplaceOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error)
+	FindOneAndUpdate(ctx context.Context, collName string, query map[string]interface{}, update interface{}, upsert bool, before interface{}) error
+	BulkWrite(ctx context.Context, collName string, models []mongo.WriteModel) (*mongo.BulkWriteResult, error)
 	Remove(ctx context.Context, collName string, query map[string]interface{}) error
 	WithTransaction(ctx context.Context, fn func(context.Context) error) error
 	Initialize(ctx context.Context, credential options.Credential, dbURI string, dbName string) error
@@ -35,11 +48,36 @@ type mongodbImpl struct {
 
 func GetInstance() MongoDB {
 	once.Do(func() {
-		mongoInstance = &mongodbImpl{}
+		mongoInstance = NewMongoDB()
 	})
 	return mongoInstance
 }
 
+// Databases is implemented by the MongoDB that reach the other databases of their connection
+type Databases interface {
+	// Database returns the database with the given name, on the same connection. It must not be disconnected.
+	Database(name string) MongoDB
+}
+
+// Expirer is implemented by the MongoDB that remove the expired documents by themselves
+type Expirer interface {
+	// Expire makes the server remove the documents of the collection once the time in field has passed
+	Expire(ctx context.Context, collName string, field string) error
+}
+
+// expire calls Expire on db when it is an Expirer, and does nothing otherwise
+func expire(ctx context.Context, db MongoDB, collName string, field string) error {
+	if expirer, ok := db.(Expirer); ok {
+		return expirer.Expire(ctx, collName, field)
+	}
+	return nil
+}
+
+// NewMongoDB returns a MongoDB apart from the package instance, to be initialized by the caller
+func NewMongoDB() MongoDB {
+	return &mongodbImpl{}
+}
+
 func (m *mongodbImpl) Initialize(ctx context.Context, credential options.Credential, dbURI, dbName string) error {
 	client, err := mongo.Connect(ctx, options.Client().ApplyURI(dbURI).SetAuth(credential))
 	if err != nil {
@@ -55,6 +93,21 @@ func (m *mongodbImpl) Initialize(ctx context.Context, credential options.Credent
 	return nil
 }
 
+// Database returns the database with the given name on the client of m
+func (m *mongodbImpl) Database(name string) MongoDB {
+	return &mongodbImpl{client: m.client, dbName: name}
+}
+
+// Expire creates a TTL index on field, which the server checks about once a minute. Creating it again does
+// nothing.
+func (m *mongodbImpl) Expire(ctx context.Context, collName string, field string) error {
+	_, err := m.client.Database(m.dbName).Collection(collName).Indexes().CreateOne(ctx, mongo.IndexModel{
+		Keys:    map[string]interface{}{field: 1},
+		Options: options.Index().SetExpireAfterSeconds(0),
+	})
+	return Classify(err)
+}
+
 func (m *mongodbImpl) WithTransaction(ctx context.Context, fn func(context.Context) error) error {
 	return m.client.UseSession(ctx, func(sessionContext mongo.SessionContext) error {
 		err := sessionContext.StartTransaction()
@@ -63,9 +116,10 @@ func (m *mongodbImpl) WithTransaction(ctx context.Context, fn func(context.Conte
 		}
 		err = fn(sessionContext)
 		if err != nil {
-			return sessionContext.AbortTransaction(sessionContext)
+			_ = sessionContext.AbortTransaction(sessionContext)
+			return err
 		}
-		return sessionContext.CommitTransaction(sessionContext)
+		return Classify(sessionContext.CommitTransaction(sessionContext))
 	})
 }
 
@@ -73,16 +127,16 @@ func (m *mongodbImpl) WithTransaction(ctx context.Context, fn func(context.Conte
 func (m *mongodbImpl) Insert(ctx context.Context, collName string, doc interface{}) (interface{}, error) {
 	insertedObject, err := m.client.Database(m.dbName).Collection(collName).InsertOne(ctx, doc)
 	if insertedObject == nil {
-		return nil, err
+		return nil, Classify(err)
 	}
-	return insertedObject.InsertedID, err
+	return insertedObject.InsertedID, Classify(err)
 }
 
 // Find finds all documents in the collection
 func (m *mongodbImpl) Find(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
 	cur, err := m.client.Database(m.dbName).Collection(collName).Find(ctx, query)
 	if err != nil {
-		return err
+		return Classify(err)
 	}
 
 	resultv := reflect.ValueOf(doc)
@@ -100,7 +154,7 @@ func (m *mongodbImpl) Find(ctx context.Context, collName string, query map[strin
 		elemp := reflect.New(elem)
 		err := cur.Decode(elemp.Interface())
 		if err != nil {
-			return err
+			return Classify(err)
 		}
 		slicev = reflect.Append(slicev, elemp.Elem())
 		slicev = slicev.Slice(0, slicev.Cap())
@@ -108,29 +162,60 @@ func (m *mongodbImpl) Find(ctx context.Context, collName string, query map[strin
 	}
 
 	resultv.Elem().Set(slicev.Slice(0, i))
-	return nil
+	return Classify(cur.Err())
+}
+
+// FindCursor returns a cursor over the documents of the query, the caller must close it
+func (m *mongodbImpl) FindCursor(ctx context.Context, collName string, query map[string]interface{}) (Cursor, error) {
+	cur, err := m.client.Database(m.dbName).Collection(collName).Find(ctx, query)
+	if err != nil {
+		return nil, Classify(err)
+	}
+	return cur, nil
 }
 
 // FindOne finds one document in mongo
 func (m *mongodbImpl) FindOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
-	return m.client.Database(m.dbName).Collection(collName).FindOne(ctx, query).Decode(doc)
+	return Classify(m.client.Database(m.dbName).Collection(collName).FindOne(ctx, query).Decode(doc))
 }
 
 // UpdateOne updates one or more documents in the collection
 func (m *mongodbImpl) UpdateOne(ctx context.Context, collName string, selector map[string]interface{}, update interface{}) (*mongo.UpdateResult, error) {
 	updateResult, err := m.client.Database(m.dbName).Collection(collName).UpdateOne(ctx, selector, update)
-	return updateResult, err
+	return updateResult, Classify(err)
+}
+
+// ReplaceOne replaces the whole document matched by the selector
+func (m *mongodbImpl) ReplaceOne(ctx context.Context, collName string, selector map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	updateResult, err := m.client.Database(m.dbName).Collection(collName).ReplaceOne(ctx, selector, doc)
+	return updateResult, Classify(err)
+}
+
+// FindOneAndUpdate atomically applies the update to the document matched by the query, decoding the document
+// as it was before the update into before. ErrNotFound means nothing matched, and the document was inserted
+// when upsert is set.
+func (m *mongodbImpl) FindOneAndUpdate(ctx context.Context, collName string, query map[string]interface{}, update interface{}, upsert bool, before interface{}) error {
+	return Classify(m.client.Database(m.dbName).Collection(collName).FindOneAndUpdate(ctx, query, update,
+		options.FindOneAndUpdate().SetUpsert(upsert).SetReturnDocument(options.Before)).Decode(before))
+}
+
+// BulkWrite runs the write models unordered, so a failing model does not stop the others
+func (m *mongodbImpl) BulkWrite(ctx context.Context, collName string, models []mongo.WriteModel) (*mongo.BulkWriteResult, error) {
+	bulkResult, err := m.client.Database(m.dbName).Collection(collName).BulkWrite(ctx, models,
+		options.BulkWrite().SetOrdered(false))
+	return bulkResult, Classify(err)
 }
 
 // Remove one or more documents in the collection
 func (m *mongodbImpl) Remove(ctx context.Context, collName string, selector map[string]interface{}) error {
 	_, err := m.client.Database(m.dbName).Collection(collName).DeleteOne(ctx, selector)
-	return err
+	return Classify(err)
 }
 
 // Count returns the number of documents of the query
 func (m *mongodbImpl) Count(ctx context.Context, collName string, query map[string]interface{}) (int64, error) {
-	return m.client.Database(m.dbName).Collection(collName).CountDocuments(ctx, query)
+	count, err := m.client.Database(m.dbName).Collection(collName).CountDocuments(ctx, query)
+	return count, Classify(err)
 }
 
 func (m *mongodbImpl) Disconnect() {
@@ -44,6 +44,13 @@ func (m *DataAccessLayerMock) Find(ctx context.Context, collName string, query m
 	return args.Error(0)
 }
 
+//FindCursor is a mock for db FindCursor
+func (m *DataAccessLayerMock) FindCursor(ctx context.Context, collName string, query map[string]interface{}) (Cursor, error) {
+	args := m.Called(ctx, collName, query)
+	cursor, _ := args.Get(0).(Cursor)
+	return cursor, args.Error(1)
+}
+
 //Count is a mock for db Count
 func (m *DataAccessLayerMock) Count(ctx context.Context, collName string, query map[string]interface{}) (int64, error) {
 	args := m.Called(ctx, collName, query)
@@ -56,6 +63,24 @@ func (m *DataAccessLayerMock) UpdateOne(ctx context.Context, collName string, se
 	return args.Get(0).(*mongo.UpdateResult), args.Error(1)
 }
 
+//FindOneAndUpdate is a mock for FindOneAndUpdate
+func (m *DataAccessLayerMock) FindOneAndUpdate(ctx context.Context, collName string, selector map[string]interface{}, update interface{}, upsert bool, before interface{}) error {
+	args := m.Called(ctx, collName, selector, update, upsert, before)
+	return args.Error(0)
+}
+
+//ReplaceOne is a mock for ReplaceOne
+func (m *DataAccessLayerMock) ReplaceOne(ctx context.Context, collName string, selector map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	args := m.Called(ctx, collName, selector, doc)
+	return args.Get(0).(*mongo.UpdateResult), args.Error(1)
+}
+
+//BulkWrite is a mock for BulkWrite
+func (m *DataAccessLayerMock) BulkWrite(ctx context.Context, collName string, models []mongo.WriteModel) (*mongo.BulkWriteResult, error) {
+	args := m.Called(ctx, collName, models)
+	return args.Get(0).(*mongo.BulkWriteResult), args.Error(1)
+}
+
 //Remove is a mock for Remove
 func (m *DataAccessLayerMock) Remove(ctx context.Context, collName string, selector map[string]interface{}) error {
 	args := m.Called(ctx, collName, selector)
@@ -0,0 +1,89 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sync"
+	"time"
+
+	// registers the postgres driver
+	_ "github.com/lib/pq"
+)
+
+var (
+	postgresOnce     sync.Once
+	postgresInstance PostgreSQL
+)
+
+// PostgreSQL is the connection of the PostgreSQL storage backend
+type PostgreSQL interface {
+	Initialize(ctx context.Context, dsn string) error
+	Migrate(ctx context.Context) error
+	DB() *sql.DB
+	Disconnect()
+}
+
+type postgresImpl struct {
+	db *sql.DB
+}
+
+// GetPostgresInstance returns the PostgreSQL connection singleton
+func GetPostgresInstance() PostgreSQL {
+	postgresOnce.Do(func() {
+		postgresInstance = &postgresImpl{}
+	})
+	return postgresInstance
+}
+
+func (p *postgresImpl) Initialize(ctx context.Context, dsn string) error {
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return err
+	}
+	if err = db.PingContext(ctx); err != nil {
+		_ = db.Close()
+		return Classify(err)
+	}
+
+	p.db = db
+	return nil
+}
+
+func (p *postgresImpl) DB() *sql.DB {
+	return p.db
+}
+
+// Migrate applies the pending schema migrations
+func (p *postgresImpl) Migrate(ctx context.Context) error {
+	return migrate(ctx, p.db, postgresMigrations)
+}
+
+func (p *postgresImpl) Disconnect() {
+	_ = p.db.Close()
+}
+
+// Row is implemented by *sql.Row and *sql.Rows
+type Row interface {
+	Scan(dest ...interface{}) error
+}
+
+// ScanDocument decodes the single JSONB column of the row into doc
+func ScanDocument(row Row, doc interface{}) error {
+	var raw []byte
+	if err := row.Scan(&raw); err != nil {
+		return Classify(err)
+	}
+	if err := json.Unmarshal(raw, doc); err != nil {
+		return NewError(KindValidation, err)
+	}
+	return nil
+}
+
+// NullTime stores zero times as NULL
+func NullTime(t time.Time) interface{} {
+	if t.IsZero() {
+		return nil
+	}
+	return t
+}
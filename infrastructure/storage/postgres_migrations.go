@@ -0,0 +1,91 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"github.com/labstack/gommon/log"
+)
+
+// postgresMigrations are applied in order, each one exactly once. Never edit a released migration, append a new one.
+var postgresMigrations = []string{
+	`CREATE TABLE users (
+		id         TEXT PRIMARY KEY,
+		client_id  TEXT NOT NULL DEFAULT '',
+		status     TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ,
+		doc        JSONB NOT NULL
+	);
+	CREATE INDEX users_client_id_idx ON users (client_id);
+	CREATE INDEX users_updated_at_idx ON users (updated_at);
+	CREATE TABLE old_users (
+		id         TEXT PRIMARY KEY,
+		client_id  TEXT NOT NULL DEFAULT '',
+		status     TEXT NOT NULL DEFAULT '',
+		updated_at TIMESTAMPTZ,
+		doc        JSONB NOT NULL
+	);
+	CREATE INDEX old_users_client_id_idx ON old_users (client_id);
+	CREATE INDEX old_users_updated_at_idx ON old_users (updated_at);`,
+	`ALTER TABLE old_users ADD COLUMN user_id TEXT;
+	UPDATE old_users SET user_id = id, doc = jsonb_build_object('_id', id, 'userId', id,
+		'archivedAt', COALESCE(doc->'updatedAt', to_jsonb(updated_at)), 'user', doc);
+	ALTER TABLE old_users ALTER COLUMN user_id SET NOT NULL;
+	CREATE INDEX old_users_user_id_idx ON old_users (user_id, updated_at);`,
+	`CREATE TABLE tombstones (
+		user_id    TEXT PRIMARY KEY,
+		removed_at TIMESTAMPTZ NOT NULL,
+		expires_at TIMESTAMPTZ NOT NULL
+	);
+	CREATE INDEX tombstones_expires_at_idx ON tombstones (expires_at);`,
+}
+
+// migrationLock is the key of the advisory lock taken by migrate, any constant shared by every replica works
+const migrationLock = 5781301
+
+// migrate records the applied versions in schema_migrations and runs every pending migration in its own transaction
+func migrate(ctx context.Context, db *sql.DB, migrations []string) error {
+	for {
+		applied, err := migrateNext(ctx, db, migrations)
+		if err != nil || !applied {
+			return err
+		}
+	}
+}
+
+// migrateNext applies the first pending migration, reporting false when there is none. The transaction takes the
+// migration lock before reading the current version, so replicas starting together wait for each other instead of
+// applying the same migration twice.
+func migrateNext(ctx context.Context, db *sql.DB, migrations []string) (bool, error) {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return false, Classify(err)
+	}
+	if _, err = tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLock); err == nil {
+		_, err = tx.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+			version    INTEGER PRIMARY KEY,
+			applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+		)`)
+	}
+	var current int
+	if err == nil {
+		err = tx.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations`).Scan(&current)
+	}
+	if err != nil || current >= len(migrations) {
+		_ = tx.Rollback()
+		return false, Classify(err)
+	}
+
+	version := current + 1
+	log.Infof("[Storage migrate] Applying migration %d", version)
+	if _, err = tx.ExecContext(ctx, migrations[version-1]); err == nil {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version) VALUES ($1)`, version)
+	}
+	if err != nil {
+		_ = tx.Rollback()
+		return false, Classify(err)
+	}
+	if err = tx.Commit(); err != nil {
+		return false, Classify(err)
+	}
+	return true, nil
+}
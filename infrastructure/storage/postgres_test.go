@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+var testMigrations = []string{"CREATE TABLE a (id TEXT)", "CREATE TABLE b (id TEXT)"}
+
+//expectVersion expects the start of a migration transaction, which locks and reads the current version
+func expectVersion(dbMock sqlmock.Sqlmock, version int) {
+	dbMock.ExpectBegin()
+	dbMock.ExpectExec(regexp.QuoteMeta("SELECT pg_advisory_xact_lock($1)")).WithArgs(migrationLock).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectQuery("SELECT COALESCE").WillReturnRows(sqlmock.NewRows([]string{"version"}).AddRow(version))
+}
+
+func TestMigrate_AppliesPending(t *testing.T) {
+	db, dbMock, _ := sqlmock.New()
+	defer db.Close()
+
+	expectVersion(dbMock, 1)
+	dbMock.ExpectExec(regexp.QuoteMeta("CREATE TABLE b (id TEXT)")).WillReturnResult(sqlmock.NewResult(0, 0))
+	dbMock.ExpectExec("INSERT INTO schema_migrations").WithArgs(2).WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectCommit()
+	expectVersion(dbMock, 2)
+	dbMock.ExpectRollback()
+
+	assert.Nil(t, migrate(context.Background(), db, testMigrations))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestMigrate_AppliedByAnotherReplica(t *testing.T) {
+	db, dbMock, _ := sqlmock.New()
+	defer db.Close()
+
+	//the version is read once the lock is held, after the replica holding it committed
+	expectVersion(dbMock, 2)
+	dbMock.ExpectRollback()
+
+	assert.Nil(t, migrate(context.Background(), db, testMigrations))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestMigrate_RollbackOnError(t *testing.T) {
+	db, dbMock, _ := sqlmock.New()
+	defer db.Close()
+
+	expectVersion(dbMock, 0)
+	dbMock.ExpectExec(regexp.QuoteMeta("CREATE TABLE a (id TEXT)")).WillReturnError(context.DeadlineExceeded)
+	dbMock.ExpectRollback()
+
+	err := migrate(context.Background(), db, testMigrations)
+
+	assert.Equal(t, KindTimeout, KindOf(err))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
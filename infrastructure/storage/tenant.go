@@ -0,0 +1,184 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"sync"
+)
+
+// TenantDB routes every operation to the storage of the ClientID carried by its context, see tenant.Router.
+// Dedicated databases are opened on the connection of the wrapped MongoDB on first use, prefixed collections
+// live in the shared database. A ClientID rejected by the policy fails with a validation error.
+type TenantDB struct {
+	db     MongoDB
+	router *tenant.Router
+
+	mu        sync.Mutex
+	databases map[string]MongoDB
+}
+
+// NewTenantDB wraps db with the routes of router
+func NewTenantDB(db MongoDB, router *tenant.Router) *TenantDB {
+	return &TenantDB{db: db, router: router, databases: make(map[string]MongoDB)}
+}
+
+// Initialize initializes the wrapped MongoDB and makes the TenantDB the instance returned by GetInstance
+func (t *TenantDB) Initialize(ctx context.Context, credential options.Credential, dbURI string, dbName string) error {
+	if err := t.db.Initialize(ctx, credential, dbURI, dbName); err != nil {
+		return err
+	}
+	GetInstance()
+	mongoInstance = t
+	return nil
+}
+
+// Disconnect disconnects the wrapped MongoDB, which the dedicated databases share
+func (t *TenantDB) Disconnect() {
+	t.db.Disconnect()
+}
+
+// route returns the storage and the collection name of the tenant of ctx
+func (t *TenantDB) route(ctx context.Context, collName string) (MongoDB, string, error) {
+	clientID := tenant.FromContext(ctx)
+	route, err := t.router.Resolve(clientID)
+	if err != nil {
+		return nil, "", NewError(KindValidation, errors.Wrapf(err, "client %q", clientID))
+	}
+	if route.Database == "" {
+		return t.db, route.Prefix + collName, nil
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	db, ok := t.databases[route.Database]
+	if !ok {
+		if db, err = openDatabase(t.db, route.Database); err != nil {
+			return nil, "", err
+		}
+		t.databases[route.Database] = db
+	}
+	return db, route.Prefix + collName, nil
+}
+
+// openDatabase returns the database with the given name on the connection of db
+func openDatabase(db MongoDB, name string) (MongoDB, error) {
+	if databases, ok := db.(Databases); ok {
+		if opened := databases.Database(name); opened != nil {
+			return opened, nil
+		}
+	}
+	return nil, fmt.Errorf("storage can not open database %s", name)
+}
+
+// Insert inserts in the storage of the tenant of ctx
+func (t *TenantDB) Insert(ctx context.Context, collName string, doc interface{}) (interface{}, error) {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return nil, err
+	}
+	return db.Insert(ctx, collName, doc)
+}
+
+// Find finds in the storage of the tenant of ctx
+func (t *TenantDB) Find(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return err
+	}
+	return db.Find(ctx, collName, query, doc)
+}
+
+// FindOne finds in the storage of the tenant of ctx
+func (t *TenantDB) FindOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return err
+	}
+	return db.FindOne(ctx, collName, query, doc)
+}
+
+// FindCursor finds in the storage of the tenant of ctx
+func (t *TenantDB) FindCursor(ctx context.Context, collName string, query map[string]interface{}) (Cursor, error) {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return nil, err
+	}
+	return db.FindCursor(ctx, collName, query)
+}
+
+// Count counts in the storage of the tenant of ctx
+func (t *TenantDB) Count(ctx context.Context, collName string, query map[string]interface{}) (int64, error) {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return 0, err
+	}
+	return db.Count(ctx, collName, query)
+}
+
+// UpdateOne updates in the storage of the tenant of ctx
+func (t *TenantDB) UpdateOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return nil, err
+	}
+	return db.UpdateOne(ctx, collName, query, doc)
+}
+
+// ReplaceOne replaces in the storage of the tenant of ctx
+func (t *TenantDB) ReplaceOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) (*mongo.UpdateResult, error) {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return nil, err
+	}
+	return db.ReplaceOne(ctx, collName, query, doc)
+}
+
+// FindOneAndUpdate updates in the storage of the tenant of ctx
+func (t *TenantDB) FindOneAndUpdate(ctx context.Context, collName string, query map[string]interface{}, update interface{}, upsert bool, before interface{}) error {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return err
+	}
+	return db.FindOneAndUpdate(ctx, collName, query, update, upsert, before)
+}
+
+// BulkWrite writes in the storage of the tenant of ctx
+func (t *TenantDB) BulkWrite(ctx context.Context, collName string, models []mongo.WriteModel) (*mongo.BulkWriteResult, error) {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return nil, err
+	}
+	return db.BulkWrite(ctx, collName, models)
+}
+
+// Remove removes from the storage of the tenant of ctx
+func (t *TenantDB) Remove(ctx context.Context, collName string, query map[string]interface{}) error {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return err
+	}
+	return db.Remove(ctx, collName, query)
+}
+
+// Expire expires the collection in the storage of the tenant of ctx
+func (t *TenantDB) Expire(ctx context.Context, collName string, field string) error {
+	db, collName, err := t.route(ctx, collName)
+	if err != nil {
+		return err
+	}
+	return expire(ctx, db, collName, field)
+}
+
+// WithTransaction runs fn in a transaction of the storage of the tenant of ctx. The operations of fn must stay
+// on that tenant.
+func (t *TenantDB) WithTransaction(ctx context.Context, fn func(context.Context) error) error {
+	db, _, err := t.route(ctx, "")
+	if err != nil {
+		return err
+	}
+	return db.WithTransaction(ctx, fn)
+}
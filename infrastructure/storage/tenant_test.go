@@ -0,0 +1,56 @@
+package storage
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"testing"
+)
+
+func TestTenantDB(t *testing.T) {
+	shared := NewMemoryDB()
+	router := tenant.NewRouter(map[string]tenant.Route{
+		"acme":   {Database: "users_acme"},
+		"globex": {Prefix: "globex_"},
+	}, config.TenantShared)
+	db := NewTenantDB(shared, router)
+	ctx := context.Background()
+
+	//initech has no route and shares the database with the users without a ClientID
+	for clientID, id := range map[string]string{"acme": "1", "globex": "1", "initech": "1", "": "2"} {
+		_, err := db.Insert(tenant.NewContext(ctx, clientID), "users", bson.M{"_id": id, "clientId": clientID})
+		assert.Nil(t, err)
+	}
+
+	var users []bson.M
+	assert.Nil(t, shared.Find(ctx, "users", map[string]interface{}{}, &users))
+	assert.Len(t, users, 2)
+	assert.Nil(t, shared.Find(ctx, "globex_users", map[string]interface{}{}, &users))
+	assert.Len(t, users, 1)
+	assert.Nil(t, shared.Database("users_acme").Find(ctx, "users", map[string]interface{}{}, &users))
+	assert.Len(t, users, 1)
+	assert.Equal(t, "acme", users[0]["clientId"])
+
+	var user bson.M
+	assert.Nil(t, db.FindOne(tenant.NewContext(ctx, "acme"), "users", map[string]interface{}{"_id": "1"}, &user))
+	assert.Equal(t, "acme", user["clientId"])
+	assert.Nil(t, db.Remove(tenant.NewContext(ctx, "acme"), "users", map[string]interface{}{"_id": "1"}))
+	assert.True(t, IsNotFound(db.FindOne(tenant.NewContext(ctx, "acme"), "users", map[string]interface{}{"_id": "1"}, &user)))
+	assert.Nil(t, db.FindOne(ctx, "users", map[string]interface{}{"_id": "1"}, &user))
+	assert.Equal(t, "initech", user["clientId"])
+}
+
+func TestTenantDB_Reject(t *testing.T) {
+	router := tenant.NewRouter(map[string]tenant.Route{"acme": {Prefix: "acme_"}}, config.TenantReject)
+	db := NewTenantDB(NewMemoryDB(), router)
+
+	_, err := db.Insert(tenant.NewContext(context.Background(), "initech"), "users", bson.M{"_id": "1"})
+
+	assert.Equal(t, KindValidation, KindOf(err))
+	assert.Contains(t, err.Error(), `client "initech": unknown tenant`)
+	assert.Equal(t, KindValidation, KindOf(db.WithTransaction(context.Background(), func(context.Context) error {
+		return nil
+	})))
+}
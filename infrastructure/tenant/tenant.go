@@ -0,0 +1,154 @@
+package tenant
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"sort"
+	"strings"
+	"sync"
+)
+
+var (
+	instance *Router
+	once     sync.Once
+
+	//ErrUnknown is returned for a ClientID without a route when the policy is config.TenantReject
+	ErrUnknown = errors.New("unknown tenant")
+)
+
+//Route is where the users of a tenant are stored: a dedicated database, or the collections of the shared
+//database with a prefix. The zero Route is the shared database.
+type Route struct {
+	Database string `json:"database,omitempty"`
+	Prefix   string `json:"prefix,omitempty"`
+}
+
+//Router resolves the route of a ClientID
+type Router struct {
+	mu     sync.RWMutex
+	routes map[string]Route
+	policy string
+}
+
+//GetInstance returns the router shared by the storage and the services, without routes until configured
+func GetInstance() *Router {
+	once.Do(func() {
+		instance = NewRouter(nil, config.TenantShared)
+	})
+	return instance
+}
+
+//NewRouter returns a router with the routes by ClientID and the policy for the other ClientIDs
+func NewRouter(routes map[string]Route, policy string) *Router {
+	r := &Router{}
+	_ = r.Configure(routes, policy)
+	return r
+}
+
+//ParseRoutes reads the routes from JSON, an object of routes by ClientID. An empty spec has no routes.
+func ParseRoutes(spec string) (map[string]Route, error) {
+	routes := make(map[string]Route)
+	if strings.TrimSpace(spec) == "" {
+		return routes, nil
+	}
+	if err := json.Unmarshal([]byte(spec), &routes); err != nil {
+		return nil, err
+	}
+	for clientID, route := range routes {
+		if clientID == "" {
+			return nil, errors.New("tenant route: ClientID must not be empty")
+		}
+		if (route.Database == "") == (route.Prefix == "") {
+			return nil, fmt.Errorf("tenant route %s: set either database or prefix", clientID)
+		}
+	}
+	return routes, nil
+}
+
+//Configure replaces the routes and the policy, config.TenantShared when empty
+func (r *Router) Configure(routes map[string]Route, policy string) error {
+	if policy == "" {
+		policy = config.TenantShared
+	}
+	if policy != config.TenantShared && policy != config.TenantReject {
+		return fmt.Errorf("unknown tenant policy: %s", policy)
+	}
+	copied := make(map[string]Route, len(routes))
+	for clientID, route := range routes {
+		copied[clientID] = route
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.routes, r.policy = copied, policy
+	return nil
+}
+
+//Enabled tells if any ClientID is routed apart from the shared database
+func (r *Router) Enabled() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.routes) > 0 || r.policy == config.TenantReject
+}
+
+//ClientIDs returns the ClientIDs that have a route, sorted
+func (r *Router) ClientIDs() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clientIDs := make([]string, 0, len(r.routes))
+	for clientID := range r.routes {
+		clientIDs = append(clientIDs, clientID)
+	}
+	sort.Strings(clientIDs)
+	return clientIDs
+}
+
+//Resolve returns the route of the ClientID. A ClientID without a route, the empty one included, gets the
+//shared database or ErrUnknown depending on the policy.
+func (r *Router) Resolve(clientID string) (Route, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if route, ok := r.routes[clientID]; ok {
+		return route, nil
+	}
+	if r.policy == config.TenantReject {
+		return Route{}, ErrUnknown
+	}
+	return Route{}, nil
+}
+
+//Scope returns the ClientID when it has a route of its own and empty when it shares the database, so users of
+//the same scope are stored together
+func (r *Router) Scope(clientID string) string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if _, ok := r.routes[clientID]; ok {
+		return clientID
+	}
+	return ""
+}
+
+type contextKey struct{}
+
+//NewContext returns ctx carrying the ClientID whose storage the operations run on
+func NewContext(ctx context.Context, clientID string) context.Context {
+	return context.WithValue(ctx, contextKey{}, clientID)
+}
+
+//FromContext returns the ClientID carried by ctx, empty when there is none
+func FromContext(ctx context.Context) string {
+	clientID, _ := ctx.Value(contextKey{}).(string)
+	return clientID
+}
+
+//WithClientID returns ctx carrying the ClientID, or ctx itself when clientID is empty so the one of the caller
+//is kept
+func WithClientID(ctx context.Context, clientID string) context.Context {
+	if clientID == "" {
+		return ctx
+	}
+	return NewContext(ctx, clientID)
+}
@@ -0,0 +1,73 @@
+package tenant
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseRoutes(t *testing.T) {
+	routes, err := ParseRoutes(`{"acme":{"database":"users_acme"},"globex":{"prefix":"globex_"}}`)
+
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]Route{"acme": {Database: "users_acme"}, "globex": {Prefix: "globex_"}}, routes)
+
+	routes, err = ParseRoutes(" ")
+	assert.Nil(t, err)
+	assert.Empty(t, routes)
+}
+
+func TestParseRoutes_Invalid(t *testing.T) {
+	for _, spec := range []string{
+		`{"acme":{}}`,
+		`{"acme":{"database":"users_acme","prefix":"acme_"}}`,
+		`{"":{"prefix":"shared_"}}`,
+		`["acme"]`,
+	} {
+		_, err := ParseRoutes(spec)
+		assert.NotNil(t, err, spec)
+	}
+}
+
+func TestRouter_Resolve(t *testing.T) {
+	routes := map[string]Route{"acme": {Database: "users_acme"}}
+	shared := NewRouter(routes, "")
+	reject := NewRouter(routes, config.TenantReject)
+
+	for _, r := range []*Router{shared, reject} {
+		route, err := r.Resolve("acme")
+		assert.Nil(t, err)
+		assert.Equal(t, Route{Database: "users_acme"}, route)
+		assert.True(t, r.Enabled())
+		assert.Equal(t, "acme", r.Scope("acme"))
+		assert.Equal(t, "", r.Scope("globex"))
+	}
+
+	route, err := shared.Resolve("globex")
+	assert.Nil(t, err)
+	assert.Equal(t, Route{}, route)
+	_, err = reject.Resolve("globex")
+	assert.Equal(t, ErrUnknown, err)
+	_, err = reject.Resolve("")
+	assert.Equal(t, ErrUnknown, err)
+}
+
+func TestRouter_Configure(t *testing.T) {
+	r := NewRouter(nil, "")
+	assert.False(t, r.Enabled())
+
+	assert.NotNil(t, r.Configure(nil, "drop"))
+	assert.Nil(t, r.Configure(nil, config.TenantReject))
+	assert.True(t, r.Enabled())
+}
+
+func TestContext(t *testing.T) {
+	ctx := context.Background()
+	assert.Equal(t, "", FromContext(ctx))
+
+	ctx = NewContext(ctx, "acme")
+	assert.Equal(t, "acme", FromContext(ctx))
+	assert.Equal(t, "acme", FromContext(WithClientID(ctx, "")))
+	assert.Equal(t, "globex", FromContext(WithClientID(ctx, "globex")))
+}
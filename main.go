@@ -2,10 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
+	"github.com/coaraujo/users-go-processor/commands"
+	"github.com/coaraujo/users-go-processor/handlers"
 	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/fault"
 	"github.com/coaraujo/users-go-processor/infrastructure/queue"
 	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
 	"github.com/coaraujo/users-go-processor/processor"
+	"github.com/coaraujo/users-go-processor/services/cep"
+	"github.com/coaraujo/users-go-processor/services/olduser"
+	"github.com/coaraujo/users-go-processor/services/tombstone"
+	userService "github.com/coaraujo/users-go-processor/services/user"
 	"github.com/labstack/echo"
 	"github.com/labstack/echo/middleware"
 	"github.com/labstack/gommon/log"
@@ -13,23 +22,148 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 )
 
+//subcommands run a one-off job against the storage instead of the processor
+var subcommands = map[string]func(args []string) error{
+	"import":          commands.Import,
+	"export":          commands.Export,
+	"reconcile":       commands.Reconcile,
+	"migrate-removal": commands.MigrateRemoval,
+}
+
+//brokerSubcommands run a one-off job against the broker, the storage is not connected
+var brokerSubcommands = map[string]func(broker queue.Broker, args []string) error{
+	"loadgen": commands.LoadGen,
+}
+
 func main() {
+	rules, err := fault.ParseRules(config.FaultInjection)
+	if err != nil {
+		log.Fatalf("[Go-Processor] Invalid FAULT_INJECTION: %s", err)
+	}
+	fault.GetInstance().SetRules(rules)
+	routes, err := tenant.ParseRoutes(config.Tenants)
+	if err != nil {
+		log.Fatalf("[Go-Processor] Invalid TENANTS: %s", err)
+	}
+	if err := tenant.GetInstance().Configure(routes, config.TenantPolicy); err != nil {
+		log.Fatalf("[Go-Processor] Invalid TENANT_POLICY: %s", err)
+	}
+
+	if len(os.Args) > 1 {
+		runSubcommand(os.Args[1], os.Args[2:])
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	services, err := initializeStorage(ctx)
+	if err != nil {
+		log.Fatalf("[Go-Processor] Could not resolve Data access layer: %s", err)
+	}
+	defer disconnectStorage()
+
+	users := userService.NewCached(services.users)
+	options := processor.Options{
+		Broker:   newBroker(),
+		Users:    users,
+		OldUsers: services.oldUsers,
+	}
+	if config.TombstoneTTL > 0 {
+		options.Tombstones = services.tombstones
+		purgeCtx, stopPurge := context.WithCancel(context.Background())
+		defer stopPurge()
+		expireTombstones(ctx, purgeCtx, services.tombstones)
+	}
+	if config.CEPAPIURL != "" {
+		options.CEP = cep.New(config.CEPAPIURL, config.CEPCacheSize, config.CEPCacheTTL, config.CEPTimeout)
+	}
+	p := processor.New(options)
+	if err := p.Start(ctx); err != nil {
+		log.Fatalf("[Go-Processor] Fail to connect with the broker. Error: %s ", err)
+	}
+
 	e := echo.New()
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
 		AllowOrigins: []string{"*"},
 		AllowHeaders: []string{echo.HeaderOrigin, echo.HeaderContentType, echo.HeaderAccept},
 	}))
+	loadHealthcheck(e)
+	handlers.RegisterEvents(e, p)
+	handlers.RegisterCache(e, users)
+	handlers.RegisterSchemas(e)
+	if config.FaultAdmin {
+		handlers.RegisterFaults(e)
+	}
+	setupServer(e, p)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
+//newBroker returns the broker selected by config.Broker, the ActiveMQ package instance by default. It is handed
+//to its users explicitly, the package instance is left as it is.
+func newBroker() queue.Broker {
+	var broker queue.Broker
+	switch config.Broker {
+	case "memory":
+		log.Infof("[Go-Processor] Using in-memory broker")
+		broker = queue.NewMemoryBroker()
+	case "kafka":
+		log.Infof("[Go-Processor] Using Kafka broker. Brokers: %s Group: %s", config.KafkaBrokers, config.KafkaGroupID)
+		broker = queue.NewKafkaBroker(strings.Split(config.KafkaBrokers, ","), config.KafkaGroupID)
+	default:
+		broker = queue.GetInstance()
+	}
+	if faultsEnabled() {
+		log.Infof("[Go-Processor] Injecting faults in the broker")
+		broker = queue.NewFaultyBroker(broker, fault.GetInstance())
+	}
+	return broker
+}
+
+//faultsEnabled tells if the storage and the broker are wrapped with the fault injection
+func faultsEnabled() bool {
+	return config.FaultInjection != "" || config.FaultAdmin
+}
 
-	if err := queue.GetInstance().NewConnection(); err != nil {
-		log.Errorf("[Go-Processor] Fail to connect with ActiveMQ. Error: %s ", err)
+//storageServices are the services built over the storage selected by config.StorageBackend
+type storageServices struct {
+	users      userService.Users
+	oldUsers   olduser.OldUsers
+	tombstones tombstone.Tombstones
+}
+
+//initializeStorage connects the storage selected by config.StorageBackend and returns the services built over it.
+//The storage is the package instance as well, which the subcommands use.
+func initializeStorage(ctx context.Context) (*storageServices, error) {
+	switch config.StorageBackend {
+	case config.StoragePostgres:
+		log.Infof("[Go-Processor] Using PostgreSQL storage")
+		if tenant.GetInstance().Enabled() {
+			return nil, errors.New("tenant routing is only supported by the MongoDB storage")
+		}
+		db := storage.GetPostgresInstance()
+		if err := db.Initialize(ctx, config.PostgresDSN); err != nil {
+			return nil, err
+		}
+		if err := db.Migrate(ctx); err != nil {
+			return nil, err
+		}
+		return &storageServices{
+			users:      userService.NewPostgres(db.DB()),
+			oldUsers:   olduser.NewPostgres(db.DB()),
+			tombstones: tombstone.NewPostgres(db.DB()),
+		}, nil
+	case config.StorageMemory:
+		log.Infof("[Go-Processor] Using in-memory storage, nothing is persisted")
+		db := withTenants(withFaults(storage.NewMemoryDB()))
+		if err := db.Initialize(ctx, options.Credential{}, "", ""); err != nil {
+			return nil, err
+		}
+		return newStorageServices(db), nil
 	}
-	defer queue.GetInstance().Disconnect()
 
 	credential := options.Credential{
 		Username:      config.MongodbUser,
@@ -38,20 +172,101 @@ func main() {
 		AuthSource:    config.MongodbDatabase,
 		AuthMechanism: config.MongodbAuth,
 	}
-	if err := storage.GetInstance().Initialize(ctx, credential, "mongodb://"+config.MongodbHost+":"+config.MongodbPort,
+	db := withTenants(withFaults(storage.GetInstance()))
+	if err := db.Initialize(ctx, credential, "mongodb://"+config.MongodbHost+":"+config.MongodbPort,
 		config.MongodbDatabase); err != nil {
-		e.Logger.Fatal("[Go-Processor] Could not resolve Data access layer: ", err)
+		return nil, err
 	}
+	return newStorageServices(db), nil
+}
 
-	go queue.GetInstance().Listen(config.UserCreateTopic)
-	go queue.GetInstance().Listen(config.UserRemovedTopic)
-	go processor.GetInstance().Process()
+//expireTombstones has the storage remove the expired tombstones: MongoDB by itself, once the TTL indexes are created
+//under ctx, and PostgreSQL by deleting them every config.TombstonePurgeInterval until purgeCtx is done
+func expireTombstones(ctx context.Context, purgeCtx context.Context, tombstones tombstone.Tombstones) {
+	if expirer, ok := tombstones.(tombstone.Expirer); ok {
+		if err := expirer.Expire(ctx); err != nil {
+			log.Errorf("[Go-Processor] Could not create the tombstones TTL index, expired tombstones are kept. Error: %s", err)
+		}
+	}
+	purger, ok := tombstones.(tombstone.Purger)
+	if !ok {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(config.TombstonePurgeInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-purgeCtx.Done():
+				return
+			case <-ticker.C:
+			}
+			purged, err := purger.Purge(purgeCtx)
+			if err != nil {
+				log.Errorf("[Go-Processor] Could not purge the expired tombstones. Error: %s", err)
+				continue
+			}
+			log.Infof("[Go-Processor] Purged %d expired tombstones", purged)
+		}
+	}()
+}
 
-	loadHealthcheck(e)
-	setupServer(e)
+func newStorageServices(db storage.MongoDB) *storageServices {
+	return &storageServices{users: userService.New(db), oldUsers: olduser.New(db), tombstones: tombstone.New(db)}
+}
+
+//withFaults wraps db with the fault injection when it is enabled, the PostgreSQL storage is never wrapped
+func withFaults(db storage.MongoDB) storage.MongoDB {
+	if !faultsEnabled() {
+		return db
+	}
+	log.Infof("[Go-Processor] Injecting faults in the storage")
+	return storage.NewFaultyDB(db, fault.GetInstance())
+}
+
+//withTenants routes db by ClientID when tenants are configured
+func withTenants(db storage.MongoDB) storage.MongoDB {
+	if !tenant.GetInstance().Enabled() {
+		return db
+	}
+	log.Infof("[Go-Processor] Routing the storage by tenant")
+	return storage.NewTenantDB(db, tenant.GetInstance())
 }
 
-func setupServer(e *echo.Echo) {
+func disconnectStorage() {
+	if config.StorageBackend == config.StoragePostgres {
+		storage.GetPostgresInstance().Disconnect()
+		return
+	}
+	storage.GetInstance().Disconnect()
+}
+
+func runSubcommand(name string, args []string) {
+	if subcommand, ok := brokerSubcommands[name]; ok {
+		if err := subcommand(newBroker(), args); err != nil {
+			log.Fatalf("[Go-Processor] %s failed: %s", name, err)
+		}
+		return
+	}
+
+	subcommand, ok := subcommands[name]
+	if !ok {
+		log.Fatalf("[Go-Processor] Unknown subcommand: %s", name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := initializeStorage(ctx); err != nil {
+		log.Fatalf("[Go-Processor] Could not resolve Data access layer: %s", err)
+	}
+	defer disconnectStorage()
+
+	if err := subcommand(args); err != nil {
+		log.Fatalf("[Go-Processor] %s failed: %s", name, err)
+	}
+}
+
+func setupServer(e *echo.Echo, p processor.Processor) {
 	go func() {
 		port := os.Getenv("PORT")
 		if port == "" {
@@ -62,7 +277,7 @@ func setupServer(e *echo.Echo) {
 		}
 	}()
 
-	quit := make(chan os.Signal)
+	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, os.Interrupt)
 	<-quit
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -70,7 +285,9 @@ func setupServer(e *echo.Echo) {
 	if err := e.Shutdown(ctx); err != nil {
 		e.Logger.Fatal(err)
 	}
-	queue.GetInstance().Disconnect()
+	if err := p.Stop(ctx); err != nil {
+		e.Logger.Error(err)
+	}
 }
 
 func loadHealthcheck(e *echo.Echo) {
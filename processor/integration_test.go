@@ -0,0 +1,365 @@
+package processor
+
+import (
+	"context"
+	"errors"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/queue"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"github.com/go-stomp/stomp/server"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+//failingUsers fails the upserts of the users in failures as many times as given, forever when negative. The
+//upsert of a blocked user waits for its ctx to be done.
+type failingUsers struct {
+	userService.Users
+	mu       sync.Mutex
+	failures map[string]int
+	blocked  map[string]chan struct{}
+}
+
+//block makes the next upsert of the user wait for its ctx, the returned channel is closed once it started
+func (u *failingUsers) block(id string) <-chan struct{} {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	started := make(chan struct{})
+	u.blocked[id] = started
+	return started
+}
+
+func (u *failingUsers) Upsert(ctx context.Context, user *domains.User) (bool, error) {
+	u.mu.Lock()
+	failures := u.failures[user.ID]
+	if failures != 0 {
+		u.failures[user.ID] = failures - 1
+	}
+	started, blocked := u.blocked[user.ID]
+	delete(u.blocked, user.ID)
+	u.mu.Unlock()
+
+	if blocked {
+		close(started)
+		<-ctx.Done()
+		return false, storage.Classify(ctx.Err())
+	}
+	if failures != 0 {
+		return false, storage.NewError(storage.KindNetwork, errors.New("connection reset by peer"))
+	}
+	return u.Users.Upsert(ctx, user)
+}
+
+//settlingBroker records how the processor settles the messages
+type settlingBroker struct {
+	queue.Broker
+	mu      sync.Mutex
+	settled []string
+}
+
+func (b *settlingBroker) record(action string, message *queue.Message) {
+	if message.Header[probeHeader] != "" {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.settled = append(b.settled, action+" "+string(message.Body))
+}
+
+func (b *settlingBroker) AckMessage(message *queue.Message) {
+	b.record("ack", message)
+	b.Broker.AckMessage(message)
+}
+
+func (b *settlingBroker) RedeliveryMessage(message *queue.Message) {
+	b.record("redeliver", message)
+	b.Broker.RedeliveryMessage(message)
+}
+
+func (b *settlingBroker) DeadLetterMessage(message *queue.Message, reason error) {
+	b.record("dead-letter", message)
+	b.Broker.DeadLetterMessage(message, reason)
+}
+
+func (b *settlingBroker) settlements() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.settled...)
+}
+
+//integration runs the processor and its STOMP broker against an in-process STOMP server, over a MemoryDB.
+//The server treats destinations without the /queue prefix as topics: messages published before a subscription
+//are dropped and nacked messages are not sent again, so the subscriptions are probed before the tests publish.
+type integration struct {
+	p        *processorImpl
+	users    *failingUsers
+	broker   *settlingBroker
+	client   queue.Broker
+	listener net.Listener
+
+	mu       sync.Mutex
+	attempts map[string][]string
+	probed   map[string]bool
+}
+
+//probeHeader marks the messages that only check a subscription, they are acked without being processed
+const probeHeader = "probe"
+
+//startIntegration starts the processor and its server, which the test stops with a deferred stop
+func startIntegration(t *testing.T, failures map[string]int) *integration {
+	if testing.Short() {
+		t.Skip("integration test")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() { _ = server.Serve(listener) }()
+
+	db := storage.NewMemoryDB()
+	it := &integration{
+		users:    &failingUsers{Users: userService.New(db), failures: failures, blocked: make(map[string]chan struct{})},
+		broker:   &settlingBroker{Broker: queue.NewStompBroker("tcp", listener.Addr().String(), "", "")},
+		client:   queue.NewStompBroker("tcp", listener.Addr().String(), "", ""),
+		listener: listener,
+		attempts: make(map[string][]string),
+		probed:   make(map[string]bool),
+	}
+	if err := it.client.NewConnection(); err != nil {
+		t.Fatal(err)
+	}
+	it.p = newProcessor(Options{
+		Broker:  it.broker,
+		Storage: db,
+		Users:   it.users,
+	})
+	//every delivery is recorded with its attempts header before the real handler runs
+	for topic, handler := range it.p.handlers {
+		topic, handler := topic, handler
+		it.p.handlers[topic] = func(ctx context.Context, msg *queue.Message) {
+			it.mu.Lock()
+			if msg.Header[probeHeader] != "" {
+				it.probed[topic] = true
+				it.mu.Unlock()
+				it.p.broker.AckMessage(msg)
+				return
+			}
+			it.attempts[topic] = append(it.attempts[topic], msg.Header["attempts"])
+			it.mu.Unlock()
+			handler(ctx, msg)
+		}
+	}
+	if err := it.p.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for topic := range it.p.handlers {
+		topic := topic
+		eventually(t, func() bool {
+			it.mu.Lock()
+			defer it.mu.Unlock()
+			if !it.probed[topic] {
+				_ = it.client.Publish(probe(topic))
+			}
+			return it.probed[topic]
+		}, "processor did not subscribe to "+topic)
+	}
+
+	return it
+}
+
+func (it *integration) stop(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, it.p.Stop(ctx))
+	it.client.Disconnect()
+	_ = it.listener.Close()
+}
+
+func (it *integration) publish(t *testing.T, topic string, body string) {
+	if err := it.client.Publish(queue.NewMessage(topic, "application/json", []byte(body))); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//listen subscribes the client to the topic, returning once the subscription receives messages
+func (it *integration) listen(t *testing.T, topic string) {
+	go it.client.Listen(topic)
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		_ = it.client.Publish(probe(topic))
+		select {
+		case msg := <-it.client.Notifier(topic):
+			it.client.AckMessage(msg)
+			return
+		case <-time.After(20 * time.Millisecond):
+		}
+	}
+	t.Fatal("client did not subscribe to " + topic)
+}
+
+//next returns the next message of a topic the client listens to, skipping the probes
+func (it *integration) next(t *testing.T, topic string) *queue.Message {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case msg := <-it.client.Notifier(topic):
+			it.client.AckMessage(msg)
+			if msg.Header[probeHeader] == "" {
+				return msg
+			}
+		case <-timeout:
+			t.Fatal("no message received on " + topic)
+		}
+	}
+}
+
+func probe(topic string) *queue.Message {
+	msg := queue.NewMessage(topic, "application/json", nil)
+	msg.Header[probeHeader] = "true"
+	return msg
+}
+
+//settled waits for the deliveries of the topic to reach count, and for the redeliveries that could follow
+func (it *integration) settled(t *testing.T, topic string, count int) []string {
+	eventually(t, func() bool { return len(it.deliveries(topic)) >= count }, "messages were not delivered")
+	time.Sleep(10 * time.Duration(config.RedeliveryDelay) * time.Millisecond)
+	return it.deliveries(topic)
+}
+
+func (it *integration) deliveries(topic string) []string {
+	it.mu.Lock()
+	defer it.mu.Unlock()
+	return append([]string(nil), it.attempts[topic]...)
+}
+
+//eventually polls condition until it holds, failing the test after 5 seconds
+func eventually(t *testing.T, condition func() bool, message string) {
+	for deadline := time.Now().Add(5 * time.Second); !condition(); {
+		if time.Now().After(deadline) {
+			t.Fatal(message)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+//withRedelivery sets the maximum redeliveries with a short delay, returning the restore of the previous ones
+func withRedelivery(maximum int) func() {
+	maximumRedeliveries, redeliveryDelay := config.MaximumRedeliveries, config.RedeliveryDelay
+	config.MaximumRedeliveries, config.RedeliveryDelay = maximum, 10
+	return func() {
+		config.MaximumRedeliveries, config.RedeliveryDelay = maximumRedeliveries, redeliveryDelay
+	}
+}
+
+func TestIntegration_CreateUpdateRemove(t *testing.T) {
+	it := startIntegration(t, nil)
+	defer it.stop(t)
+	ctx := context.Background()
+
+	it.publish(t, config.UserCreateTopic, `{ "_id":"1", "fullName":"first", "status":"active", "updatedAt":"2019-08-15T18:00:00Z" }`)
+	eventually(t, func() bool {
+		_, err := it.p.users.Get(ctx, "1")
+		return err == nil
+	}, "user was not created")
+
+	it.publish(t, config.UserCreateTopic, `{ "_id":"1", "fullName":"second", "updatedAt":"2019-08-15T19:00:00Z" }`)
+	eventually(t, func() bool {
+		stored, err := it.p.users.Get(ctx, "1")
+		return err == nil && stored.Name == "second"
+	}, "user was not updated")
+	stored, _ := it.p.users.Get(ctx, "1")
+	assert.Equal(t, domains.StatusActive, stored.Status)
+	assert.Equal(t, int64(2), stored.Version)
+
+	it.publish(t, config.UserRemovedTopic, `{ "_id":"1", "updatedAt":"2019-08-15T20:00:00Z" }`)
+	eventually(t, func() bool {
+		_, err := it.p.users.Get(ctx, "1")
+		return storage.IsNotFound(err)
+	}, "user was not removed")
+	archived, err := it.p.oldUsers.Latest(ctx, "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "second", archived.User.Name)
+	assert.Equal(t, domains.ArchiveRemoved, archived.Reason)
+
+	assert.Equal(t, []string{"", ""}, it.deliveries(config.UserCreateTopic))
+	assert.Equal(t, []string{""}, it.deliveries(config.UserRemovedTopic))
+}
+
+func TestIntegration_Retries(t *testing.T) {
+	defer withRedelivery(3)()
+	it := startIntegration(t, map[string]int{"2": 2})
+	defer it.stop(t)
+
+	it.publish(t, config.UserCreateTopic, `{ "_id":"2" }`)
+	eventually(t, func() bool {
+		_, err := it.p.users.Get(context.Background(), "2")
+		return err == nil
+	}, "user was not created after the retries")
+
+	//the failed deliveries are acked and resent with the next attempt
+	assert.Equal(t, []string{"", "1", "2"}, it.deliveries(config.UserCreateTopic))
+}
+
+func TestIntegration_MaxRedeliveries(t *testing.T) {
+	defer withRedelivery(2)()
+	it := startIntegration(t, map[string]int{"3": -1})
+	defer it.stop(t)
+
+	it.publish(t, config.UserCreateTopic, `{ "_id":"3" }`)
+
+	//past the last attempt the message is nacked instead of resent
+	assert.Equal(t, []string{"", "1", "2"}, it.settled(t, config.UserCreateTopic, 3))
+	_, err := it.p.users.Get(context.Background(), "3")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestIntegration_RemoveUnknownUser_Redelivered(t *testing.T) {
+	defer withRedelivery(1)()
+	it := startIntegration(t, nil)
+	defer it.stop(t)
+
+	it.publish(t, config.UserRemovedTopic, `{ "_id":"4" }`)
+
+	assert.Equal(t, []string{"", "1"}, it.settled(t, config.UserRemovedTopic, 2))
+}
+
+func TestIntegration_InvalidMessage_DeadLettered(t *testing.T) {
+	it := startIntegration(t, nil)
+	defer it.stop(t)
+	it.listen(t, config.DeadLetterQueue)
+
+	it.publish(t, config.UserCreateTopic, `hello world`)
+
+	msg := it.next(t, config.DeadLetterQueue)
+	assert.Equal(t, "hello world", string(msg.Body))
+	assert.Equal(t, config.UserCreateTopic, msg.Header["original-destination"])
+	assert.NotEmpty(t, msg.Header["dead-letter-reason"])
+	assert.Equal(t, []string{""}, it.deliveries(config.UserCreateTopic))
+}
+
+func TestIntegration_Stop_LeavesInFlightMessageUnsettled(t *testing.T) {
+	defer withRedelivery(3)()
+	it := startIntegration(t, nil)
+	defer it.stop(t)
+	started := it.users.block("5")
+
+	it.publish(t, config.UserCreateTopic, `{ "_id":"5" }`)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("message was not delivered")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.Nil(t, it.p.Stop(ctx))
+
+	//neither acked nor resent by the stopped processor, the broker keeps it for the next consumer
+	time.Sleep(10 * time.Duration(config.RedeliveryDelay) * time.Millisecond)
+	assert.Empty(t, it.broker.settlements())
+	assert.Equal(t, []string{""}, it.deliveries(config.UserCreateTopic))
+}
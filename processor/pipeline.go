@@ -0,0 +1,273 @@
+package processor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/schema"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	userService "github.com/coaraujo/users-go-processor/services/user"
+	"time"
+)
+
+//Result is the outcome of a user event that was successfully persisted
+type Result string
+
+const (
+	Created Result = "created"
+	Updated Result = "updated"
+	Deleted Result = "deleted"
+	//Tombstoned is the result of a remove for an unknown user, which only leaves its tombstone
+	Tombstoned Result = "tombstoned"
+)
+
+//RemovedError is the cause of the conflict returned for a create that is not newer than the tombstone of the
+//user
+type RemovedError struct {
+	ID        string
+	UpdatedAt time.Time
+	RemovedAt time.Time
+}
+
+func (e *RemovedError) Error() string {
+	return fmt.Sprintf("user %s updated at %s was removed at %s", e.ID,
+		e.UpdatedAt.Format(time.RFC3339), e.RemovedAt.Format(time.RFC3339))
+}
+
+//IsRemoved reports whether err rejected a create older than the removal of its user
+func IsRemoved(err error) bool {
+	if storageErr, ok := err.(*storage.Error); ok {
+		err = storageErr.Err
+	}
+	_, ok := err.(*RemovedError)
+	return ok
+}
+
+//DecodeUser parses and validates the payload of a user create event
+var DecodeUser = func(body []byte) (*domains.User, error) {
+	return decodeUser(schema.UserCreate, body)
+}
+
+//DecodeRemovedUser parses and validates the payload of a user remove event
+var DecodeRemovedUser = func(body []byte) (*domains.User, error) {
+	return decodeUser(schema.UserRemove, body)
+}
+
+//decodeUser checks the payload against the named schema first when config.SchemaValidation is set, the
+//violations are returned as a validation error
+func decodeUser(name string, body []byte) (*domains.User, error) {
+	if config.SchemaValidation {
+		if err := schema.Validate(name, body); err != nil {
+			return nil, storage.NewError(storage.KindValidation, err)
+		}
+	}
+
+	var user domains.User
+	if err := json.Unmarshal(body, &user); err != nil {
+		return nil, storage.NewError(storage.KindValidation, err)
+	}
+	if err := userService.Validate(&user); err != nil {
+		return nil, err
+	}
+	//the deletion marker and the status history are kept by the storage, never set by events
+	user.DeletedAt = nil
+	user.StatusHistory = nil
+	return &user, nil
+}
+
+//SaveUser runs the user create pipeline of the processor wired with the package instances
+var SaveUser = func(ctx context.Context, user *domains.User) (Result, error) {
+	return defaultProcessor().SaveUser(ctx, user)
+}
+
+//RemoveUser runs the user remove pipeline of the processor wired with the package instances
+var RemoveUser = func(ctx context.Context, removed *domains.User) (Result, error) {
+	return defaultProcessor().RemoveUser(ctx, removed)
+}
+
+//SaveUser inserts the user, or merges it into the stored one when it already exists, see Users.Upsert. Only a
+//user without phones, addresses nor status is merged by a single atomic upsert, the others are read and then
+//written conditioned on the version read. A write that conflicts, with another upsert creating the same user
+//or with a concurrent write of the user read, is retried up to config.MaximumWriteRetries times, reading the
+//user again. Storage calls run under ctx, a cancelled ctx aborts the pending write.
+//With tombstones, a user updated before its last removal is rejected with a RemovedError conflict.
+//The user is stored with the tenant of its ClientID. A partial update without ClientID is merged into the
+//tenant that already stores the user.
+func (p *processorImpl) SaveUser(ctx context.Context, user *domains.User) (Result, error) {
+	ctx = tenant.WithClientID(ctx, user.ClientID)
+	ctx, err := p.resolveTenant(ctx, user.ID)
+	if err != nil {
+		return "", err
+	}
+	if err := p.checkTombstone(ctx, user); err != nil {
+		return "", err
+	}
+	if p.cep != nil {
+		p.cep.Enrich(ctx, user)
+	}
+	for attempt := 1; ; attempt++ {
+		result, err := p.saveUser(ctx, user)
+		if storage.KindOf(err) != storage.KindConflict || attempt > config.MaximumWriteRetries {
+			return result, err
+		}
+		p.logger.Infof("[Processor SaveUser] User written concurrently, retrying. ID: %s Attempt: %d", user.ID, attempt)
+	}
+}
+
+//checkTombstone rejects the user when its tombstone covers it
+func (p *processorImpl) checkTombstone(ctx context.Context, user *domains.User) error {
+	if p.tombstones == nil || user.UpdatedAt.IsZero() {
+		return nil
+	}
+	tombstone, err := p.tombstones.Get(ctx, user.ID)
+	if storage.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		p.logger.Errorf("[Processor SaveUser] Error to get tombstone. ERROR: %s", err)
+		return err
+	}
+	if tombstone.Covers(user.UpdatedAt) {
+		return storage.NewError(storage.KindConflict,
+			&RemovedError{ID: user.ID, UpdatedAt: user.UpdatedAt, RemovedAt: tombstone.RemovedAt})
+	}
+	return nil
+}
+
+func (p *processorImpl) saveUser(ctx context.Context, user *domains.User) (Result, error) {
+	created, err := p.users.Upsert(ctx, user)
+	if err != nil {
+		p.logger.Errorf("[Processor SaveUser] Error to upsert user. ERROR: %s", err)
+		return "", err
+	}
+
+	if created {
+		return Created, nil
+	}
+	return Updated, nil
+}
+
+//RemoveUser removes the user with the removal strategy of the processor: it is moved to the old users
+//collection and deleted from users by default, marked as deleted with config.RemovalSoftDelete or deleted
+//without archive with config.RemovalHardDelete.
+//With tombstones, the removal leaves a tombstone of the user, and removing an unknown user only writes it.
+//The user is looked up in the tenant of the ClientID of the event, or in every tenant when it has none.
+func (p *processorImpl) RemoveUser(ctx context.Context, removed *domains.User) (Result, error) {
+	ctx = tenant.WithClientID(ctx, removed.ClientID)
+	ctx, err := p.resolveTenant(ctx, removed.ID)
+	if err != nil {
+		return "", err
+	}
+	removedAt := removed.UpdatedAt
+	if removedAt.IsZero() {
+		removedAt = time.Now()
+	}
+
+	//Find user from mongo
+	user, err := p.users.Get(ctx, removed.ID)
+	if storage.IsNotFound(err) && p.tombstones != nil {
+		//a miss may come from the Get cache, the tombstone is only written once the storage confirms it
+		user, err = p.storedUser(ctx, removed.ID)
+	}
+	if storage.IsNotFound(err) && p.tombstones != nil {
+		//the create may still be on its way, the tombstone rejects it when it arrives
+		if err = p.putTombstone(ctx, removed.ID, removedAt); err != nil {
+			return "", err
+		}
+		return Tombstoned, nil
+	}
+	if err != nil {
+		p.logger.Errorf("[Processor RemoveUser] Unexpected error to get user. ERROR: %s", err)
+		return "", err
+	}
+
+	if err = p.removeUser(ctx, user, removed, removedAt); err != nil {
+		return "", err
+	}
+	//a failure is retried by the redelivery, which finds the user removed and writes the tombstone
+	if p.tombstones != nil {
+		if err = p.putTombstone(ctx, user.ID, removedAt); err != nil {
+			return "", err
+		}
+	}
+	return Deleted, nil
+}
+
+//resolveTenant returns ctx with the tenant storing the user of an event without ClientID when tenants are
+//routed: the shared database, unless the policy rejects it, and every routed ClientID are looked up. A user
+//stored in more than one tenant is a validation error, and one stored in none stays in the tenant of ctx.
+func (p *processorImpl) resolveTenant(ctx context.Context, id string) (context.Context, error) {
+	router := tenant.GetInstance()
+	if tenant.FromContext(ctx) != "" || !router.Enabled() {
+		return ctx, nil
+	}
+
+	var found []string
+	for _, clientID := range append([]string{""}, router.ClientIDs()...) {
+		if _, err := router.Resolve(clientID); err != nil {
+			continue
+		}
+		_, err := p.storedUser(tenant.NewContext(ctx, clientID), id)
+		if storage.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			p.logger.Errorf("[Processor resolveTenant] Unexpected error to find the tenant of user. ERROR: %s", err)
+			return ctx, err
+		}
+		found = append(found, clientID)
+	}
+	switch len(found) {
+	case 0:
+		return ctx, nil
+	case 1:
+		return tenant.NewContext(ctx, found[0]), nil
+	}
+	return ctx, storage.NewError(storage.KindValidation,
+		fmt.Errorf("user %s is stored by the clients %q, the event must set its clientId", id, found))
+}
+
+//storedUser reads the live user with GetWithDeleted, which the Get cache does not answer
+func (p *processorImpl) storedUser(ctx context.Context, id string) (*domains.User, error) {
+	user, err := p.users.GetWithDeleted(ctx, id)
+	if err == nil && user.DeletedAt != nil {
+		return nil, storage.ErrNotFound
+	}
+	return user, err
+}
+
+func (p *processorImpl) putTombstone(ctx context.Context, id string, removedAt time.Time) error {
+	if err := p.tombstones.Put(ctx, id, removedAt); err != nil {
+		p.logger.Errorf("[Processor RemoveUser] Error to write tombstone. ERROR: %s", err)
+		return err
+	}
+	return nil
+}
+
+func (p *processorImpl) removeUser(ctx context.Context, user *domains.User, removed *domains.User, removedAt time.Time) error {
+	switch p.removal {
+	case config.RemovalSoftDelete:
+		if err := p.users.SoftDelete(ctx, user.ID, removedAt); err != nil {
+			p.logger.Errorf("[Processor RemoveUser] Unexpected error to soft delete user. ERROR: %s", err)
+			return err
+		}
+		return nil
+	case config.RemovalHardDelete:
+	default:
+		//Archive a new generation of the user, next to the event that removed it
+		entry := &domains.ArchivedUser{UserID: user.ID, Reason: domains.ArchiveRemoved, Source: removed, User: *user}
+		if _, err := p.oldUsers.Insert(ctx, entry); err != nil {
+			p.logger.Errorf("[Processor RemoveUser] Error to move user to old user collection. ERROR: %s", err)
+			return err
+		}
+	}
+
+	if err := p.users.Delete(ctx, user.ID); err != nil {
+		p.logger.Errorf("[Processor RemoveUser] Unexpected error to delete user. ERROR: %s", err)
+		return err
+	}
+	return nil
+}
@@ -1,139 +1,95 @@
 package processor
 
 import (
-	"github.com/coaraujo/users-go-processor/infrastructure/queue"
-	"github.com/go-stomp/stomp"
+	"context"
 	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/queue"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
 	"github.com/coaraujo/users-go-processor/services/olduser"
 	"github.com/coaraujo/users-go-processor/services/user"
 	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
-	"go.mongodb.org/mongo-driver/mongo"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestProcessUser_UnmarshalError(t *testing.T) {
 	userServiceMock := &user.UserMock{}
-
-	msg := &stomp.Message{Body: []byte("hello world")}
-
-	_ = userServiceMock.Initialize()
-
-	processUser(msg)
-
-	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
-	userServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"), mock.Anything)
-	userServiceMock.AssertNotCalled(t, "Update", mock.AnythingOfType("*domains.User"),
-		mock.AnythingOfType("*domains.User"), mock.Anything)
-
-	userServiceMock.AssertExpectations(t)
-}
-
-func TestProcessUser_GetUser_Error(t *testing.T) {
-	userServiceMock := &user.UserMock{}
 	brokerServiceMock := &queue.BrokerMock{}
 
-	id := "111111-222-3333-45454545-888990000"
-	user := &domains.User{ID: id}
-	userError := errors.New("user error")
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	msg := &queue.Message{Body: []byte("hello world")}
 
 	_ = userServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", user.ID).
-		Return(user, userError).
-		Once()
+	brokerServiceMock.On("DeadLetterMessage", msg, mock.Anything).Once()
 
-	processUser(msg)
+	defaultProcessor().processUser(context.Background(), msg)
 
+	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
 	userServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"), mock.Anything)
 	userServiceMock.AssertNotCalled(t, "Update", mock.AnythingOfType("*domains.User"),
 		mock.AnythingOfType("*domains.User"), mock.Anything)
 
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
-func TestProcessUser_GetUser_NotFound(t *testing.T) {
+func TestProcessUser_UpsertUser_Error(t *testing.T) {
 	userServiceMock := &user.UserMock{}
 	brokerServiceMock := &queue.BrokerMock{}
 
 	id := "111111-222-3333-45454545-888990000"
 	user := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	userError := errors.New("user error")
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 
 	_ = userServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", user.ID).
-		Return(user, mongo.ErrNoDocuments).
+	userServiceMock.On("Upsert", mock.Anything, user).
+		Return(false, userError).
 		Once()
 
-	userServiceMock.On("Insert", user, mock.Anything).
-		Return(id, nil).
-		Once()
+	brokerServiceMock.On("RedeliveryMessage", msg).Once()
 
-	processUser(msg)
+	defaultProcessor().processUser(context.Background(), msg)
 
+	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
+	userServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"), mock.Anything)
 	userServiceMock.AssertNotCalled(t, "Update", mock.AnythingOfType("*domains.User"),
 		mock.AnythingOfType("*domains.User"), mock.Anything)
 
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
-func TestProcessUser_InsertUser_Error(t *testing.T) {
+func TestProcessUser_UpsertUser_Created(t *testing.T) {
 	userServiceMock := &user.UserMock{}
 	brokerServiceMock := &queue.BrokerMock{}
 
 	id := "111111-222-3333-45454545-888990000"
 	user := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
-	insertError := errors.New("Insert user error")
-
-	_ = userServiceMock.Initialize()
-	_ = brokerServiceMock.Initialize()
-
-	userServiceMock.On("Get", user.ID).
-		Return(user, mongo.ErrNoDocuments).
-		Once()
-
-	userServiceMock.On("Insert", user, mock.Anything).
-		Return("", insertError).
-		Once()
-
-	processUser(msg)
-
-	userServiceMock.AssertNotCalled(t, "Update", mock.AnythingOfType("*domains.User"),
-		mock.AnythingOfType("*domains.User"), mock.Anything)
-
-	userServiceMock.AssertExpectations(t)
-}
-
-func TestProcessUser_UpdateUser_Error(t *testing.T) {
-	userServiceMock := &user.UserMock{}
-	brokerServiceMock := &queue.BrokerMock{}
-
-	id := "111111-222-3333-45454545-888990000"
-	newUser := &domains.User{ID: id}
-	oldUser := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
-	updateError := errors.New("update oldUser error")
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 
 	_ = userServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", newUser.ID).
-		Return(oldUser, nil).
+	userServiceMock.On("Upsert", mock.Anything, user).
+		Return(true, nil).
 		Once()
 
-	userServiceMock.On("Update", newUser, oldUser, mock.Anything).
-		Return(updateError).
-		Once()
+	brokerServiceMock.On("AckMessage", msg).Once()
 
-	processUser(msg)
+	defaultProcessor().processUser(context.Background(), msg)
 
-	userServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"), mock.Anything)
+	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
 func TestProcessUser_Success(t *testing.T) {
@@ -142,24 +98,22 @@ func TestProcessUser_Success(t *testing.T) {
 
 	id := "111111-222-3333-45454545-888990000"
 	newUser := &domains.User{ID: id}
-	oldUser := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 
 	_ = userServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", newUser.ID).
-		Return(oldUser, nil).
+	userServiceMock.On("Upsert", mock.Anything, newUser).
+		Return(false, nil).
 		Once()
 
-	userServiceMock.On("Update", newUser, oldUser, mock.Anything).
-		Return(nil).
-		Once()
+	brokerServiceMock.On("AckMessage", msg).Once()
 
-	processUser(msg)
+	defaultProcessor().processUser(context.Background(), msg)
 
 	userServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"), mock.Anything)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
 func TestProcessDeletedUser_UnmarshalError(t *testing.T) {
@@ -167,20 +121,23 @@ func TestProcessDeletedUser_UnmarshalError(t *testing.T) {
 	olduserServiceMock := &olduser.OldUserMock{}
 	brokerServiceMock := &queue.BrokerMock{}
 
-	msg := &stomp.Message{Body: []byte("hello world")}
+	msg := &queue.Message{Body: []byte("hello world")}
 
 	_ = userServiceMock.Initialize()
 	_ = olduserServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	processDeletedUser(msg)
+	brokerServiceMock.On("DeadLetterMessage", msg, mock.Anything).Once()
+
+	defaultProcessor().processDeletedUser(context.Background(), msg)
 
 	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
-	olduserServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"))
+	olduserServiceMock.AssertNotCalled(t, "Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser"))
 	userServiceMock.AssertNotCalled(t, "Delete", mock.Anything)
 
 	olduserServiceMock.AssertExpectations(t)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
 func TestProcessDeletedUser_GetUser_Error(t *testing.T) {
@@ -190,24 +147,27 @@ func TestProcessDeletedUser_GetUser_Error(t *testing.T) {
 
 	id := "111111-222-3333-45454545-888990000"
 	userMock := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 	getError := errors.New("get user error")
 
 	_ = userServiceMock.Initialize()
 	_ = olduserServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", id).
+	userServiceMock.On("Get", mock.Anything, id).
 		Return(userMock, getError).
 		Once()
 
-	processDeletedUser(msg)
+	brokerServiceMock.On("RedeliveryMessage", msg).Once()
+
+	defaultProcessor().processDeletedUser(context.Background(), msg)
 
-	olduserServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"))
+	olduserServiceMock.AssertNotCalled(t, "Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser"))
 	userServiceMock.AssertNotCalled(t, "Delete", mock.Anything)
 
 	olduserServiceMock.AssertExpectations(t)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
 func TestProcessDeletedUser_InsertOldUser_Error(t *testing.T) {
@@ -217,27 +177,30 @@ func TestProcessDeletedUser_InsertOldUser_Error(t *testing.T) {
 
 	id := "111111-222-3333-45454545-888990000"
 	userMock := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 	insertError := errors.New("insert user error")
 
 	_ = userServiceMock.Initialize()
 	_ = olduserServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", id).
+	userServiceMock.On("Get", mock.Anything, id).
 		Return(userMock, nil).
 		Once()
 
-	olduserServiceMock.On("Insert", userMock).
+	olduserServiceMock.On("Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser")).
 		Return("id", insertError).
 		Once()
 
-	processDeletedUser(msg)
+	brokerServiceMock.On("RedeliveryMessage", msg).Once()
+
+	defaultProcessor().processDeletedUser(context.Background(), msg)
 
 	userServiceMock.AssertNotCalled(t, "Delete", mock.Anything)
 
 	olduserServiceMock.AssertExpectations(t)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
 func TestProcessDeletedUser_DeleteUser_Error(t *testing.T) {
@@ -248,29 +211,32 @@ func TestProcessDeletedUser_DeleteUser_Error(t *testing.T) {
 	id := "111111-222-3333-45454545-888990000"
 	insertedID := "66666-4444-88888-252525225-6661112222"
 	userMock := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 	deleteError := errors.New("delete user error")
 
 	_ = userServiceMock.Initialize()
 	_ = olduserServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", id).
+	userServiceMock.On("Get", mock.Anything, id).
 		Return(userMock, nil).
 		Once()
 
-	olduserServiceMock.On("Insert", userMock).
+	olduserServiceMock.On("Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser")).
 		Return(insertedID, nil).
 		Once()
 
-	userServiceMock.On("Delete", userMock.ID).
+	userServiceMock.On("Delete", mock.Anything, userMock.ID).
 		Return(deleteError).
 		Once()
 
-	processDeletedUser(msg)
+	brokerServiceMock.On("RedeliveryMessage", msg).Once()
+
+	defaultProcessor().processDeletedUser(context.Background(), msg)
 
 	olduserServiceMock.AssertExpectations(t)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
 }
 
 func TestProcessDeletedUser_Success(t *testing.T) {
@@ -281,26 +247,454 @@ func TestProcessDeletedUser_Success(t *testing.T) {
 	id := "111111-222-3333-45454545-888990000"
 	insertedID := "66666-4444-88888-252525225-6661112222"
 	userMock := &domains.User{ID: id}
-	msg := &stomp.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+	msg := &queue.Message{Body: []byte("{ \"_id\":\"" + id + "\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
 
 	_ = userServiceMock.Initialize()
 	_ = olduserServiceMock.Initialize()
 	_ = brokerServiceMock.Initialize()
 
-	userServiceMock.On("Get", id).
+	userServiceMock.On("Get", mock.Anything, id).
 		Return(userMock, nil).
 		Once()
 
-	olduserServiceMock.On("Insert", userMock).
+	olduserServiceMock.On("Insert", mock.Anything, mock.AnythingOfType("*domains.ArchivedUser")).
 		Return(insertedID, nil).
 		Once()
 
-	userServiceMock.On("Delete", userMock.ID).
+	userServiceMock.On("Delete", mock.Anything, userMock.ID).
 		Return(nil).
 		Once()
 
-	processDeletedUser(msg)
+	brokerServiceMock.On("AckMessage", msg).Once()
 
+	defaultProcessor().processDeletedUser(context.Background(), msg)
+
+	entry := olduserServiceMock.Calls[0].Arguments.Get(1).(*domains.ArchivedUser)
+	assert.Equal(t, id, entry.UserID)
+	assert.Equal(t, domains.ArchiveRemoved, entry.Reason)
+	assert.Equal(t, *userMock, entry.User)
+	assert.Equal(t, id, entry.Source.ID)
 	olduserServiceMock.AssertExpectations(t)
 	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
+}
+
+func TestProcessUser_MissingID(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	brokerServiceMock := &queue.BrokerMock{}
+
+	msg := &queue.Message{Body: []byte("{ \"email\":\"email\", \"enqueuedAt\": \"2019-08-15T18:15:59-03:00\" }")}
+
+	_ = userServiceMock.Initialize()
+	_ = brokerServiceMock.Initialize()
+
+	brokerServiceMock.On("DeadLetterMessage", msg, mock.Anything).Once()
+
+	defaultProcessor().processUser(context.Background(), msg)
+
+	userServiceMock.AssertNotCalled(t, "Get", mock.Anything)
+	userServiceMock.AssertNotCalled(t, "Insert", mock.AnythingOfType("*domains.User"))
+	userServiceMock.AssertExpectations(t)
+	brokerServiceMock.AssertExpectations(t)
+}
+
+func TestResolveFailure_Policies(t *testing.T) {
+	cases := []struct {
+		kind    storage.Kind
+		policy  failurePolicy
+		outcome string
+	}{
+		{storage.KindValidation, processUserPolicy, "DeadLetterMessage"},
+		{storage.KindConflict, processUserPolicy, "RedeliveryMessage"},
+		{storage.KindTransient, processUserPolicy, "RedeliveryMessage"},
+		{storage.KindTimeout, processUserPolicy, "RedeliveryMessage"},
+		{storage.KindNetwork, processUserPolicy, "RedeliveryMessage"},
+		{storage.KindUnknown, processUserPolicy, "RedeliveryMessage"},
+		{storage.KindValidation, processDeletedUserPolicy, "DeadLetterMessage"},
+		{storage.KindConflict, processDeletedUserPolicy, "DeadLetterMessage"},
+		{storage.KindTransient, processDeletedUserPolicy, "RedeliveryMessage"},
+		{storage.KindTimeout, processDeletedUserPolicy, "RedeliveryMessage"},
+		{storage.KindNetwork, processDeletedUserPolicy, "RedeliveryMessage"},
+		{storage.KindUnknown, processDeletedUserPolicy, "RedeliveryMessage"},
+		//a transient error is redelivered even when the policy lists its class
+		{storage.KindTransient, failurePolicy{storage.KindTransient: deadLetter}, "RedeliveryMessage"},
+	}
+	for _, c := range cases {
+		brokerServiceMock := &queue.BrokerMock{}
+		p := newProcessor(Options{Broker: brokerServiceMock, Users: &user.UserMock{}, OldUsers: &olduser.OldUserMock{}})
+		msg := &queue.Message{Body: []byte("{}")}
+		err := storage.NewError(c.kind, errors.New("error"))
+
+		if c.outcome == "DeadLetterMessage" {
+			brokerServiceMock.On(c.outcome, msg, err).Once()
+		} else {
+			brokerServiceMock.On(c.outcome, msg).Once()
+		}
+
+		p.resolveFailure(context.Background(), msg, "1", err, c.policy)
+
+		brokerServiceMock.AssertExpectations(t)
+	}
+}
+
+func TestProcessUser_MemoryBroker_Flow(t *testing.T) {
+	userServiceMock := &user.UserMock{}
+	broker := queue.NewMemoryBroker()
+	defer broker.Disconnect()
+
+	id := "111111-222-3333-45454545-888990000"
+	newUser := &domains.User{ID: id}
+
+	_ = userServiceMock.Initialize()
+	_ = broker.Initialize()
+
+	userServiceMock.On("Upsert", mock.Anything, newUser).
+		Return(true, nil).
+		Once()
+
+	go broker.Listen(config.UserCreateTopic)
+	_ = broker.Publish(queue.NewMessage(config.UserCreateTopic, "application/json", []byte("hello world")))
+	_ = broker.Publish(queue.NewMessage(config.UserCreateTopic, "application/json", []byte("{ \"_id\":\""+id+"\" }")))
+
+	defaultProcessor().processUser(context.Background(), <-broker.Notifier(config.UserCreateTopic))
+	defaultProcessor().processUser(context.Background(), <-broker.Notifier(config.UserCreateTopic))
+
+	assert.Len(t, broker.Acked(config.UserCreateTopic), 2)
+	assert.Len(t, broker.Queued(config.DeadLetterQueue), 1)
+	assert.Equal(t, 0, broker.InFlight())
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestSaveUser_Conflict_Retries(t *testing.T) {
+	defer func(retries int) { config.MaximumWriteRetries = retries }(config.MaximumWriteRetries)
+	config.MaximumWriteRetries = 2
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	newUser := &domains.User{ID: "id", Name: "name"}
+	conflict := storage.NewError(storage.KindConflict, errors.New("E11000 duplicate key"))
+
+	userServiceMock.On("Upsert", mock.Anything, newUser).Return(false, conflict).Once()
+	userServiceMock.On("Upsert", mock.Anything, newUser).Return(false, nil).Once()
+
+	result, err := SaveUser(context.Background(), newUser)
+
+	assert.Nil(t, err)
+	assert.Equal(t, Updated, result)
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestSaveUser_Conflict_Exhausted(t *testing.T) {
+	defer func(retries int) { config.MaximumWriteRetries = retries }(config.MaximumWriteRetries)
+	config.MaximumWriteRetries = 2
+	userServiceMock := &user.UserMock{}
+	_ = userServiceMock.Initialize()
+
+	newUser := &domains.User{ID: "id"}
+	conflict := storage.NewError(storage.KindConflict, errors.New("E11000 duplicate key"))
+
+	userServiceMock.On("Upsert", mock.Anything, newUser).Return(false, conflict).Times(3)
+
+	_, err := SaveUser(context.Background(), newUser)
+
+	assert.Equal(t, conflict, err)
+	userServiceMock.AssertExpectations(t)
+}
+
+func TestProcessor_StartStop(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	db := storage.NewMemoryDB()
+	p := New(Options{Broker: broker, Storage: db})
+
+	assert.Nil(t, p.Start(context.Background()))
+	assert.NotNil(t, p.Start(context.Background()))
+	_ = broker.Publish(queue.NewMessage(config.UserCreateTopic, "application/json", []byte("{ \"_id\":\"1\" }")))
+
+	for deadline := time.Now().Add(time.Second); len(broker.Acked(config.UserCreateTopic)) == 0; {
+		if time.Now().After(deadline) {
+			t.Fatal("message was not acked")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	created, err := user.New(db).Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", created.ID)
+
+	assert.Nil(t, p.Stop(context.Background()))
+	assert.Equal(t, queue.ErrBrokerClosed, broker.Publish(queue.NewMessage(config.UserCreateTopic, "", nil)))
+}
+
+func TestProcessUser_InvalidStatusTransition_DeadLettered(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	defer broker.Disconnect()
+	_ = broker.Initialize()
+	db := storage.NewMemoryDB()
+	p := newProcessor(Options{Broker: broker, Storage: db})
+
+	go broker.Listen(config.UserCreateTopic)
+	for _, body := range []string{
+		"{ \"_id\":\"1\", \"status\":\"active\", \"updatedAt\":\"2019-08-15T18:00:00Z\" }",
+		"{ \"_id\":\"1\", \"status\":\"deleted\", \"updatedAt\":\"2019-08-15T19:00:00Z\" }",
+		"{ \"_id\":\"1\", \"status\":\"active\", \"updatedAt\":\"2019-08-15T20:00:00Z\" }",
+	} {
+		_ = broker.Publish(queue.NewMessage(config.UserCreateTopic, "application/json", []byte(body)))
+		p.processUser(context.Background(), <-broker.Notifier(config.UserCreateTopic))
+	}
+
+	assert.Len(t, broker.Acked(config.UserCreateTopic), 3)
+	assert.Len(t, broker.Queued(config.DeadLetterQueue), 1)
+	stored, err := user.New(db).Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, domains.StatusDeleted, stored.Status)
+	assert.Equal(t, []domains.StatusTransition{
+		{To: domains.StatusActive, At: time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)},
+		{From: domains.StatusActive, To: domains.StatusDeleted, At: time.Date(2019, 8, 15, 19, 0, 0, 0, time.UTC)},
+	}, stored.StatusHistory)
+}
+
+func TestRemoveUser_RemovalStrategies(t *testing.T) {
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	for _, strategy := range []string{config.RemovalArchive, config.RemovalSoftDelete, config.RemovalHardDelete} {
+		db := storage.NewMemoryDB()
+		p := newProcessor(Options{Broker: queue.NewMemoryBroker(), Storage: db, RemovalStrategy: strategy})
+		_, err := p.users.Insert(context.Background(), &domains.User{ID: "1", UpdatedAt: updatedAt})
+		assert.Nil(t, err)
+
+		result, err := p.RemoveUser(context.Background(), &domains.User{ID: "1", UpdatedAt: updatedAt})
+		assert.Nil(t, err, strategy)
+		assert.Equal(t, Deleted, result, strategy)
+
+		_, err = p.users.Get(context.Background(), "1")
+		assert.True(t, storage.IsNotFound(err), strategy)
+		deleted, err := p.users.GetWithDeleted(context.Background(), "1")
+		assert.Equal(t, strategy == config.RemovalSoftDelete, err == nil, strategy)
+		if err == nil {
+			assert.True(t, updatedAt.Equal(*deleted.DeletedAt), strategy)
+		}
+		_, err = p.oldUsers.Latest(context.Background(), "1")
+		assert.Equal(t, strategy == config.RemovalArchive, err == nil, strategy)
+	}
+}
+
+func TestProcessor_Tombstones(t *testing.T) {
+	defer func(ttl time.Duration) { config.TombstoneTTL = ttl }(config.TombstoneTTL)
+	config.TombstoneTTL = time.Hour
+	broker := queue.NewMemoryBroker()
+	defer broker.Disconnect()
+	_ = broker.Initialize()
+	db := storage.NewMemoryDB()
+	p := newProcessor(Options{Broker: broker, Storage: db})
+
+	go broker.Listen(config.UserRemovedTopic)
+	go broker.Listen(config.UserCreateTopic)
+	//the remove arrives before the create it follows, and a stale create after a removal
+	_ = broker.Publish(queue.NewMessage(config.UserRemovedTopic, "application/json",
+		[]byte("{ \"_id\":\"1\", \"updatedAt\":\"2019-08-15T19:00:00Z\" }")))
+	p.processDeletedUser(context.Background(), <-broker.Notifier(config.UserRemovedTopic))
+	for _, body := range []string{
+		"{ \"_id\":\"1\", \"updatedAt\":\"2019-08-15T18:00:00Z\" }",
+		"{ \"_id\":\"1\", \"updatedAt\":\"2019-08-15T20:00:00Z\" }",
+	} {
+		_ = broker.Publish(queue.NewMessage(config.UserCreateTopic, "application/json", []byte(body)))
+		p.processUser(context.Background(), <-broker.Notifier(config.UserCreateTopic))
+	}
+
+	assert.Len(t, broker.Acked(config.UserRemovedTopic), 1)
+	assert.Len(t, broker.Acked(config.UserCreateTopic), 2)
+	assert.Len(t, broker.Queued(config.DeadLetterQueue), 0)
+	stored, err := p.users.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.True(t, time.Date(2019, 8, 15, 20, 0, 0, 0, time.UTC).Equal(stored.UpdatedAt))
+	assert.Equal(t, int64(1), stored.Version)
+
+	result, err := p.RemoveUser(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Date(2019, 8, 15, 21, 0, 0, 0, time.UTC)})
+	assert.Nil(t, err)
+	assert.Equal(t, Deleted, result)
+	_, err = p.SaveUser(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Date(2019, 8, 15, 20, 30, 0, 0, time.UTC)})
+	assert.True(t, IsRemoved(err))
+	assert.Equal(t, storage.KindConflict, storage.KindOf(err))
+}
+
+func TestRemoveUser_Tombstones_StaleCachedMiss(t *testing.T) {
+	defer func(ttl time.Duration, mode string) {
+		config.TombstoneTTL, config.UserCacheMode = ttl, mode
+	}(config.TombstoneTTL, config.UserCacheMode)
+	config.TombstoneTTL, config.UserCacheMode = time.Hour, config.UserCacheNegative
+	db := storage.NewMemoryDB()
+	users := user.NewCached(user.New(db))
+	p := newProcessor(Options{Broker: queue.NewMemoryBroker(), Storage: db, Users: users})
+
+	//the miss is cached, then another replica creates the user
+	_, err := users.Get(context.Background(), "1")
+	assert.True(t, storage.IsNotFound(err))
+	_, err = user.New(db).Insert(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+
+	result, err := p.RemoveUser(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.Equal(t, Deleted, result)
+	_, err = user.New(db).GetWithDeleted(context.Background(), "1")
+	assert.True(t, storage.IsNotFound(err))
+	_, err = p.oldUsers.Latest(context.Background(), "1")
+	assert.Nil(t, err)
+}
+
+func TestProcessDeletedUser_SchemaViolation_DeadLettered(t *testing.T) {
+	defer func(validation bool) { config.SchemaValidation = validation }(config.SchemaValidation)
+	config.SchemaValidation = true
+	broker := queue.NewMemoryBroker()
+	defer broker.Disconnect()
+	_ = broker.Initialize()
+	p := newProcessor(Options{Broker: broker, Storage: storage.NewMemoryDB()})
+
+	go broker.Listen(config.UserRemovedTopic)
+	_ = broker.Publish(queue.NewMessage(config.UserRemovedTopic, "application/json", []byte("{ \"updatedAt\":\"today\" }")))
+	p.processDeletedUser(context.Background(), <-broker.Notifier(config.UserRemovedTopic))
+
+	deadLettered := broker.Queued(config.DeadLetterQueue)
+	assert.Len(t, deadLettered, 1)
+	assert.Equal(t, "validation: user-remove schema: $._id: is required; $.updatedAt: must be a RFC 3339 date-time",
+		deadLettered[0].Header["dead-letter-reason"])
+}
+
+func TestProcessor_ResultTopic(t *testing.T) {
+	broker := queue.NewMemoryBroker()
+	defer broker.Disconnect()
+	_ = broker.Initialize()
+	p := newProcessor(Options{Broker: broker, Storage: storage.NewMemoryDB(), ResultTopic: "results"})
+
+	go broker.Listen(config.UserCreateTopic)
+	created := queue.NewMessage(config.UserCreateTopic, "application/json", []byte("{ \"_id\":\"1\" }"))
+	created.Header[CorrelationHeader] = "a"
+	_ = broker.Publish(created)
+	_ = broker.Publish(queue.NewMessage(config.UserCreateTopic, "application/json", []byte("hello world")))
+	p.processUser(context.Background(), <-broker.Notifier(config.UserCreateTopic))
+	p.processUser(context.Background(), <-broker.Notifier(config.UserCreateTopic))
+
+	results := broker.Queued("results")
+	assert.Len(t, results, 2)
+	assert.Equal(t, "a", results[0].Header[CorrelationHeader])
+	assert.JSONEq(t, `{"_id":"1","topic":"`+config.UserCreateTopic+`","result":"created"}`, string(results[0].Body))
+	assert.Equal(t, "", results[1].Header[CorrelationHeader])
+	assert.Contains(t, string(results[1].Body), `"kind":"validation"`)
+}
+
+func TestProcessor_Tenants(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Database: "users_acme"}}, config.TenantReject)
+	shared := storage.NewMemoryDB()
+	p := newProcessor(Options{Broker: &queue.BrokerMock{}, Storage: storage.NewTenantDB(shared, tenant.GetInstance())})
+	ctx := context.Background()
+
+	result, err := p.SaveUser(ctx, &domains.User{ID: "1", ClientID: "acme", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.Equal(t, Created, result)
+	_, err = p.SaveUser(ctx, &domains.User{ID: "2", ClientID: "globex", UpdatedAt: time.Now()})
+	assert.Equal(t, storage.KindValidation, storage.KindOf(err))
+
+	result, err = p.RemoveUser(ctx, &domains.User{ID: "1", ClientID: "acme"})
+	assert.Nil(t, err)
+	assert.Equal(t, Deleted, result)
+	count, _ := shared.Database("users_acme").Count(ctx, "old_users", nil)
+	assert.Equal(t, int64(1), count)
+	count, _ = shared.Database("users_acme").Count(ctx, "users", nil)
+	assert.Equal(t, int64(0), count)
+}
+
+func TestSaveUser_WithoutClientID_ResolvesTenant(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Database: "users_acme"}}, config.TenantShared)
+	shared := storage.NewMemoryDB()
+	p := newProcessor(Options{Broker: &queue.BrokerMock{}, Storage: storage.NewTenantDB(shared, tenant.GetInstance())})
+	ctx := context.Background()
+
+	_, err := p.SaveUser(ctx, &domains.User{ID: "1", ClientID: "acme", Email: "old@email.com", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+
+	result, err := p.SaveUser(ctx, &domains.User{ID: "1", Email: "new@email.com", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.Equal(t, Updated, result)
+	count, _ := shared.Count(ctx, "users", nil)
+	assert.Equal(t, int64(0), count)
+	stored, err := p.users.Get(tenant.NewContext(ctx, "acme"), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "new@email.com", stored.Email)
+	assert.Equal(t, "acme", stored.ClientID)
+}
+
+func TestRemoveUser_WithoutClientID_ResolvesTenant(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Database: "users_acme"},
+		"globex": {Prefix: "globex_"}}, config.TenantShared)
+	shared := storage.NewMemoryDB()
+	p := newProcessor(Options{Broker: &queue.BrokerMock{}, Storage: storage.NewTenantDB(shared, tenant.GetInstance())})
+	ctx := context.Background()
+
+	for _, created := range []*domains.User{
+		{ID: "1", ClientID: "acme"}, {ID: "2", ClientID: "acme"}, {ID: "2", ClientID: "initech"},
+	} {
+		_, err := p.SaveUser(ctx, &domains.User{ID: created.ID, ClientID: created.ClientID, UpdatedAt: time.Now()})
+		assert.Nil(t, err)
+	}
+
+	result, err := p.RemoveUser(ctx, &domains.User{ID: "1"})
+	assert.Nil(t, err)
+	assert.Equal(t, Deleted, result)
+	count, _ := shared.Database("users_acme").Count(ctx, "users", nil)
+	assert.Equal(t, int64(1), count)
+
+	_, err = p.RemoveUser(ctx, &domains.User{ID: "2"})
+	assert.Equal(t, storage.KindValidation, storage.KindOf(err))
+	count, _ = shared.Count(ctx, "users", nil)
+	assert.Equal(t, int64(1), count)
+}
+
+//racingDB writes the user as another replica would, once, right after the first read of a user
+type racingDB struct {
+	storage.MongoDB
+	once sync.Once
+	race func()
+}
+
+func (db *racingDB) FindOne(ctx context.Context, collName string, query map[string]interface{}, doc interface{}) error {
+	err := db.MongoDB.FindOne(ctx, collName, query, doc)
+	if collName == "users" {
+		db.once.Do(db.race)
+	}
+	return err
+}
+
+func TestSaveUser_ConcurrentPhonesAndAddresses_Retries(t *testing.T) {
+	defer func(retries int) { config.MaximumWriteRetries = retries }(config.MaximumWriteRetries)
+	config.MaximumWriteRetries = 2
+	memory := storage.NewMemoryDB()
+	replica := user.New(memory)
+	_, err := replica.Insert(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now(),
+		Phones: domains.Phones{{Type: domains.PhoneMobile, DDD: "11", Number: "911111111"}}})
+	assert.Nil(t, err)
+
+	db := &racingDB{MongoDB: memory}
+	db.race = func() {
+		_, err := replica.Upsert(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now(),
+			Phones:    domains.Phones{{Type: domains.PhoneMobile, DDD: "11", Number: "922222222"}},
+			Addresses: []domains.Address{{Type: domains.AddressShipping, CEP: "01001-000", Number: "1"}}})
+		assert.Nil(t, err)
+	}
+	p := newProcessor(Options{Broker: queue.NewMemoryBroker(), Storage: db, Users: user.New(db)})
+
+	result, err := p.SaveUser(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now(),
+		Phones:    domains.Phones{{Type: domains.PhoneMobile, DDD: "11", Number: "933333333"}},
+		Addresses: []domains.Address{{Type: domains.AddressShipping, CEP: "20040-002", Number: "2"}}})
+	assert.Nil(t, err)
+	assert.Equal(t, Updated, result)
+
+	//the write conditioned on the version read conflicts with the replica, the retry merges into its write
+	stored, err := replica.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	var numbers []string
+	for _, phone := range stored.Phones {
+		numbers = append(numbers, phone.Number)
+	}
+	assert.ElementsMatch(t, []string{"911111111", "922222222", "933333333"}, numbers)
+	assert.Len(t, stored.Addresses, 2)
 }
@@ -1,132 +1,360 @@
 package processor
 
 import (
-	"github.com/go-stomp/stomp"
-	"time"
+	"context"
 	"encoding/json"
+	"errors"
 	"github.com/coaraujo/users-go-processor/domains"
 	"github.com/coaraujo/users-go-processor/infrastructure/config"
 	"github.com/coaraujo/users-go-processor/infrastructure/queue"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/services/cep"
 	"github.com/coaraujo/users-go-processor/services/olduser"
+	"github.com/coaraujo/users-go-processor/services/tombstone"
 	userService "github.com/coaraujo/users-go-processor/services/user"
 	"github.com/labstack/gommon/log"
-	"go.mongodb.org/mongo-driver/mongo"
+	"reflect"
 	"sync"
+	"time"
+)
+
+//action is what a handler does with a message that failed to be processed
+type action int
+
+const (
+	redeliver action = iota
+	ack
+	deadLetter
 )
 
+//failurePolicy maps an error class to the action taken by a handler. Classes not listed, and transient errors
+//whatever their class, are redelivered.
+type failurePolicy map[storage.Kind]action
+
 var (
-	instance Processor
-	once     sync.Once
+	//the conflicts of a create are concurrent writes of the user, which SaveUser already retried, so they are
+	//redelivered as well
+	processUserPolicy = failurePolicy{
+		storage.KindValidation: deadLetter,
+	}
+	processDeletedUserPolicy = failurePolicy{
+		storage.KindConflict:   deadLetter,
+		storage.KindValidation: deadLetter,
+	}
 )
 
+//Logger is the logging used by a Processor, *log.Logger of gommon implements it
+type Logger interface {
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+//Handler processes a message received on a topic, and acks, redelivers or dead-letters it. Its storage calls
+//run under ctx, which is cancelled when the processor stops.
+type Handler func(ctx context.Context, msg *queue.Message)
+
+//Options wires a Processor. Only Broker is required in practice, the other fields have defaults:
+//  - Users and OldUsers are built over Storage, or are the package instances when Storage is nil too
+//  - Handlers are added to the user create and remove handlers, replacing them on the same topic
+//  - Logger writes through gommon
+//  - CEP fills the addresses of saved users, it is the package instance when config.CEPAPIURL is set
+//  - RemovalStrategy is one of the config.Removal* strategies, config.RemovalStrategy by default
+//  - Tombstones reject the creates older than a removal, built like OldUsers when config.TombstoneTTL is set
+//  - ResultTopic receives the Outcome of every settled message, config.ResultTopic by default and off when empty
+type Options struct {
+	Broker     queue.Broker
+	Storage    storage.MongoDB
+	Users      userService.Users
+	OldUsers   olduser.OldUsers
+	Tombstones tombstone.Tombstones
+	Handlers   map[string]Handler
+	Logger     Logger
+	CEP        cep.CEP
+
+	RemovalStrategy string
+	ResultTopic     string
+}
+
+//Outcome is published to the result topic once a message is acked or dead-lettered, with the correlation-id
+//header of the message. Redelivered messages have no outcome, nor those the broker stops redelivering.
+type Outcome struct {
+	ID     string `json:"_id,omitempty"`
+	Topic  string `json:"topic"`
+	Result Result `json:"result,omitempty"`
+	Kind   string `json:"kind,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+//CorrelationHeader identifies a message in its Outcome
+const CorrelationHeader = "correlation-id"
+
+//Processor consumes the topics of its handlers between Start and Stop
 type Processor interface {
-	Process()
+	//Start connects the broker and consumes the topics in background
+	Start(ctx context.Context) error
+	//Stop cancels the messages in flight, which are left to be redelivered, waits for the consumer to return
+	//until ctx is done and disconnects the broker
+	Stop(ctx context.Context) error
+	//SaveUser runs the user create pipeline outside of the broker
+	SaveUser(ctx context.Context, user *domains.User) (Result, error)
+	//RemoveUser runs the user remove pipeline outside of the broker
+	RemoveUser(ctx context.Context, user *domains.User) (Result, error)
 }
 
 type processorImpl struct {
-}
+	broker     queue.Broker
+	users      userService.Users
+	oldUsers   olduser.OldUsers
+	tombstones tombstone.Tombstones
+	handlers   map[string]Handler
+	logger     Logger
+	cep        cep.CEP
+	removal    string
+	results    string
 
-func GetInstance() Processor {
-	once.Do(func() {
-		instance = &processorImpl{}
-	})
-	return instance
+	mu      sync.Mutex
+	cancel  context.CancelFunc
+	stopped chan struct{}
 }
 
-func (p *processorImpl) Process() {
-	for {
-		select {
-		case <-time.After(time.Second * 5):
-			continue
-			
-		case msg := <-queue.GetInstance().Notifier(config.UserCreateTopic):
-			log.Infof("[Processor Process] Message received. CHANNEL: %s MESSAGE: %s", config.UserCreateTopic, string(msg.Body))
-			processUser(msg)
-			continue
+var defaultLogger Logger = log.New("-")
 
-		case msg := <-queue.GetInstance().Notifier(config.UserRemovedTopic):
-			log.Infof("[Processor Process] Message received. CHANNEL: %s MESSAGE: %s", config.UserRemovedTopic, string(msg.Body))
-			processDeletedUser(msg)
-			continue
+//New returns a Processor wired with the options, see Options for the defaults
+func New(options Options) Processor {
+	return newProcessor(options)
+}
+
+func newProcessor(options Options) *processorImpl {
+	p := &processorImpl{
+		broker:     options.Broker,
+		users:      options.Users,
+		oldUsers:   options.OldUsers,
+		tombstones: options.Tombstones,
+		logger:     options.Logger,
+		cep:        options.CEP,
+		removal:    options.RemovalStrategy,
+		results:    options.ResultTopic,
+	}
+	if p.broker == nil {
+		p.broker = queue.GetInstance()
+	}
+	if p.users == nil {
+		if options.Storage != nil {
+			p.users = userService.New(options.Storage)
+		} else {
+			p.users = userService.GetInstance()
+		}
+	}
+	if p.oldUsers == nil {
+		if options.Storage != nil {
+			p.oldUsers = olduser.New(options.Storage)
+		} else {
+			p.oldUsers = olduser.GetInstance()
+		}
+	}
+	if p.tombstones == nil && config.TombstoneTTL > 0 {
+		if options.Storage != nil {
+			p.tombstones = tombstone.New(options.Storage)
+		} else {
+			p.tombstones = tombstone.GetInstance()
 		}
 	}
+	if p.logger == nil {
+		p.logger = defaultLogger
+	}
+	if p.cep == nil && config.CEPAPIURL != "" {
+		p.cep = cep.GetInstance()
+	}
+	if p.removal == "" {
+		p.removal = config.RemovalStrategy
+	}
+	if p.results == "" {
+		p.results = config.ResultTopic
+	}
+
+	p.handlers = map[string]Handler{
+		config.UserCreateTopic:  p.processUser,
+		config.UserRemovedTopic: p.processDeletedUser,
+	}
+	for topic, handler := range options.Handlers {
+		p.handlers[topic] = handler
+	}
+	return p
 }
 
-var processUser = func(msg *stomp.Message) {
-	//Get message from broker
-	var user domains.User
-	if err := json.Unmarshal(msg.Body, &user); err != nil {
-		log.Errorf("[Processor processUser] Error to parse. RESPONSE: %s ERROR:", string(msg.Body), err)
-		queue.GetInstance().AckMessage(msg)
-		return
+//defaultProcessor is wired with the package instances, it backs SaveUser and RemoveUser
+var defaultProcessor = func() *processorImpl {
+	return newProcessor(Options{})
+}
+
+func (p *processorImpl) Start(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel != nil {
+		return errors.New("processor already started")
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := p.broker.NewConnection(); err != nil {
+		return err
+	}
+	for topic := range p.handlers {
+		go p.broker.Listen(topic)
 	}
-	log.Infof("[Processor processUser] Processing new MESSAGE: %+v", user)
 
-	//Find user from mongo
-	mongoUser, err := userService.GetInstance().Get(user.ID)
+	processing, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.stopped = make(chan struct{})
+	go func() {
+		defer close(p.stopped)
+		p.process(processing)
+	}()
+	return nil
+}
 
-	//Create new user on mongo if it doesnt exist.
-	if err == mongo.ErrNoDocuments {
-		id, err := userService.GetInstance().Insert(&user)
-		if err != nil {
-			log.Errorf("[Processor processUser] Error to insert user. ERROR: %s", err)
-			queue.GetInstance().RedeliveryMessage(msg)
+func (p *processorImpl) Stop(ctx context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cancel == nil {
+		return nil
+	}
+
+	p.cancel()
+	p.cancel = nil
+	select {
+	case <-p.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	p.broker.Disconnect()
+	return nil
+}
+
+//process consumes the topics until ctx is cancelled. The notifier of a topic only exists once the broker
+//subscribed to it, so the topics are looked up again every 5 seconds.
+func (p *processorImpl) process(ctx context.Context) {
+	for {
+		topics := make([]string, 0, len(p.handlers))
+		cases := []reflect.SelectCase{
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ctx.Done())},
+			{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(time.After(time.Second * 5))},
+		}
+		for topic := range p.handlers {
+			topics = append(topics, topic)
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv,
+				Chan: reflect.ValueOf(p.broker.Notifier(topic))})
+		}
+
+		chosen, value, _ := reflect.Select(cases)
+		switch chosen {
+		case 0:
+			p.logger.Infof("[Processor Process] Stopping. CAUSE: %s", ctx.Err())
 			return
+		case 1:
+			continue
 		}
-		queue.GetInstance().AckMessage(msg)
-		log.Infof("[Processor processUser] Message successfully processed. Inserted user with ID: %s", id)
+
+		topic := topics[chosen-2]
+		msg := value.Interface().(*queue.Message)
+		p.logger.Infof("[Processor Process] Message received. CHANNEL: %s MESSAGE: %s", topic, string(msg.Body))
+		p.handlers[topic](ctx, msg)
+	}
+}
+
+//resolveFailure acks, redelivers or dead-letters msg according to the class of err. id is the user of the
+//message, empty when it could not be decoded. When ctx is done the processor is stopping: msg is left
+//unsettled, the broker delivers it again once a consumer reconnects.
+func (p *processorImpl) resolveFailure(ctx context.Context, msg *queue.Message, id string, err error, policy failurePolicy) {
+	kind := storage.KindOf(err)
+	if ctx.Err() != nil {
+		p.logger.Infof("[Processor resolveFailure] Stopping, message left unsettled after %s error", kind)
 		return
 	}
-	if err != nil {
-		log.Errorf("[Processor processUser] Unexpected error to get user. ERROR: %s", err)
-		queue.GetInstance().RedeliveryMessage(msg)
+	resolution := policy[kind]
+	if storage.IsTransient(err) {
+		resolution = redeliver
+	}
+	switch resolution {
+	case ack:
+		p.logger.Infof("[Processor resolveFailure] Acking message after %s error", kind)
+		p.broker.AckMessage(msg)
+	case deadLetter:
+		p.logger.Infof("[Processor resolveFailure] Dead-lettering message after %s error", kind)
+		p.broker.DeadLetterMessage(msg, err)
+	default:
+		p.broker.RedeliveryMessage(msg)
 		return
 	}
+	p.publishOutcome(msg, &Outcome{ID: id, Kind: kind.String(), Error: err.Error()})
+}
 
-	//Update user on mongo
-	if err = userService.GetInstance().Update(&user, mongoUser); err != nil {
-		log.Errorf("[Processor processUser] Error to update user on users collection. ERROR: %s", err)
-		queue.GetInstance().RedeliveryMessage(msg)
+//publishOutcome sends the outcome of msg to the result topic, when there is one. A failure is only logged,
+//the message was already settled.
+func (p *processorImpl) publishOutcome(msg *queue.Message, outcome *Outcome) {
+	if p.results == "" {
 		return
 	}
-
-	log.Infof("[Processor processUser] Message successfully processed. Updated user with ID: %s", mongoUser.ID)
-	queue.GetInstance().AckMessage(msg)
-	return
+	outcome.Topic = msg.Destination
+	body, err := json.Marshal(outcome)
+	if err != nil {
+		p.logger.Errorf("[Processor publishOutcome] Could not encode outcome. ERROR: %s", err)
+		return
+	}
+	result := queue.NewMessage(p.results, "application/json", body)
+	if correlation := msg.Header[CorrelationHeader]; correlation != "" {
+		result.Header[CorrelationHeader] = correlation
+	}
+	if err := p.broker.Publish(result); err != nil {
+		p.logger.Errorf("[Processor publishOutcome] Could not publish outcome. ERROR: %s", err)
+	}
 }
 
-var processDeletedUser = func(msg *stomp.Message) {
+func (p *processorImpl) processUser(ctx context.Context, msg *queue.Message) {
 	//Get message from broker
-	var queueResponse domains.User
-	if err := json.Unmarshal(msg.Body, &queueResponse); err != nil {
-		log.Errorf("[Processor processDeletedUser] Error to parse. RESPONSE: %s ERROR: %s", string(msg.Body), err)
-		queue.GetInstance().AckMessage(msg)
+	user, err := DecodeUser(msg.Body)
+	if err != nil {
+		p.logger.Errorf("[Processor processUser] Invalid message. RESPONSE: %s ERROR: %s", string(msg.Body), err)
+		p.resolveFailure(ctx, msg, "", err, processUserPolicy)
 		return
 	}
+	p.logger.Infof("[Processor processUser] Processing new MESSAGE: %+v", *user)
 
-	//Find user from mongo
-	user, err := userService.GetInstance().Get(queueResponse.ID)
+	result, err := p.SaveUser(ctx, user)
+	if IsRemoved(err) {
+		//the removal already superseded the create, retrying it would be rejected again
+		p.logger.Infof("[Processor processUser] Stale message acked. ERROR: %s", err)
+		p.broker.AckMessage(msg)
+		p.publishOutcome(msg, &Outcome{ID: user.ID, Kind: storage.KindOf(err).String(), Error: err.Error()})
+		return
+	}
 	if err != nil {
-		log.Errorf("[Processor processDeletedUser] Unexpected error to get user. ERROR: %s", err)
-		queue.GetInstance().RedeliveryMessage(msg)
+		p.resolveFailure(ctx, msg, user.ID, err, processUserPolicy)
 		return
 	}
 
-	//Insert user on old users collection
-	_, err = olduser.GetInstance().Insert(user)
+	p.logger.Infof("[Processor processUser] Message successfully processed. User %s with ID: %s", result, user.ID)
+	p.broker.AckMessage(msg)
+	p.publishOutcome(msg, &Outcome{ID: user.ID, Result: result})
+}
+
+func (p *processorImpl) processDeletedUser(ctx context.Context, msg *queue.Message) {
+	//Get message from broker
+	user, err := DecodeRemovedUser(msg.Body)
 	if err != nil {
-		log.Errorf("[Processor processDeletedUser] Error to move user to old user collection. ERROR: %s", err)
-		queue.GetInstance().RedeliveryMessage(msg)
+		p.logger.Errorf("[Processor processDeletedUser] Invalid message. RESPONSE: %s ERROR: %s", string(msg.Body), err)
+		p.resolveFailure(ctx, msg, "", err, processDeletedUserPolicy)
 		return
 	}
 
-	if err = userService.GetInstance().Delete(user.ID); err != nil {
-		log.Errorf("[Processor processDeletedUser] Unexpected error to delete user. ERROR: %s", err)
-		queue.GetInstance().RedeliveryMessage(msg)
+	result, err := p.RemoveUser(ctx, user)
+	if err != nil {
+		p.resolveFailure(ctx, msg, user.ID, err, processDeletedUserPolicy)
 		return
 	}
-	
-	log.Infof("[Processor processDeletedUser] Message successfully processed. Deleted user with ID: %s", user.ID)
-	queue.GetInstance().AckMessage(msg)
-	return
+
+	p.logger.Infof("[Processor processDeletedUser] Message successfully processed. User %s with ID: %s", result, user.ID)
+	p.broker.AckMessage(msg)
+	p.publishOutcome(msg, &Outcome{ID: user.ID, Result: result})
 }
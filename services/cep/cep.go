@@ -0,0 +1,194 @@
+package cep
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/clients/client"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/labstack/gommon/log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	once     sync.Once
+	instance CEP
+)
+
+// CEP looks up postal codes to fill the addresses of users
+type CEP interface {
+	// Lookup returns the address of the CEP, or nil when the CEP does not exist
+	Lookup(ctx context.Context, cep string) (*domains.Address, error)
+	// Enrich fills the street, neighborhood, city and UF of the addresses of user that have a CEP and leave
+	// them empty. Lookup errors are logged and the address is kept as it is.
+	Enrich(ctx context.Context, user *domains.User)
+}
+
+type cepImpl struct {
+	url     string
+	size    int
+	ttl     time.Duration
+	timeout time.Duration
+	now     func() time.Time
+
+	mu    sync.Mutex
+	items map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	address   *domains.Address
+	expiresAt time.Time
+}
+
+// viaCEP is the response of the lookup API
+type viaCEP struct {
+	Logradouro string `json:"logradouro"`
+	Bairro     string `json:"bairro"`
+	Localidade string `json:"localidade"`
+	UF         string `json:"uf"`
+	Erro       bool   `json:"erro"`
+}
+
+// GetInstance returns the CEP lookup of config.CEPAPIURL, with its results cached for config.CEPCacheTTL
+func GetInstance() CEP {
+	once.Do(func() {
+		instance = New(config.CEPAPIURL, config.CEPCacheSize, config.CEPCacheTTL, config.CEPTimeout)
+	})
+	return instance
+}
+
+// New returns a CEP lookup of the ViaCEP compatible API at url, caching up to size results for ttl. Each
+// request is given up after timeout.
+func New(url string, size int, ttl time.Duration, timeout time.Duration) CEP {
+	return &cepImpl{
+		url:     strings.TrimSuffix(url, "/"),
+		size:    size,
+		ttl:     ttl,
+		timeout: timeout,
+		now:     time.Now,
+		items:   map[string]cacheEntry{},
+	}
+}
+
+func (c *cepImpl) Lookup(ctx context.Context, cep string) (*domains.Address, error) {
+	cep = digits(cep)
+	if len(cep) != 8 {
+		return nil, nil
+	}
+	if address, ok := c.cached(cep); ok {
+		return address, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	url := fmt.Sprintf("%s/%s/json", c.url, cep)
+	resp, err := client.GetInstance().RequestContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var address *domains.Address
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var body viaCEP
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+			return nil, err
+		}
+		if !body.Erro {
+			address = &domains.Address{CEP: cep, Street: body.Logradouro, Neighborhood: body.Bairro,
+				City: body.Localidade, UF: body.UF}
+		}
+	case http.StatusBadRequest, http.StatusNotFound:
+	default:
+		return nil, fmt.Errorf("cep: GET %s returned %d", url, resp.StatusCode)
+	}
+
+	c.store(cep, address)
+	return address, nil
+}
+
+func (c *cepImpl) Enrich(ctx context.Context, user *domains.User) {
+	for i := range user.Addresses {
+		address := &user.Addresses[i]
+		if address.CEP == "" || address.Action == domains.AddressRemove ||
+			(address.Street != "" && address.Neighborhood != "" && address.City != "" && address.UF != "") {
+			continue
+		}
+
+		found, err := c.Lookup(ctx, address.CEP)
+		if err != nil {
+			log.Errorf("[CEP Enrich] Error looking up CEP %s of user %s. ERROR: %s", address.CEP, user.ID, err)
+			continue
+		}
+		if found == nil {
+			continue
+		}
+		for field, value := range map[*string]string{
+			&address.Street:       found.Street,
+			&address.Neighborhood: found.Neighborhood,
+			&address.City:         found.City,
+			&address.UF:           found.UF,
+		} {
+			if *field == "" {
+				*field = value
+			}
+		}
+	}
+}
+
+// cached returns the cached result of cep, a nil address being a CEP that does not exist
+func (c *cepImpl) cached(cep string) (*domains.Address, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.items[cep]
+	if !ok {
+		return nil, false
+	}
+	if c.now().After(entry.expiresAt) {
+		delete(c.items, cep)
+		return nil, false
+	}
+	return entry.address, true
+}
+
+// store caches the result of cep. A full cache drops its expired entries, or any entry when none expired.
+func (c *cepImpl) store(cep string, address *domains.Address) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.size <= 0 {
+		return
+	}
+
+	now := c.now()
+	if len(c.items) >= c.size {
+		for key, entry := range c.items {
+			if now.After(entry.expiresAt) {
+				delete(c.items, key)
+			}
+		}
+	}
+	for key := range c.items {
+		if len(c.items) < c.size {
+			break
+		}
+		delete(c.items, key)
+	}
+	c.items[cep] = cacheEntry{address: address, expiresAt: now.Add(c.ttl)}
+}
+
+func digits(value string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, value)
+}
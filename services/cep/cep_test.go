@@ -0,0 +1,115 @@
+package cep
+
+import (
+	"context"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newServer(requests *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		switch r.URL.Path {
+		case "/01001000/json":
+			fmt.Fprint(w, `{"cep":"01001-000","logradouro":"Praça da Sé","bairro":"Sé","localidade":"São Paulo","uf":"SP"}`)
+		case "/99999999/json":
+			fmt.Fprint(w, `{"erro":true}`)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+}
+
+func TestCEP_Enrich(t *testing.T) {
+	var requests int32
+	server := newServer(&requests)
+	defer server.Close()
+	service := New(server.URL, 10, time.Minute, time.Second)
+
+	user := &domains.User{ID: "1", Addresses: []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001-000", Number: "1", Street: "Praça da Sé, lado ímpar"},
+		{Type: domains.AddressBilling, CEP: "99999-999", Number: "2"},
+		{Type: domains.AddressBilling, Number: "3"},
+	}}
+	service.Enrich(context.Background(), user)
+
+	assert.Equal(t, []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001-000", Number: "1", Street: "Praça da Sé, lado ímpar",
+			Neighborhood: "Sé", City: "São Paulo", UF: "SP"},
+		{Type: domains.AddressBilling, CEP: "99999-999", Number: "2"},
+		{Type: domains.AddressBilling, Number: "3"},
+	}, user.Addresses)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+}
+
+func TestCEP_Lookup_Cached(t *testing.T) {
+	var requests int32
+	server := newServer(&requests)
+	defer server.Close()
+	service := New(server.URL, 10, time.Minute, time.Second).(*cepImpl)
+	now := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	service.now = func() time.Time { return now }
+
+	for _, cep := range []string{"01001-000", "01001000", "99999-999", "99999999"} {
+		_, err := service.Lookup(context.Background(), cep)
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	now = now.Add(2 * time.Minute)
+	address, err := service.Lookup(context.Background(), "01001-000")
+	assert.Nil(t, err)
+	assert.Equal(t, "São Paulo", address.City)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&requests))
+}
+
+func TestCEP_Lookup_Error(t *testing.T) {
+	var requests int32
+	server := newServer(&requests)
+	defer server.Close()
+	service := New(server.URL, 10, time.Minute, time.Second)
+
+	for i := 0; i < 2; i++ {
+		address, err := service.Lookup(context.Background(), "20040-002")
+		assert.NotNil(t, err)
+		assert.Nil(t, address)
+	}
+	assert.Equal(t, int32(2), atomic.LoadInt32(&requests))
+
+	user := &domains.User{Addresses: []domains.Address{{CEP: "20040-002"}}}
+	service.Enrich(context.Background(), user)
+	assert.Equal(t, []domains.Address{{CEP: "20040-002"}}, user.Addresses)
+}
+
+func TestCEP_Lookup_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+	service := New(server.URL, 10, time.Minute, 50*time.Millisecond)
+
+	start := time.Now()
+	address, err := service.Lookup(context.Background(), "01001-000")
+	assert.NotNil(t, err)
+	assert.Nil(t, address)
+	assert.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	service = New(server.URL, 10, time.Minute, time.Minute)
+	start = time.Now()
+	_, err = service.Lookup(ctx, "01001-000")
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+}
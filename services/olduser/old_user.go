@@ -3,7 +3,11 @@ package olduser
 import (
 	"context"
 	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
 	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"sort"
 	"sync"
 	"time"
 )
@@ -17,42 +21,163 @@ var (
 	once     sync.Once
 )
 
+// OldUsers is the repository of the archived users, implemented over MongoDB and PostgreSQL. Every archive of
+// a user is kept as its own entry. On MongoDB entries are stored with the users of their ClientID, see
+// user.Users.
 type OldUsers interface {
-	Get(id string) (*domains.User, error)
-	Insert(user *domains.User) (string, error)
+	Insert(ctx context.Context, entry *domains.ArchivedUser) (string, error)
+	List(ctx context.Context, userID string) ([]*domains.ArchivedUser, error)
+	Latest(ctx context.Context, userID string) (*domains.ArchivedUser, error)
+	Each(ctx context.Context, filter domains.UserFilter, fn func(entry *domains.ArchivedUser) error) error
 }
 
-type oldUsersImpl struct{}
+type oldUsersImpl struct {
+	db storage.MongoDB
+}
+
+// New returns the OldUsers stored in db
+func New(db storage.MongoDB) OldUsers {
+	return &oldUsersImpl{db: db}
+}
 
+// GetInstance returns the OldUsers of the storage backend selected by config.StorageBackend
 func GetInstance() OldUsers {
 	once.Do(func() {
+		if config.StorageBackend == config.StoragePostgres {
+			instance = &postgresOldUsers{}
+			return
+		}
 		instance = &oldUsersImpl{}
 	})
 	return instance
 }
 
-func (o *oldUsersImpl) Get(id string) (*domains.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+// database is the storage given to New, or the package instance
+func (o *oldUsersImpl) database() storage.MongoDB {
+	if o.db != nil {
+		return o.db
+	}
+	return storage.GetInstance()
+}
+
+// Insert writes a new archive entry, with a generated ID and archived now unless they are set
+func (o *oldUsersImpl) Insert(ctx context.Context, entry *domains.ArchivedUser) (string, error) {
+	ctx, cancel := context.WithTimeout(tenant.WithClientID(ctx, entry.User.ClientID), config.StorageWriteTimeout)
 	defer cancel()
 
-	var user domains.User
-	if mgoErr := storage.GetInstance().FindOne(ctx, oldUsersCollection, map[string]interface{}{"_id": id}, &user); mgoErr != nil {
-		return nil, mgoErr
+	prepareEntry(entry)
+
+	id, mgoErr := o.database().Insert(ctx, oldUsersCollection, entry)
+	if mgoErr != nil {
+		return "", mgoErr
 	}
 
-	return &user, nil
+	return id.(string), nil
 }
 
-func (o *oldUsersImpl) Insert(user *domains.User) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+// List returns the archive entries of the user, the oldest first
+func (o *oldUsersImpl) List(ctx context.Context, userID string) ([]*domains.ArchivedUser, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
 	defer cancel()
 
-	user.UpdatedAt = time.Now()
+	var entries []*domains.ArchivedUser
+	err := o.each(ctx, map[string]interface{}{"$or": []interface{}{
+		map[string]interface{}{"userId": userID},
+		map[string]interface{}{"_id": userID, "userId": map[string]interface{}{"$exists": false}},
+	}}, func(entry *domains.ArchivedUser) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].ArchivedAt.Before(entries[j].ArchivedAt) })
+	return entries, nil
+}
+
+// Latest returns the last archive entry of the user, or storage.ErrNotFound when it was never archived
+func (o *oldUsersImpl) Latest(ctx context.Context, userID string) (*domains.ArchivedUser, error) {
+	entries, err := o.List(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, storage.ErrNotFound
+	}
+	return entries[len(entries)-1], nil
+}
+
+// Each streams the archive entries whose snapshot matches the filter from a cursor, stopping at the first
+// error returned by fn. The update time of the filter is matched against the archive time.
+func (o *oldUsersImpl) Each(ctx context.Context, filter domains.UserFilter, fn func(entry *domains.ArchivedUser) error) error {
+	ctx, cancel := context.WithCancel(tenant.WithClientID(ctx, filter.ClientID))
+	defer cancel()
 
-	id, mgoErr := storage.GetInstance().Insert(ctx, oldUsersCollection, user)
+	return o.each(ctx, archiveQuery(filter), fn)
+}
+
+func (o *oldUsersImpl) each(ctx context.Context, query map[string]interface{}, fn func(entry *domains.ArchivedUser) error) error {
+	cursor, mgoErr := o.database().FindCursor(ctx, oldUsersCollection, query)
 	if mgoErr != nil {
-		return "", mgoErr
+		return mgoErr
 	}
+	defer cursor.Close(ctx)
 
-	return id.(string), nil
+	for cursor.Next(ctx) {
+		entry, err := decodeEntry(cursor.Decode)
+		if err != nil {
+			return err
+		}
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return storage.Classify(cursor.Err())
+}
+
+// prepareEntry generates the ID of a new entry and stamps its archive time
+func prepareEntry(entry *domains.ArchivedUser) {
+	if entry.ID == "" {
+		entry.ID = primitive.NewObjectID().Hex()
+	}
+	if entry.UserID == "" {
+		entry.UserID = entry.User.ID
+	}
+	if entry.ArchivedAt.IsZero() {
+		entry.ArchivedAt = time.Now()
+	}
+}
+
+// archiveQuery matches the entries whose snapshot matches the filter, and the legacy documents that match it
+func archiveQuery(filter domains.UserFilter) map[string]interface{} {
+	entries := map[string]interface{}{"userId": map[string]interface{}{"$exists": true}}
+	legacy := map[string]interface{}{"userId": map[string]interface{}{"$exists": false}}
+	for field, value := range filter.Query() {
+		legacy[field] = value
+		if field == "updatedAt" {
+			entries["archivedAt"] = value
+		} else {
+			entries["user."+field] = value
+		}
+	}
+	return map[string]interface{}{"$or": []interface{}{entries, legacy}}
+}
+
+// decodeEntry reads an archive entry. Documents archived before entries existed are the user snapshot itself,
+// keyed by the user ID and archived at their update time.
+func decodeEntry(decode func(doc interface{}) error) (*domains.ArchivedUser, error) {
+	var entry domains.ArchivedUser
+	if err := decode(&entry); err != nil {
+		return nil, storage.Classify(err)
+	}
+	if entry.UserID != "" {
+		return &entry, nil
+	}
+
+	var user domains.User
+	if err := decode(&user); err != nil {
+		return nil, storage.Classify(err)
+	}
+	return &domains.ArchivedUser{ID: user.ID, UserID: user.ID, ArchivedAt: user.UpdatedAt, User: user}, nil
 }
@@ -1,6 +1,7 @@
 package olduser
 
 import (
+	"context"
 	"github.com/coaraujo/users-go-processor/domains"
 	"github.com/stretchr/testify/mock"
 )
@@ -17,14 +18,34 @@ func (o *OldUserMock) Initialize() error {
 	return nil
 }
 
-//Get is a mock for Get
-func (o *OldUserMock) Get(id string) (*domains.User, error) {
-	args := o.Called(id)
-	return args.Get(0).(*domains.User), args.Error(1)
-}
-
 //Insert is a mock for Insert
-func (o *OldUserMock) Insert(user *domains.User) (string, error) {
-	args := o.Called(user)
+func (o *OldUserMock) Insert(ctx context.Context, entry *domains.ArchivedUser) (string, error) {
+	args := o.Called(ctx, entry)
 	return args.String(0), args.Error(1)
 }
+
+//List is a mock for List
+func (o *OldUserMock) List(ctx context.Context, userID string) ([]*domains.ArchivedUser, error) {
+	args := o.Called(ctx, userID)
+	entries, _ := args.Get(0).([]*domains.ArchivedUser)
+	return entries, args.Error(1)
+}
+
+//Latest is a mock for Latest
+func (o *OldUserMock) Latest(ctx context.Context, userID string) (*domains.ArchivedUser, error) {
+	args := o.Called(ctx, userID)
+	entry, _ := args.Get(0).(*domains.ArchivedUser)
+	return entry, args.Error(1)
+}
+
+//Each is a mock for Each, calling fn with every entry given to Return
+func (o *OldUserMock) Each(ctx context.Context, filter domains.UserFilter, fn func(entry *domains.ArchivedUser) error) error {
+	args := o.Called(ctx, filter)
+	entries, _ := args.Get(0).([]*domains.ArchivedUser)
+	for _, entry := range entries {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
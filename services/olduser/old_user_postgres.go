@@ -0,0 +1,111 @@
+package olduser
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+)
+
+// postgresOldUsers archives the removed users as JSONB entries in the old_users table. The updated_at column
+// is the archive time of the entry, client_id and status are the ones of its snapshot.
+type postgresOldUsers struct {
+	db *sql.DB
+}
+
+var postgresDB = func() *sql.DB {
+	return storage.GetPostgresInstance().DB()
+}
+
+// NewPostgres returns the OldUsers stored in the PostgreSQL db
+func NewPostgres(db *sql.DB) OldUsers {
+	return &postgresOldUsers{db: db}
+}
+
+// database is the db given to NewPostgres, or the one of the package instance
+func (o *postgresOldUsers) database() *sql.DB {
+	if o.db != nil {
+		return o.db
+	}
+	return postgresDB()
+}
+
+// Insert writes a new archive entry, with a generated ID and archived now unless they are set
+func (o *postgresOldUsers) Insert(ctx context.Context, entry *domains.ArchivedUser) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	prepareEntry(entry)
+
+	doc, err := json.Marshal(entry)
+	if err != nil {
+		return "", storage.NewError(storage.KindValidation, err)
+	}
+	if _, err = o.database().ExecContext(ctx,
+		`INSERT INTO old_users (id, user_id, client_id, status, updated_at, doc) VALUES ($1, $2, $3, $4, $5, $6::jsonb)`,
+		entry.ID, entry.UserID, entry.User.ClientID, entry.User.Status, entry.ArchivedAt, string(doc)); err != nil {
+		return "", storage.Classify(err)
+	}
+
+	return entry.ID, nil
+}
+
+// List returns the archive entries of the user, the oldest first
+func (o *postgresOldUsers) List(ctx context.Context, userID string) ([]*domains.ArchivedUser, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
+	defer cancel()
+
+	var entries []*domains.ArchivedUser
+	err := o.each(ctx, `SELECT doc FROM old_users WHERE user_id = $1 ORDER BY updated_at, id`,
+		[]interface{}{userID}, func(entry *domains.ArchivedUser) error {
+			entries = append(entries, entry)
+			return nil
+		})
+	return entries, err
+}
+
+// Latest returns the last archive entry of the user, or storage.ErrNotFound when it was never archived
+func (o *postgresOldUsers) Latest(ctx context.Context, userID string) (*domains.ArchivedUser, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
+	defer cancel()
+
+	var entry domains.ArchivedUser
+	if err := storage.ScanDocument(o.database().QueryRowContext(ctx,
+		`SELECT doc FROM old_users WHERE user_id = $1 ORDER BY updated_at DESC, id DESC LIMIT 1`, userID),
+		&entry); err != nil {
+		return nil, err
+	}
+
+	return &entry, nil
+}
+
+// Each streams the archive entries matching the filter ordered by user and archive time, stopping at the first
+// error returned by fn
+func (o *postgresOldUsers) Each(ctx context.Context, filter domains.UserFilter, fn func(entry *domains.ArchivedUser) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	where, args := filter.Where()
+	return o.each(ctx, `SELECT doc FROM old_users WHERE `+where+` ORDER BY user_id, updated_at`, args, fn)
+}
+
+func (o *postgresOldUsers) each(ctx context.Context, query string, args []interface{}, fn func(entry *domains.ArchivedUser) error) error {
+	rows, err := o.database().QueryContext(ctx, query, args...)
+	if err != nil {
+		return storage.Classify(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry domains.ArchivedUser
+		if err := storage.ScanDocument(rows, &entry); err != nil {
+			return err
+		}
+		if err := fn(&entry); err != nil {
+			return err
+		}
+	}
+	return storage.Classify(rows.Err())
+}
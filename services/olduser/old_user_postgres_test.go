@@ -0,0 +1,66 @@
+package olduser
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+)
+
+func withPostgres(t *testing.T) (*postgresOldUsers, sqlmock.Sqlmock) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgresDB = func() *sql.DB { return db }
+	return &postgresOldUsers{}, dbMock
+}
+
+func TestPostgresOldUsers_Insert_Archive(t *testing.T) {
+	oldUsers, dbMock := withPostgres(t)
+	dbMock.ExpectExec(regexp.QuoteMeta("INSERT INTO old_users")).
+		WithArgs(sqlmock.AnyArg(), "id", "client", "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	entry := &domains.ArchivedUser{User: domains.User{ID: "id", ClientID: "client"}}
+	id, err := oldUsers.Insert(context.Background(), entry)
+
+	assert.Nil(t, err)
+	assert.Equal(t, entry.ID, id)
+	assert.NotEqual(t, "id", id)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresOldUsers_List(t *testing.T) {
+	oldUsers, dbMock := withPostgres(t)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT doc FROM old_users WHERE user_id = $1 ORDER BY updated_at, id")).
+		WithArgs("id").
+		WillReturnRows(sqlmock.NewRows([]string{"doc"}).
+			AddRow(`{"_id":"a","userId":"id","user":{"_id":"id","fullName":"first"}}`).
+			AddRow(`{"_id":"b","userId":"id","user":{"_id":"id","fullName":"second"}}`))
+
+	entries, err := oldUsers.List(context.Background(), "id")
+
+	assert.Nil(t, err)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "second", entries[1].User.Name)
+}
+
+func TestPostgresOldUsers_Latest(t *testing.T) {
+	oldUsers, dbMock := withPostgres(t)
+	dbMock.ExpectQuery(regexp.QuoteMeta("ORDER BY updated_at DESC, id DESC LIMIT 1")).WithArgs("id").
+		WillReturnRows(sqlmock.NewRows([]string{"doc"}).AddRow(`{"_id":"b","userId":"id","user":{"_id":"id"}}`))
+	dbMock.ExpectQuery("SELECT doc FROM old_users").WithArgs("none").WillReturnRows(sqlmock.NewRows([]string{"doc"}))
+
+	entry, err := oldUsers.Latest(context.Background(), "id")
+	assert.Nil(t, err)
+	assert.Equal(t, "b", entry.ID)
+	assert.Equal(t, "id", entry.User.ID)
+
+	_, err = oldUsers.Latest(context.Background(), "none")
+	assert.True(t, storage.IsNotFound(err))
+}
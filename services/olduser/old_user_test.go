@@ -4,82 +4,186 @@ import (
 	"context"
 	"github.com/coaraujo/users-go-processor/domains"
 	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo/options"
 	"testing"
 	"time"
 )
 
-func TestOldUsersImpl_Get_Success(t *testing.T) {
+func TestOldUsersImpl_Insert_Success(t *testing.T) {
 	mongoMock := &storage.DataAccessLayerMock{}
-	oldUserMock := &domains.User{}
+	entry := &domains.ArchivedUser{User: domains.User{ID: "user"}}
+	mockId := "inserted_id"
 
 	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
-	mongoMock.On("FindOne", mock.Anything, oldUsersCollection, mock.Anything, mock.AnythingOfType("*domains.User")).
-		Return(nil).
+	mongoMock.On("Insert", mock.Anything, oldUsersCollection, entry).
+		Return(mockId, nil).
 		Once()
 
-	oldUser, err := GetInstance().Get("id")
+	id, err := GetInstance().Insert(context.Background(), entry)
 	assert.Nil(t, err)
-	assert.Equal(t, oldUser, oldUserMock)
+	assert.Equal(t, id, mockId)
+	assert.NotEmpty(t, entry.ID)
+	assert.Equal(t, "user", entry.UserID)
+	assert.False(t, entry.ArchivedAt.IsZero())
 
 	mongoMock.AssertExpectations(t)
 }
 
-func TestOldUsersImpl_Get_Error(t *testing.T) {
+func TestOldUsersImpl_Insert_Error(t *testing.T) {
 	mongoMock := &storage.DataAccessLayerMock{}
 	mgoErr := errors.New("error")
 
 	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
-	mongoMock.On("FindOne", mock.Anything, oldUsersCollection, mock.Anything, mock.AnythingOfType("*domains.User")).
-		Return(mgoErr).
+	mongoMock.On("Insert", mock.Anything, oldUsersCollection, mock.Anything).
+		Return("", mgoErr).
 		Once()
 
-	oldUser, err := GetInstance().Get("id")
-	assert.NotNil(t, err)
-	assert.Equal(t, mgoErr, err)
-	assert.Nil(t, oldUser)
+	id, err := GetInstance().Insert(context.Background(), &domains.ArchivedUser{})
+	assert.Equal(t, err, mgoErr)
+	assert.Equal(t, "", id)
 
 	mongoMock.AssertExpectations(t)
 }
 
-func TestOldUsersImpl_Insert_Success(t *testing.T) {
+func TestOldUsersImpl_MemoryDB_Generations(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	oldUsers := New(db)
+	first := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+
+	//archived before entries existed, the snapshot keyed by the user ID
+	_, err := db.Insert(context.Background(), oldUsersCollection, &domains.User{ID: "1", Name: "legacy", UpdatedAt: first})
+	assert.Nil(t, err)
+	for i, name := range []string{"second", "third"} {
+		_, err := oldUsers.Insert(context.Background(), &domains.ArchivedUser{ArchivedAt: first.Add(time.Duration(i+1) * time.Hour),
+			Reason: domains.ArchiveRemoved, Source: &domains.User{ID: "1"}, User: domains.User{ID: "1", Name: name}})
+		assert.Nil(t, err)
+	}
+	_, err = oldUsers.Insert(context.Background(), &domains.ArchivedUser{User: domains.User{ID: "2"}})
+	assert.Nil(t, err)
+
+	entries, err := oldUsers.List(context.Background(), "1")
+	assert.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		assert.Equal(t, "1", entry.UserID)
+		names = append(names, entry.User.Name)
+	}
+	assert.Equal(t, []string{"legacy", "second", "third"}, names)
+	assert.NotEqual(t, entries[1].ID, entries[2].ID)
+	assert.True(t, first.Equal(entries[0].ArchivedAt))
+
+	latest, err := oldUsers.Latest(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "third", latest.User.Name)
+	assert.Equal(t, domains.ArchiveRemoved, latest.Reason)
+	assert.Equal(t, "1", latest.Source.ID)
+
+	_, err = oldUsers.Latest(context.Background(), "3")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+//sliceCursor is a storage.Cursor over an in-memory slice of documents
+type sliceCursor struct {
+	docs []interface{}
+	i    int
+}
+
+func (c *sliceCursor) Next(ctx context.Context) bool {
+	c.i++
+	return c.i <= len(c.docs)
+}
+
+func (c *sliceCursor) Decode(doc interface{}) error {
+	raw, err := bson.Marshal(c.docs[c.i-1])
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, doc)
+}
+
+func (c *sliceCursor) Err() error { return nil }
+
+func (c *sliceCursor) Close(ctx context.Context) error { return nil }
+
+func TestOldUsersImpl_Each_Success(t *testing.T) {
 	mongoMock := &storage.DataAccessLayerMock{}
-	updatedAt := time.Now()
-	oldUserMock := &domains.User{}
-	mockId := "inserted_id"
+	from := time.Now().Add(-time.Hour)
+	filter := domains.UserFilter{ClientID: "client", UpdatedFrom: from}
+	cursor := &sliceCursor{docs: []interface{}{
+		domains.User{ID: "1"},
+		domains.ArchivedUser{ID: "entry", UserID: "2", User: domains.User{ID: "2"}},
+	}}
 
 	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
-	mongoMock.On("Insert", mock.Anything, oldUsersCollection, mock.Anything).
-		Return(mockId, nil).
+	mongoMock.On("FindCursor", mock.Anything, oldUsersCollection, map[string]interface{}{"$or": []interface{}{
+		map[string]interface{}{
+			"userId":        map[string]interface{}{"$exists": true},
+			"user.clientId": "client",
+			"archivedAt":    map[string]interface{}{"$gte": from},
+		},
+		map[string]interface{}{
+			"userId":    map[string]interface{}{"$exists": false},
+			"clientId":  "client",
+			"updatedAt": map[string]interface{}{"$gte": from},
+		},
+	}}).
+		Return(cursor, nil).
 		Once()
 
-	id, err := GetInstance().Insert(oldUserMock)
+	var ids []string
+	err := GetInstance().Each(context.Background(), filter, func(entry *domains.ArchivedUser) error {
+		ids = append(ids, entry.ID+"/"+entry.UserID)
+		return nil
+	})
 	assert.Nil(t, err)
-	assert.Equal(t, id, mockId)
-	assert.NotEqual(t, updatedAt, oldUserMock.UpdatedAt)
+	assert.Equal(t, []string{"1/1", "entry/2"}, ids)
 
 	mongoMock.AssertExpectations(t)
 }
 
-func TestOldUsersImpl_Insert_Error(t *testing.T) {
+func TestOldUsersImpl_Each_Error(t *testing.T) {
 	mongoMock := &storage.DataAccessLayerMock{}
-	updatedAt := time.Now()
-	userMock := &domains.User{}
-	mockid := "inserted_id"
 	mgoErr := errors.New("error")
 
 	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
-	mongoMock.On("Insert", mock.Anything, oldUsersCollection, mock.Anything).
-		Return("", mgoErr).
+	mongoMock.On("FindCursor", mock.Anything, oldUsersCollection, mock.Anything).
+		Return(nil, mgoErr).
 		Once()
 
-	id, err := GetInstance().Insert(userMock)
-	assert.Equal(t, err, mgoErr)
-	assert.NotEqual(t, id, mockid)
-	assert.NotEqual(t, updatedAt, userMock.UpdatedAt)
+	err := GetInstance().Each(context.Background(), domains.UserFilter{}, func(entry *domains.ArchivedUser) error { return nil })
+	assert.Equal(t, mgoErr, err)
 
 	mongoMock.AssertExpectations(t)
 }
+
+func TestOldUsersImpl_Tenants(t *testing.T) {
+	router := tenant.NewRouter(map[string]tenant.Route{"acme": {Database: "users_acme"}}, "")
+	shared := storage.NewMemoryDB()
+	oldUsers := New(storage.NewTenantDB(shared, router))
+	ctx := context.Background()
+
+	_, err := oldUsers.Insert(ctx, &domains.ArchivedUser{User: domains.User{ID: "1", ClientID: "acme"}})
+	assert.Nil(t, err)
+	_, err = oldUsers.Insert(ctx, &domains.ArchivedUser{User: domains.User{ID: "1", ClientID: "globex"}})
+	assert.Nil(t, err)
+
+	entries, err := oldUsers.List(tenant.NewContext(ctx, "acme"), "1")
+	assert.Nil(t, err)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "acme", entries[0].User.ClientID)
+	count, _ := shared.Count(ctx, oldUsersCollection, nil)
+	assert.Equal(t, int64(1), count)
+
+	var clients []string
+	assert.Nil(t, oldUsers.Each(ctx, domains.UserFilter{ClientID: "acme"}, func(entry *domains.ArchivedUser) error {
+		clients = append(clients, entry.User.ClientID)
+		return nil
+	}))
+	assert.Equal(t, []string{"acme"}, clients)
+}
@@ -0,0 +1,122 @@
+package tombstone
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"sync"
+	"time"
+)
+
+const (
+	tombstonesCollection = "tombstones"
+)
+
+var (
+	instance Tombstones
+	once     sync.Once
+)
+
+// Tombstones is the repository of the removed users, implemented over MongoDB and PostgreSQL. A tombstone
+// expires config.TombstoneTTL after it is written.
+type Tombstones interface {
+	Put(ctx context.Context, userID string, removedAt time.Time) error
+	Get(ctx context.Context, userID string) (*domains.Tombstone, error)
+}
+
+// Expirer is implemented by the Tombstones whose storage removes the expired tombstones by itself once told to
+type Expirer interface {
+	// Expire makes the storage remove the tombstones once they expire
+	Expire(ctx context.Context) error
+}
+
+// Purger is implemented by the Tombstones whose storage keeps the expired tombstones until they are purged
+type Purger interface {
+	// Purge deletes the expired tombstones, reporting how many were deleted
+	Purge(ctx context.Context) (int64, error)
+}
+
+type tombstonesImpl struct {
+	db storage.MongoDB
+}
+
+// New returns the Tombstones stored in db
+func New(db storage.MongoDB) Tombstones {
+	return &tombstonesImpl{db: db}
+}
+
+// GetInstance returns the Tombstones of the storage backend selected by config.StorageBackend
+func GetInstance() Tombstones {
+	once.Do(func() {
+		if config.StorageBackend == config.StoragePostgres {
+			instance = &postgresTombstones{}
+			return
+		}
+		instance = &tombstonesImpl{}
+	})
+	return instance
+}
+
+// database is the storage given to New, or the package instance
+func (t *tombstonesImpl) database() storage.MongoDB {
+	if t.db != nil {
+		return t.db
+	}
+	return storage.GetInstance()
+}
+
+// Put writes the tombstone of the user, unless it already has one removed later. The tombstone expires
+// config.TombstoneTTL from now.
+func (t *tombstonesImpl) Put(ctx context.Context, userID string, removedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	//a tombstone removed later does not match, so the upsert collides with its _id and is left as it is
+	query := map[string]interface{}{"_id": userID, "removedAt": map[string]interface{}{"$lt": removedAt}}
+	update := map[string]interface{}{"$set": map[string]interface{}{
+		"removedAt": removedAt,
+		"expiresAt": time.Now().Add(config.TombstoneTTL),
+	}}
+	var before domains.Tombstone
+	err := t.database().FindOneAndUpdate(ctx, tombstonesCollection, query, update, true, &before)
+	if err == nil || storage.IsNotFound(err) || storage.KindOf(err) == storage.KindConflict {
+		return nil
+	}
+	return err
+}
+
+// Get returns the tombstone of the user, or storage.ErrNotFound when it has none or it expired
+func (t *tombstonesImpl) Get(ctx context.Context, userID string) (*domains.Tombstone, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
+	defer cancel()
+
+	var tombstone domains.Tombstone
+	query := map[string]interface{}{"_id": userID, "expiresAt": map[string]interface{}{"$gt": time.Now()}}
+	if err := t.database().FindOne(ctx, tombstonesCollection, query, &tombstone); err != nil {
+		return nil, err
+	}
+
+	return &tombstone, nil
+}
+
+// Expire creates a TTL index on expiresAt in the storage of the shared database, unless the tenant policy
+// rejects it, and of every routed ClientID. A storage that can not expire documents, like the MemoryDB, keeps
+// the expired tombstones, which Get ignores.
+func (t *tombstonesImpl) Expire(ctx context.Context) error {
+	expirer, ok := t.database().(storage.Expirer)
+	if !ok {
+		return nil
+	}
+	router := tenant.GetInstance()
+	for _, clientID := range append([]string{""}, router.ClientIDs()...) {
+		if _, err := router.Resolve(clientID); err != nil {
+			continue
+		}
+		if err := expirer.Expire(tenant.NewContext(ctx, clientID), tombstonesCollection, "expiresAt"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package tombstone
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/stretchr/testify/mock"
+	"time"
+)
+
+//TombstoneMock is a mock for Tombstones
+type TombstoneMock struct {
+	mock.Mock
+}
+
+//Initialize is a mock for Initialize
+func (t *TombstoneMock) Initialize() error {
+	GetInstance()
+	instance = t
+	return nil
+}
+
+//Put is a mock for Put
+func (t *TombstoneMock) Put(ctx context.Context, userID string, removedAt time.Time) error {
+	args := t.Called(ctx, userID, removedAt)
+	return args.Error(0)
+}
+
+//Get is a mock for Get
+func (t *TombstoneMock) Get(ctx context.Context, userID string) (*domains.Tombstone, error) {
+	args := t.Called(ctx, userID)
+	tombstone, _ := args.Get(0).(*domains.Tombstone)
+	return tombstone, args.Error(1)
+}
@@ -0,0 +1,79 @@
+package tombstone
+
+import (
+	"context"
+	"database/sql"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"time"
+)
+
+// postgresTombstones keeps a row per removed user in the tombstones table
+type postgresTombstones struct {
+	db *sql.DB
+}
+
+var postgresDB = func() *sql.DB {
+	return storage.GetPostgresInstance().DB()
+}
+
+// NewPostgres returns the Tombstones stored in the PostgreSQL db
+func NewPostgres(db *sql.DB) Tombstones {
+	return &postgresTombstones{db: db}
+}
+
+// database is the db given to NewPostgres, or the one of the package instance
+func (t *postgresTombstones) database() *sql.DB {
+	if t.db != nil {
+		return t.db
+	}
+	return postgresDB()
+}
+
+// Put writes the tombstone of the user, unless it already has one removed later. The tombstone expires
+// config.TombstoneTTL from now.
+func (t *postgresTombstones) Put(ctx context.Context, userID string, removedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	if _, err := t.database().ExecContext(ctx, `INSERT INTO tombstones (user_id, removed_at, expires_at)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id) DO UPDATE SET removed_at = EXCLUDED.removed_at, expires_at = EXCLUDED.expires_at
+		WHERE tombstones.removed_at < EXCLUDED.removed_at`,
+		userID, removedAt, time.Now().Add(config.TombstoneTTL)); err != nil {
+		return storage.Classify(err)
+	}
+
+	return nil
+}
+
+// Get returns the tombstone of the user, or storage.ErrNotFound when it has none or it expired
+func (t *postgresTombstones) Get(ctx context.Context, userID string) (*domains.Tombstone, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
+	defer cancel()
+
+	var tombstone domains.Tombstone
+	err := t.database().QueryRowContext(ctx,
+		`SELECT user_id, removed_at, expires_at FROM tombstones WHERE user_id = $1 AND expires_at > $2`,
+		userID, time.Now()).Scan(&tombstone.UserID, &tombstone.RemovedAt, &tombstone.ExpiresAt)
+	if err != nil {
+		return nil, storage.Classify(err)
+	}
+
+	return &tombstone, nil
+}
+
+// Purge deletes the expired tombstones. PostgreSQL has no TTL, so it is called every
+// config.TombstonePurgeInterval.
+func (t *postgresTombstones) Purge(ctx context.Context) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageBulkTimeout)
+	defer cancel()
+
+	result, err := t.database().ExecContext(ctx, `DELETE FROM tombstones WHERE expires_at <= $1`, time.Now())
+	if err != nil {
+		return 0, storage.Classify(err)
+	}
+	purged, _ := result.RowsAffected()
+	return purged, nil
+}
@@ -0,0 +1,63 @@
+package tombstone
+
+import (
+	"context"
+	"database/sql"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func withPostgres(t *testing.T) (*postgresTombstones, sqlmock.Sqlmock) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgresDB = func() *sql.DB { return db }
+	return &postgresTombstones{}, dbMock
+}
+
+func TestPostgresTombstones_Put(t *testing.T) {
+	tombstones, dbMock := withPostgres(t)
+	removedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("WHERE tombstones.removed_at < EXCLUDED.removed_at")).
+		WithArgs("id", removedAt, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.Nil(t, tombstones.Put(context.Background(), "id", removedAt))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresTombstones_Get(t *testing.T) {
+	tombstones, dbMock := withPostgres(t)
+	removedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	dbMock.ExpectQuery(regexp.QuoteMeta("FROM tombstones WHERE user_id = $1 AND expires_at > $2")).
+		WithArgs("id", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "removed_at", "expires_at"}).
+			AddRow("id", removedAt, removedAt.Add(time.Hour)))
+	dbMock.ExpectQuery("FROM tombstones").WithArgs("none", sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"user_id", "removed_at", "expires_at"}))
+
+	tombstone, err := tombstones.Get(context.Background(), "id")
+	assert.Nil(t, err)
+	assert.Equal(t, "id", tombstone.UserID)
+	assert.True(t, removedAt.Equal(tombstone.RemovedAt))
+
+	_, err = tombstones.Get(context.Background(), "none")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestPostgresTombstones_Purge(t *testing.T) {
+	tombstones, dbMock := withPostgres(t)
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM tombstones WHERE expires_at <= $1")).
+		WithArgs(sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	purged, err := tombstones.Purge(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), purged)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
@@ -0,0 +1,81 @@
+package tombstone
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"testing"
+	"time"
+)
+
+func withMemoryDB(t *testing.T) Tombstones {
+	db := storage.NewMemoryDB()
+	if err := db.Initialize(context.Background(), options.Credential{}, "", ""); err != nil {
+		t.Fatal(err)
+	}
+	return New(db)
+}
+
+func TestTombstonesImpl_PutGet(t *testing.T) {
+	tombstones := withMemoryDB(t)
+	defer func(ttl time.Duration) { config.TombstoneTTL = ttl }(config.TombstoneTTL)
+	config.TombstoneTTL = time.Hour
+	removedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+
+	assert.Nil(t, tombstones.Put(context.Background(), "1", removedAt))
+	//an older removal does not move the tombstone back
+	assert.Nil(t, tombstones.Put(context.Background(), "1", removedAt.Add(-time.Hour)))
+
+	tombstone, err := tombstones.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "1", tombstone.UserID)
+	assert.True(t, removedAt.Equal(tombstone.RemovedAt))
+	assert.True(t, tombstone.ExpiresAt.After(time.Now()))
+
+	assert.Nil(t, tombstones.Put(context.Background(), "1", removedAt.Add(time.Hour)))
+	tombstone, err = tombstones.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.True(t, removedAt.Add(time.Hour).Equal(tombstone.RemovedAt))
+
+	_, err = tombstones.Get(context.Background(), "2")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestTombstonesImpl_Get_Expired(t *testing.T) {
+	tombstones := withMemoryDB(t)
+	defer func(ttl time.Duration) { config.TombstoneTTL = ttl }(config.TombstoneTTL)
+	config.TombstoneTTL = -time.Second
+
+	assert.Nil(t, tombstones.Put(context.Background(), "1", time.Now()))
+
+	_, err := tombstones.Get(context.Background(), "1")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+//expiringDB records the collections it is told to expire
+type expiringDB struct {
+	storage.MongoDB
+	expired []string
+}
+
+func (db *expiringDB) Expire(ctx context.Context, collName string, field string) error {
+	db.expired = append(db.expired, collName+"."+field)
+	return nil
+}
+
+func TestTombstonesImpl_Expire_EveryTenant(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Prefix: "acme_"}, "globex": {Prefix: "globex_"}},
+		config.TenantReject)
+	db := &expiringDB{MongoDB: storage.NewMemoryDB()}
+
+	assert.Nil(t, New(storage.NewTenantDB(db, tenant.GetInstance())).(Expirer).Expire(context.Background()))
+	//the shared database is rejected by the policy
+	assert.Equal(t, []string{"acme_tombstones.expiresAt", "globex_tombstones.expiresAt"}, db.expired)
+
+	//a storage that can not expire is left as it is
+	assert.Nil(t, withMemoryDB(t).(Expirer).Expire(context.Background()))
+}
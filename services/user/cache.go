@@ -0,0 +1,254 @@
+package user
+
+import (
+	"container/list"
+	"context"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//CacheStats are the counters of the Users.Get cache
+type CacheStats struct {
+	Mode      string `json:"mode"`
+	Size      int    `json:"size"`
+	Hits      int64  `json:"hits"`
+	Misses    int64  `json:"misses"`
+	Evictions int64  `json:"evictions"`
+}
+
+//cachedUsers is a read-through LRU cache in front of Users.Get. Every write invalidates the users it touches.
+//
+//In config.UserCacheFull mode found and missing users are cached, which saves the FindOne of hot users: the
+//Upsert of a cached user with phones, addresses or status merges into it instead of reading it again, and
+//caches the merged user. It is meant for a single replica writing each user: one processor, or Kafka keyed by
+//_id. With more writers a stale cached user fails the version check of Update, which invalidates it and makes
+//SaveUser retry, so it stays correct but spends retries.
+//
+//In config.UserCacheNegative mode only missing users are cached. A stale miss lasts at most the TTL: a remove
+//of a user that another replica created meanwhile fails with not found and is redelivered. With tombstones the
+//remove does not trust the miss, it confirms it with GetWithDeleted, which is never cached, before writing the
+//tombstone. Either way it is safe with any number of replicas.
+type cachedUsers struct {
+	hits      int64
+	misses    int64
+	evictions int64
+
+	Users
+	mode  string
+	size  int
+	ttl   time.Duration
+	now   func() time.Time
+	mu    sync.Mutex
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+//cacheEntry is kept by the cacheKey of the user in id
+type cacheEntry struct {
+	id        string
+	user      *domains.User
+	expiresAt time.Time
+}
+
+func newCachedUsers(users Users, mode string, size int, ttl time.Duration) *cachedUsers {
+	return &cachedUsers{
+		Users: users,
+		mode:  mode,
+		size:  size,
+		ttl:   ttl,
+		now:   time.Now,
+		lru:   list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+//NewCached puts users behind the Get cache of config.UserCacheMode, users is returned as is when the cache is off
+func NewCached(users Users) Users {
+	if config.UserCacheMode != config.UserCacheFull && config.UserCacheMode != config.UserCacheNegative {
+		return users
+	}
+	return newCachedUsers(users, config.UserCacheMode, config.UserCacheSize, config.UserCacheTTL)
+}
+
+//GetCacheStats returns the counters of the Users.Get cache of the package instance, zeroed when it is disabled
+func GetCacheStats() CacheStats {
+	return CacheStatsOf(GetInstance())
+}
+
+//CacheStatsOf returns the counters of the Get cache of users, zeroed when users is not cached
+func CacheStatsOf(users Users) CacheStats {
+	cache, ok := users.(*cachedUsers)
+	if !ok {
+		return CacheStats{}
+	}
+	return cache.stats()
+}
+
+func (c *cachedUsers) stats() CacheStats {
+	c.mu.Lock()
+	size := c.lru.Len()
+	c.mu.Unlock()
+
+	return CacheStats{
+		Mode:      c.mode,
+		Size:      size,
+		Hits:      atomic.LoadInt64(&c.hits),
+		Misses:    atomic.LoadInt64(&c.misses),
+		Evictions: atomic.LoadInt64(&c.evictions),
+	}
+}
+
+func (c *cachedUsers) Get(ctx context.Context, id string) (*domains.User, error) {
+	key := cacheKey(ctx, "", id)
+	if entry, ok := c.lookup(key); ok {
+		atomic.AddInt64(&c.hits, 1)
+		if entry.user == nil {
+			return nil, storage.ErrNotFound
+		}
+		return copyUser(entry.user), nil
+	}
+	atomic.AddInt64(&c.misses, 1)
+
+	user, err := c.Users.Get(ctx, id)
+	switch {
+	case storage.IsNotFound(err):
+		c.store(key, nil)
+	case err == nil && c.mode == config.UserCacheFull:
+		c.store(key, copyUser(user))
+	}
+	return user, err
+}
+
+func (c *cachedUsers) Insert(ctx context.Context, user *domains.User) (string, error) {
+	defer c.invalidate(cacheKey(ctx, user.ClientID, user.ID))
+	return c.Users.Insert(ctx, user)
+}
+
+func (c *cachedUsers) Update(ctx context.Context, newUser *domains.User, oldUser *domains.User) error {
+	defer c.invalidate(cacheKey(ctx, oldUser.ClientID, oldUser.ID))
+	return c.Users.Update(ctx, newUser, oldUser)
+}
+
+//Upsert merges a user that needs it into the user cached in config.UserCacheFull mode, and goes through the
+//Upsert of the storage otherwise: missing, soft deleted and new users are left to it
+func (c *cachedUsers) Upsert(ctx context.Context, user *domains.User) (bool, error) {
+	ctx = tenant.WithClientID(ctx, user.ClientID)
+	key := cacheKey(ctx, user.ClientID, user.ID)
+	if c.mode == config.UserCacheFull && needsMerge(user) {
+		if stored, err := c.Get(ctx, user.ID); err == nil {
+			if err := c.Users.Update(ctx, user, stored); err != nil {
+				c.invalidate(key)
+				return false, err
+			}
+			c.store(key, copyUser(stored))
+			return false, nil
+		}
+	}
+
+	defer c.invalidate(key)
+	return c.Users.Upsert(ctx, user)
+}
+
+func (c *cachedUsers) Replace(ctx context.Context, user *domains.User) error {
+	defer c.invalidate(cacheKey(ctx, user.ClientID, user.ID))
+	return c.Users.Replace(ctx, user)
+}
+
+func (c *cachedUsers) Delete(ctx context.Context, id string) error {
+	defer c.invalidate(cacheKey(ctx, "", id))
+	return c.Users.Delete(ctx, id)
+}
+
+func (c *cachedUsers) SoftDelete(ctx context.Context, id string, deletedAt time.Time) error {
+	defer c.invalidate(cacheKey(ctx, "", id))
+	return c.Users.SoftDelete(ctx, id, deletedAt)
+}
+
+func (c *cachedUsers) BulkSave(ctx context.Context, users []*domains.User) (*BulkResult, error) {
+	defer func() {
+		for _, user := range users {
+			c.invalidate(cacheKey(ctx, user.ClientID, user.ID))
+		}
+	}()
+	return c.Users.BulkSave(ctx, users)
+}
+
+func (c *cachedUsers) lookup(id string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[id]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expiresAt) {
+		c.lru.Remove(element)
+		delete(c.items, id)
+		return nil, false
+	}
+	c.lru.MoveToFront(element)
+	return entry, true
+}
+
+func (c *cachedUsers) store(id string, user *domains.User) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry := &cacheEntry{id: id, user: user, expiresAt: c.now().Add(c.ttl)}
+	if element, ok := c.items[id]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+		return
+	}
+	c.items[id] = c.lru.PushFront(entry)
+
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.items, oldest.Value.(*cacheEntry).id)
+		atomic.AddInt64(&c.evictions, 1)
+	}
+}
+
+func (c *cachedUsers) invalidate(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[id]; ok {
+		c.lru.Remove(element)
+		delete(c.items, id)
+	}
+}
+
+//cacheKey keys the users by the storage of their ClientID, or of the one of ctx, since tenants routed apart can
+//have users with the same id
+func cacheKey(ctx context.Context, clientID string, id string) string {
+	if clientID == "" {
+		clientID = tenant.FromContext(ctx)
+	}
+	if scope := tenant.GetInstance().Scope(clientID); scope != "" {
+		return scope + "/" + id
+	}
+	return id
+}
+
+//copyUser keeps the cached user apart from the callers, Update merges into the user returned by Get
+func copyUser(user *domains.User) *domains.User {
+	copied := *user
+	if user.Phones != nil {
+		copied.Phones = append(domains.Phones{}, user.Phones...)
+	}
+	if user.Addresses != nil {
+		copied.Addresses = append([]domains.Address{}, user.Addresses...)
+	}
+	if user.StatusHistory != nil {
+		copied.StatusHistory = append([]domains.StatusTransition{}, user.StatusHistory...)
+	}
+	return &copied
+}
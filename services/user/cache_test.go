@@ -0,0 +1,162 @@
+package user
+
+import (
+	"context"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/mongo"
+	"testing"
+	"time"
+)
+
+func TestCachedUsers_Get_ReadThrough(t *testing.T) {
+	usersMock := &UserMock{}
+	cache := newCachedUsers(usersMock, config.UserCacheFull, 10, time.Minute)
+	stored := &domains.User{ID: "1", Email: "user@email.com", Phones: domains.Phones{{Number: "1"}}}
+
+	usersMock.On("Get", mock.Anything, "1").Return(stored, nil).Once()
+
+	first, err := cache.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	first.Email = "changed"
+	first.Phones[0].Number = "changed"
+
+	second, err := cache.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "user@email.com", second.Email)
+	assert.Equal(t, "1", second.Phones[0].Number)
+
+	stats := cache.stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(1), stats.Misses)
+	usersMock.AssertExpectations(t)
+}
+
+func TestCachedUsers_InvalidatedOnWrites(t *testing.T) {
+	usersMock := &UserMock{}
+	cache := newCachedUsers(usersMock, config.UserCacheFull, 10, time.Minute)
+	stored := &domains.User{ID: "1"}
+
+	usersMock.On("Get", mock.Anything, "1").Return(stored, nil).Times(3)
+	usersMock.On("Update", mock.Anything, stored, stored).Return(nil).Once()
+	usersMock.On("Delete", mock.Anything, "1").Return(nil).Once()
+
+	_, _ = cache.Get(context.Background(), "1")
+	assert.Nil(t, cache.Update(context.Background(), stored, stored))
+	_, _ = cache.Get(context.Background(), "1")
+	assert.Nil(t, cache.Delete(context.Background(), "1"))
+	_, _ = cache.Get(context.Background(), "1")
+
+	assert.Equal(t, int64(3), cache.stats().Misses)
+	usersMock.AssertExpectations(t)
+}
+
+func TestCachedUsers_NegativeMode(t *testing.T) {
+	usersMock := &UserMock{}
+	cache := newCachedUsers(usersMock, config.UserCacheNegative, 10, time.Minute)
+
+	usersMock.On("Get", mock.Anything, "found").Return(&domains.User{ID: "found"}, nil).Twice()
+	usersMock.On("Get", mock.Anything, "missing").Return((*domains.User)(nil), mongo.ErrNoDocuments).Once()
+
+	_, _ = cache.Get(context.Background(), "found")
+	_, _ = cache.Get(context.Background(), "found")
+	_, err := cache.Get(context.Background(), "missing")
+	assert.True(t, storage.IsNotFound(err))
+	_, err = cache.Get(context.Background(), "missing")
+	assert.True(t, storage.IsNotFound(err))
+
+	stats := cache.stats()
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	usersMock.AssertExpectations(t)
+}
+
+func TestCachedUsers_TTLAndEviction(t *testing.T) {
+	usersMock := &UserMock{}
+	cache := newCachedUsers(usersMock, config.UserCacheFull, 2, time.Minute)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+
+	for _, id := range []string{"1", "2", "3"} {
+		usersMock.On("Get", mock.Anything, id).Return(&domains.User{ID: id}, nil)
+	}
+
+	_, _ = cache.Get(context.Background(), "1")
+	_, _ = cache.Get(context.Background(), "2")
+	_, _ = cache.Get(context.Background(), "1")
+	_, _ = cache.Get(context.Background(), "3")
+	assert.Equal(t, int64(1), cache.stats().Evictions)
+
+	//"2" was the least recently used
+	_, _ = cache.Get(context.Background(), "1")
+	assert.Equal(t, int64(2), cache.stats().Hits)
+
+	now = now.Add(time.Minute)
+	_, _ = cache.Get(context.Background(), "1")
+	assert.Equal(t, int64(2), cache.stats().Hits)
+	assert.Equal(t, int64(4), cache.stats().Misses)
+}
+
+func TestCachedUsers_KeyedByTenant(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Prefix: "acme_"}}, "")
+	usersMock := &UserMock{}
+	cache := newCachedUsers(usersMock, config.UserCacheFull, 10, time.Minute)
+	acme := tenant.NewContext(context.Background(), "acme")
+
+	usersMock.On("Get", acme, "1").Return(&domains.User{ID: "1", ClientID: "acme"}, nil).Twice()
+	usersMock.On("Get", context.Background(), "1").Return(&domains.User{ID: "1"}, nil).Once()
+	usersMock.On("Upsert", mock.Anything, &domains.User{ID: "1", ClientID: "acme"}).Return(false, nil).Once()
+
+	user, _ := cache.Get(acme, "1")
+	assert.Equal(t, "acme", user.ClientID)
+	user, _ = cache.Get(context.Background(), "1")
+	assert.Equal(t, "", user.ClientID)
+	_, _ = cache.Upsert(context.Background(), &domains.User{ID: "1", ClientID: "acme"})
+	_, _ = cache.Get(acme, "1")
+	_, _ = cache.Get(context.Background(), "1")
+
+	assert.Equal(t, int64(1), cache.stats().Hits)
+	usersMock.AssertExpectations(t)
+}
+
+func TestCachedUsers_Upsert_MergesIntoCachedUser(t *testing.T) {
+	db := storage.NewMemoryDB()
+	cache := newCachedUsers(New(db), config.UserCacheFull, 10, time.Minute)
+	ctx := context.Background()
+	phone := func(number string) domains.Phones {
+		return domains.Phones{{Type: domains.PhoneMobile, DDD: "11", Number: number}}
+	}
+
+	created, err := cache.Upsert(ctx, &domains.User{ID: "1", Phones: phone("911111111"), UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.True(t, created)
+	_, err = cache.Upsert(ctx, &domains.User{ID: "1", Phones: phone("922222222"), UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	_, err = cache.Upsert(ctx, &domains.User{ID: "1", Status: domains.StatusActive, UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	//the last merge reads the user cached by the one before
+	assert.Equal(t, int64(1), cache.stats().Hits)
+
+	stored, err := New(db).Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.Len(t, stored.Phones, 2)
+	assert.Equal(t, domains.StatusActive, stored.Status)
+	assert.Equal(t, int64(3), stored.Version)
+
+	//another writer makes the cached user stale, its merge conflicts and the retry reads it again
+	_, err = New(db).Upsert(ctx, &domains.User{ID: "1", Phones: phone("933333333"), UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	_, err = cache.Upsert(ctx, &domains.User{ID: "1", Phones: phone("944444444"), UpdatedAt: time.Now()})
+	assert.Equal(t, ErrVersionConflict, err)
+	_, err = cache.Upsert(ctx, &domains.User{ID: "1", Phones: phone("944444444"), UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+
+	stored, err = New(db).Get(ctx, "1")
+	assert.Nil(t, err)
+	assert.Len(t, stored.Phones, 4)
+}
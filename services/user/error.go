@@ -0,0 +1,58 @@
+package user
+
+import (
+	"errors"
+	"fmt"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+)
+
+var (
+	//ErrMissingID for users received without _id
+	ErrMissingID = storage.NewError(storage.KindValidation, errors.New("user without _id"))
+	//ErrVersionConflict for updates of a user that was written since it was read
+	ErrVersionConflict = storage.NewError(storage.KindConflict, errors.New("user version changed since it was read"))
+	//ErrInvalidStatus for users received with a status that is not one of the domains statuses
+	ErrInvalidStatus = storage.NewError(storage.KindValidation, errors.New("unknown user status"))
+)
+
+//StatusTransitionError is the cause of the validation error returned for a status change that the domains
+//transitions do not allow
+type StatusTransitionError struct {
+	ID   string
+	From string
+	To   string
+}
+
+func (e *StatusTransitionError) Error() string {
+	return fmt.Sprintf("user %s can not move from status %s to %s", e.ID, e.From, e.To)
+}
+
+//IsInvalidStatusTransition reports whether err was caused by a status change that is not allowed
+func IsInvalidStatusTransition(err error) bool {
+	if storageErr, ok := err.(*storage.Error); ok {
+		err = storageErr.Err
+	}
+	_, ok := err.(*StatusTransitionError)
+	return ok
+}
+
+//validateStatusTransition checks that the stored user can move to the status of the event
+var validateStatusTransition = func(stored *domains.User, user *domains.User) error {
+	if user.Status == "" || domains.CanTransition(stored.Status, user.Status) {
+		return nil
+	}
+	return storage.NewError(storage.KindValidation,
+		&StatusTransitionError{ID: stored.ID, From: stored.Status, To: user.Status})
+}
+
+//Validate checks if the user can be persisted
+var Validate = func(user *domains.User) error {
+	if user.ID == "" {
+		return ErrMissingID
+	}
+	if user.Status != "" && !domains.IsStatus(user.Status) {
+		return ErrInvalidStatus
+	}
+	return nil
+}
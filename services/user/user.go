@@ -3,10 +3,14 @@ package user
 import (
 	"context"
 	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
 	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
 	"github.com/labstack/gommon/log"
+	"github.com/pkg/errors"
+	"go.mongodb.org/mongo-driver/mongo"
 	"sync"
 	"time"
 )
@@ -20,41 +24,91 @@ var (
 	once     sync.Once
 )
 
+// Users is the repository of the users, implemented over MongoDB and PostgreSQL. On MongoDB the operations given
+// a user or a filter run on the storage of its ClientID, see storage.TenantDB, and the ones given an id on the
+// storage of the ClientID carried by the context, tenant.NewContext.
 type Users interface {
-	Get(id string) (*domains.User, error)
-	Insert(user *domains.User) (string, error)
-	Update(newUser *domains.User, oldUser *domains.User) error
-	Delete(id string) error
+	Get(ctx context.Context, id string) (*domains.User, error)
+	Insert(ctx context.Context, user *domains.User) (string, error)
+	Update(ctx context.Context, newUser *domains.User, oldUser *domains.User) error
+	Upsert(ctx context.Context, user *domains.User) (bool, error)
+	Replace(ctx context.Context, user *domains.User) error
+	Delete(ctx context.Context, id string) error
+	SoftDelete(ctx context.Context, id string, deletedAt time.Time) error
+	GetWithDeleted(ctx context.Context, id string) (*domains.User, error)
+	BulkSave(ctx context.Context, users []*domains.User) (*BulkResult, error)
+	Each(ctx context.Context, filter domains.UserFilter, fn func(user *domains.User) error) error
 }
 
-type usersImpl struct{}
+//BulkResult summarizes a BulkSave. Failed is keyed by the index of the user in the saved slice.
+type BulkResult struct {
+	Inserted int64
+	Updated  int64
+	Failed   map[int]error
+}
+
+type usersImpl struct {
+	db storage.MongoDB
+}
+
+// New returns the Users stored in db, without the Get cache
+func New(db storage.MongoDB) Users {
+	return &usersImpl{db: db}
+}
 
+// GetInstance returns the Users of the storage backend selected by config.StorageBackend, behind the Get
+// cache when config.UserCacheMode is set
 func GetInstance() Users {
 	once.Do(func() {
-		instance = &usersImpl{}
+		if config.StorageBackend == config.StoragePostgres {
+			instance = &postgresUsers{}
+		} else {
+			instance = &usersImpl{}
+		}
+
+		instance = NewCached(instance)
 	})
 	return instance
 }
 
-func (u *usersImpl) Get(id string) (*domains.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+// database is the storage given to New, or the package instance
+func (u *usersImpl) database() storage.MongoDB {
+	if u.db != nil {
+		return u.db
+	}
+	return storage.GetInstance()
+}
+
+// Get returns the user, soft deleted users are not found
+func (u *usersImpl) Get(ctx context.Context, id string) (*domains.User, error) {
+	return u.get(ctx, liveFilter(id))
+}
+
+// GetWithDeleted returns the user even when it was soft deleted
+func (u *usersImpl) GetWithDeleted(ctx context.Context, id string) (*domains.User, error) {
+	return u.get(ctx, map[string]interface{}{"_id": id})
+}
+
+func (u *usersImpl) get(ctx context.Context, query map[string]interface{}) (*domains.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
 	defer cancel()
 
 	var user domains.User
-	if mgoErr := storage.GetInstance().FindOne(ctx, usersCollection, map[string]interface{}{"_id": id}, &user); mgoErr != nil {
+	if mgoErr := u.database().FindOne(ctx, usersCollection, query, &user); mgoErr != nil {
 		return nil, mgoErr
 	}
 
 	return &user, nil
 }
 
-func (u *usersImpl) Insert(user *domains.User) (string, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+func (u *usersImpl) Insert(ctx context.Context, user *domains.User) (string, error) {
+	ctx, cancel := context.WithTimeout(tenant.WithClientID(ctx, user.ClientID), config.StorageWriteTimeout)
 	defer cancel()
 
 	validateUpdatedAt(user)
+	user.Version = 1
 
-	id, mgoErr := storage.GetInstance().Insert(ctx, usersCollection, user)
+	id, mgoErr := u.database().Insert(ctx, usersCollection, user)
 	if mgoErr != nil {
 		return "", mgoErr
 	}
@@ -62,38 +116,362 @@ func (u *usersImpl) Insert(user *domains.User) (string, error) {
 	return id.(string), nil
 }
 
-func (u *usersImpl) Delete(id string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+func (u *usersImpl) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
 	defer cancel()
 
-	if mgoErr := storage.GetInstance().Remove(ctx, usersCollection, map[string]interface{}{"_id": id}); mgoErr != nil {
+	if mgoErr := u.database().Remove(ctx, usersCollection, map[string]interface{}{"_id": id}); mgoErr != nil {
 		return mgoErr
 	}
 
 	return nil
 }
 
-func (u *usersImpl) Update(newUser *domains.User, oldUser *domains.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+// SoftDelete marks the user as deleted at deletedAt, keeping it in users. Users already soft deleted are not
+// found.
+func (u *usersImpl) SoftDelete(ctx context.Context, id string, deletedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	result, mgoErr := u.database().UpdateOne(ctx, usersCollection, liveFilter(id), map[string]interface{}{
+		"$set": map[string]interface{}{"deletedAt": deletedAt},
+		"$inc": map[string]interface{}{"version": 1},
+	})
+	if mgoErr != nil {
+		return mgoErr
+	}
+	if result.MatchedCount == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Update merges newUser into oldUser and writes it only if the stored version is still the one of oldUser,
+// returning ErrVersionConflict otherwise. A status change the domains transitions do not allow is rejected
+// with a StatusTransitionError before writing.
+func (u *usersImpl) Update(ctx context.Context, newUser *domains.User, oldUser *domains.User) error {
+	ctx, cancel := context.WithTimeout(tenant.WithClientID(ctx, oldUser.ClientID), config.StorageWriteTimeout)
 	defer cancel()
 
 	validateUpdatedAt(newUser)
-	updateNewUserValues(oldUser, newUser)
+	if err := updateNewUserValues(oldUser, newUser); err != nil {
+		return err
+	}
 
-	_, mgoErr := storage.GetInstance().UpdateOne(ctx, usersCollection, map[string]interface{}{"_id": oldUser.ID},
-		map[string]interface{}{"$set": &oldUser});
+	version := oldUser.Version
+	oldUser.Version = version + 1
+	result, mgoErr := u.database().UpdateOne(ctx, usersCollection, versionFilter(oldUser.ID, version),
+		mergedUpdate(newUser, oldUser))
+	if mgoErr == nil && result.MatchedCount == 0 {
+		mgoErr = ErrVersionConflict
+	}
 	if mgoErr != nil {
+		oldUser.Version = version
 		return mgoErr
 	}
 
 	return nil
 }
 
-var updateNewUserValues = func(oldUser *domains.User, newUser *domains.User) {
-	if newUser.Phones != nil && !isEqual(*oldUser.Phones, *newUser.Phones) {
-		oldUser.Phones = newUser.Phones
+// Upsert merges the user into the stored one with the rules of Update, or inserts it when it does not exist,
+// reporting whether it was created. Only a user without phones, addresses nor status is written by a single
+// atomic upsert. Phones and addresses are merged one by one and status changes are checked against the stored
+// status, which update operators cannot express, so users with them go through mergeUpsert, a read followed by
+// a versioned write that fails with ErrVersionConflict when the user is written in between. So does a user
+// that was soft deleted, which the upsert does not match and fails to insert again.
+func (u *usersImpl) Upsert(ctx context.Context, user *domains.User) (bool, error) {
+	ctx = tenant.WithClientID(ctx, user.ClientID)
+	if needsMerge(user) {
+		return mergeUpsert(ctx, u, user)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	validateUpdatedAt(user)
+
+	var before domains.User
+	mgoErr := u.database().FindOneAndUpdate(ctx, usersCollection, liveFilter(user.ID), upsertUpdate(user), true,
+		&before)
+	if storage.IsNotFound(mgoErr) {
+		return true, nil
+	}
+	if storage.KindOf(mgoErr) == storage.KindConflict {
+		return mergeUpsert(ctx, u, user)
+	}
+	if mgoErr != nil {
+		return false, mgoErr
+	}
+
+	return false, nil
+}
+
+// Replace overwrites the stored user with the given one, without merging nor checking the version. The
+// stored version becomes user.Version + 1, so callers pass the version they read.
+func (u *usersImpl) Replace(ctx context.Context, user *domains.User) error {
+	ctx, cancel := context.WithTimeout(tenant.WithClientID(ctx, user.ClientID), config.StorageWriteTimeout)
+	defer cancel()
+
+	validateUpdatedAt(user)
+	user.Version++
+
+	result, mgoErr := u.database().ReplaceOne(ctx, usersCollection, map[string]interface{}{"_id": user.ID}, user)
+	if mgoErr != nil {
+		return mgoErr
+	}
+	if result.MatchedCount == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// BulkSave merges the users into the stored ones with the same rules as Update and writes them in a single
+// bulk operation. Users repeated in the slice are merged in order. Like Update the writes are conditioned on
+// the version that was read, a user written meanwhile fails with a conflict. When tenants are routed the users
+// of each ClientID are written in their own bulk operation, and those of a rejected ClientID fail.
+func (u *usersImpl) BulkSave(ctx context.Context, users []*domains.User) (*BulkResult, error) {
+	if !tenant.GetInstance().Enabled() {
+		return u.bulkSave(ctx, users)
+	}
+
+	var clientIDs []string
+	indexes := make(map[string][]int)
+	for i, user := range users {
+		if _, ok := indexes[user.ClientID]; !ok {
+			clientIDs = append(clientIDs, user.ClientID)
+		}
+		indexes[user.ClientID] = append(indexes[user.ClientID], i)
+	}
+
+	result := &BulkResult{Failed: make(map[int]error)}
+	for _, clientID := range clientIDs {
+		group := make([]*domains.User, len(indexes[clientID]))
+		for j, i := range indexes[clientID] {
+			group[j] = users[i]
+		}
+
+		groupResult, err := u.bulkSave(tenant.WithClientID(ctx, clientID), group)
+		if storage.KindOf(err) == storage.KindValidation {
+			for _, i := range indexes[clientID] {
+				result.Failed[i] = err
+			}
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		result.Inserted += groupResult.Inserted
+		result.Updated += groupResult.Updated
+		for j, err := range groupResult.Failed {
+			result.Failed[indexes[clientID][j]] = err
+		}
+	}
+	return result, nil
+}
+
+func (u *usersImpl) bulkSave(ctx context.Context, users []*domains.User) (*BulkResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageBulkTimeout)
+	defer cancel()
+
+	result := &BulkResult{Failed: make(map[int]error)}
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+
+	var storedUsers []domains.User
+	if mgoErr := u.database().Find(ctx, usersCollection,
+		map[string]interface{}{"_id": map[string]interface{}{"$in": ids}}, &storedUsers); mgoErr != nil {
+		return nil, mgoErr
+	}
+
+	//soft deleted users are recreated from the saved ones, replacing the stored document
+	merged := make(map[string]*domains.User, len(storedUsers))
+	versions := make(map[string]int64, len(storedUsers))
+	recreated := make(map[string]bool)
+	for i := range storedUsers {
+		versions[storedUsers[i].ID] = storedUsers[i].Version
+		if storedUsers[i].DeletedAt == nil {
+			merged[storedUsers[i].ID] = &storedUsers[i]
+		} else {
+			recreated[storedUsers[i].ID] = true
+		}
+	}
+
+	//models[i] writes the merged user of every index in indexes[i]
+	var models []mongo.WriteModel
+	var indexes [][]int
+	position := make(map[string]int)
+	for i, user := range users {
+		validateUpdatedAt(user)
+		if current, ok := merged[user.ID]; ok {
+			if err := updateNewUserValues(current, user); err != nil {
+				result.Failed[i] = err
+				continue
+			}
+		} else {
+			newUser := *user
+			newUser.Phones = mergePhones(nil, user.Phones, user.UpdatedAt)
+			newUser.Addresses = mergeAddresses(nil, user.Addresses)
+			newUser.StatusHistory = initialStatus(user)
+			merged[user.ID] = &newUser
+		}
+
+		if p, ok := position[user.ID]; ok {
+			indexes[p] = append(indexes[p], i)
+			continue
+		}
+		position[user.ID] = len(models)
+		indexes = append(indexes, []int{i})
+		if recreated[user.ID] {
+			models = append(models, mongo.NewReplaceOneModel().
+				SetFilter(versionFilter(user.ID, versions[user.ID])).
+				SetReplacement(merged[user.ID]))
+			continue
+		}
+		models = append(models, mongo.NewUpdateOneModel().
+			SetFilter(versionFilter(user.ID, versions[user.ID])).
+			SetUpdate(mergedUpdate(user, merged[user.ID])).
+			SetUpsert(true))
 	}
-	if newUser.Status != "" {
+	for id, user := range merged {
+		user.Version = versions[id] + 1
+	}
+
+	if len(models) == 0 {
+		return result, nil
+	}
+
+	bulkResult, mgoErr := u.database().BulkWrite(ctx, usersCollection, models)
+	if bulkException, ok := errors.Cause(mgoErr).(mongo.BulkWriteException); ok {
+		for _, writeError := range bulkException.WriteErrors {
+			for _, i := range indexes[writeError.Index] {
+				result.Failed[i] = storage.Classify(writeError.WriteError)
+			}
+		}
+	} else if mgoErr != nil {
+		return nil, mgoErr
+	}
+
+	if bulkResult != nil {
+		result.Inserted = bulkResult.UpsertedCount
+		result.Updated = bulkResult.MatchedCount
+	}
+	return result, nil
+}
+
+// Each streams the users matching the filter from a cursor, stopping at the first error returned by fn. Soft
+// deleted users are only streamed, alone, when filter.Deleted is set.
+func (u *usersImpl) Each(ctx context.Context, filter domains.UserFilter, fn func(user *domains.User) error) error {
+	ctx, cancel := context.WithCancel(tenant.WithClientID(ctx, filter.ClientID))
+	defer cancel()
+
+	query := filter.Query()
+	query["deletedAt"] = map[string]interface{}{"$exists": filter.Deleted}
+	cursor, mgoErr := u.database().FindCursor(ctx, usersCollection, query)
+	if mgoErr != nil {
+		return mgoErr
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		var user domains.User
+		if err := cursor.Decode(&user); err != nil {
+			return storage.Classify(err)
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	return storage.Classify(cursor.Err())
+}
+
+// liveFilter matches the user unless it was soft deleted
+func liveFilter(id string) map[string]interface{} {
+	return map[string]interface{}{"_id": id, "deletedAt": map[string]interface{}{"$exists": false}}
+}
+
+// versionFilter matches the user only while it has the given version. Users stored before versioning have
+// no version field.
+func versionFilter(id string, version int64) map[string]interface{} {
+	if version == 0 {
+		return map[string]interface{}{"_id": id, "version": map[string]interface{}{"$exists": false}}
+	}
+	return map[string]interface{}{"_id": id, "version": version}
+}
+
+// upsertUpdate expresses updateNewUserValues as update operators, so the merge happens on the server. Fields
+// set on the user overwrite the stored ones. Phones, addresses and status are left to mergeUpsert.
+var upsertUpdate = func(user *domains.User) map[string]interface{} {
+	set := map[string]interface{}{"updatedAt": user.UpdatedAt}
+	for field, value := range map[string]string{
+		"username":  user.Username,
+		"email":     user.Email,
+		"fullName":  user.Name,
+		"clientId":  user.ClientID,
+		"gender":    user.Gender,
+		"birthDate": user.BirthDate,
+	} {
+		if value != "" {
+			set[field] = value
+		}
+	}
+
+	return map[string]interface{}{
+		"$set": set,
+		"$inc": map[string]interface{}{"version": 1},
+	}
+}
+
+// mergedUpdate writes the merged user. The lists the event emptied are omitted from $set, so they are unset.
+var mergedUpdate = func(newUser *domains.User, merged *domains.User) map[string]interface{} {
+	update := map[string]interface{}{"$set": merged}
+	if fields := emptiedFields(newUser, merged); len(fields) > 0 {
+		unset := make(map[string]interface{}, len(fields))
+		for _, field := range fields {
+			unset[field] = ""
+		}
+		update["$unset"] = unset
+	}
+	return update
+}
+
+// emptiedFields are the fields of the lists set on newUser that the merge left empty, such as the phones or
+// addresses after removing the last one. Being empty, they are omitted from the merged document and must be removed explicitly.
+var emptiedFields = func(newUser *domains.User, merged *domains.User) []string {
+	var fields []string
+	if newUser.Phones != nil && len(merged.Phones) == 0 {
+		fields = append(fields, "phones")
+	}
+	if newUser.Addresses != nil && len(merged.Addresses) == 0 {
+		fields = append(fields, "addresses")
+	}
+	return fields
+}
+
+// needsMerge reports whether the user has fields that the atomic upsert can not merge
+func needsMerge(user *domains.User) bool {
+	return user.Phones != nil || user.Addresses != nil || user.Status != ""
+}
+
+// updateNewUserValues merges the fields set on newUser into oldUser. A status change is checked against the
+// domains transitions first, and oldUser is left untouched when it is not allowed.
+var updateNewUserValues = func(oldUser *domains.User, newUser *domains.User) error {
+	if err := validateStatusTransition(oldUser, newUser); err != nil {
+		return err
+	}
+
+	if newUser.Phones != nil {
+		oldUser.Phones = mergePhones(oldUser.Phones, newUser.Phones, newUser.UpdatedAt)
+	}
+	if newUser.Addresses != nil {
+		oldUser.Addresses = mergeAddresses(oldUser.Addresses, newUser.Addresses)
+	}
+	if newUser.Status != "" && !domains.SameStatus(oldUser.Status, newUser.Status) {
+		oldUser.StatusHistory = append(oldUser.StatusHistory,
+			domains.StatusTransition{From: oldUser.Status, To: newUser.Status, At: newUser.UpdatedAt})
 		oldUser.Status = newUser.Status
 	}
 	if newUser.Username != "" {
@@ -115,14 +493,169 @@ var updateNewUserValues = func(oldUser *domains.User, newUser *domains.User) {
 		oldUser.BirthDate = newUser.BirthDate
 	}
 	oldUser.UpdatedAt = newUser.UpdatedAt
+	return nil
+}
+
+// initialStatus is the status history of a user created with the status of the event
+var initialStatus = func(user *domains.User) []domains.StatusTransition {
+	if user.Status == "" {
+		return nil
+	}
+	return []domains.StatusTransition{{To: user.Status, At: user.UpdatedAt}}
+}
+
+// mergeUpsert is Upsert as a read followed by a versioned Update, or an Insert when the user does not exist.
+// A user written meanwhile fails with a conflict, like the race of two upserts creating the same user. A soft
+// deleted user is replaced by the new one, as if it had been archived.
+var mergeUpsert = func(ctx context.Context, users Users, user *domains.User) (bool, error) {
+	validateUpdatedAt(user)
+	stored, err := users.GetWithDeleted(ctx, user.ID)
+	if storage.IsNotFound(err) || (err == nil && stored.DeletedAt != nil) {
+		user.Phones = mergePhones(nil, user.Phones, user.UpdatedAt)
+		user.Addresses = mergeAddresses(nil, user.Addresses)
+		user.StatusHistory = initialStatus(user)
+		if err == nil {
+			user.Version = stored.Version
+			err = users.Replace(ctx, user)
+		} else {
+			_, err = users.Insert(ctx, user)
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return false, users.Update(ctx, user, stored)
+}
+
+// mergePhones applies the event phones to the stored ones, matching them by domains.PhoneNumber.Key. A phone
+// with the domains.PhoneRemove action removes the number, any other adds it or replaces the stored one,
+// keeping its type and verification unless the event sets them. A primary phone makes the others secondary.
+// Event phones in the legacy shape replace the whole shape as it used to: the stored numbers in its slots
+// that the event does not have are removed first.
+var mergePhones = func(stored domains.Phones, phones domains.Phones, updatedAt time.Time) domains.Phones {
+	legacy := false
+	for _, phone := range phones {
+		legacy = legacy || phone.Legacy
+	}
+	keys := make(map[string]bool, len(phones))
+	for _, phone := range phones {
+		keys[phone.Key()] = true
+	}
+
+	merged := domains.Phones{}
+	for _, phone := range stored {
+		if legacy && phone.LegacySlot() && !keys[phone.Key()] {
+			continue
+		}
+		phone.Legacy = false
+		merged = append(merged, phone)
+	}
+	indexOf := func(key string) int {
+		for i := range merged {
+			if merged[i].Key() == key {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, phone := range phones {
+		i := indexOf(phone.Key())
+		if phone.Action == domains.PhoneRemove {
+			if i >= 0 {
+				merged = append(merged[:i], merged[i+1:]...)
+			}
+			continue
+		}
+
+		phone.Action, phone.Legacy = "", false
+		if i >= 0 {
+			if phone.Type == "" {
+				phone.Type = merged[i].Type
+			}
+			if phone.Verification == "" || phone.Verification == merged[i].Verification {
+				phone.Verification = merged[i].Verification
+				phone.VerificationUpdatedAt = merged[i].VerificationUpdatedAt
+			}
+			if isEqual(merged[i], phone) {
+				continue
+			}
+		} else if phone.Verification == "" {
+			phone.Verification = domains.PhoneUnverified
+		}
+		if phone.UpdatedAt.IsZero() {
+			phone.UpdatedAt = updatedAt
+		}
+		if phone.VerificationUpdatedAt.IsZero() && phone.Verification != domains.PhoneUnverified {
+			phone.VerificationUpdatedAt = phone.UpdatedAt
+		}
+
+		if phone.Primary {
+			for j := range merged {
+				merged[j].Primary = false
+			}
+		}
+		if i >= 0 {
+			merged[i] = phone
+		} else {
+			merged = append(merged, phone)
+		}
+	}
+	return merged
+}
+
+// mergeAddresses applies the event addresses to the stored ones, matching them by domains.Address.Key. An
+// address with the domains.AddressRemove action removes it, any other adds it or overwrites the stored fields
+// it sets.
+var mergeAddresses = func(stored []domains.Address, addresses []domains.Address) []domains.Address {
+	merged := append([]domains.Address{}, stored...)
+	indexOf := func(key string) int {
+		for i := range merged {
+			if merged[i].Key() == key {
+				return i
+			}
+		}
+		return -1
+	}
+
+	for _, address := range addresses {
+		i := indexOf(address.Key())
+		switch {
+		case address.Action == domains.AddressRemove:
+			if i >= 0 {
+				merged = append(merged[:i], merged[i+1:]...)
+			}
+		case i >= 0:
+			current := &merged[i]
+			for field, value := range map[*string]string{
+				&current.CEP:          address.CEP,
+				&current.Street:       address.Street,
+				&current.Neighborhood: address.Neighborhood,
+				&current.City:         address.City,
+				&current.UF:           address.UF,
+			} {
+				if value != "" {
+					*field = value
+				}
+			}
+		default:
+			address.Action = ""
+			merged = append(merged, address)
+		}
+	}
+	return merged
 }
 
 var isEqual = func(interface1, interface2 interface{}) bool {
 	return cmp.Equal(interface1, interface2, cmpopts.IgnoreFields(interface1, "UpdatedAt"))
 }
 
+// validateUpdatedAt sets the updatedAt of a user received without it, which also dates its phones and status
+// transitions
 var validateUpdatedAt = func(user *domains.User) {
-	if &user.UpdatedAt == nil {
+	if user.UpdatedAt.IsZero() {
 		log.Errorf("[User validateUpdatedAt] user without updatedAt. Setting updatedAt with time.Now(). Id: %s ", user.ID)
 		updatedAt := time.Now()
 		user.UpdatedAt = updatedAt
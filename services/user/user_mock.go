@@ -1,8 +1,10 @@
 package user
 
 import (
+	"context"
 	"github.com/coaraujo/users-go-processor/domains"
 	"github.com/stretchr/testify/mock"
+	"time"
 )
 
 //UserMock is a mock for User
@@ -18,25 +20,67 @@ func (u *UserMock) Initialize() error {
 }
 
 //Get is a mock for Get
-func (u *UserMock) Get(id string) (*domains.User, error) {
-	args := u.Called(id)
+func (u *UserMock) Get(ctx context.Context, id string) (*domains.User, error) {
+	args := u.Called(ctx, id)
 	return args.Get(0).(*domains.User), args.Error(1)
 }
 
 //Insert is a mock for Insert
-func (u *UserMock) Insert(user *domains.User) (string, error) {
-	args := u.Called(user)
+func (u *UserMock) Insert(ctx context.Context, user *domains.User) (string, error) {
+	args := u.Called(ctx, user)
 	return args.String(0), args.Error(1)
 }
 
 //Update is a mock for Update
-func (u *UserMock) Update(newUser *domains.User, oldUser *domains.User) error {
-	args := u.Called(newUser, oldUser)
+func (u *UserMock) Update(ctx context.Context, newUser *domains.User, oldUser *domains.User) error {
+	args := u.Called(ctx, newUser, oldUser)
+	return args.Error(0)
+}
+
+//Upsert is a mock for Upsert
+func (u *UserMock) Upsert(ctx context.Context, user *domains.User) (bool, error) {
+	args := u.Called(ctx, user)
+	return args.Bool(0), args.Error(1)
+}
+
+//Replace is a mock for Replace
+func (u *UserMock) Replace(ctx context.Context, user *domains.User) error {
+	args := u.Called(ctx, user)
 	return args.Error(0)
 }
 
 //Delete is a mock for  Delete
-func (u *UserMock) Delete(id string) error {
-	args := u.Called(id)
+func (u *UserMock) Delete(ctx context.Context, id string) error {
+	args := u.Called(ctx, id)
+	return args.Error(0)
+}
+
+//SoftDelete is a mock for SoftDelete
+func (u *UserMock) SoftDelete(ctx context.Context, id string, deletedAt time.Time) error {
+	args := u.Called(ctx, id, deletedAt)
 	return args.Error(0)
 }
+
+//GetWithDeleted is a mock for GetWithDeleted
+func (u *UserMock) GetWithDeleted(ctx context.Context, id string) (*domains.User, error) {
+	args := u.Called(ctx, id)
+	return args.Get(0).(*domains.User), args.Error(1)
+}
+
+//BulkSave is a mock for BulkSave
+func (u *UserMock) BulkSave(ctx context.Context, users []*domains.User) (*BulkResult, error) {
+	args := u.Called(ctx, users)
+	return args.Get(0).(*BulkResult), args.Error(1)
+}
+
+//Each is a mock for Each, calling fn with every user given to Return
+func (u *UserMock) Each(ctx context.Context, filter domains.UserFilter, fn func(user *domains.User) error) error {
+	args := u.Called(ctx, filter)
+	users, _ := args.Get(0).([]*domains.User)
+	for _, user := range users {
+		if err := fn(user); err != nil {
+			return err
+		}
+	}
+	return args.Error(1)
+}
@@ -0,0 +1,353 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/lib/pq"
+	"time"
+)
+
+// postgresUsers keeps each user as a JSONB document in the users table, next to the columns used by filters
+type postgresUsers struct {
+	db *sql.DB
+}
+
+// versionCondition reads the version of the stored document, users stored before versioning have none
+const versionCondition = `COALESCE((users.doc->>'version')::bigint, 0)`
+
+// liveCondition excludes the soft deleted users
+const liveCondition = `NOT users.doc ? 'deletedAt'`
+
+var postgresDB = func() *sql.DB {
+	return storage.GetPostgresInstance().DB()
+}
+
+// NewPostgres returns the Users stored in the PostgreSQL db
+func NewPostgres(db *sql.DB) Users {
+	return &postgresUsers{db: db}
+}
+
+// database is the db given to NewPostgres, or the one of the package instance
+func (u *postgresUsers) database() *sql.DB {
+	if u.db != nil {
+		return u.db
+	}
+	return postgresDB()
+}
+
+// Get returns the user, soft deleted users are not found
+func (u *postgresUsers) Get(ctx context.Context, id string) (*domains.User, error) {
+	return u.get(ctx, `SELECT doc FROM users WHERE id = $1 AND `+liveCondition, id)
+}
+
+// GetWithDeleted returns the user even when it was soft deleted
+func (u *postgresUsers) GetWithDeleted(ctx context.Context, id string) (*domains.User, error) {
+	return u.get(ctx, `SELECT doc FROM users WHERE id = $1`, id)
+}
+
+func (u *postgresUsers) get(ctx context.Context, query string, id string) (*domains.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageReadTimeout)
+	defer cancel()
+
+	var user domains.User
+	if err := storage.ScanDocument(u.database().QueryRowContext(ctx, query, id), &user); err != nil {
+		return nil, err
+	}
+
+	return &user, nil
+}
+
+func (u *postgresUsers) Insert(ctx context.Context, user *domains.User) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	validateUpdatedAt(user)
+	user.Version = 1
+
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return "", storage.NewError(storage.KindValidation, err)
+	}
+	if _, err = u.database().ExecContext(ctx,
+		`INSERT INTO users (id, client_id, status, updated_at, doc) VALUES ($1, $2, $3, $4, $5::jsonb)`,
+		user.ID, user.ClientID, user.Status, storage.NullTime(user.UpdatedAt), string(doc)); err != nil {
+		return "", storage.Classify(err)
+	}
+
+	return user.ID, nil
+}
+
+func (u *postgresUsers) Delete(ctx context.Context, id string) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	if _, err := u.database().ExecContext(ctx, `DELETE FROM users WHERE id = $1`, id); err != nil {
+		return storage.Classify(err)
+	}
+
+	return nil
+}
+
+// SoftDelete marks the user as deleted at deletedAt, keeping its row. Users already soft deleted are not
+// found.
+func (u *postgresUsers) SoftDelete(ctx context.Context, id string, deletedAt time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	marker, err := json.Marshal(map[string]interface{}{"deletedAt": deletedAt})
+	if err != nil {
+		return storage.NewError(storage.KindValidation, err)
+	}
+	result, err := u.database().ExecContext(ctx,
+		`UPDATE users SET doc = jsonb_set(users.doc || $2::jsonb, '{version}', to_jsonb(`+versionCondition+` + 1))
+		WHERE id = $1 AND `+liveCondition, id, string(marker))
+	if err != nil {
+		return storage.Classify(err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// Update merges newUser into oldUser and writes it as a partial update, fields missing from the merged
+// document keep their stored value unless the merge emptied them. The write only happens if the stored version is still the one of oldUser,
+// ErrVersionConflict is returned otherwise.
+func (u *postgresUsers) Update(ctx context.Context, newUser *domains.User, oldUser *domains.User) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	validateUpdatedAt(newUser)
+	if err := updateNewUserValues(oldUser, newUser); err != nil {
+		return err
+	}
+
+	version := oldUser.Version
+	oldUser.Version = version + 1
+	doc, err := json.Marshal(oldUser)
+	if err != nil {
+		oldUser.Version = version
+		return storage.NewError(storage.KindValidation, err)
+	}
+
+	//a nil array is sent as NULL, which would empty the document
+	emptied := append([]string{}, emptiedFields(newUser, oldUser)...)
+	result, err := u.database().ExecContext(ctx,
+		`UPDATE users SET client_id = $2, status = $3, updated_at = $4, doc = (doc || $5::jsonb) - $7::text[]
+		WHERE id = $1 AND `+versionCondition+` = $6`,
+		oldUser.ID, oldUser.ClientID, oldUser.Status, storage.NullTime(oldUser.UpdatedAt), string(doc), version,
+		pq.Array(emptied))
+	if err != nil {
+		oldUser.Version = version
+		return storage.Classify(err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		oldUser.Version = version
+		return ErrVersionConflict
+	}
+
+	return nil
+}
+
+// Upsert merges the user into the stored one with the rules of Update, or inserts it when it does not exist,
+// reporting whether it was created. The jsonb concatenation keeps the stored fields that are empty on the
+// user, since they are omitted from its document.
+// Only a user without phones, addresses nor status is written by the single atomic statement. Users with them
+// go through mergeUpsert, as on MongoDB, which fails with ErrVersionConflict when the user is written between
+// its read and its write, and so does a soft deleted user, which the conflict clause does not update.
+func (u *postgresUsers) Upsert(ctx context.Context, user *domains.User) (bool, error) {
+	if needsMerge(user) {
+		return mergeUpsert(ctx, u, user)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	validateUpdatedAt(user)
+	user.Version = 1
+
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return false, storage.NewError(storage.KindValidation, err)
+	}
+
+	var created bool
+	err = u.database().QueryRowContext(ctx, `INSERT INTO users (id, client_id, status, updated_at, doc)
+		VALUES ($1, $2, $3, $4, $5::jsonb)
+		ON CONFLICT (id) DO UPDATE SET
+			client_id = COALESCE(NULLIF(EXCLUDED.client_id, ''), users.client_id),
+			status = COALESCE(NULLIF(EXCLUDED.status, ''), users.status),
+			updated_at = EXCLUDED.updated_at,
+			doc = jsonb_set(users.doc || EXCLUDED.doc, '{version}', to_jsonb(`+versionCondition+` + 1))
+		WHERE `+liveCondition+`
+		RETURNING xmax = 0`,
+		user.ID, user.ClientID, user.Status, storage.NullTime(user.UpdatedAt), string(doc)).Scan(&created)
+	if err == sql.ErrNoRows {
+		return mergeUpsert(ctx, u, user)
+	}
+	if err != nil {
+		return false, storage.Classify(err)
+	}
+
+	return created, nil
+}
+
+// Replace overwrites the stored user with the given one, without merging nor checking the version. The
+// stored version becomes user.Version + 1, so callers pass the version they read.
+func (u *postgresUsers) Replace(ctx context.Context, user *domains.User) error {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageWriteTimeout)
+	defer cancel()
+
+	validateUpdatedAt(user)
+	user.Version++
+
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return storage.NewError(storage.KindValidation, err)
+	}
+	result, err := u.database().ExecContext(ctx,
+		`UPDATE users SET client_id = $2, status = $3, updated_at = $4, doc = $5::jsonb WHERE id = $1`,
+		user.ID, user.ClientID, user.Status, storage.NullTime(user.UpdatedAt), string(doc))
+	if err != nil {
+		return storage.Classify(err)
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return storage.ErrNotFound
+	}
+
+	return nil
+}
+
+// BulkSave merges the users into the stored ones with the same rules as Update and upserts each merged
+// user conditioned on the version that was read. Like the mongo bulk write it is not atomic, a failing user
+// does not stop the others.
+func (u *postgresUsers) BulkSave(ctx context.Context, users []*domains.User) (*BulkResult, error) {
+	ctx, cancel := context.WithTimeout(ctx, config.StorageBulkTimeout)
+	defer cancel()
+
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.ID)
+	}
+
+	rows, err := u.database().QueryContext(ctx, `SELECT doc FROM users WHERE id = ANY($1)`, pq.Array(ids))
+	if err != nil {
+		return nil, storage.Classify(err)
+	}
+	merged := make(map[string]*domains.User, len(users))
+	versions := make(map[string]int64, len(users))
+	for rows.Next() {
+		var stored domains.User
+		if err := storage.ScanDocument(rows, &stored); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		versions[stored.ID] = stored.Version
+		//soft deleted users are recreated from the saved ones
+		if stored.DeletedAt == nil {
+			merged[stored.ID] = &stored
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, storage.Classify(err)
+	}
+
+	result := &BulkResult{Failed: make(map[int]error)}
+	//order[i] is written once, for every index in indexes[order[i]]
+	var order []string
+	indexes := make(map[string][]int)
+	for i, user := range users {
+		validateUpdatedAt(user)
+		if current, ok := merged[user.ID]; ok {
+			if err := updateNewUserValues(current, user); err != nil {
+				result.Failed[i] = err
+				continue
+			}
+		} else {
+			newUser := *user
+			newUser.Phones = mergePhones(nil, user.Phones, user.UpdatedAt)
+			newUser.Addresses = mergeAddresses(nil, user.Addresses)
+			newUser.StatusHistory = initialStatus(user)
+			merged[user.ID] = &newUser
+		}
+		if _, ok := indexes[user.ID]; !ok {
+			order = append(order, user.ID)
+		}
+		indexes[user.ID] = append(indexes[user.ID], i)
+	}
+
+	for _, id := range order {
+		inserted, err := u.upsertUser(ctx, merged[id], versions[id])
+		if err != nil {
+			for _, i := range indexes[id] {
+				result.Failed[i] = err
+			}
+			continue
+		}
+		if inserted {
+			result.Inserted++
+		} else {
+			result.Updated++
+		}
+	}
+	return result, nil
+}
+
+// upsertUser writes the user if it is new or still has the given version, reporting whether the row was
+// inserted. xmax is only zero for rows created by the statement, and no row is returned when the version
+// changed.
+func (u *postgresUsers) upsertUser(ctx context.Context, user *domains.User, version int64) (bool, error) {
+	user.Version = version + 1
+	doc, err := json.Marshal(user)
+	if err != nil {
+		return false, storage.NewError(storage.KindValidation, err)
+	}
+
+	var inserted bool
+	err = u.database().QueryRowContext(ctx, `INSERT INTO users (id, client_id, status, updated_at, doc)
+		VALUES ($1, $2, $3, $4, $5::jsonb)
+		ON CONFLICT (id) DO UPDATE SET client_id = EXCLUDED.client_id, status = EXCLUDED.status,
+			updated_at = EXCLUDED.updated_at, doc = EXCLUDED.doc
+		WHERE `+versionCondition+` = $6
+		RETURNING xmax = 0`,
+		user.ID, user.ClientID, user.Status, storage.NullTime(user.UpdatedAt), string(doc), version).Scan(&inserted)
+	if err == sql.ErrNoRows {
+		return false, ErrVersionConflict
+	}
+	return inserted, storage.Classify(err)
+}
+
+// Each streams the users matching the filter ordered by id, stopping at the first error returned by fn
+func (u *postgresUsers) Each(ctx context.Context, filter domains.UserFilter, fn func(user *domains.User) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	where, args := filter.Where()
+	if filter.Deleted {
+		where = `NOT (` + liveCondition + `) AND ` + where
+	} else {
+		where = liveCondition + ` AND ` + where
+	}
+	rows, err := u.database().QueryContext(ctx, `SELECT doc FROM users WHERE `+where+` ORDER BY id`, args...)
+	if err != nil {
+		return storage.Classify(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user domains.User
+		if err := storage.ScanDocument(rows, &user); err != nil {
+			return err
+		}
+		if err := fn(&user); err != nil {
+			return err
+		}
+	}
+	return storage.Classify(rows.Err())
+}
@@ -0,0 +1,251 @@
+package user
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/lib/pq"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func withPostgres(t *testing.T) (*postgresUsers, sqlmock.Sqlmock) {
+	db, dbMock, err := sqlmock.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+	postgresDB = func() *sql.DB { return db }
+	return &postgresUsers{}, dbMock
+}
+
+func TestPostgresUsers_Get_Success(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT doc FROM users WHERE id = $1")).WithArgs("id").
+		WillReturnRows(sqlmock.NewRows([]string{"doc"}).AddRow(`{"_id":"id","email":"user@email.com"}`))
+
+	user, err := users.Get(context.Background(), "id")
+
+	assert.Nil(t, err)
+	assert.Equal(t, &domains.User{ID: "id", Email: "user@email.com"}, user)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_Get_NotFound(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectQuery("SELECT doc FROM users").WillReturnRows(sqlmock.NewRows([]string{"doc"}))
+
+	user, err := users.Get(context.Background(), "id")
+
+	assert.Nil(t, user)
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestPostgresUsers_Insert_Conflict(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec("INSERT INTO users").WillReturnError(&pq.Error{Code: "23505"})
+
+	_, err := users.Insert(context.Background(), &domains.User{ID: "id", UpdatedAt: time.Now()})
+
+	assert.Equal(t, storage.KindConflict, storage.KindOf(err))
+}
+
+func TestPostgresUsers_Update_PartialDocument(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	updatedAt := time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+	dbMock.ExpectExec(regexp.QuoteMeta("doc = (doc || $5::jsonb) - $7::text[]")).
+		WithArgs("id", "client", "ACTIVE", updatedAt,
+			`{"_id":"id","email":"new@email.com","status":"ACTIVE","clientId":"client","updatedAt":"2019-08-01T00:00:00Z","statusHistory":[{"to":"ACTIVE","at":"2019-08-01T00:00:00Z"}],"version":3}`,
+			int64(2), "{}").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := users.Update(context.Background(), &domains.User{Email: "new@email.com", Status: "ACTIVE", UpdatedAt: updatedAt},
+		&domains.User{ID: "id", Email: "old@email.com", ClientID: "client", Version: 2})
+
+	assert.Nil(t, err)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_Update_RemovesLastPhone(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec(regexp.QuoteMeta("doc = (doc || $5::jsonb) - $7::text[]")).
+		WithArgs("id", "", "", sqlmock.AnyArg(), sqlmock.AnyArg(), int64(1), "{\"phones\"}").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	oldUser := &domains.User{ID: "id", Version: 1, Phones: domains.Phones{{Type: domains.PhoneMobile, Number: "9999"}}}
+
+	err := users.Update(context.Background(), &domains.User{UpdatedAt: time.Now(),
+		Phones: domains.Phones{{Number: "9999", Action: domains.PhoneRemove}}}, oldUser)
+
+	assert.Nil(t, err)
+	assert.Empty(t, oldUser.Phones)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_Update_RemovesLastAddress(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec(regexp.QuoteMeta("doc = (doc || $5::jsonb) - $7::text[]")).
+		WithArgs("id", "", "", sqlmock.AnyArg(), sqlmock.AnyArg(), int64(1), "{\"addresses\"}").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	oldUser := &domains.User{ID: "id", Version: 1, Addresses: []domains.Address{
+		{Type: domains.AddressBilling, CEP: "20040-002", Number: "10"},
+	}}
+
+	err := users.Update(context.Background(), &domains.User{UpdatedAt: time.Now(), Addresses: []domains.Address{
+		{Type: domains.AddressBilling, CEP: "20040002", Number: "10", Action: domains.AddressRemove},
+	}}, oldUser)
+
+	assert.Nil(t, err)
+	assert.Empty(t, oldUser.Addresses)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_Update_VersionConflict(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 0))
+	oldUser := &domains.User{ID: "id", Version: 2}
+
+	err := users.Update(context.Background(), &domains.User{Name: "name", UpdatedAt: time.Now()}, oldUser)
+
+	assert.Equal(t, ErrVersionConflict, err)
+	assert.Equal(t, int64(2), oldUser.Version)
+}
+
+func TestPostgresUsers_Replace_NotFound(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	err := users.Replace(context.Background(), &domains.User{ID: "id", UpdatedAt: time.Now()})
+
+	assert.Equal(t, storage.ErrNotFound, err)
+}
+
+func TestPostgresUsers_Delete(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec(regexp.QuoteMeta("DELETE FROM users WHERE id = $1")).WithArgs("id").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	assert.Nil(t, users.Delete(context.Background(), "id"))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_BulkSave(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectQuery("SELECT doc FROM users WHERE id = ANY").
+		WillReturnRows(sqlmock.NewRows([]string{"doc"}).AddRow(`{"_id":"1","email":"old@email.com"}`))
+	dbMock.ExpectQuery("INSERT INTO users").WithArgs("1", "", "ACTIVE", sqlmock.AnyArg(), sqlmock.AnyArg(), int64(0)).
+		WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(false))
+	dbMock.ExpectQuery("INSERT INTO users").WithArgs("2", "", "", sqlmock.AnyArg(), sqlmock.AnyArg(), int64(0)).
+		WillReturnError(&pq.Error{Code: "23514"})
+
+	result, err := users.BulkSave(context.Background(), []*domains.User{{ID: "1", Name: "name"}, {ID: "2"}, {ID: "1", Status: "ACTIVE"}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result.Updated)
+	assert.Equal(t, int64(0), result.Inserted)
+	assert.Len(t, result.Failed, 1)
+	assert.Equal(t, storage.KindValidation, storage.KindOf(result.Failed[1]))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_Each_Filter(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectQuery(regexp.QuoteMeta("SELECT doc FROM users WHERE NOT users.doc ? 'deletedAt' AND client_id = $1 AND status = $2 ORDER BY id")).
+		WithArgs("client", "ACTIVE").
+		WillReturnRows(sqlmock.NewRows([]string{"doc"}).AddRow(`{"_id":"1"}`).AddRow(`{"_id":"2"}`))
+
+	var ids []string
+	err := users.Each(context.Background(), domains.UserFilter{ClientID: "client", Status: "ACTIVE"}, func(user *domains.User) error {
+		ids = append(ids, user.ID)
+		return nil
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"1", "2"}, ids)
+}
+
+func TestPostgresUsers_Upsert(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectQuery(regexp.QuoteMeta("doc = jsonb_set(users.doc || EXCLUDED.doc, '{version}'")).
+		WithArgs("id", "", "", sqlmock.AnyArg(), sqlmock.AnyArg()).
+		WillReturnRows(sqlmock.NewRows([]string{"created"}).AddRow(true))
+
+	created, err := users.Upsert(context.Background(), &domains.User{ID: "id", Email: "email", UpdatedAt: time.Now()})
+
+	assert.Nil(t, err)
+	assert.True(t, created)
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+func TestPostgresUsers_SoftDelete(t *testing.T) {
+	users, dbMock := withPostgres(t)
+	dbMock.ExpectExec(regexp.QuoteMeta("WHERE id = $1 AND NOT users.doc ? 'deletedAt'")).
+		WithArgs("id", `{"deletedAt":"2019-08-01T00:00:00Z"}`).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	dbMock.ExpectExec("UPDATE users").WillReturnResult(sqlmock.NewResult(0, 0))
+
+	deletedAt := time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+	assert.Nil(t, users.SoftDelete(context.Background(), "id", deletedAt))
+	assert.True(t, storage.IsNotFound(users.SoftDelete(context.Background(), "id", deletedAt)))
+	assert.Nil(t, dbMock.ExpectationsWereMet())
+}
+
+//storedDoc is a sqlmock argument that decodes the written document into user
+type storedDoc struct {
+	user *domains.User
+}
+
+func (d storedDoc) Match(v driver.Value) bool {
+	doc, ok := v.(string)
+	return ok && json.Unmarshal([]byte(doc), d.user) == nil
+}
+
+//TestBulkSave_NewUser_RemoveActions imports a new user with remove actions on both backends, which store it
+//as Update would merge it into an empty user
+func TestBulkSave_NewUser_RemoveActions(t *testing.T) {
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	imported := func() []*domains.User {
+		return []*domains.User{{ID: "1", UpdatedAt: updatedAt, Phones: domains.Phones{
+			{Type: domains.PhoneMobile, DDD: "11", Number: "911111111"},
+			{Type: domains.PhoneMobile, DDD: "11", Number: "922222222", Action: domains.PhoneRemove},
+		}, Addresses: []domains.Address{
+			{Type: domains.AddressShipping, CEP: "01001-000", Number: "1"},
+			{Type: domains.AddressShipping, CEP: "20040-002", Number: "2", Action: domains.AddressRemove},
+		}}}
+	}
+	check := func(t *testing.T, stored *domains.User) {
+		assert.Equal(t, domains.Phones{{Type: domains.PhoneMobile, DDD: "11", Number: "911111111",
+			Verification: domains.PhoneUnverified, UpdatedAt: updatedAt}},
+			stored.Phones)
+		assert.Equal(t, []domains.Address{{Type: domains.AddressShipping, CEP: "01001-000", Number: "1"}}, stored.Addresses)
+	}
+
+	t.Run("mongo", func(t *testing.T) {
+		users := New(storage.NewMemoryDB())
+		result, err := users.BulkSave(context.Background(), imported())
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), result.Inserted)
+
+		stored, err := users.Get(context.Background(), "1")
+		assert.Nil(t, err)
+		check(t, stored)
+	})
+
+	t.Run("postgres", func(t *testing.T) {
+		users, dbMock := withPostgres(t)
+		var stored domains.User
+		dbMock.ExpectQuery("SELECT doc FROM users WHERE id = ANY").WillReturnRows(sqlmock.NewRows([]string{"doc"}))
+		dbMock.ExpectQuery("INSERT INTO users").WithArgs("1", "", "", sqlmock.AnyArg(), storedDoc{&stored}, int64(0)).
+			WillReturnRows(sqlmock.NewRows([]string{"inserted"}).AddRow(true))
+
+		result, err := users.BulkSave(context.Background(), imported())
+		assert.Nil(t, err)
+		assert.Equal(t, int64(1), result.Inserted)
+		assert.Nil(t, dbMock.ExpectationsWereMet())
+		check(t, &stored)
+	})
+}
@@ -3,9 +3,12 @@ package user
 import (
 	"go.mongodb.org/mongo-driver/mongo"
 	"context"
+	"encoding/json"
 	"errors"
 	"github.com/coaraujo/users-go-processor/domains"
+	"github.com/coaraujo/users-go-processor/infrastructure/config"
 	"github.com/coaraujo/users-go-processor/infrastructure/storage"
+	"github.com/coaraujo/users-go-processor/infrastructure/tenant"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.mongodb.org/mongo-driver/mongo/options"
@@ -22,7 +25,7 @@ func TestUsersImpl_Get_Success(t *testing.T) {
 		Return(nil).
 		Once()
 
-	user, err := GetInstance().Get("id")
+	user, err := GetInstance().Get(context.Background(), "id")
 	assert.Nil(t, err)
 	assert.Equal(t, user, userMock)
 
@@ -38,7 +41,7 @@ func TestUsersImpl_Get_Error(t *testing.T) {
 		Return(mgoErr).
 		Once()
 
-	user, err := GetInstance().Get("id")
+	user, err := GetInstance().Get(context.Background(), "id")
 	assert.NotNil(t, err)
 	assert.Equal(t, mgoErr, err)
 	assert.Nil(t, user)
@@ -58,7 +61,7 @@ func TestUsersImpl_Insert_Success(t *testing.T) {
 		Return(mockid, nil).
 		Once()
 
-	id, err := GetInstance().Insert(user)
+	id, err := GetInstance().Insert(context.Background(), user)
 	assert.Nil(t, err)
 	assert.Equal(t, id, mockid)
 
@@ -77,7 +80,7 @@ func TestUsersImpl_Insert_GenericError(t *testing.T) {
 		Return("", mgoErr).
 		Once()
 
-	id, err := GetInstance().Insert(user)
+	id, err := GetInstance().Insert(context.Background(), user)
 	assert.Equal(t, err, mgoErr)
 	assert.NotEqual(t, id, mockid)
 
@@ -94,7 +97,7 @@ func TestUsersImpl_Insert_UpdatedAtNull_Error(t *testing.T) {
 		Return(mockid, nil).
 		Once()
 
-	id, err := GetInstance().Insert(user)
+	id, err := GetInstance().Insert(context.Background(), user)
 	assert.Nil(t, err)
 	assert.Equal(t, id, mockid)
 	assert.NotNil(t, user.UpdatedAt)
@@ -112,7 +115,7 @@ func TestUsersImpl_Delete_Success(t *testing.T) {
 		Return(nil).
 		Once()
 
-	err := GetInstance().Delete(mockId)
+	err := GetInstance().Delete(context.Background(), mockId)
 	assert.Nil(t, err)
 
 	mongoMock.AssertExpectations(t)
@@ -129,7 +132,7 @@ func TestUsersImpl_Delete_Error(t *testing.T) {
 		Return(mgoErr).
 		Once()
 
-	err := GetInstance().Delete(mockId)
+	err := GetInstance().Delete(context.Background(), mockId)
 	assert.NotNil(t, err)
 	assert.Equal(t, err, mgoErr)
 
@@ -142,9 +145,10 @@ func TestUsersImpl_Update_Success(t *testing.T) {
 	mockClientId := "clientId"
 	username := "newUsername"
 	email := "oldEmail"
-	status := "unchangedStatus"
-	phone1 := &domains.Phone{Phone: "phone1", UpdatedAt: time.Now()}
-	phone2 := &domains.Phone{Phone: "phone2", UpdatedAt: time.Now()}
+	status := domains.StatusActive
+	phone1 := domains.Phones{{Number: "phone1", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
+	phone2 := domains.Phones{{Number: "phone2", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
+	updatedAt := time.Now()
 
 	oldUser := domains.User{
 		Email:     email,
@@ -165,6 +169,7 @@ func TestUsersImpl_Update_Success(t *testing.T) {
 		BirthDate: "birthdate2",
 		Phones:    phone2,
 		ClientID:  mockClientId,
+		UpdatedAt: updatedAt,
 	}
 
 	expectedUser := domains.User{
@@ -174,16 +179,18 @@ func TestUsersImpl_Update_Success(t *testing.T) {
 		Gender:    "gender2",
 		Status:    status,
 		BirthDate: "birthdate2",
-		Phones:    phone2,
+		Phones:    append(phone1, phone2...),
 		ClientID:  mockClientId,
+		UpdatedAt: updatedAt,
+		Version:   1,
 	}
 
 	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
 	mongoMock.On("UpdateOne", mock.Anything, usersCollection, mock.Anything, mock.Anything).
-		Return(&mongo.UpdateResult{}, nil).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil).
 		Once()
 
-	err := GetInstance().Update(&newUser, &oldUser)
+	err := GetInstance().Update(context.Background(), &newUser, &oldUser)
 	assert.Nil(t, err)
 	assert.Equal(t, oldUser, expectedUser)
 
@@ -203,7 +210,7 @@ func TestUsersImpl_Update_Error(t *testing.T) {
 		Return(&mongo.UpdateResult{}, mgoErr).
 		Once()
 
-	err := GetInstance().Update(user, userMock)
+	err := GetInstance().Update(context.Background(), user, userMock)
 	assert.NotNil(t, err)
 	assert.Equal(t, err, mgoErr)
 
@@ -211,15 +218,16 @@ func TestUsersImpl_Update_Error(t *testing.T) {
 }
 
 func TestUsersImpl_updateNewUserValues_ChangeAllValues(t *testing.T) {
-	phone1 := &domains.Phone{Phone: "phone1", UpdatedAt: time.Now()}
-	phone2 := &domains.Phone{Phone: "phone2", UpdatedAt: time.Now()}
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	phone1 := domains.Phones{{Number: "phone1", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
+	phone2 := domains.Phones{{Number: "phone2", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
 
 	oldUser := domains.User{
 		Email:     "email1",
 		Username:  "username1",
 		Name:      "name1",
 		Gender:    "gender1",
-		Status:    "status1",
+		Status:    domains.StatusActive,
 		BirthDate: "birthdate1",
 		Phones:    phone1,
 		ClientID:  "client1",
@@ -230,32 +238,35 @@ func TestUsersImpl_updateNewUserValues_ChangeAllValues(t *testing.T) {
 		Username:  "username2",
 		Name:      "name2",
 		Gender:    "gender2",
-		Status:    "status2",
+		Status:    domains.StatusBlocked,
 		BirthDate: "birthdate2",
 		Phones:    phone2,
 		ClientID:  "client2",
+		UpdatedAt: updatedAt,
 	}
 
 	expectedUser := domains.User{
-		Email:     "email2",
-		Username:  "username2",
-		Name:      "name2",
-		Gender:    "gender2",
-		Status:    "status2",
-		BirthDate: "birthdate2",
-		Phones:    phone2,
-		ClientID:  "client2",
+		Email:         "email2",
+		Username:      "username2",
+		Name:          "name2",
+		Gender:        "gender2",
+		Status:        domains.StatusBlocked,
+		BirthDate:     "birthdate2",
+		Phones:        append(phone1, phone2...),
+		ClientID:      "client2",
+		UpdatedAt:     updatedAt,
+		StatusHistory: []domains.StatusTransition{{From: domains.StatusActive, To: domains.StatusBlocked, At: updatedAt}},
 	}
 
-	updateNewUserValues(&oldUser, &newUser)
+	assert.Nil(t, updateNewUserValues(&oldUser, &newUser))
 
-	assert.Equal(t, newUser, expectedUser)
+	assert.Equal(t, phone2, newUser.Phones)
 	assert.Equal(t, oldUser, expectedUser)
 }
 
 func TestUsersImpl_updateNewUserValues_ChangeSomeValues(t *testing.T) {
-	phone1 := &domains.Phone{Phone: "phone1", UpdatedAt: time.Now()}
-	phone2 := &domains.Phone{Phone: "phone2", UpdatedAt: time.Now()}
+	phone1 := domains.Phones{{Number: "phone1", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
+	phone2 := domains.Phones{{Number: "phone2", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
 
 	oldUser := domains.User{
 		Email:    "email1",
@@ -266,25 +277,26 @@ func TestUsersImpl_updateNewUserValues_ChangeSomeValues(t *testing.T) {
 	newUser := domains.User{
 		Email:  "email1",
 		Phones: phone2,
-		Status: "status2",
+		Status: domains.StatusPending,
 	}
 
 	expectedUser := domains.User{
-		Email:    "email1",
-		Phones:   phone2,
-		Status:   "status2",
-		Username: "username1",
+		Email:         "email1",
+		Phones:        append(phone1, phone2...),
+		Status:        domains.StatusPending,
+		Username:      "username1",
+		StatusHistory: []domains.StatusTransition{{To: domains.StatusPending}},
 	}
 
-	updateNewUserValues(&oldUser, &newUser)
+	assert.Nil(t, updateNewUserValues(&oldUser, &newUser))
 
 	assert.Equal(t, oldUser, expectedUser)
 	assert.NotEqual(t, newUser, expectedUser)
 }
 
 func TestUsersImpl_isEqual_True(t *testing.T) {
-	phone1 := &domains.Phone{Phone: "phone1", UpdatedAt: time.Now()}
-	phone2 := &domains.Phone{Phone: "phone1", UpdatedAt: time.Now()}
+	phone1 := domains.Phones{{Number: "phone1", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
+	phone2 := domains.Phones{{Number: "phone1", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
 
 	user := domains.User{
 		Email:    "email1",
@@ -300,13 +312,13 @@ func TestUsersImpl_isEqual_True(t *testing.T) {
 		Username: "username2",
 	}
 
-	resp := isEqual(*user.Phones, *anotherUser.Phones)
+	resp := isEqual(user.Phones[0], anotherUser.Phones[0])
 	assert.True(t, resp)
 }
 
 func TestUsersImpl_isEqual_False(t *testing.T) {
-	phone1 := &domains.Phone{Phone: "phone1", UpdatedAt: time.Now()}
-	phone2 := &domains.Phone{Phone: "phone2", UpdatedAt: time.Now()}
+	phone1 := domains.Phones{{Number: "phone1", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
+	phone2 := domains.Phones{{Number: "phone2", Verification: domains.PhoneUnverified, UpdatedAt: time.Now()}}
 
 	user := domains.User{
 		Email:    "email1",
@@ -322,7 +334,7 @@ func TestUsersImpl_isEqual_False(t *testing.T) {
 		Username: "username2",
 	}
 
-	resp := isEqual(*user.Phones, *anotherUser.Phones)
+	resp := isEqual(user.Phones[0], anotherUser.Phones[0])
 	assert.False(t, resp)
 }
 
@@ -341,6 +353,571 @@ func TestUsersImpl_validateUpdatedAt_WhenItDoesntExist(t *testing.T) {
 
 	validateUpdatedAt(user)
 
-	assert.NotNil(t, user.UpdatedAt)
-	assert.NotEqual(t, user.UpdatedAt, &updatedAt)
+	assert.False(t, user.UpdatedAt.IsZero())
+	assert.False(t, user.UpdatedAt.Before(updatedAt))
+}
+
+func TestUsersImpl_MemoryDB_Upsert_WithoutUpdatedAt_DatesStatusTransition(t *testing.T) {
+	users := New(storage.NewMemoryDB())
+
+	_, err := users.Upsert(context.Background(), &domains.User{ID: "1", Status: domains.StatusPending})
+	assert.Nil(t, err)
+	_, err = users.Upsert(context.Background(), &domains.User{ID: "1", Status: domains.StatusActive})
+	assert.Nil(t, err)
+
+	user, err := users.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.False(t, user.UpdatedAt.IsZero())
+	if assert.Len(t, user.StatusHistory, 2) {
+		for _, transition := range user.StatusHistory {
+			assert.False(t, transition.At.IsZero())
+		}
+	}
+}
+
+func TestUsersImpl_BulkSave_MergeAndUpsert(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+	updatedAt := time.Now()
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("Find", mock.Anything, usersCollection, mock.Anything, mock.AnythingOfType("*[]domains.User")).
+		Run(func(args mock.Arguments) {
+			*args.Get(3).(*[]domains.User) = []domains.User{{ID: "1", Email: "email1", Username: "username1"}}
+		}).
+		Return(nil).
+		Once()
+	mongoMock.On("BulkWrite", mock.Anything, usersCollection, mock.MatchedBy(func(models []mongo.WriteModel) bool {
+		return len(models) == 2
+	})).
+		Return(&mongo.BulkWriteResult{MatchedCount: 1, UpsertedCount: 1}, nil).
+		Once()
+
+	users := []*domains.User{
+		{ID: "1", Username: "username2", UpdatedAt: updatedAt},
+		{ID: "2", Email: "email2", UpdatedAt: updatedAt},
+		{ID: "1", Name: "name", UpdatedAt: updatedAt},
+	}
+	result, err := GetInstance().BulkSave(context.Background(), users)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result.Inserted)
+	assert.Equal(t, int64(1), result.Updated)
+	assert.Empty(t, result.Failed)
+
+	mongoMock.AssertExpectations(t)
+}
+
+func TestUsersImpl_BulkSave_PartialFailure(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+	bulkErr := storage.Classify(mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+		{WriteError: mongo.WriteError{Index: 1, Code: 121, Message: "Document failed validation"}},
+	}})
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("Find", mock.Anything, usersCollection, mock.Anything, mock.Anything).
+		Return(nil).
+		Once()
+	mongoMock.On("BulkWrite", mock.Anything, usersCollection, mock.Anything).
+		Return(&mongo.BulkWriteResult{UpsertedCount: 1}, bulkErr).
+		Once()
+
+	users := []*domains.User{{ID: "1"}, {ID: "2"}, {ID: "2"}}
+	result, err := GetInstance().BulkSave(context.Background(), users)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result.Inserted)
+	assert.Len(t, result.Failed, 2)
+	assert.Equal(t, storage.KindValidation, storage.KindOf(result.Failed[2]))
+
+	mongoMock.AssertExpectations(t)
+}
+
+func TestUsersImpl_BulkSave_FindError(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+	mgoErr := errors.New("error")
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("Find", mock.Anything, usersCollection, mock.Anything, mock.Anything).
+		Return(mgoErr).
+		Once()
+
+	result, err := GetInstance().BulkSave(context.Background(), []*domains.User{{ID: "1"}})
+	assert.Equal(t, mgoErr, err)
+	assert.Nil(t, result)
+
+	mongoMock.AssertNotCalled(t, "BulkWrite", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestUsersImpl_Replace_Success(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+	user := &domains.User{ID: "id", Email: "email", UpdatedAt: time.Now()}
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("ReplaceOne", mock.Anything, usersCollection, map[string]interface{}{"_id": "id"}, user).
+		Return(&mongo.UpdateResult{MatchedCount: 1}, nil).
+		Once()
+
+	err := GetInstance().Replace(context.Background(), user)
+	assert.Nil(t, err)
+
+	mongoMock.AssertExpectations(t)
+}
+
+func TestUsersImpl_Replace_NotFound(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("ReplaceOne", mock.Anything, usersCollection, mock.Anything, mock.Anything).
+		Return(&mongo.UpdateResult{}, nil).
+		Once()
+
+	err := GetInstance().Replace(context.Background(), &domains.User{ID: "id"})
+	assert.Equal(t, storage.ErrNotFound, err)
+
+	mongoMock.AssertExpectations(t)
+}
+
+func TestUsersImpl_MemoryDB_SaveFlow(t *testing.T) {
+	_ = storage.NewMemoryDB().Initialize(context.Background(), options.Credential{}, "", "")
+	updatedAt := time.Now().UTC().Truncate(time.Millisecond)
+
+	_, err := GetInstance().Insert(context.Background(), &domains.User{ID: "1", Email: "old@email.com", Status: "ACTIVE", UpdatedAt: updatedAt})
+	assert.Nil(t, err)
+	_, err = GetInstance().Insert(context.Background(), &domains.User{ID: "1"})
+	assert.Equal(t, storage.KindConflict, storage.KindOf(err))
+
+	oldUser, err := GetInstance().Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Nil(t, GetInstance().Update(context.Background(), &domains.User{Name: "name", UpdatedAt: updatedAt}, oldUser))
+
+	result, err := GetInstance().BulkSave(context.Background(), []*domains.User{{ID: "1", Status: "INACTIVE"}, {ID: "2", Email: "new@email.com"}})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result.Inserted)
+	assert.Equal(t, int64(1), result.Updated)
+
+	user, err := GetInstance().Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "old@email.com", user.Email)
+	assert.Equal(t, "name", user.Name)
+	assert.Equal(t, "INACTIVE", user.Status)
+
+	assert.Nil(t, GetInstance().Delete(context.Background(), "1"))
+	_, err = GetInstance().Get(context.Background(), "1")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestUsersImpl_Update_VersionConflict(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+	oldUser := &domains.User{ID: "id", Version: 3}
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("UpdateOne", mock.Anything, usersCollection,
+		map[string]interface{}{"_id": "id", "version": int64(3)}, mock.Anything).
+		Return(&mongo.UpdateResult{}, nil).
+		Once()
+
+	err := GetInstance().Update(context.Background(), &domains.User{ID: "id", Name: "name"}, oldUser)
+	assert.Equal(t, ErrVersionConflict, err)
+	assert.Equal(t, int64(3), oldUser.Version)
+
+	mongoMock.AssertExpectations(t)
+}
+
+func TestUsersImpl_MemoryDB_VersionConflict(t *testing.T) {
+	_ = storage.NewMemoryDB().Initialize(context.Background(), options.Credential{}, "", "")
+
+	_, err := GetInstance().Insert(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	first, _ := GetInstance().Get(context.Background(), "1")
+	second, _ := GetInstance().Get(context.Background(), "1")
+	assert.Equal(t, int64(1), first.Version)
+
+	assert.Nil(t, GetInstance().Update(context.Background(), &domains.User{Name: "first"}, first))
+	assert.Equal(t, ErrVersionConflict, GetInstance().Update(context.Background(), &domains.User{Name: "second"}, second))
+
+	stored, _ := GetInstance().Get(context.Background(), "1")
+	assert.Equal(t, "first", stored.Name)
+	assert.Equal(t, int64(2), stored.Version)
+}
+
+func TestUsersImpl_Upsert_MergeRules(t *testing.T) {
+	mongoMock := &storage.DataAccessLayerMock{}
+	updatedAt := time.Now()
+
+	_ = mongoMock.Initialize(context.Background(), options.Credential{}, mock.Anything, mock.Anything)
+	mongoMock.On("FindOneAndUpdate", mock.Anything, usersCollection, liveFilter("id"),
+		map[string]interface{}{
+			"$set": map[string]interface{}{"updatedAt": updatedAt, "email": "email"},
+			"$inc": map[string]interface{}{"version": 1},
+		}, true, mock.AnythingOfType("*domains.User")).
+		Return(nil).
+		Once()
+
+	created, err := GetInstance().Upsert(context.Background(), &domains.User{ID: "id", Email: "email", UpdatedAt: updatedAt})
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	mongoMock.AssertExpectations(t)
+}
+
+func TestUsersImpl_MemoryDB_Upsert(t *testing.T) {
+	_ = storage.NewMemoryDB().Initialize(context.Background(), options.Credential{}, "", "")
+
+	created, err := GetInstance().Upsert(context.Background(), &domains.User{ID: "1", Email: "email", Status: "ACTIVE", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	created, err = GetInstance().Upsert(context.Background(), &domains.User{ID: "1", Name: "name", Status: "INACTIVE", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	user, err := GetInstance().Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "email", user.Email)
+	assert.Equal(t, "name", user.Name)
+	assert.Equal(t, "INACTIVE", user.Status)
+	assert.Equal(t, int64(2), user.Version)
+}
+
+func TestUsersImpl_MemoryDB_Cancelled(t *testing.T) {
+	_ = storage.NewMemoryDB().Initialize(context.Background(), options.Credential{}, "", "")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := GetInstance().Upsert(ctx, &domains.User{ID: "1", UpdatedAt: time.Now()})
+	assert.Contains(t, err.Error(), context.Canceled.Error())
+	_, err = GetInstance().Get(context.Background(), "1")
+	assert.True(t, storage.IsNotFound(err))
+}
+
+func TestUsersImpl_mergePhones(t *testing.T) {
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	verifiedAt := updatedAt.Add(-time.Hour)
+	stored := domains.Phones{
+		{Type: domains.PhoneMobile, DDD: "21", Number: "99999-0000", Primary: true, Verification: domains.PhoneVerified,
+			VerificationUpdatedAt: verifiedAt, UpdatedAt: verifiedAt},
+		{Type: domains.PhoneHome, DDD: "21", Number: "2222-0000", Verification: domains.PhoneUnverified, UpdatedAt: verifiedAt},
+	}
+
+	merged := mergePhones(stored, domains.Phones{
+		{Type: domains.PhoneMobile, DDD: "21", Number: "99999-0000", Primary: true},
+		{DDD: "(21)", Number: "2222 0000", Action: domains.PhoneRemove},
+		{Type: domains.PhoneWork, DDD: "11", Number: "3333-0000", Primary: true},
+	}, updatedAt)
+
+	assert.Equal(t, domains.Phones{
+		{Type: domains.PhoneMobile, DDD: "21", Number: "99999-0000", Verification: domains.PhoneVerified,
+			VerificationUpdatedAt: verifiedAt, UpdatedAt: verifiedAt},
+		{Type: domains.PhoneWork, DDD: "11", Number: "3333-0000", Primary: true, Verification: domains.PhoneUnverified,
+			UpdatedAt: updatedAt},
+	}, merged)
+	assert.Len(t, stored, 2)
+	assert.True(t, stored[0].Primary)
+}
+
+func TestUsersImpl_mergePhones_Verification(t *testing.T) {
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+	stored := domains.Phones{{Type: domains.PhoneMobile, Number: "1", Verification: domains.PhonePending}}
+
+	merged := mergePhones(stored, domains.Phones{{Number: "1", Verification: domains.PhoneVerified}}, updatedAt)
+
+	assert.Equal(t, domains.Phones{{Type: domains.PhoneMobile, Number: "1", Verification: domains.PhoneVerified,
+		VerificationUpdatedAt: updatedAt, UpdatedAt: updatedAt}}, merged)
+}
+
+func TestUsersImpl_MemoryDB_LegacyPhones(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	_, err := db.Insert(context.Background(), usersCollection, map[string]interface{}{
+		"_id": "1", "version": int64(1),
+		"phones": map[string]interface{}{"phone": "2222", "cellphone": "9999", "ddd_cellphone": "21",
+			"mobile_phone_confirmed": true},
+	})
+	assert.Nil(t, err)
+
+	user, err := GetInstance().Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, domains.Phones{
+		{Type: domains.PhoneMobile, DDD: "21", Number: "9999", Primary: true, Verification: domains.PhoneVerified},
+		{Type: domains.PhoneHome, Number: "2222"},
+	}, user.Phones)
+
+	created, err := GetInstance().Upsert(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now(),
+		Phones: domains.Phones{{Number: "2222", Action: domains.PhoneRemove}}})
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	var stored map[string]interface{}
+	assert.Nil(t, db.FindOne(context.Background(), usersCollection, map[string]interface{}{"_id": "1"}, &stored))
+	assert.Len(t, stored["phones"], 1)
+	assert.Equal(t, int64(2), stored["version"])
+}
+
+func TestUsersImpl_MemoryDB_RemoveLastPhone(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	_, err := db.Insert(context.Background(), usersCollection, map[string]interface{}{
+		"_id": "1", "version": int64(1),
+		"phones": []interface{}{map[string]interface{}{"type": domains.PhoneMobile, "number": "9999"}},
+	})
+	assert.Nil(t, err)
+
+	created, err := GetInstance().Upsert(context.Background(), &domains.User{ID: "1", UpdatedAt: time.Now(),
+		Phones: domains.Phones{{Number: "9999", Action: domains.PhoneRemove}}})
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	var stored map[string]interface{}
+	assert.Nil(t, db.FindOne(context.Background(), usersCollection, map[string]interface{}{"_id": "1"}, &stored))
+	assert.NotContains(t, stored, "phones")
+	assert.Equal(t, int64(2), stored["version"])
+}
+
+func TestUsersImpl_MemoryDB_RemoveLastAddress(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	_, err := db.Insert(context.Background(), usersCollection, map[string]interface{}{
+		"_id": "1", "version": int64(1),
+		"addresses": []interface{}{map[string]interface{}{"type": domains.AddressShipping, "cep": "01001-000", "number": "1"}},
+	})
+	assert.Nil(t, err)
+
+	err = GetInstance().Update(context.Background(), &domains.User{UpdatedAt: time.Now(), Addresses: []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001000", Number: "1", Action: domains.AddressRemove},
+	}}, &domains.User{ID: "1", Version: 1, Addresses: []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001-000", Number: "1"},
+	}})
+	assert.Nil(t, err)
+
+	var stored map[string]interface{}
+	assert.Nil(t, db.FindOne(context.Background(), usersCollection, map[string]interface{}{"_id": "1"}, &stored))
+	assert.NotContains(t, stored, "addresses")
+	assert.Equal(t, int64(2), stored["version"])
+}
+
+func TestUsersImpl_mergePhones_Legacy(t *testing.T) {
+	var event domains.User
+	assert.Nil(t, json.Unmarshal([]byte(`{"phones":{"cellphone":"999","ddd_cellphone":"11"}}`), &event))
+	stored := domains.Phones{
+		{Type: domains.PhoneMobile, DDD: "11", Number: "888", Primary: true, Verification: domains.PhoneVerified},
+		{Type: domains.PhoneHome, Number: "2222"},
+		{Type: domains.PhoneWork, Number: "3333"},
+	}
+	updatedAt := time.Date(2019, 8, 1, 0, 0, 0, 0, time.UTC)
+
+	merged := mergePhones(stored, event.Phones, updatedAt)
+
+	assert.Equal(t, domains.Phones{
+		{Type: domains.PhoneWork, Number: "3333"},
+		{Type: domains.PhoneMobile, DDD: "11", Number: "999", Primary: true, Verification: domains.PhoneUnverified,
+			UpdatedAt: updatedAt},
+	}, merged)
+}
+
+func TestUsersImpl_mergeAddresses(t *testing.T) {
+	stored := []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001-000", Street: "Praça da Sé", Number: "1", City: "São Paulo", UF: "SP"},
+		{Type: domains.AddressBilling, CEP: "20040-002", Number: "10", Complement: "sala 2"},
+	}
+
+	merged := mergeAddresses(stored, []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001000", Number: "1", Neighborhood: "Sé"},
+		{Type: domains.AddressBilling, CEP: "20040002", Number: "10", Complement: "sala 2", Action: domains.AddressRemove},
+		{Type: domains.AddressBilling, CEP: "22250-040", Number: "5"},
+	})
+
+	assert.Equal(t, []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001000", Street: "Praça da Sé", Number: "1", Neighborhood: "Sé",
+			City: "São Paulo", UF: "SP"},
+		{Type: domains.AddressBilling, CEP: "22250-040", Number: "5"},
+	}, merged)
+	assert.Len(t, stored, 2)
+	assert.Equal(t, "", stored[0].Neighborhood)
+}
+
+func TestUsersImpl_MemoryDB_UpsertAddresses(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	users := New(db)
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+
+	created, err := users.Upsert(context.Background(), &domains.User{ID: "1", UpdatedAt: updatedAt,
+		Addresses: []domains.Address{{Type: domains.AddressShipping, CEP: "01001-000", Number: "1"}}})
+	assert.Nil(t, err)
+	assert.True(t, created)
+
+	created, err = users.Upsert(context.Background(), &domains.User{ID: "1", UpdatedAt: updatedAt.Add(time.Hour),
+		Addresses: []domains.Address{{Type: domains.AddressBilling, CEP: "20040-002", Number: "10"}}})
+	assert.Nil(t, err)
+	assert.False(t, created)
+
+	stored, err := users.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, []domains.Address{
+		{Type: domains.AddressShipping, CEP: "01001-000", Number: "1"},
+		{Type: domains.AddressBilling, CEP: "20040-002", Number: "10"},
+	}, stored.Addresses)
+}
+
+func TestUsersImpl_updateNewUserValues_InvalidStatusTransition(t *testing.T) {
+	oldUser := domains.User{ID: "1", Name: "name1", Status: domains.StatusDeleted}
+
+	err := updateNewUserValues(&oldUser, &domains.User{Name: "name2", Status: domains.StatusActive})
+
+	assert.Equal(t, storage.KindValidation, storage.KindOf(err))
+	assert.True(t, IsInvalidStatusTransition(err))
+	assert.Equal(t, domains.User{ID: "1", Name: "name1", Status: domains.StatusDeleted}, oldUser)
+}
+
+func TestUsersImpl_updateNewUserValues_LegacyStatus(t *testing.T) {
+	oldUser := domains.User{Status: "statusTeste"}
+
+	assert.Nil(t, updateNewUserValues(&oldUser, &domains.User{Status: domains.StatusActive}))
+	assert.Equal(t, domains.StatusActive, oldUser.Status)
+	assert.Nil(t, updateNewUserValues(&oldUser, &domains.User{Status: "ACTIVE"}))
+	assert.Len(t, oldUser.StatusHistory, 1)
+}
+
+func TestUsersImpl_Validate_InvalidStatus(t *testing.T) {
+	assert.Equal(t, ErrInvalidStatus, Validate(&domains.User{ID: "1", Status: "statusTeste"}))
+	//the schemas accept the lowercase and uppercase spellings only
+	assert.Equal(t, ErrInvalidStatus, Validate(&domains.User{ID: "1", Status: "Blocked"}))
+	assert.Nil(t, Validate(&domains.User{ID: "1", Status: "BLOCKED"}))
+	assert.Nil(t, Validate(&domains.User{ID: "1", Status: "blocked"}))
+}
+
+func TestUsersImpl_MemoryDB_BulkSave_InvalidStatusTransition(t *testing.T) {
+	_ = storage.NewMemoryDB().Initialize(context.Background(), options.Credential{}, "", "")
+
+	result, err := GetInstance().BulkSave(context.Background(), []*domains.User{
+		{ID: "1", Status: domains.StatusPending},
+		{ID: "1", Status: domains.StatusDeleted},
+		{ID: "1", Name: "name", Status: domains.StatusActive},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), result.Inserted)
+	assert.Len(t, result.Failed, 1)
+	assert.True(t, IsInvalidStatusTransition(result.Failed[2]))
+
+	user, err := GetInstance().Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, domains.StatusDeleted, user.Status)
+	assert.Equal(t, "", user.Name)
+	assert.Len(t, user.StatusHistory, 2)
+}
+
+func TestUsersImpl_MemoryDB_SoftDelete(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	users := New(db)
+	deletedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+
+	_, err := users.Insert(context.Background(), &domains.User{ID: "1", Name: "name", UpdatedAt: deletedAt})
+	assert.Nil(t, err)
+	_, err = users.Insert(context.Background(), &domains.User{ID: "2", UpdatedAt: deletedAt})
+	assert.Nil(t, err)
+
+	assert.Nil(t, users.SoftDelete(context.Background(), "1", deletedAt))
+	assert.True(t, storage.IsNotFound(users.SoftDelete(context.Background(), "1", deletedAt)))
+	_, err = users.Get(context.Background(), "1")
+	assert.True(t, storage.IsNotFound(err))
+	deleted, err := users.GetWithDeleted(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.True(t, deletedAt.Equal(*deleted.DeletedAt))
+	assert.Equal(t, int64(2), deleted.Version)
+
+	var live, soft []string
+	_ = users.Each(context.Background(), domains.UserFilter{}, func(user *domains.User) error {
+		live = append(live, user.ID)
+		return nil
+	})
+	_ = users.Each(context.Background(), domains.UserFilter{Deleted: true}, func(user *domains.User) error {
+		soft = append(soft, user.ID)
+		return nil
+	})
+	assert.Equal(t, []string{"2"}, live)
+	assert.Equal(t, []string{"1"}, soft)
+}
+
+func TestUsersImpl_MemoryDB_Upsert_RecreatesSoftDeleted(t *testing.T) {
+	db := storage.NewMemoryDB()
+	_ = db.Initialize(context.Background(), options.Credential{}, "", "")
+	users := New(db)
+	updatedAt := time.Date(2019, 8, 15, 18, 0, 0, 0, time.UTC)
+
+	for _, id := range []string{"1", "2"} {
+		_, err := users.Insert(context.Background(), &domains.User{ID: id, Name: "name", Status: domains.StatusDeleted, UpdatedAt: updatedAt})
+		assert.Nil(t, err)
+		assert.Nil(t, users.SoftDelete(context.Background(), id, updatedAt))
+	}
+
+	created, err := users.Upsert(context.Background(), &domains.User{ID: "1", Email: "email", UpdatedAt: updatedAt.Add(time.Hour)})
+	assert.Nil(t, err)
+	assert.True(t, created)
+	result, err := users.BulkSave(context.Background(), []*domains.User{{ID: "2", Status: domains.StatusActive, UpdatedAt: updatedAt.Add(time.Hour)}})
+	assert.Nil(t, err)
+	assert.Empty(t, result.Failed)
+
+	recreated, err := users.Get(context.Background(), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "email", recreated.Email)
+	assert.Equal(t, "", recreated.Name)
+	assert.Nil(t, recreated.DeletedAt)
+	assert.Equal(t, int64(3), recreated.Version)
+
+	recreated, err = users.Get(context.Background(), "2")
+	assert.Nil(t, err)
+	assert.Equal(t, domains.StatusActive, recreated.Status)
+	assert.Equal(t, "", recreated.Name)
+	assert.Nil(t, recreated.DeletedAt)
+	assert.Len(t, recreated.StatusHistory, 1)
+}
+
+func TestUsersImpl_Tenants(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Database: "users_acme"}}, config.TenantReject)
+	shared := storage.NewMemoryDB()
+	users := New(storage.NewTenantDB(shared, tenant.GetInstance()))
+	ctx := context.Background()
+
+	created, err := users.Upsert(ctx, &domains.User{ID: "1", ClientID: "acme", Name: "acme", UpdatedAt: time.Now()})
+	assert.Nil(t, err)
+	assert.True(t, created)
+	_, err = users.Upsert(ctx, &domains.User{ID: "1", ClientID: "globex", UpdatedAt: time.Now()})
+	assert.Equal(t, storage.KindValidation, storage.KindOf(err))
+
+	_, err = users.Get(ctx, "1")
+	assert.Equal(t, storage.KindValidation, storage.KindOf(err))
+	stored, err := users.Get(tenant.NewContext(ctx, "acme"), "1")
+	assert.Nil(t, err)
+	assert.Equal(t, "acme", stored.Name)
+	count, _ := shared.Database("users_acme").Count(ctx, usersCollection, nil)
+	assert.Equal(t, int64(1), count)
+
+	var streamed []string
+	assert.Nil(t, users.Each(ctx, domains.UserFilter{ClientID: "acme"}, func(user *domains.User) error {
+		streamed = append(streamed, user.ID)
+		return nil
+	}))
+	assert.Equal(t, []string{"1"}, streamed)
+}
+
+func TestUsersImpl_BulkSave_Tenants(t *testing.T) {
+	defer func() { _ = tenant.GetInstance().Configure(nil, "") }()
+	_ = tenant.GetInstance().Configure(map[string]tenant.Route{"acme": {Prefix: "acme_"}}, config.TenantReject)
+	shared := storage.NewMemoryDB()
+	users := New(storage.NewTenantDB(shared, tenant.GetInstance()))
+	ctx := context.Background()
+	now := time.Now()
+
+	result, err := users.BulkSave(ctx, []*domains.User{
+		{ID: "1", ClientID: "acme", UpdatedAt: now},
+		{ID: "2", ClientID: "globex", UpdatedAt: now},
+		{ID: "3", ClientID: "acme", UpdatedAt: now},
+	})
+
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), result.Inserted)
+	assert.Len(t, result.Failed, 1)
+	assert.Equal(t, storage.KindValidation, storage.KindOf(result.Failed[1]))
+	count, _ := shared.Count(ctx, "acme_"+usersCollection, nil)
+	assert.Equal(t, int64(2), count)
 }